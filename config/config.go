@@ -16,13 +16,31 @@
 package config
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
 	"regexp"
+	"slices"
+	"strings"
+	"text/template"
 	"time"
 
 	"github.com/BurntSushi/toml"
 	cs "github.com/apache/cloudstack-go/v2/cloudstack"
+	"github.com/cloudbase/garm-provider-common/params"
 	"github.com/invopop/jsonschema"
 )
 
@@ -69,6 +87,21 @@ type Config struct {
 	Secret    string `toml:"secret"`
 	VerifySSL bool   `toml:"verify_ssl"`
 
+	// APIPath overrides the path of api_url entirely (optional). By default the
+	// path is normalized to end in /client/api; set this for deployments that
+	// expose the API under a non-standard path.
+	APIPath string `toml:"api_path"`
+
+	// UserAgent is the User-Agent sent with every API request (optional), so the
+	// provider's calls can be told apart in the CloudStack access logs. The
+	// provider defaults it to garm-provider-cloudstack/<version>.
+	UserAgent string `toml:"user_agent"`
+
+	// SignatureVersion selects how API requests are signed: "3" (default)
+	// signs them with signatureversion=3 and an expiry, "legacy" without
+	// either, for CloudStack deployments that don't accept them.
+	SignatureVersion string `toml:"signature_version"`
+
 	// Zone: name or UUID of the CloudStack zone
 	Zone string `toml:"zone"`
 
@@ -78,26 +111,320 @@ type Config struct {
 	// Template: name or UUID of the VM template
 	Template string `toml:"template"`
 
+	// TemplateFilter is the CloudStack template filter used to look templates
+	// up by name (default: executable). Use self or community to find templates
+	// that the default filter doesn't return.
+	TemplateFilter string `toml:"template_filter"`
+
 	// Project: name or UUID of the CloudStack project (optional)
 	Project string `toml:"project"`
 
+	// ProjectFromLabel is a label key whose value selects the deploy project of
+	// a runner, for pools that carry a "<key>=<project>" label (optional). The
+	// value is a project name or UUID; runners without the label use Project.
+	ProjectFromLabel string `toml:"project_from_label"`
+
+	// Domain: name or UUID of the CloudStack domain that service offering
+	// names are looked up in (optional). Offerings created by domain admins
+	// can share a name across domains.
+	Domain string `toml:"domain"`
+
+	// Account narrows service offering name lookups to an account of Domain
+	// (optional, requires Domain).
+	Account string `toml:"account"`
+
 	// SSHKeyName is the name of the SSH keypair to use (optional)
 	SSHKeyName string `toml:"ssh_key_name"`
 
+	// ZoneSSHKeyNames overrides SSHKeyName for deploys into a zone, keyed by
+	// zone name or UUID (optional). CloudStack keypairs can be zone specific.
+	ZoneSSHKeyNames map[string]string `toml:"zone_ssh_key_names"`
+
+	// SSHPrivateKeyPath is the PEM encoded RSA private key of the SSH keypair
+	// (optional). It is used to decrypt the passwords of password-enabled
+	// templates.
+	SSHPrivateKeyPath string `toml:"ssh_private_key_path"`
+
+	// MissingKeypairPolicy makes deploys with an SSH keypair first check that
+	// it exists, and selects what to do if not: fail, ignore or create. By
+	// default there is no check.
+	MissingKeypairPolicy string `toml:"missing_keypair_policy"`
+
 	// AsyncTimeout is the timeout for async CloudStack API calls (default: 15m).
 	// This is how long the provider will wait for VM deployments to complete.
 	// Supports Go duration strings like "15m", "1h", "30s".
 	AsyncTimeout Duration `toml:"async_timeout"`
 
+	// CreateGracePeriod is how long a failed deploy is re-checked for a VM that
+	// came up anyway before the failure is reported (default: 0, disabled). Busy
+	// management servers sometimes report errors for deploys that succeed.
+	CreateGracePeriod Duration `toml:"create_grace_period"`
+
+	// TemplateReadyTimeout is how long a deploy is retried, with backoff, while
+	// CloudStack reports that the template is still being downloaded to the
+	// zone (default: 0, not retried). Deploys that race a template upload then
+	// succeed once the template is ready.
+	TemplateReadyTimeout Duration `toml:"template_ready_timeout"`
+
+	// DeployPollInterval is how often the async job of a VM deployment is polled
+	// (optional). When unset the client's built-in backoff is used, which backs
+	// off from 1s to 15s between polls.
+	DeployPollInterval Duration `toml:"deploy_poll_interval"`
+
+	// DeletePollInterval is how often the async job of a VM destroy is polled
+	// (optional). When unset the client's built-in backoff is used.
+	DeletePollInterval Duration `toml:"delete_poll_interval"`
+
+	// PowerPollInterval is how often the async job of a VM start, stop or
+	// reboot is polled (optional). When unset the client's built-in backoff is
+	// used.
+	PowerPollInterval Duration `toml:"power_poll_interval"`
+
+	// LeaseTTL is the maximum age of a VM (optional). When set, new VMs are
+	// tagged with GARM_EXPIRES_AT and ReapExpired destroys them once it has
+	// passed, so leaked runners don't live forever.
+	LeaseTTL Duration `toml:"lease_ttl"`
+
 	// Expunge controls whether VMs are permanently deleted when destroyed.
 	// If true, VMs are expunged immediately instead of lingering in "Destroyed" state.
 	// Default: false (VMs remain in "Destroyed" state and can be recovered).
 	Expunge bool `toml:"expunge"`
 
+	// ExpungeRetries is how many times an expunging destroy is retried when CloudStack
+	// reports that another operation is in progress on the VM (default: 5).
+	// Set to a negative value to disable retries.
+	ExpungeRetries int `toml:"expunge_retries"`
+
+	// ExpungeRetryInterval is the initial wait between expunge retries (default: 2s).
+	// The wait doubles after each attempt, up to MaxExpungeRetryInterval.
+	ExpungeRetryInterval Duration `toml:"expunge_retry_interval"`
+
+	// LeaveOnFailure keeps VMs whose create failed after the deploy went through,
+	// for example while waiting for readiness, instead of destroying them
+	// (default: false). Meant for debugging; the VMs are not tracked by garm.
+	LeaveOnFailure bool `toml:"leave_on_failure"`
+
+	// AuditLogPath is a file that every create, delete, start, stop and restart
+	// is appended to as a JSON line (optional). Failing to write it never fails
+	// the operation.
+	AuditLogPath string `toml:"audit_log_path"`
+
+	// TagVolumes also tags the ROOT volume of new VMs with GARM_CONTROLLER_ID
+	// and GARM_POOL_ID (default: false). Failing to tag the volume doesn't fail
+	// the deploy.
+	TagVolumes bool `toml:"tag_volumes"`
+
+	// CheckTemplatePermissions checks that the account can deploy the template
+	// before every deploy (default: false). A template that can be listed but
+	// not deployed otherwise only fails the deploy itself.
+	CheckTemplatePermissions bool `toml:"check_template_permissions"`
+
+	// TagRunnerContext tags new VMs with the entity their runner is registered
+	// to, taken from the repo URL garm passes in the bootstrap params (default:
+	// false): GARM_ENTITY_TYPE, GARM_OWNER and, for repositories, GARM_REPO.
+	TagRunnerContext bool `toml:"tag_runner_context"`
+
+	// UniqueDisplayNames appends a short random suffix to the display name of
+	// new VMs, so retried deploys of the same runner can be told apart in the
+	// UI. The Name tag keeps the runner name.
+	UniqueDisplayNames bool `toml:"unique_display_names"`
+
+	// NameCollisionPolicy makes deploys first check whether a VM with the same
+	// name already exists, and selects what to do if so: fail, suffix or
+	// reuse. By default there is no check.
+	NameCollisionPolicy string `toml:"name_collision_policy"`
+
+	// DuplicateNameRetries is how many times a lookup by name is repeated when
+	// it finds more than one VM, waiting for all but one to be destroyed, as
+	// happens briefly while garm retries a deploy (default: 0 - no retries).
+	DuplicateNameRetries int `toml:"duplicate_name_retries"`
+
+	// IgnoreDedication stops deploys from being attached to the explicit
+	// dedication affinity group of the account or project (default: false).
+	IgnoreDedication bool `toml:"ignore_dedication"`
+
+	// TagTemplates adds extra tags to every VM, keyed by tag name. Values are Go
+	// text/template strings rendered with TagTemplateData, for example
+	// team = "team-{{.Pool}}". The tags the provider sets itself take precedence.
+	TagTemplates map[string]string `toml:"tag_templates"`
+
+	// MaxNameLength caps the length of VM names (default: 63, the host name
+	// limit). Longer garm instance names are shortened, while the display name
+	// keeps the full name. Lower it for CloudStack versions with a stricter limit.
+	MaxNameLength int `toml:"max_name_length"`
+
+	// ListPageSize is the number of VMs requested per page when listing VMs
+	// (default: 500, CloudStack's default.page.size). Some management servers
+	// respond faster with smaller pages.
+	ListPageSize int `toml:"list_page_size"`
+
+	// MaxTagValueLength caps the length of VM tag values (default: 255, the
+	// size of CloudStack's resource tag value column). Longer values, such as
+	// long label lists, are shortened and end in a hash of the full value.
+	MaxTagValueLength int `toml:"max_tag_value_length"`
+
+	// MaxNICs caps the number of networks a VM may be attached to (optional).
+	// CloudStack doesn't expose the NIC limit of a hypervisor or template, so
+	// deploys over it only fail late; set it to reject them up front.
+	MaxNICs int `toml:"max_nics"`
+
+	// DefaultOSArch is the architecture assumed for runners whose bootstrap
+	// params carry no os_arch (optional). It picks the runner tools and the
+	// OSArch tag; without it the arch is left empty, unless the template
+	// reports an architecture, in which case such runners are refused.
+	DefaultOSArch string `toml:"default_os_arch"`
+
+	// ErroredInstances controls how VMs in the CloudStack Error state are
+	// reported when listing a pool: "report" (default) uses the status mapping,
+	// "exclude" leaves them out and "flag" reports them with the error status.
+	ErroredInstances string `toml:"errored_instances"`
+
+	// AutoReapErrored destroys VMs found in the Error state while listing a pool
+	// (default: false). Reaped VMs are left out of the listing.
+	AutoReapErrored bool `toml:"auto_reap_errored"`
+
+	// IncludeStoppedInList controls whether stopped VMs are reported when listing
+	// a pool (default: true). Stop-on-idle pools may want to exclude them.
+	IncludeStoppedInList *bool `toml:"include_stopped_in_list"`
+
+	// IncludeTerminated reports Destroyed and Expunging VMs when listing a pool
+	// (default: false), for tooling that audits recently destroyed runners.
+	IncludeTerminated bool `toml:"include_terminated"`
+
+	// RequireNetwork fails deploys into advanced zones that have no networks
+	// from network_ids or a profile (default: true), instead of leaving the
+	// choice of network to CloudStack.
+	RequireNetwork *bool `toml:"require_network"`
+
+	// ReadinessTag makes deploys wait until the VM carries this tag before
+	// reporting success (optional). The runner image or userdata is expected to
+	// set it through the CloudStack API once cloud-init has finished.
+	ReadinessTag string `toml:"readiness_tag"`
+
+	// ReadinessTimeout is how long to wait for ReadinessTag (default: 10m).
+	ReadinessTimeout Duration `toml:"readiness_timeout"`
+
+	// IPWaitTimeout makes deploys wait, for up to this long, until a NIC of the
+	// VM has an IP address (default: 0, disabled). A VM can be Running without
+	// its networking having come up.
+	IPWaitTimeout Duration `toml:"ip_wait_timeout"`
+
+	// IPv6Only is for zones without IPv4 (default: false). Deploys need
+	// networks with an IPv6 CIDR, VMs must get an IPv6 address, and
+	// ip_wait_timeout waits for an IPv6 address specifically.
+	IPv6Only bool `toml:"ipv6_only"`
+
+	// RefreshInstanceIP makes instance lookups retry for a few seconds when a
+	// VM is Running but has no IP address yet (default: false), at the cost of
+	// slower lookups of such VMs.
+	RefreshInstanceIP bool `toml:"refresh_instance_ip"`
+
+	// OperationTimeout caps the overall duration of a CreateInstance or
+	// DeleteInstance call, across all of its API calls and waits (default: 0,
+	// no cap). The per-step timeouts still apply within it.
+	OperationTimeout Duration `toml:"operation_timeout"`
+
+	// FlavorMap maps pool flavor strings to service offerings (name or UUID), so
+	// pools can select their size through the flavor alone. Flavors that are not
+	// listed are treated as service offering names or UUIDs.
+	FlavorMap map[string]string `toml:"flavor_map"`
+
+	// BatchStartStagger is the delay between starting consecutive deploys when
+	// creating instances in a batch (default: 0, all start at once). Only
+	// CreateRunningInstances creates batches; the provider never does.
+	BatchStartStagger Duration `toml:"batch_start_stagger"`
+
+	// BatchTags creates the tags shared by the VMs of a batch once all of them
+	// are deployed, with a single createTags call for the VMs that share them
+	// (default: false). The ownership and per-VM tags are still created as
+	// soon as each VM is deployed.
+	BatchTags bool `toml:"batch_tags"`
+
+	// DeleteConcurrency is how many VMs RemoveAllInstances destroys at once
+	// (default: 10).
+	DeleteConcurrency int `toml:"delete_concurrency"`
+
+	// AllowedDetails adds keys to the deploy details the details extra spec may
+	// set, on top of spec.DefaultAllowedDetails.
+	AllowedDetails []string `toml:"allowed_details"`
+
+	// DefaultExtraPackages are installed on every Linux runner, on top of or
+	// instead of the extra_packages of the pool depending on its
+	// merge_strategy.
+	DefaultExtraPackages []string `toml:"default_extra_packages"`
+
+	// DefaultPreInstallScripts are run on every Linux runner before the runner
+	// is installed, keyed by script name. They combine with the
+	// pre_install_scripts of the pool like DefaultExtraPackages.
+	DefaultPreInstallScripts map[string]string `toml:"default_pre_install_scripts"`
+
+	// Profiles are named bundles of deploy settings that pools select with the
+	// profile extra spec.
+	Profiles []Profile `toml:"profiles"`
+
+	// StatusMap overrides how CloudStack VM states are reported to garm, keyed by
+	// lowercased CloudStack state (for example "stopping" = "stopped"). States
+	// that are not listed use the built-in mapping.
+	StatusMap map[string]string `toml:"status_map"`
+
+	// TreatStartingAsPending reports VMs in the Starting state as pending_create
+	// instead of running (default: false), so garm doesn't use them before they
+	// are reachable.
+	TreatStartingAsPending bool `toml:"treat_starting_as_pending"`
+
 	// resolved holds the resolved UUIDs after calling ResolveNames()
 	resolved resolvedIDs
 }
 
+// Profile is a named set of deploy settings. Settings that are left empty fall
+// back to the provider defaults, and explicit extra specs override them.
+type Profile struct {
+	// Name is what pools put in the profile extra spec.
+	Name string `toml:"name"`
+	// ServiceOffering is a service offering name or UUID.
+	ServiceOffering string `toml:"service_offering"`
+	// Template is a template name or UUID.
+	Template string `toml:"template"`
+	// Networks are network names or UUIDs, like the network_ids extra spec.
+	Networks []string `toml:"networks"`
+	// StoragePoolTag selects the primary storage of the root volume.
+	StoragePoolTag string `toml:"storage_pool_tag"`
+	// Tags are added to the VMs deployed with this profile.
+	Tags map[string]string `toml:"tags"`
+
+	// serviceOfferingID and templateID are set by ResolveNames.
+	serviceOfferingID string
+	templateID        string
+}
+
+// ServiceOfferingID returns the resolved service offering UUID, or the
+// configured value if names have not been resolved.
+func (p *Profile) ServiceOfferingID() string {
+	if p.serviceOfferingID != "" {
+		return p.serviceOfferingID
+	}
+	return p.ServiceOffering
+}
+
+// TemplateID returns the resolved template UUID, or the configured value if
+// names have not been resolved.
+func (p *Profile) TemplateID() string {
+	if p.templateID != "" {
+		return p.templateID
+	}
+	return p.Template
+}
+
+// Profile returns the profile with the given name.
+func (c *Config) Profile(name string) (*Profile, bool) {
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == name {
+			return &c.Profiles[i], true
+		}
+	}
+	return nil, false
+}
+
 // DefaultAsyncTimeout is the default timeout for async CloudStack API calls (15 minutes).
 const DefaultAsyncTimeout = 15 * time.Minute
 
@@ -109,12 +436,351 @@ func (c *Config) GetAsyncTimeout() int64 {
 	return int64(c.AsyncTimeout.Duration.Seconds())
 }
 
+// DefaultMaxNameLength is the default VM name length limit.
+const DefaultMaxNameLength = 63
+
+// MinMaxNameLength is the lowest accepted max_name_length. garm instance names
+// can't be told apart reliably below it.
+const MinMaxNameLength = 16
+
+// GetMaxNameLength returns the configured VM name length limit, or the default if not set.
+func (c *Config) GetMaxNameLength() int {
+	if c.MaxNameLength <= 0 {
+		return DefaultMaxNameLength
+	}
+	return c.MaxNameLength
+}
+
+// DefaultListPageSize is the default list page size. It matches the default
+// of CloudStack's default.page.size setting, the largest page size it accepts.
+const DefaultListPageSize = 500
+
+// GetListPageSize returns the configured list page size, or the default if not set.
+func (c *Config) GetListPageSize() int {
+	if c.ListPageSize <= 0 {
+		return DefaultListPageSize
+	}
+	return c.ListPageSize
+}
+
+// DefaultTemplateFilter is the template filter used when template_filter is
+// not set.
+const DefaultTemplateFilter = "executable"
+
+// templateFilters lists the template filters CloudStack accepts.
+var templateFilters = []string{"featured", "self", "selfexecutable", "sharedexecutable", "executable", "community", "all"}
+
+// GetTemplateFilter returns the configured template filter, or the default if
+// not set.
+func (c *Config) GetTemplateFilter() string {
+	if c.TemplateFilter == "" {
+		return DefaultTemplateFilter
+	}
+	return c.TemplateFilter
+}
+
+// Values of name_collision_policy.
+const (
+	// NameCollisionFail fails the deploy if the name is taken.
+	NameCollisionFail = "fail"
+	// NameCollisionSuffix deploys under the name with a random suffix instead.
+	NameCollisionSuffix = "suffix"
+	// NameCollisionReuse returns the existing VM if it is a running VM of the
+	// same controller and pool, and fails otherwise.
+	NameCollisionReuse = "reuse"
+)
+
+// Values of missing_keypair_policy.
+const (
+	// MissingKeypairFail fails the deploy before anything is created.
+	MissingKeypairFail = "fail"
+	// MissingKeypairIgnore deploys without a keypair.
+	MissingKeypairIgnore = "ignore"
+	// MissingKeypairCreate registers the public key of ssh_private_key_path
+	// under the missing name.
+	MissingKeypairCreate = "create"
+)
+
+// DefaultDeleteConcurrency is the default number of VMs destroyed at once by
+// RemoveAllInstances.
+const DefaultDeleteConcurrency = 10
+
+// GetDeleteConcurrency returns the configured bulk delete concurrency, or the
+// default if not set.
+func (c *Config) GetDeleteConcurrency() int {
+	if c.DeleteConcurrency <= 0 {
+		return DefaultDeleteConcurrency
+	}
+	return c.DeleteConcurrency
+}
+
+// DefaultMaxTagValueLength is the default tag value length limit. It matches
+// the size of the value column of CloudStack's resource_tags table.
+const DefaultMaxTagValueLength = 255
+
+// MinMaxTagValueLength is the lowest accepted max_tag_value_length. It is the
+// length of a UUID, so the controller and pool IDs always fit.
+const MinMaxTagValueLength = 36
+
+// GetMaxTagValueLength returns the configured tag value length limit, or the
+// default if not set.
+func (c *Config) GetMaxTagValueLength() int {
+	if c.MaxTagValueLength <= 0 {
+		return DefaultMaxTagValueLength
+	}
+	return c.MaxTagValueLength
+}
+
+// GetCreateGracePeriod returns the configured create grace period, or 0 if
+// failed deploys are not re-checked.
+func (c *Config) GetCreateGracePeriod() time.Duration {
+	return max(c.CreateGracePeriod.Duration, 0)
+}
+
+// GetTemplateReadyTimeout returns the configured template ready timeout, or 0
+// if deploys aren't retried while the template is downloading.
+func (c *Config) GetTemplateReadyTimeout() time.Duration {
+	return max(c.TemplateReadyTimeout.Duration, 0)
+}
+
+// GetDeployPollInterval returns the configured deploy job poll interval, or 0 if
+// the client's built-in backoff should be used.
+func (c *Config) GetDeployPollInterval() time.Duration {
+	return max(c.DeployPollInterval.Duration, 0)
+}
+
+// GetDeletePollInterval returns the configured destroy job poll interval, or 0 if
+// the client's built-in backoff should be used.
+func (c *Config) GetDeletePollInterval() time.Duration {
+	return max(c.DeletePollInterval.Duration, 0)
+}
+
+// GetPowerPollInterval returns the configured start/stop/reboot job poll
+// interval, or 0 if the client's built-in backoff should be used.
+func (c *Config) GetPowerPollInterval() time.Duration {
+	return max(c.PowerPollInterval.Duration, 0)
+}
+
+// GetLeaseTTL returns the configured VM lease TTL, or 0 if VMs don't expire.
+func (c *Config) GetLeaseTTL() time.Duration {
+	return max(c.LeaseTTL.Duration, 0)
+}
+
+// DefaultExpungeRetries is the default number of expunge retries on "operation in progress" errors.
+const DefaultExpungeRetries = 5
+
+// DefaultExpungeRetryInterval is the default initial backoff between expunge retries.
+const DefaultExpungeRetryInterval = 2 * time.Second
+
+// MaxExpungeRetryInterval caps the backoff between expunge retries.
+const MaxExpungeRetryInterval = 30 * time.Second
+
+// GetExpungeRetries returns the configured number of expunge retries, or the default if not set.
+func (c *Config) GetExpungeRetries() int {
+	if c.ExpungeRetries < 0 {
+		return 0
+	}
+	if c.ExpungeRetries == 0 {
+		return DefaultExpungeRetries
+	}
+	return c.ExpungeRetries
+}
+
+// GetExpungeRetryInterval returns the configured initial expunge retry backoff, or the default if not set.
+func (c *Config) GetExpungeRetryInterval() time.Duration {
+	if c.ExpungeRetryInterval.Duration <= 0 {
+		return DefaultExpungeRetryInterval
+	}
+	return c.ExpungeRetryInterval.Duration
+}
+
+// knownStatuses lists the garm instance statuses a status_map entry may map to.
+var knownStatuses = []params.InstanceStatus{
+	params.InstanceRunning,
+	params.InstanceStopped,
+	params.InstanceError,
+	params.InstancePendingDelete,
+	params.InstancePendingForceDelete,
+	params.InstanceDeleting,
+	params.InstanceDeleted,
+	params.InstancePendingCreate,
+	params.InstanceCreating,
+	params.InstanceStatusUnknown,
+}
+
+// Values of ErroredInstances.
+const (
+	ErroredInstancesReport  = "report"
+	ErroredInstancesExclude = "exclude"
+	ErroredInstancesFlag    = "flag"
+)
+
+// StatusOverrides returns the status_map entries keyed by lowercased CloudStack
+// state. With errored_instances set to "flag", the Error state maps to the error
+// status, and with treat_starting_as_pending the Starting state maps to
+// pending_create, unless status_map says otherwise.
+func (c *Config) StatusOverrides() map[string]params.InstanceStatus {
+	flag := c.ErroredInstances == ErroredInstancesFlag
+	if len(c.StatusMap) == 0 && !flag && !c.TreatStartingAsPending {
+		return nil
+	}
+	overrides := make(map[string]params.InstanceStatus, len(c.StatusMap)+2)
+	if flag {
+		overrides["error"] = params.InstanceError
+	}
+	if c.TreatStartingAsPending {
+		overrides["starting"] = params.InstancePendingCreate
+	}
+	for state, status := range c.StatusMap {
+		overrides[strings.ToLower(state)] = params.InstanceStatus(status)
+	}
+	return overrides
+}
+
+// LoadSSHPrivateKey reads and parses the RSA private key at ssh_private_key_path.
+// Both PKCS #1 ("RSA PRIVATE KEY") and PKCS #8 ("PRIVATE KEY") PEM blocks are accepted.
+func (c *Config) LoadSSHPrivateKey() (*rsa.PrivateKey, error) {
+	if c.SSHPrivateKeyPath == "" {
+		return nil, fmt.Errorf("ssh_private_key_path is not set")
+	}
+	data, err := os.ReadFile(c.SSHPrivateKeyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ssh_private_key_path: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("ssh_private_key_path %s does not contain a PEM encoded key", c.SSHPrivateKeyPath)
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ssh_private_key_path: %w", err)
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse ssh_private_key_path: %w", err)
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("ssh_private_key_path %s is not an RSA key", c.SSHPrivateKeyPath)
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("ssh_private_key_path %s has unsupported PEM type %q", c.SSHPrivateKeyPath, block.Type)
+	}
+}
+
+// TagTemplateData is the data tag_templates are rendered with.
+type TagTemplateData struct {
+	Name       string
+	Pool       string
+	Controller string
+	OSType     string
+	OSArch     string
+	Flavor     string
+	Image      string
+}
+
+// NewTagTemplateData returns the template data for an instance, shared by
+// tag_templates and the root_volume_name extra spec.
+func NewTagTemplateData(data params.BootstrapInstance, controllerID string) TagTemplateData {
+	return TagTemplateData{
+		Name:       data.Name,
+		Pool:       data.PoolID,
+		Controller: controllerID,
+		OSType:     string(data.OSType),
+		OSArch:     string(data.OSArch),
+		Flavor:     data.Flavor,
+		Image:      data.Image,
+	}
+}
+
+// parseTagTemplates parses every tag_templates entry.
+func (c *Config) parseTagTemplates() (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template, len(c.TagTemplates))
+	for key, text := range c.TagTemplates {
+		tmpl, err := template.New(key).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tag_templates entry %q: %w", key, err)
+		}
+		templates[key] = tmpl
+	}
+	return templates, nil
+}
+
+// RenderTags renders tag_templates with the given data. Tags that render to an
+// empty value are left out, since CloudStack rejects empty tag values.
+func (c *Config) RenderTags(data TagTemplateData) (map[string]string, error) {
+	templates, err := c.parseTagTemplates()
+	if err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(templates))
+	for key, tmpl := range templates {
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("failed to render tag %q: %w", key, err)
+		}
+		if b.Len() > 0 {
+			tags[key] = b.String()
+		}
+	}
+	return tags, nil
+}
+
+// GetIncludeStoppedInList returns whether stopped VMs are listed, defaulting to true.
+func (c *Config) GetIncludeStoppedInList() bool {
+	if c.IncludeStoppedInList == nil {
+		return true
+	}
+	return *c.IncludeStoppedInList
+}
+
+// GetRequireNetwork returns whether deploys into advanced zones need networks, defaulting to true.
+func (c *Config) GetRequireNetwork() bool {
+	if c.RequireNetwork == nil {
+		return true
+	}
+	return *c.RequireNetwork
+}
+
+// DefaultReadinessTimeout is the default time to wait for the readiness tag.
+const DefaultReadinessTimeout = 10 * time.Minute
+
+// GetIPWaitTimeout returns the configured IP wait timeout, or 0 if deploys
+// don't wait for an IP address.
+func (c *Config) GetIPWaitTimeout() time.Duration {
+	return max(c.IPWaitTimeout.Duration, 0)
+}
+
+// GetOperationTimeout returns the configured overall operation timeout, or 0
+// if operations are not capped.
+func (c *Config) GetOperationTimeout() time.Duration {
+	return max(c.OperationTimeout.Duration, 0)
+}
+
+// GetReadinessTimeout returns the configured readiness timeout, or the default if not set.
+func (c *Config) GetReadinessTimeout() time.Duration {
+	if c.ReadinessTimeout.Duration <= 0 {
+		return DefaultReadinessTimeout
+	}
+	return c.ReadinessTimeout.Duration
+}
+
 // resolvedIDs holds the resolved UUIDs for each resource.
 type resolvedIDs struct {
 	ZoneID            string
 	ServiceOfferingID string
 	TemplateID        string
 	ProjectID         string
+	DomainID          string
+	// FlavorOfferings maps flavor_map keys to resolved service offering UUIDs.
+	FlavorOfferings map[string]string
+	// ZoneSSHKeyNames maps resolved zone UUIDs to zone_ssh_key_names keypairs.
+	ZoneSSHKeyNames map[string]string
 }
 
 // ZoneID returns the resolved zone UUID.
@@ -137,6 +803,109 @@ func (c *Config) ProjectID() string {
 	return c.resolved.ProjectID
 }
 
+// DomainID returns the resolved domain UUID (may be empty if not set).
+func (c *Config) DomainID() string {
+	return c.resolved.DomainID
+}
+
+// FlavorServiceOfferingID returns the resolved service offering UUID for a
+// flavor listed in flavor_map, and whether the flavor is mapped.
+func (c *Config) FlavorServiceOfferingID(flavor string) (string, bool) {
+	id, ok := c.resolved.FlavorOfferings[flavor]
+	return id, ok
+}
+
+// ZoneSSHKeyName returns the SSH keypair to use in a zone: its
+// zone_ssh_key_names entry, or ssh_key_name if the zone has none.
+func (c *Config) ZoneSSHKeyName(zoneID string) string {
+	if name, ok := c.resolved.ZoneSSHKeyNames[zoneID]; ok {
+		return name
+	}
+	return c.SSHKeyName
+}
+
+// SetResolvedZoneSSHKeyNames sets the zone_ssh_key_names keypairs keyed by
+// zone UUID directly (for testing purposes).
+func (c *Config) SetResolvedZoneSSHKeyNames(keyNames map[string]string) {
+	c.resolved.ZoneSSHKeyNames = keyNames
+}
+
+// SetResolvedFlavorOfferings sets the resolved flavor_map offerings directly (for testing purposes).
+func (c *Config) SetResolvedFlavorOfferings(offerings map[string]string) {
+	c.resolved.FlavorOfferings = offerings
+}
+
+// SetResolvedDomainID sets the resolved domain UUID directly (for testing purposes).
+func (c *Config) SetResolvedDomainID(domainID string) {
+	c.resolved.DomainID = domainID
+}
+
+// ResolvedResource is a resource of the config, as configured and as resolved
+// by ResolveNames.
+type ResolvedResource struct {
+	Name string `json:"name,omitempty"`
+	ID   string `json:"id,omitempty"`
+}
+
+// ResolvedSummary describes what the config resolved to, for debugging. It
+// holds no credentials.
+type ResolvedSummary struct {
+	APIURL          string                      `json:"api_url"`
+	Zone            ResolvedResource            `json:"zone"`
+	ServiceOffering ResolvedResource            `json:"service_offering"`
+	Template        ResolvedResource            `json:"template"`
+	TemplateFilter  string                      `json:"template_filter"`
+	Project         ResolvedResource            `json:"project"`
+	Domain          ResolvedResource            `json:"domain"`
+	Account         string                      `json:"account,omitempty"`
+	FlavorMap       map[string]ResolvedResource `json:"flavor_map,omitempty"`
+	Profiles        map[string]ResolvedProfile  `json:"profiles,omitempty"`
+}
+
+// ResolvedProfile is the resolved service offering and template of a profile.
+type ResolvedProfile struct {
+	ServiceOffering ResolvedResource `json:"service_offering"`
+	Template        ResolvedResource `json:"template"`
+}
+
+// ResolvedSummary returns the configured names and resolved UUIDs of the
+// resources the provider deploys with. The API key and secret are left out,
+// as is any user info in api_url.
+func (c *Config) ResolvedSummary() ResolvedSummary {
+	apiURL := c.APIURL
+	if u, err := url.Parse(c.APIURL); err == nil && u.User != nil {
+		u.User = nil
+		apiURL = u.String()
+	}
+	summary := ResolvedSummary{
+		APIURL:          apiURL,
+		Zone:            ResolvedResource{Name: c.Zone, ID: c.ZoneID()},
+		ServiceOffering: ResolvedResource{Name: c.ServiceOffering, ID: c.ServiceOfferingID()},
+		Template:        ResolvedResource{Name: c.Template, ID: c.TemplateID()},
+		TemplateFilter:  c.GetTemplateFilter(),
+		Project:         ResolvedResource{Name: c.Project, ID: c.ProjectID()},
+		Domain:          ResolvedResource{Name: c.Domain, ID: c.DomainID()},
+		Account:         c.Account,
+	}
+	if len(c.FlavorMap) > 0 {
+		summary.FlavorMap = make(map[string]ResolvedResource, len(c.FlavorMap))
+		for flavor, offering := range c.FlavorMap {
+			id, _ := c.FlavorServiceOfferingID(flavor)
+			summary.FlavorMap[flavor] = ResolvedResource{Name: offering, ID: id}
+		}
+	}
+	if len(c.Profiles) > 0 {
+		summary.Profiles = make(map[string]ResolvedProfile, len(c.Profiles))
+		for _, profile := range c.Profiles {
+			summary.Profiles[profile.Name] = ResolvedProfile{
+				ServiceOffering: ResolvedResource{Name: profile.ServiceOffering, ID: profile.serviceOfferingID},
+				Template:        ResolvedResource{Name: profile.Template, ID: profile.templateID},
+			}
+		}
+	}
+	return summary
+}
+
 // SetResolvedIDs sets the resolved UUIDs directly (for testing purposes).
 func (c *Config) SetResolvedIDs(zoneID, serviceOfferingID, templateID, projectID string) {
 	c.resolved = resolvedIDs{
@@ -150,15 +919,55 @@ func (c *Config) SetResolvedIDs(zoneID, serviceOfferingID, templateID, projectID
 // NewConfig loads and validates the provider configuration from a TOML file.
 // It also resolves symbolic names to UUIDs.
 func NewConfig(path string) (*Config, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.ResolveNames(); err != nil {
+		return nil, fmt.Errorf("error resolving names: %w", err)
+	}
+	return cfg, nil
+}
+
+// LoadConfig loads and validates the provider configuration from a TOML file
+// without contacting CloudStack. Call ResolveNames before using the resolved
+// IDs.
+func LoadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening config: %w", err)
+	}
+	defer f.Close()
+	return NewConfigFromReader(f, false)
+}
+
+// NewConfigFromBytes loads and validates the provider configuration from TOML
+// data. If resolve is true, symbolic names are also resolved to UUIDs, which
+// requires access to the CloudStack API.
+func NewConfigFromBytes(data []byte, resolve bool) (*Config, error) {
+	return NewConfigFromReader(bytes.NewReader(data), resolve)
+}
+
+// NewConfigFromReader loads and validates the provider configuration from a
+// TOML reader. If resolve is true, symbolic names are also resolved to UUIDs,
+// which requires access to the CloudStack API.
+func NewConfigFromReader(r io.Reader, resolve bool) (*Config, error) {
 	var cfg Config
-	if _, err := toml.DecodeFile(path, &cfg); err != nil {
+	if _, err := toml.NewDecoder(r).Decode(&cfg); err != nil {
 		return nil, fmt.Errorf("error decoding config: %w", err)
 	}
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("error validating config: %w", err)
 	}
-	if err := cfg.resolveNames(); err != nil {
-		return nil, fmt.Errorf("error resolving names: %w", err)
+	apiURL, err := normalizeAPIURL(cfg.APIURL, cfg.APIPath)
+	if err != nil {
+		return nil, fmt.Errorf("error validating config: %w", err)
+	}
+	cfg.APIURL = apiURL
+	if resolve {
+		if err := cfg.ResolveNames(); err != nil {
+			return nil, fmt.Errorf("error resolving names: %w", err)
+		}
 	}
 	return &cfg, nil
 }
@@ -183,13 +992,244 @@ func (c *Config) Validate() error {
 	if c.Template == "" {
 		return fmt.Errorf("missing template")
 	}
+	if c.Account != "" && c.Domain == "" {
+		return fmt.Errorf("account requires domain")
+	}
+	if _, err := c.parseTagTemplates(); err != nil {
+		return err
+	}
+	if c.SSHPrivateKeyPath != "" {
+		if _, err := c.LoadSSHPrivateKey(); err != nil {
+			return err
+		}
+	}
+	if c.MaxNameLength != 0 && (c.MaxNameLength < MinMaxNameLength || c.MaxNameLength > 255) {
+		return fmt.Errorf("invalid max_name_length %d: must be between %d and 255", c.MaxNameLength, MinMaxNameLength)
+	}
+	if c.ListPageSize < 0 || c.ListPageSize > DefaultListPageSize {
+		return fmt.Errorf("invalid list_page_size %d: must be between 1 and %d", c.ListPageSize, DefaultListPageSize)
+	}
+	if c.MaxTagValueLength != 0 && (c.MaxTagValueLength < MinMaxTagValueLength || c.MaxTagValueLength > DefaultMaxTagValueLength) {
+		return fmt.Errorf("invalid max_tag_value_length %d: must be between %d and %d", c.MaxTagValueLength, MinMaxTagValueLength, DefaultMaxTagValueLength)
+	}
+	if c.TemplateFilter != "" && !slices.Contains(templateFilters, c.TemplateFilter) {
+		return fmt.Errorf("invalid template_filter %q: must be one of %s", c.TemplateFilter, strings.Join(templateFilters, ", "))
+	}
+	switch c.SignatureVersion {
+	case "", SignatureVersion3, SignatureVersionLegacy:
+	default:
+		return fmt.Errorf("invalid signature_version %q: must be %s or %s", c.SignatureVersion, SignatureVersion3, SignatureVersionLegacy)
+	}
+	switch c.NameCollisionPolicy {
+	case "", NameCollisionFail, NameCollisionSuffix, NameCollisionReuse:
+	default:
+		return fmt.Errorf("invalid name_collision_policy %q: must be fail, suffix or reuse", c.NameCollisionPolicy)
+	}
+	switch c.MissingKeypairPolicy {
+	case "", MissingKeypairFail, MissingKeypairIgnore:
+	case MissingKeypairCreate:
+		if c.SSHPrivateKeyPath == "" {
+			return fmt.Errorf("missing_keypair_policy create requires ssh_private_key_path")
+		}
+	default:
+		return fmt.Errorf("invalid missing_keypair_policy %q: must be fail, ignore or create", c.MissingKeypairPolicy)
+	}
+	if c.DuplicateNameRetries < 0 {
+		return fmt.Errorf("invalid duplicate_name_retries %d: must not be negative", c.DuplicateNameRetries)
+	}
+	if c.DeleteConcurrency < 0 {
+		return fmt.Errorf("invalid delete_concurrency %d: must not be negative", c.DeleteConcurrency)
+	}
+	if c.MaxNICs < 0 {
+		return fmt.Errorf("invalid max_nics %d: must not be negative", c.MaxNICs)
+	}
+	profiles := make(map[string]bool, len(c.Profiles))
+	for _, profile := range c.Profiles {
+		if profile.Name == "" {
+			return fmt.Errorf("profile without a name")
+		}
+		if profiles[profile.Name] {
+			return fmt.Errorf("duplicate profile %q", profile.Name)
+		}
+		profiles[profile.Name] = true
+	}
+	switch params.OSArch(c.DefaultOSArch) {
+	case "", params.Amd64, params.I386, params.Arm64, params.Arm:
+	default:
+		return fmt.Errorf("invalid default_os_arch %q: must be one of amd64, i386, arm64 or arm", c.DefaultOSArch)
+	}
+	switch c.ErroredInstances {
+	case "", ErroredInstancesReport, ErroredInstancesExclude, ErroredInstancesFlag:
+	default:
+		return fmt.Errorf("invalid errored_instances %q: must be one of report, exclude or flag", c.ErroredInstances)
+	}
+	for state, status := range c.StatusMap {
+		if !slices.Contains(knownStatuses, params.InstanceStatus(status)) {
+			return fmt.Errorf("invalid status_map entry %q: unknown status %q", state, status)
+		}
+	}
 	return nil
 }
 
-// resolveNames resolves symbolic names to UUIDs using the CloudStack API.
+// DefaultAPIPath is the path under which CloudStack serves its API.
+const DefaultAPIPath = "/client/api"
+
+// normalizeAPIURL makes sure the API URL points at the CloudStack API endpoint.
+// If apiPath is set it replaces the URL path; otherwise /client/api is appended
+// to the path unless it is already present.
+func normalizeAPIURL(rawURL, apiPath string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid api_url %q: %w", rawURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid api_url %q: expected an http(s) URL", rawURL)
+	}
+
+	if apiPath != "" {
+		u.Path = "/" + strings.TrimLeft(apiPath, "/")
+		return u.String(), nil
+	}
+
+	p := strings.TrimRight(u.Path, "/")
+	switch {
+	case strings.HasSuffix(p, DefaultAPIPath):
+	case strings.HasSuffix(p, "/client"):
+		p += "/api"
+	default:
+		p += DefaultAPIPath
+	}
+	u.Path = p
+	return u.String(), nil
+}
+
+// TLSConfig returns the TLS configuration used for every connection to the
+// CloudStack API. Certificate verification follows VerifySSL.
+func (c *Config) TLSConfig() *tls.Config {
+	return &tls.Config{InsecureSkipVerify: !c.VerifySSL}
+}
+
+// NewClient returns an async CloudStack API client for this config. Both the
+// name resolver and the runtime client are built here, so they always share the
+// same transport settings and honor VerifySSL the same way.
+func (c *Config) NewClient(options ...cs.ClientOption) *cs.CloudStackClient {
+	options = append([]cs.ClientOption{cs.WithHTTPClient(c.httpClient())}, options...)
+	return cs.NewAsyncClient(c.APIURL, c.APIKey, c.Secret, c.VerifySSL, options...)
+}
+
+// NewSyncClient returns a CloudStack API client that doesn't wait for async
+// jobs, so callers can poll the returned job IDs themselves.
+func (c *Config) NewSyncClient(options ...cs.ClientOption) *cs.CloudStackClient {
+	options = append([]cs.ClientOption{cs.WithHTTPClient(c.httpClient())}, options...)
+	return cs.NewClient(c.APIURL, c.APIKey, c.Secret, c.VerifySSL, options...)
+}
+
+// DefaultUserAgent is the User-Agent sent when user_agent is not set.
+const DefaultUserAgent = "garm-provider-cloudstack"
+
+// GetUserAgent returns the configured User-Agent, or DefaultUserAgent if not set.
+func (c *Config) GetUserAgent() string {
+	if c.UserAgent == "" {
+		return DefaultUserAgent
+	}
+	return c.UserAgent
+}
+
+// userAgentTransport sets the User-Agent header of every request.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(req)
+}
+
+// Values of SignatureVersion.
+const (
+	SignatureVersion3      = "3"
+	SignatureVersionLegacy = "legacy"
+)
+
+// legacySignatureTransport re-signs the requests of the CloudStack client,
+// which always signs with signatureversion=3, without the signatureversion
+// and expires parameters.
+type legacySignatureTransport struct {
+	base   http.RoundTripper
+	secret string
+}
+
+func (t *legacySignatureTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if req.Method == http.MethodPost {
+		body, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, err
+		}
+		form.Set("signature", t.sign(form))
+		encoded := form.Encode()
+		req.Body = io.NopCloser(strings.NewReader(encoded))
+		req.ContentLength = int64(len(encoded))
+		return t.base.RoundTrip(req)
+	}
+	query, err := url.ParseQuery(req.URL.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	signature := t.sign(query)
+	req.URL.RawQuery = cs.EncodeValues(query) + "&signature=" + url.QueryEscape(signature)
+	return t.base.RoundTrip(req)
+}
+
+// sign drops the signature version parameters from params and returns their
+// signature, computed the way the CloudStack client does.
+func (t *legacySignatureTransport) sign(params url.Values) string {
+	params.Del("signature")
+	params.Del("signatureversion")
+	params.Del("expires")
+	mac := hmac.New(sha1.New, []byte(t.secret))
+	mac.Write([]byte(strings.ToLower(cs.EncodeValues(params))))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// httpClient returns the HTTP client used for the CloudStack API.
+func (c *Config) httpClient() *http.Client {
+	jar, _ := cookiejar.New(nil)
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSClientConfig:       c.TLSConfig(),
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	var roundTripper http.RoundTripper = &userAgentTransport{base: transport, userAgent: c.GetUserAgent()}
+	if c.SignatureVersion == SignatureVersionLegacy {
+		roundTripper = &legacySignatureTransport{base: roundTripper, secret: c.Secret}
+	}
+	httpClient := &http.Client{
+		Jar:       jar,
+		Transport: roundTripper,
+		Timeout:   60 * time.Second,
+	}
+	return httpClient
+}
+
+// ResolveNames resolves symbolic names to UUIDs using the CloudStack API.
 // If the value is already a UUID, it's used directly; otherwise, the name is resolved.
-func (c *Config) resolveNames() error {
-	client := cs.NewAsyncClient(c.APIURL, c.APIKey, c.Secret, c.VerifySSL)
+func (c *Config) ResolveNames() error {
+	client := c.NewClient()
 
 	// Resolve zone
 	if isUUID(c.Zone) {
@@ -202,77 +1242,313 @@ func (c *Config) resolveNames() error {
 		c.resolved.ZoneID = zone.Id
 	}
 
-	// Resolve service offering
-	if isUUID(c.ServiceOffering) {
-		c.resolved.ServiceOfferingID = c.ServiceOffering
-	} else {
-		so, _, err := client.ServiceOffering.GetServiceOfferingByName(c.ServiceOffering)
-		if err != nil {
-			return fmt.Errorf("failed to resolve service_offering %q: %w", c.ServiceOffering, err)
+	// Resolve zone_ssh_key_names zones
+	if len(c.ZoneSSHKeyNames) > 0 {
+		c.resolved.ZoneSSHKeyNames = make(map[string]string, len(c.ZoneSSHKeyNames))
+	}
+	for zoneName, keyName := range c.ZoneSSHKeyNames {
+		zoneID := zoneName
+		if !isUUID(zoneName) {
+			zone, _, err := client.Zone.GetZoneByName(zoneName)
+			if err != nil {
+				return fmt.Errorf("failed to resolve zone %q of zone_ssh_key_names: %w", zoneName, err)
+			}
+			zoneID = zone.Id
 		}
-		c.resolved.ServiceOfferingID = so.Id
+		c.resolved.ZoneSSHKeyNames[zoneID] = keyName
 	}
 
-	// Resolve project (needed before resolving template if using project-scoped templates)
-	if c.Project != "" {
-		if isUUID(c.Project) {
-			c.resolved.ProjectID = c.Project
+	// Resolve domain (needed before resolving service offerings by name)
+	if c.Domain != "" {
+		if isUUID(c.Domain) {
+			c.resolved.DomainID = c.Domain
 		} else {
-			p := client.Project.NewListProjectsParams()
-			p.SetName(c.Project)
+			p := client.Domain.NewListDomainsParams()
+			p.SetName(c.Domain)
 			p.SetListall(true)
-			resp, err := client.Project.ListProjects(p)
+			resp, err := client.Domain.ListDomains(p)
 			if err != nil {
-				return fmt.Errorf("failed to resolve project %q: %w", c.Project, err)
+				return fmt.Errorf("failed to resolve domain %q: %w", c.Domain, err)
 			}
 			if resp.Count == 0 {
-				return fmt.Errorf("project %q not found", c.Project)
+				return fmt.Errorf("domain %q not found", c.Domain)
 			}
 			if resp.Count > 1 {
-				return fmt.Errorf("multiple projects found matching %q", c.Project)
+				return fmt.Errorf("multiple domains found matching %q", c.Domain)
 			}
-			c.resolved.ProjectID = resp.Projects[0].Id
+			c.resolved.DomainID = resp.Domains[0].Id
 		}
 	}
 
-	// Resolve template
-	if isUUID(c.Template) {
-		c.resolved.TemplateID = c.Template
-	} else {
-		p := client.Template.NewListTemplatesParams("executable")
-		p.SetName(c.Template)
-		p.SetZoneid(c.resolved.ZoneID)
-		if c.resolved.ProjectID != "" {
-			p.SetProjectid(c.resolved.ProjectID)
+	// Resolve service offering
+	offeringID, err := c.LookupServiceOffering(client, c.ServiceOffering)
+	if err != nil {
+		return fmt.Errorf("failed to resolve service_offering %q: %w", c.ServiceOffering, err)
+	}
+	c.resolved.ServiceOfferingID = offeringID
+
+	// Resolve project (needed before resolving template if using project-scoped templates)
+	if c.Project != "" {
+		projectID, err := LookupProject(client, c.Project)
+		if err != nil {
+			return err
 		}
-		resp, err := client.Template.ListTemplates(p)
+		c.resolved.ProjectID = projectID
+	}
+
+	// Resolve template
+	templateID, err := c.resolveTemplate(client, c.Template)
+	if err != nil {
+		return err
+	}
+	c.resolved.TemplateID = templateID
+
+	// Resolve flavor_map service offerings
+	if len(c.FlavorMap) > 0 {
+		c.resolved.FlavorOfferings = make(map[string]string, len(c.FlavorMap))
+	}
+	for flavor, offering := range c.FlavorMap {
+		id, err := c.LookupServiceOffering(client, offering)
 		if err != nil {
-			return fmt.Errorf("failed to resolve template %q: %w", c.Template, err)
+			return fmt.Errorf("failed to resolve service offering %q for flavor %q: %w", offering, flavor, err)
 		}
-		if resp.Count == 0 {
-			return fmt.Errorf("template %q not found", c.Template)
+		c.resolved.FlavorOfferings[flavor] = id
+	}
+
+	// Resolve profile service offerings and templates
+	for i := range c.Profiles {
+		profile := &c.Profiles[i]
+		if profile.ServiceOffering != "" {
+			id, err := c.LookupServiceOffering(client, profile.ServiceOffering)
+			if err != nil {
+				return fmt.Errorf("failed to resolve service offering %q for profile %q: %w", profile.ServiceOffering, profile.Name, err)
+			}
+			profile.serviceOfferingID = id
+		}
+		if profile.Template != "" {
+			id, err := c.resolveTemplate(client, profile.Template)
+			if err != nil {
+				return fmt.Errorf("profile %q: %w", profile.Name, err)
+			}
+			profile.templateID = id
 		}
-		// If multiple templates match, use the first one
-		c.resolved.TemplateID = resp.Templates[0].Id
 	}
 
 	return nil
 }
 
+// LookupProject returns the UUID of a project name or UUID. Names must match
+// exactly one project.
+func LookupProject(client *cs.CloudStackClient, nameOrID string) (string, error) {
+	if isUUID(nameOrID) {
+		return nameOrID, nil
+	}
+	p := client.Project.NewListProjectsParams()
+	p.SetName(nameOrID)
+	p.SetListall(true)
+	resp, err := client.Project.ListProjects(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve project %q: %w", nameOrID, err)
+	}
+	if resp.Count == 0 {
+		return "", fmt.Errorf("project %q not found", nameOrID)
+	}
+	if resp.Count > 1 {
+		return "", fmt.Errorf("multiple projects found matching %q", nameOrID)
+	}
+	return resp.Projects[0].Id, nil
+}
+
+// LookupServiceOffering returns the UUID of a service offering name or UUID.
+// Names are looked up in the resolved domain and account, if configured, and
+// must match exactly one offering.
+func (c *Config) LookupServiceOffering(client *cs.CloudStackClient, nameOrID string) (string, error) {
+	if isUUID(nameOrID) {
+		return nameOrID, nil
+	}
+	p := client.ServiceOffering.NewListServiceOfferingsParams()
+	p.SetName(nameOrID)
+	if c.resolved.DomainID != "" {
+		p.SetDomainid(c.resolved.DomainID)
+		if c.Account != "" {
+			p.SetAccount(c.Account)
+		}
+	}
+	resp, err := client.ServiceOffering.ListServiceOfferings(p)
+	if err != nil {
+		return "", err
+	}
+	// The name filter is not an exact match on every CloudStack version.
+	var ids []string
+	for _, so := range resp.ServiceOfferings {
+		if so.Name == nameOrID && !slices.Contains(ids, so.Id) {
+			ids = append(ids, so.Id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("service offering %q not found", nameOrID)
+	case 1:
+		return ids[0], nil
+	}
+	return "", fmt.Errorf("multiple service offerings found matching %q; set domain and account to disambiguate", nameOrID)
+}
+
+// LookupDiskOffering returns the UUID of a disk offering name or UUID, scoped
+// to the resolved domain like LookupServiceOffering.
+func (c *Config) LookupDiskOffering(client *cs.CloudStackClient, nameOrID string) (string, error) {
+	if isUUID(nameOrID) {
+		return nameOrID, nil
+	}
+	p := client.DiskOffering.NewListDiskOfferingsParams()
+	p.SetName(nameOrID)
+	if c.resolved.DomainID != "" {
+		p.SetDomainid(c.resolved.DomainID)
+	}
+	resp, err := client.DiskOffering.ListDiskOfferings(p)
+	if err != nil {
+		return "", err
+	}
+	// The name filter is not an exact match on every CloudStack version.
+	var ids []string
+	for _, do := range resp.DiskOfferings {
+		if do.Name == nameOrID && !slices.Contains(ids, do.Id) {
+			ids = append(ids, do.Id)
+		}
+	}
+	switch len(ids) {
+	case 0:
+		return "", fmt.Errorf("disk offering %q not found", nameOrID)
+	case 1:
+		return ids[0], nil
+	}
+	return "", fmt.Errorf("multiple disk offerings found matching %q; set domain to disambiguate", nameOrID)
+}
+
+// TemplateArch returns the architecture a template name or UUID reports in the
+// resolved zone and project, or an empty string if it reports none.
+func (c *Config) TemplateArch(client *cs.CloudStackClient, nameOrID string) (string, error) {
+	p := client.Template.NewListTemplatesParams(c.GetTemplateFilter())
+	if isUUID(nameOrID) {
+		p.SetId(nameOrID)
+	} else {
+		p.SetName(nameOrID)
+	}
+	p.SetZoneid(c.resolved.ZoneID)
+	if c.resolved.ProjectID != "" {
+		p.SetProjectid(c.resolved.ProjectID)
+	}
+	resp, err := client.Template.ListTemplates(p)
+	if err != nil {
+		return "", err
+	}
+	if resp.Count == 0 {
+		return "", fmt.Errorf("template %q not found", nameOrID)
+	}
+	return resp.Templates[0].Arch, nil
+}
+
+// resolveTemplate returns the UUID of a template name or UUID in the resolved
+// zone and project.
+func (c *Config) resolveTemplate(client *cs.CloudStackClient, nameOrID string) (string, error) {
+	if isUUID(nameOrID) {
+		return nameOrID, nil
+	}
+	p := client.Template.NewListTemplatesParams(c.GetTemplateFilter())
+	p.SetName(nameOrID)
+	p.SetZoneid(c.resolved.ZoneID)
+	if c.resolved.ProjectID != "" {
+		p.SetProjectid(c.resolved.ProjectID)
+	}
+	resp, err := client.Template.ListTemplates(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve template %q: %w", nameOrID, err)
+	}
+	if resp.Count == 0 {
+		return "", fmt.Errorf("template %q not found", nameOrID)
+	}
+	// If multiple templates match, use the first one
+	return resp.Templates[0].Id, nil
+}
+
 // configSchema is a struct that mirrors Config but with JSON schema tags for documentation.
 // The actual Config uses TOML tags, but GARM expects a JSON schema for validation.
 type configSchema struct {
-	APIURL          string `json:"api_url" jsonschema:"required,description=CloudStack API URL"`
-	APIKey          string `json:"api_key" jsonschema:"required,description=CloudStack API key"`
-	Secret          string `json:"secret" jsonschema:"required,description=CloudStack API secret"`
-	VerifySSL       bool   `json:"verify_ssl,omitempty" jsonschema:"description=Verify SSL certificates (default: false)"`
-	Zone            string `json:"zone" jsonschema:"required,description=CloudStack zone name or UUID"`
-	ServiceOffering string `json:"service_offering" jsonschema:"required,description=Compute offering name or UUID"`
-	Template        string `json:"template" jsonschema:"required,description=VM template name or UUID"`
-	Project         string `json:"project,omitempty" jsonschema:"description=CloudStack project name or UUID (optional)"`
-	SSHKeyName      string `json:"ssh_key_name,omitempty" jsonschema:"description=SSH keypair name (optional)"`
-	AsyncTimeout    string `json:"async_timeout,omitempty" jsonschema:"description=Async API call timeout (e.g. 15m - default: 15m)"`
-	Expunge         bool   `json:"expunge,omitempty" jsonschema:"description=Expunge VMs immediately on deletion (default: false)"`
+	APIURL                   string            `json:"api_url" jsonschema:"required,description=CloudStack API URL"`
+	APIKey                   string            `json:"api_key" jsonschema:"required,description=CloudStack API key"`
+	Secret                   string            `json:"secret" jsonschema:"required,description=CloudStack API secret"`
+	VerifySSL                bool              `json:"verify_ssl,omitempty" jsonschema:"description=Verify SSL certificates (default: false)"`
+	APIPath                  string            `json:"api_path,omitempty" jsonschema:"description=Override the path of api_url (default: /client/api appended when missing)"`
+	UserAgent                string            `json:"user_agent,omitempty" jsonschema:"description=User-Agent sent with API requests (default: garm-provider-cloudstack/<version>)"`
+	SignatureVersion         string            `json:"signature_version,omitempty" jsonschema:"enum=3,enum=legacy,description=How API requests are signed: 3 with signatureversion and expires or legacy without them (default: 3)"`
+	Zone                     string            `json:"zone" jsonschema:"required,description=CloudStack zone name or UUID"`
+	ServiceOffering          string            `json:"service_offering" jsonschema:"required,description=Compute offering name or UUID"`
+	Template                 string            `json:"template" jsonschema:"required,description=VM template name or UUID"`
+	TemplateFilter           string            `json:"template_filter,omitempty" jsonschema:"enum=featured,enum=self,enum=selfexecutable,enum=sharedexecutable,enum=executable,enum=community,enum=all,description=Template filter used to look templates up by name (default: executable)"`
+	Project                  string            `json:"project,omitempty" jsonschema:"description=CloudStack project name or UUID (optional)"`
+	ProjectFromLabel         string            `json:"project_from_label,omitempty" jsonschema:"description=Label key whose <key>=<project> label selects the deploy project of a runner (optional)"`
+	Domain                   string            `json:"domain,omitempty" jsonschema:"description=CloudStack domain name or UUID used to scope service offering lookups (optional)"`
+	Account                  string            `json:"account,omitempty" jsonschema:"description=Account within domain used to scope service offering lookups (optional - requires domain)"`
+	SSHKeyName               string            `json:"ssh_key_name,omitempty" jsonschema:"description=SSH keypair name (optional)"`
+	ZoneSSHKeyNames          map[string]string `json:"zone_ssh_key_names,omitempty" jsonschema:"description=SSH keypair names keyed by zone name or UUID overriding ssh_key_name in that zone"`
+	SSHPrivateKeyPath        string            `json:"ssh_private_key_path,omitempty" jsonschema:"description=Path to the PEM encoded RSA private key of the SSH keypair used to decrypt VM passwords (optional)"`
+	MissingKeypairPolicy     string            `json:"missing_keypair_policy,omitempty" jsonschema:"enum=fail,enum=ignore,enum=create,description=What to do when the SSH keypair of a deploy does not exist (default: no check)"`
+	AsyncTimeout             string            `json:"async_timeout,omitempty" jsonschema:"description=Async API call timeout (e.g. 15m - default: 15m)"`
+	CreateGracePeriod        string            `json:"create_grace_period,omitempty" jsonschema:"description=How long a failed deploy is re-checked for a running VM before failing (e.g. 30s - default: 0)"`
+	TemplateReadyTimeout     string            `json:"template_ready_timeout,omitempty" jsonschema:"description=How long deploys are retried while the template is still downloading (e.g. 5m - default: 0)"`
+	DeployPollInterval       string            `json:"deploy_poll_interval,omitempty" jsonschema:"description=Poll interval for VM deployment jobs (e.g. 5s - default: client backoff)"`
+	DeletePollInterval       string            `json:"delete_poll_interval,omitempty" jsonschema:"description=Poll interval for VM destroy jobs (e.g. 2s - default: client backoff)"`
+	PowerPollInterval        string            `json:"power_poll_interval,omitempty" jsonschema:"description=Poll interval for VM start/stop/reboot jobs (e.g. 2s - default: client backoff)"`
+	LeaseTTL                 string            `json:"lease_ttl,omitempty" jsonschema:"description=Maximum VM age after which ReapExpired destroys it (e.g. 12h - default: 0 - never)"`
+	Expunge                  bool              `json:"expunge,omitempty" jsonschema:"description=Expunge VMs immediately on deletion (default: false)"`
+	ExpungeRetries           int               `json:"expunge_retries,omitempty" jsonschema:"description=Retries for an expunge blocked by an in-progress operation (default: 5 - negative disables)"`
+	ExpungeRetryInterval     string            `json:"expunge_retry_interval,omitempty" jsonschema:"description=Initial backoff between expunge retries (e.g. 2s - default: 2s)"`
+	LeaveOnFailure           bool              `json:"leave_on_failure,omitempty" jsonschema:"description=Keep VMs whose create failed after deploying for debugging (default: false)"`
+	AuditLogPath             string            `json:"audit_log_path,omitempty" jsonschema:"description=File that mutating operations are appended to in JSON lines format (optional)"`
+	TagVolumes               bool              `json:"tag_volumes,omitempty" jsonschema:"description=Also tag the ROOT volume of new VMs with the controller and pool IDs (default: false)"`
+	CheckTemplatePermissions bool              `json:"check_template_permissions,omitempty" jsonschema:"description=Check that the account can deploy the template before every deploy (default: false)"`
+	TagRunnerContext         bool              `json:"tag_runner_context,omitempty" jsonschema:"description=Tag new VMs with the repository or organization or enterprise their runner belongs to (default: false)"`
+	UniqueDisplayNames       bool              `json:"unique_display_names,omitempty" jsonschema:"description=Append a short random suffix to VM display names (default: false)"`
+	NameCollisionPolicy      string            `json:"name_collision_policy,omitempty" jsonschema:"enum=fail,enum=suffix,enum=reuse,description=What to do when a VM with the same name already exists (default: no check)"`
+	DuplicateNameRetries     int               `json:"duplicate_name_retries,omitempty" jsonschema:"minimum=0,description=Retries for a name lookup that finds more than one VM (default: 0)"`
+	IgnoreDedication         bool              `json:"ignore_dedication,omitempty" jsonschema:"description=Do not place VMs on resources explicitly dedicated to the account or project (default: false)"`
+	TagTemplates             map[string]string `json:"tag_templates,omitempty" jsonschema:"description=Extra VM tags keyed by tag name with Go text/template values"`
+	MaxNameLength            int               `json:"max_name_length,omitempty" jsonschema:"minimum=16,maximum=255,description=Maximum VM name length (default: 63)"`
+	ListPageSize             int               `json:"list_page_size,omitempty" jsonschema:"minimum=1,maximum=500,description=Number of VMs requested per page when listing VMs (default: 500)"`
+	MaxTagValueLength        int               `json:"max_tag_value_length,omitempty" jsonschema:"minimum=36,maximum=255,description=Maximum length of VM tag values; longer values get a hash suffix (default: 255)"`
+	MaxNICs                  int               `json:"max_nics,omitempty" jsonschema:"minimum=0,description=Maximum number of networks per VM (default: 0 - not checked)"`
+	DefaultOSArch            string            `json:"default_os_arch,omitempty" jsonschema:"enum=amd64,enum=i386,enum=arm64,enum=arm,description=Architecture assumed when the bootstrap params carry no os_arch (default: none - such runners are refused if the template reports an architecture)"`
+	ErroredInstances         string            `json:"errored_instances,omitempty" jsonschema:"enum=report,enum=exclude,enum=flag,description=How Error state VMs are reported when listing a pool (default: report)"`
+	AutoReapErrored          bool              `json:"auto_reap_errored,omitempty" jsonschema:"description=Destroy Error state VMs found while listing a pool (default: false)"`
+	IncludeStoppedInList     *bool             `json:"include_stopped_in_list,omitempty" jsonschema:"description=Report stopped VMs when listing a pool (default: true)"`
+	IncludeTerminated        bool              `json:"include_terminated,omitempty" jsonschema:"description=Report Destroyed and Expunging VMs when listing a pool (default: false)"`
+	RequireNetwork           *bool             `json:"require_network,omitempty" jsonschema:"description=Fail deploys into advanced zones without networks instead of using the CloudStack default network (default: true)"`
+	ReadinessTag             string            `json:"readiness_tag,omitempty" jsonschema:"description=Tag the VM must carry before a deploy is reported successful (optional)"`
+	ReadinessTimeout         string            `json:"readiness_timeout,omitempty" jsonschema:"description=How long to wait for readiness_tag (e.g. 10m - default: 10m)"`
+	IPWaitTimeout            string            `json:"ip_wait_timeout,omitempty" jsonschema:"description=How long a deploy waits for the VM to get an IP address (e.g. 2m - default: 0 - no wait)"`
+	IPv6Only                 bool              `json:"ipv6_only,omitempty" jsonschema:"description=Require IPv6 networks and an IPv6 address for every VM in IPv6-only zones (default: false)"`
+	RefreshInstanceIP        bool              `json:"refresh_instance_ip,omitempty" jsonschema:"description=Look a Running VM without an IP address up again for a few seconds when garm gets it (default: false)"`
+	OperationTimeout         string            `json:"operation_timeout,omitempty" jsonschema:"description=Overall time budget of an instance create or delete (e.g. 30m - default: 0 - no limit)"`
+	FlavorMap                map[string]string `json:"flavor_map,omitempty" jsonschema:"description=Map of pool flavor strings to service offering names or UUIDs"`
+	BatchStartStagger        string            `json:"batch_start_stagger,omitempty" jsonschema:"description=Delay between deploys of a CreateRunningInstances batch; only for library callers (e.g. 5s - default: 0)"`
+	BatchTags                bool              `json:"batch_tags,omitempty" jsonschema:"description=Tag the VMs of a CreateRunningInstances batch together with one call per set of shared tags; only for library callers (default: false)"`
+	DeleteConcurrency        int               `json:"delete_concurrency,omitempty" jsonschema:"minimum=1,description=Number of VMs RemoveAllInstances destroys at once (default: 10)"`
+	AllowedDetails           []string          `json:"allowed_details,omitempty" jsonschema:"description=Extra deploy detail keys the details extra spec may set"`
+	DefaultExtraPackages     []string          `json:"default_extra_packages,omitempty" jsonschema:"description=Extra packages installed on every Linux runner (combined with the pool extra_packages per merge_strategy)"`
+	DefaultPreInstallScripts map[string]string `json:"default_pre_install_scripts,omitempty" jsonschema:"description=Pre-install scripts run on every Linux runner keyed by name (combined with the pool pre_install_scripts per merge_strategy)"`
+	Profiles                 []profileSchema   `json:"profiles,omitempty" jsonschema:"description=Named bundles of deploy settings selected per pool with the profile extra spec"`
+	StatusMap                map[string]string `json:"status_map,omitempty" jsonschema:"description=Overrides of the CloudStack state to garm status mapping keyed by lowercased state"`
+	TreatStartingAsPending   bool              `json:"treat_starting_as_pending,omitempty" jsonschema:"description=Report Starting VMs as pending_create instead of running (default: false)"`
+}
+
+// profileSchema is the JSON schema representation of a Profile.
+type profileSchema struct {
+	Name            string            `json:"name" jsonschema:"required,description=Profile name used in the profile extra spec"`
+	ServiceOffering string            `json:"service_offering,omitempty" jsonschema:"description=Service offering name or UUID"`
+	Template        string            `json:"template,omitempty" jsonschema:"description=Template name or UUID"`
+	Networks        []string          `json:"networks,omitempty" jsonschema:"description=Network names or UUIDs"`
+	StoragePoolTag  string            `json:"storage_pool_tag,omitempty" jsonschema:"description=Storage tag for the root volume"`
+	Tags            map[string]string `json:"tags,omitempty" jsonschema:"description=Extra tags for VMs deployed with the profile"`
 }
 
 // GetJSONSchema returns the JSON schema for the provider configuration.
@@ -0,0 +1,148 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2024 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Operations recorded in the audit log.
+const (
+	AuditCreate  = "create"
+	AuditDelete  = "delete"
+	AuditStart   = "start"
+	AuditStop    = "stop"
+	AuditRestart = "restart"
+	AuditMigrate = "migrate"
+)
+
+// Results recorded in the audit log.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// auditBufferSize is how many records can be waiting to be written before new
+// records are dropped.
+const auditBufferSize = 256
+
+// AuditRecord is one line of the audit log.
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Operation string    `json:"operation"`
+	Instance  string    `json:"instance,omitempty"`
+	VMID      string    `json:"vm_id,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// AuditLog appends a JSON line for every mutating operation to a file. Records
+// are written in the background, so operations never wait on the file; if the
+// writer falls behind, records are dropped and logged instead.
+type AuditLog struct {
+	actor string
+	file  *os.File
+
+	mu      sync.Mutex
+	closed  bool
+	records chan AuditRecord
+	done    chan struct{}
+}
+
+// NewAuditLog opens the audit log at path for appending, creating it if
+// needed. Records carry actor, the controller ID, as the actor.
+func NewAuditLog(path, actor string) (*AuditLog, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	l := &AuditLog{
+		actor:   actor,
+		file:    f,
+		records: make(chan AuditRecord, auditBufferSize),
+		done:    make(chan struct{}),
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *AuditLog) run() {
+	defer close(l.done)
+	enc := json.NewEncoder(l.file)
+	for record := range l.records {
+		if err := enc.Encode(record); err != nil {
+			slog.Error("AuditLog: failed to write record",
+				"operation", record.Operation,
+				"vm_id", record.VMID,
+				"error", err)
+		}
+	}
+}
+
+// record queues the audit record of an operation. A nil AuditLog records
+// nothing.
+func (l *AuditLog) record(operation, instance, vmID string, opErr error) {
+	if l == nil {
+		return
+	}
+	record := AuditRecord{
+		Time:      timeNow().UTC(),
+		Actor:     l.actor,
+		Operation: operation,
+		Instance:  instance,
+		VMID:      vmID,
+		Result:    AuditSuccess,
+	}
+	if opErr != nil {
+		record.Result = AuditFailure
+		record.Error = opErr.Error()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	select {
+	case l.records <- record:
+	default:
+		slog.Error("AuditLog: writer is falling behind, dropping record",
+			"operation", operation,
+			"instance", instance,
+			"vm_id", vmID)
+	}
+}
+
+// Close writes the queued records and closes the file.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	close(l.records)
+	l.mu.Unlock()
+
+	<-l.done
+	return l.file.Close()
+}
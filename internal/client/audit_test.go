@@ -0,0 +1,114 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2024 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditLog(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	origNow := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = origNow })
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Running"}), nil
+	})
+	f.handleAsync("stopVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{"id": p.Get("id"), "state": "Stopped"}, nil
+	})
+	f.handleAsync("startVirtualMachine", func(url.Values) (any, error) {
+		return nil, &fakeAPIError{Code: 530, Text: "insufficient capacity"}
+	})
+	f.handleAsync("rebootVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{"id": p.Get("id"), "state": "Running"}, nil
+	})
+	f.handle("listHosts", func(p url.Values) (any, error) {
+		return map[string]any{"count": 1, "host": []map[string]any{{"id": p.Get("id")}}}, nil
+	})
+	f.handleAsync("migrateVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{"id": p.Get("virtualmachineid"), "hostid": p.Get("hostid")}, nil
+	})
+	f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+	})
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	auditLog, err := NewAuditLog(path, "controller-1")
+	require.NoError(t, err)
+	cli := newTestCli(t, f, nil)
+	cli.SetAuditLog(auditLog)
+
+	ctx := context.Background()
+	_, err = cli.CreateRunningInstance(ctx, newTestRunnerSpec())
+	require.NoError(t, err)
+	require.NoError(t, cli.StopInstance(ctx, "runner-1", false))
+	require.Error(t, cli.StartInstance(ctx, "runner-1"))
+	require.NoError(t, cli.RestartInstance(ctx, "runner-1"))
+	require.NoError(t, cli.MigrateInstance(ctx, "runner-1", "55555555-5555-5555-5555-555555555555"))
+	require.NoError(t, cli.DestroyInstance(ctx, "runner-1", false))
+	require.NoError(t, cli.Close(ctx))
+
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+	var records []AuditRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record AuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+
+	require.Len(t, records, 6)
+	wantOps := []string{AuditCreate, AuditStop, AuditStart, AuditRestart, AuditMigrate, AuditDelete}
+	for i, record := range records {
+		require.Equal(t, wantOps[i], record.Operation)
+		require.Equal(t, now, record.Time)
+		require.Equal(t, "controller-1", record.Actor)
+		require.Equal(t, "runner-1", record.Instance)
+		require.Equal(t, testVMID, record.VMID)
+		if record.Operation == AuditStart {
+			require.Equal(t, AuditFailure, record.Result)
+			require.Contains(t, record.Error, "insufficient capacity")
+			continue
+		}
+		require.Equal(t, AuditSuccess, record.Result)
+		require.Empty(t, record.Error)
+	}
+}
+
+func TestAuditLogOpenError(t *testing.T) {
+	_, err := NewAuditLog(filepath.Join(t.TempDir(), "missing", "audit.jsonl"), "controller-1")
+	require.ErrorContains(t, err, "failed to open audit log")
+
+	// A nil audit log records nothing.
+	var auditLog *AuditLog
+	auditLog.record(AuditCreate, "runner-1", testVMID, nil)
+}
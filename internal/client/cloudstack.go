@@ -17,22 +17,149 @@ package client
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math/big"
+	"net/url"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	cs "github.com/apache/cloudstack-go/v2/cloudstack"
 	"github.com/cloudbase/garm-provider-cloudstack/config"
 	"github.com/cloudbase/garm-provider-cloudstack/internal/spec"
 	"github.com/cloudbase/garm-provider-cloudstack/internal/util"
 	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
 )
 
+// ErrClosed is returned when an operation is started after Close was called.
+var ErrClosed = errors.New("cloudstack client is shutting down")
+
+// ErrProtected is returned when deleting a VM that carries the protectedTag tag
+// without forcing it.
+var ErrProtected = errors.New("instance is protected from deletion")
+
+// ErrTemplateNotDeployable is returned by the check_template_permissions
+// preflight when the template is neither public, owned by nor shared with the
+// account of the API key.
+var ErrTemplateNotDeployable = errors.New("template not deployable by this account")
+
+// protectedTag marks long-lived runners that must not be deleted by accident.
+// Any value other than "false" protects the VM.
+const protectedTag = "GARM_PROTECTED"
+
+// expiresAtTag holds the RFC 3339 time after which ReapExpired destroys a VM.
+const expiresAtTag = "GARM_EXPIRES_AT"
+
+// timeNow returns the current time. Tests override it to control lease expiry.
+var timeNow = time.Now
+
+// DeployError is returned when deployVirtualMachine fails. It carries the parsed
+// CloudStack error and the resources the deploy was attempted with.
+type DeployError struct {
+	Code              int
+	Message           string
+	ZoneID            string
+	ServiceOfferingID string
+	TemplateID        string
+	SnapshotID        string
+	Err               error
+}
+
+func (e *DeployError) Error() string {
+	source := "template " + e.TemplateID
+	if e.SnapshotID != "" {
+		source = "snapshot " + e.SnapshotID
+	}
+	if e.Code == 0 {
+		return fmt.Sprintf("failed to deploy virtual machine (zone %s, service offering %s, %s): %s",
+			e.ZoneID, e.ServiceOfferingID, source, e.Message)
+	}
+	return fmt.Sprintf("failed to deploy virtual machine (zone %s, service offering %s, %s): CloudStack error %d: %s",
+		e.ZoneID, e.ServiceOfferingID, source, e.Code, e.Message)
+}
+
+func (e *DeployError) Unwrap() error {
+	return e.Err
+}
+
 // CloudStackCli wraps the CloudStack Go client and provider configuration.
 type CloudStackCli struct {
 	cfg    *config.Config
 	client *cs.CloudStackClient
+	// jobs doesn't wait for async jobs. It is used for the operations whose job
+	// is polled at a configured interval instead of the client's backoff.
+	jobs *cs.CloudStackClient
+
+	// opsMu guards closed and the Add side of ops, so no operation can be
+	// registered once Close has started waiting.
+	opsMu  sync.Mutex
+	ops    sync.WaitGroup
+	closed bool
+
+	// zones caches the zones looked up by zoneNetworking, keyed by ID. A zone's
+	// network type can't change once it has been created.
+	zonesMu sync.Mutex
+	zones   map[string]*cs.Zone
+
+	// accountMu guards account, the name of the account the API key belongs
+	// to, looked up once by callerAccount.
+	accountMu sync.Mutex
+	account   string
+
+	// affinityMu serializes poolAffinityGroup, so concurrent deploys in the same
+	// pool don't race to create its anti-affinity group.
+	affinityMu sync.Mutex
+
+	// keypairMu serializes checkKeypair, so concurrent deploys don't race to
+	// create the same missing keypair.
+	keypairMu sync.Mutex
+
+	// onDeploy, if set, receives the summary of every successful deploy.
+	onDeploy func(DeploySummary)
+
+	// auditLog, if set, records every mutating operation.
+	auditLog *AuditLog
+}
+
+// DeploySummary is the audit record of a successful deploy. It lists what the
+// VM was finally deployed with, after overrides and name resolution.
+type DeploySummary struct {
+	VMID              string   `json:"vm_id"`
+	Name              string   `json:"name"`
+	PoolID            string   `json:"pool_id"`
+	ZoneID            string   `json:"zone_id"`
+	ServiceOfferingID string   `json:"service_offering_id"`
+	TemplateID        string   `json:"template_id,omitempty"`
+	SnapshotID        string   `json:"snapshot_id,omitempty"`
+	NetworkIDs        []string `json:"network_ids"`
+	// UserDataSize is the size in bytes of the user data before base64
+	// encoding, and UserDataCompression how it was compressed.
+	UserDataSize        int    `json:"userdata_size"`
+	UserDataCompression string `json:"userdata_compression"`
+}
+
+// SetDeploySummaryHook registers fn to be called with the summary of every
+// successful deploy. It must be set before any deploy is started.
+func (c *CloudStackCli) SetDeploySummaryHook(fn func(DeploySummary)) {
+	c.onDeploy = fn
+}
+
+// SetAuditLog makes every create, delete, start, stop and restart be recorded
+// in l. It must be set before any operation is started; Close closes l.
+func (c *CloudStackCli) SetAuditLog(l *AuditLog) {
+	c.auditLog = l
 }
 
 func NewCloudStackCli(cfg *config.Config) (*CloudStackCli, error) {
@@ -40,274 +167,2860 @@ func NewCloudStackCli(cfg *config.Config) (*CloudStackCli, error) {
 		return nil, fmt.Errorf("nil config")
 	}
 	// Use configurable async timeout (default 15 minutes) for slow VM deployments
-	cli := cs.NewAsyncClient(cfg.APIURL, cfg.APIKey, cfg.Secret, cfg.VerifySSL, cs.WithAsyncTimeout(cfg.GetAsyncTimeout()))
-	return &CloudStackCli{cfg: cfg, client: cli}, nil
+	cli := cfg.NewClient(cs.WithAsyncTimeout(cfg.GetAsyncTimeout()))
+	return &CloudStackCli{cfg: cfg, client: cli, jobs: cfg.NewSyncClient()}, nil
 }
 
 func (c *CloudStackCli) Config() *config.Config {
 	return c.cfg
 }
 
+// OperationContext returns a context bounded by operation_timeout, for
+// callers that run a whole create or delete under one time budget. Without
+// operation_timeout, the context is only cancelled by cancel or its parent.
+func (c *CloudStackCli) OperationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if timeout := c.cfg.GetOperationTimeout(); timeout > 0 {
+		return context.WithTimeout(ctx, timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// beginOperation registers a mutating operation so Close can wait for it.
+// The returned function must be called once the operation is finished.
+func (c *CloudStackCli) beginOperation() (func(), error) {
+	c.opsMu.Lock()
+	defer c.opsMu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	c.ops.Add(1)
+	return c.ops.Done, nil
+}
+
+// Close stops accepting new operations and waits for in-flight deploys,
+// destroys and power operations to finish, so the process doesn't exit
+// halfway through creating a VM. The audit log, if any, is closed once they
+// are done. It returns the context error if the context expires first.
+func (c *CloudStackCli) Close(ctx context.Context) error {
+	c.opsMu.Lock()
+	c.closed = true
+	c.opsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		c.ops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		if c.auditLog != nil {
+			return c.auditLog.Close()
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for in-flight operations: %w", ctx.Err())
+	}
+}
+
 // CreateRunningInstance deploys a new VM and tags it appropriately.
+// If a step after the deploy fails, such as tagging the VM or waiting for it
+// to become ready, the VM is destroyed again unless leave_on_failure is set.
 func (c *CloudStackCli) CreateRunningInstance(ctx context.Context, spec *spec.RunnerSpec) (string, error) {
+	return c.createRunningInstance(ctx, spec, nil)
+}
+
+// createRunningInstance implements CreateRunningInstance. If deferTags is not
+// nil, the VM is only tagged with its immediateTags; the rest of its tags are
+// passed to deferTags instead, for the caller to create them.
+func (c *CloudStackCli) createRunningInstance(ctx context.Context, spec *spec.RunnerSpec, deferTags func(tags map[string]string)) (id string, err error) {
 	if spec == nil {
 		return "", fmt.Errorf("invalid nil runner spec")
 	}
+	defer func() { c.auditLog.record(AuditCreate, spec.BootstrapParams.Name, id, err) }()
+	done, err := c.beginOperation()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	if spec.ProjectName != "" {
+		projectID, err := c.ResolveProject(spec.ProjectName)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve the project of label %s: %w", c.cfg.ProjectFromLabel, err)
+		}
+		spec.ProjectID = projectID
+	}
+
+	name, existingID, err := c.resolveNameCollision(spec)
+	if err != nil {
+		return "", err
+	}
+	if existingID != "" {
+		return existingID, nil
+	}
+
+	// Resolve --flavor override from CLI if provided. Flavors listed in
+	// flavor_map were already applied to the spec.
+	serviceOfferingID := spec.ServiceOfferingID
+	if _, mapped := c.cfg.FlavorServiceOfferingID(spec.BootstrapParams.Flavor); spec.BootstrapParams.Flavor != "" && !mapped {
+		resolved, err := c.ResolveServiceOffering(spec.BootstrapParams.Flavor)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve flavor %q: %w", spec.BootstrapParams.Flavor, err)
+		}
+		serviceOfferingID = resolved
+	}
+
+	offering, _, err := c.client.ServiceOffering.GetServiceOfferingByID(serviceOfferingID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get service offering %s: %w", serviceOfferingID, err)
+	}
+	if spec.MinIOPS > 0 && !offering.Iscustomizediops {
+		return "", fmt.Errorf("service offering %s does not have custom IOPS, which min_iops and max_iops require", serviceOfferingID)
+	}
+	if spec.DynamicScaling && !offering.Dynamicscalingenabled {
+		return "", fmt.Errorf("service offering %s does not have dynamic scaling enabled, which enable_dynamic_scaling requires", serviceOfferingID)
+	}
+
+	// Resolve --image override from CLI if provided. When deploying from a
+	// snapshot the template is not used. A template given by name keeps its
+	// name for the GARM_IMAGE tag.
+	templateID := spec.TemplateID
+	var templateName string
+	if spec.SnapshotID != "" {
+		if err := c.validateSnapshot(spec.SnapshotID, spec.ZoneID); err != nil {
+			return "", err
+		}
+	} else if spec.BootstrapParams.Image != "" {
+		resolved, err := c.ResolveTemplate(spec.BootstrapParams.Image, spec.ZoneID, spec.ProjectID)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve image %q: %w", spec.BootstrapParams.Image, err)
+		}
+		templateID = resolved
+		if !cs.IsID(spec.BootstrapParams.Image) {
+			templateName = spec.BootstrapParams.Image
+		}
+	} else if templateID == c.cfg.TemplateID() && !cs.IsID(c.cfg.Template) {
+		templateName = c.cfg.Template
+	}
+	if spec.SnapshotID == "" && c.cfg.CheckTemplatePermissions {
+		if err := c.checkTemplatePermissions(templateID, spec.ProjectID); err != nil {
+			return "", err
+		}
+	}
+
+	if spec.StoragePoolID != "" {
+		if err := c.validateStoragePool(spec.StoragePoolID, spec.ZoneID); err != nil {
+			return "", err
+		}
+	}
+	if spec.DiskOfferingID != "" {
+		if err := c.validateDiskOffering(spec.DiskOfferingID, spec.DataDiskSize); err != nil {
+			return "", err
+		}
+	}
+
+	udata, err := spec.ComposeUserData()
+	if err != nil {
+		return "", fmt.Errorf("failed to compose user data: %w", err)
+	}
+
+	// Route network_ids to networks or security groups by zone type, resolving
+	// network names to IDs (accepts both names and UUIDs)
+	networkIDs, securityGroups, err := c.routeNetworking(spec)
+	if err != nil {
+		return "", err
+	}
+
+	if c.cfg.IPv6Only {
+		if err := c.checkIPv6Networks(networkIDs, spec.ZoneID, spec.ProjectID); err != nil {
+			return "", err
+		}
+	}
+	if spec.NetworkACL != "" {
+		if err := c.checkNetworkACL(networkIDs, spec); err != nil {
+			return "", err
+		}
+	}
+
+	params := c.client.VirtualMachine.NewDeployVirtualMachineParams(
+		serviceOfferingID,
+		templateID,
+		spec.ZoneID,
+	)
+	params.SetName(name)
+	displayName := spec.BootstrapParams.Name
+	if c.cfg.UniqueDisplayNames {
+		displayName = uniqueDisplayName(displayName)
+	}
+	params.SetDisplayname(displayName)
+	params.SetUserdata(udata)
+	if len(networkIDs) > 0 {
+		params.SetNetworkids(networkIDs)
+	}
+	if len(securityGroups) > 0 {
+		// CloudStack accepts either security group IDs or names, not a mix.
+		if cs.IsID(securityGroups[0]) {
+			params.SetSecuritygroupids(securityGroups)
+		} else {
+			params.SetSecuritygroupnames(securityGroups)
+		}
+	}
+	dhcpOptions, err := spec.DHCPOptionsNetworkList(networkIDs)
+	if err != nil {
+		return "", fmt.Errorf("invalid dhcp options: %w", err)
+	}
+	if len(dhcpOptions) > 0 {
+		params.SetDhcpoptionsnetworklist(dhcpOptions)
+	}
+	if spec.SSHKeyName != "" {
+		keypair := spec.SSHKeyName
+		if c.cfg.MissingKeypairPolicy != "" {
+			keypair, err = c.checkKeypair(keypair, spec.ProjectID)
+			if err != nil {
+				return "", err
+			}
+		}
+		if keypair != "" {
+			params.SetKeypair(keypair)
+		}
+	}
+	if spec.ProjectID != "" {
+		params.SetProjectid(spec.ProjectID)
+	}
+	if details := spec.DeployDetails(); len(details) > 0 {
+		params.SetDetails(details)
+	}
+	if spec.DynamicScaling {
+		params.SetDynamicscalingenabled(true)
+	}
+	if spec.RootDiskSize > 0 {
+		params.SetRootdisksize(int64(spec.RootDiskSize))
+	}
+	if spec.DiskOfferingID != "" {
+		params.SetDiskofferingid(spec.DiskOfferingID)
+		if spec.DataDiskSize > 0 {
+			params.SetSize(int64(spec.DataDiskSize))
+		}
+	}
+	var affinityGroupIDs []string
+	if !c.cfg.IgnoreDedication || spec.RequireDedicated {
+		groupID, err := c.dedicationAffinityGroup(spec.ProjectID)
+		if err != nil {
+			return "", err
+		}
+		if groupID == "" && spec.RequireDedicated {
+			return "", fmt.Errorf("require_dedicated is set, but no hosts or clusters are dedicated to the account or project")
+		}
+		if groupID != "" {
+			affinityGroupIDs = append(affinityGroupIDs, groupID)
+		}
+	}
+	if spec.PoolAntiAffinity {
+		groupID, err := c.poolAffinityGroup(spec.BootstrapParams.PoolID, spec.ProjectID)
+		if err != nil {
+			return "", err
+		}
+		affinityGroupIDs = append(affinityGroupIDs, groupID)
+	}
+	affinityGroupIDs = append(affinityGroupIDs, spec.AffinityGroupIDs...)
+	if len(affinityGroupIDs) > 0 {
+		params.SetAffinitygroupids(affinityGroupIDs)
+	}
+	if spec.SnapshotID != "" {
+		params.ResetTemplateid()
+		params.SetSnapshotid(spec.SnapshotID)
+	}
+
+	var vmID string
+	if spec.SSHPublicKey != "" {
+		keypair, regErr := c.registerTransientKeypair(name, spec.SSHPublicKey, spec.ProjectID)
+		if regErr != nil {
+			return "", regErr
+		}
+		params.SetKeypair(keypair)
+		// Once the VM exists, destroying it deletes the keypair too.
+		defer func() {
+			if err != nil && vmID == "" {
+				c.deleteTransientKeypair(keypair, spec.ProjectID)
+			}
+		}()
+	}
+
+	deployStart := timeNow()
+	resp, err := c.deployWhenTemplateReady(ctx, params)
+	if resp != nil {
+		// A deploy whose job timed out or was abandoned still created its VM.
+		vmID = resp.Id
+	}
+	if err == nil {
+		if templateName == "" {
+			templateName = resp.Templatename
+		}
+	} else if vm := c.recheckDeploy(ctx, name, spec.ControllerID, deployStart, err); vm != nil {
+		vmID = vm.Id
+		if templateName == "" {
+			templateName = vm.Templatename
+		}
+	} else {
+		code, msg := util.ParseCloudStackError(err)
+		err = &DeployError{
+			Code:              code,
+			Message:           msg,
+			ZoneID:            spec.ZoneID,
+			ServiceOfferingID: serviceOfferingID,
+			TemplateID:        templateID,
+			SnapshotID:        spec.SnapshotID,
+			Err:               err,
+		}
+		if vmID != "" {
+			c.cleanupFailedDeploy(ctx, vmID, err)
+		}
+		return "", err
+	}
+	if vmID == "" {
+		return "", fmt.Errorf("empty VM id in deploy response")
+	}
+	defer func() {
+		if err != nil {
+			c.cleanupFailedDeploy(ctx, vmID, err)
+		}
+	}()
+
+	tags, err := c.cfg.RenderTags(config.NewTagTemplateData(spec.BootstrapParams, spec.ControllerID))
+	if err != nil {
+		return "", fmt.Errorf("failed to render tag templates: %w", err)
+	}
+	maps.Copy(tags, spec.Tags)
+	maps.Copy(tags, instanceTags(spec.ControllerID, spec.BootstrapParams.PoolID, spec.BootstrapParams.Name,
+		string(spec.BootstrapParams.OSType), string(spec.BootstrapParams.OSArch)))
+	maps.Copy(tags, resourceTags(offering, spec))
+	maps.Copy(tags, provenanceTags(offering, templateID, templateName, spec))
+	if c.cfg.TagRunnerContext {
+		maps.Copy(tags, runnerContextTags(spec.BootstrapParams.RepoURL))
+	}
+	if ttl := c.cfg.GetLeaseTTL(); ttl > 0 {
+		tags[expiresAtTag] = timeNow().Add(ttl).UTC().Format(time.RFC3339)
+	}
+	truncateTagValues(tags, c.cfg.GetMaxTagValueLength())
+	if deferTags != nil {
+		// Only the tags shared with the rest of the batch wait. The others
+		// include the ownership tags, which the VM is listed and reaped by
+		// while it comes up.
+		own := map[string]string{}
+		for _, key := range immediateTags {
+			if value, ok := tags[key]; ok {
+				own[key] = value
+				delete(tags, key)
+			}
+		}
+		tp := c.client.Resourcetags.NewCreateTagsParams([]string{vmID}, "UserVm", own)
+		if _, err := c.client.Resourcetags.CreateTags(tp); err != nil {
+			return "", fmt.Errorf("failed to tag VM: %w", err)
+		}
+		deferTags(tags)
+	} else {
+		tp := c.client.Resourcetags.NewCreateTagsParams([]string{vmID}, "UserVm", tags)
+		if _, err := c.client.Resourcetags.CreateTags(tp); err != nil {
+			return "", fmt.Errorf("failed to tag VM: %w", err)
+		}
+	}
+	if c.cfg.TagVolumes {
+		if err := c.tagRootVolume(vmID, spec.ControllerID, spec.BootstrapParams.PoolID, spec.ProjectID); err != nil {
+			slog.Error("CreateRunningInstance: failed to tag root volume",
+				"vm_id", vmID,
+				"error", err)
+		}
+	}
+	if spec.RootVolumeName != "" {
+		if err := c.renameRootVolume(vmID, spec.RootVolumeName, spec.ProjectID); err != nil {
+			slog.Error("CreateRunningInstance: failed to rename root volume",
+				"vm_id", vmID,
+				"root_volume_name", spec.RootVolumeName,
+				"error", err)
+		}
+	}
+
+	if spec.Annotation != "" {
+		c.annotateInstance(vmID, spec.Annotation)
+	}
+
+	if c.cfg.GetIPWaitTimeout() > 0 {
+		if err := c.waitForIP(ctx, vmID); err != nil {
+			return "", err
+		}
+	} else if c.cfg.IPv6Only {
+		vm, err := c.FindOneInstance(ctx, "", vmID)
+		if err != nil {
+			return "", fmt.Errorf("failed to check IPv6 address of VM %s: %w", vmID, err)
+		}
+		if !hasIPv6(vm) {
+			return "", fmt.Errorf("VM %s has no IPv6 address, but ipv6_only is set", vmID)
+		}
+	}
+	if c.cfg.ReadinessTag != "" {
+		if err := c.waitForReadiness(ctx, vmID); err != nil {
+			return "", err
+		}
+	}
+
+	summary := DeploySummary{
+		VMID:              vmID,
+		Name:              spec.BootstrapParams.Name,
+		PoolID:            spec.BootstrapParams.PoolID,
+		ZoneID:            spec.ZoneID,
+		ServiceOfferingID: serviceOfferingID,
+		NetworkIDs:        networkIDs,
+		SnapshotID:        spec.SnapshotID,
+	}
+	if spec.SnapshotID == "" {
+		summary.TemplateID = templateID
+	}
+	summary.UserDataSize, summary.UserDataCompression = userDataStats(udata)
+	c.reportDeploy(summary)
+
+	return vmID, nil
+}
+
+// userDataStats returns the decoded size and the compression of base64
+// encoded user data.
+func userDataStats(udata string) (int, string) {
+	raw, err := base64.StdEncoding.DecodeString(udata)
+	if err != nil {
+		return 0, "none"
+	}
+	return len(raw), spec.UserDataCompression(raw)
+}
+
+// reportDeploy logs the summary of a successful deploy and passes it to the
+// deploy summary hook, if one is set.
+func (c *CloudStackCli) reportDeploy(summary DeploySummary) {
+	slog.Info("CreateRunningInstance: deployed VM",
+		"vm_id", summary.VMID,
+		"instance_name", summary.Name,
+		"pool_id", summary.PoolID,
+		"zone_id", summary.ZoneID,
+		"service_offering_id", summary.ServiceOfferingID,
+		"template_id", summary.TemplateID,
+		"snapshot_id", summary.SnapshotID,
+		"network_ids", summary.NetworkIDs,
+		"userdata_size", summary.UserDataSize,
+		"userdata_compression", summary.UserDataCompression)
+	if c.onDeploy != nil {
+		c.onDeploy(summary)
+	}
+}
+
+// cleanupFailedDeploy destroys a VM whose deploy went through but whose
+// creation failed afterwards with createErr, so it isn't left orphaned. The
+// cleanup runs even if ctx was cancelled, which is a common cause of the
+// failure.
+func (c *CloudStackCli) cleanupFailedDeploy(ctx context.Context, vmID string, createErr error) {
+	if c.cfg.LeaveOnFailure {
+		slog.Debug("CreateRunningInstance: leaving VM of failed create for debugging",
+			"vm_id", vmID,
+			"error", createErr)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Duration(c.cfg.GetAsyncTimeout())*time.Second)
+	defer cancel()
+	if err := c.destroyHeldInstance(ctx, vmID, c.cfg.Expunge, true); err != nil {
+		slog.Error("CreateRunningInstance: failed to destroy VM of failed create",
+			"vm_id", vmID,
+			"create_error", createErr,
+			"error", err)
+		return
+	}
+	slog.Debug("CreateRunningInstance: destroyed VM of failed create",
+		"vm_id", vmID,
+		"error", createErr)
+}
+
+// templateRetryInterval is the initial wait between deploys retried because the
+// template isn't ready. It doubles after each attempt, up to maxTemplateRetryInterval.
+var templateRetryInterval = 10 * time.Second
+
+const maxTemplateRetryInterval = time.Minute
+
+// deployWhenTemplateReady deploys a VM, retrying for up to
+// template_ready_timeout while CloudStack reports that the template is still
+// being downloaded to the zone. Other errors, including a missing template,
+// are returned right away.
+func (c *CloudStackCli) deployWhenTemplateReady(ctx context.Context, p *cs.DeployVirtualMachineParams) (*cs.DeployVirtualMachineResponse, error) {
+	timeout := c.cfg.GetTemplateReadyTimeout()
+	deadline := time.Now().Add(timeout)
+	backoff := templateRetryInterval
+	for attempt := 1; ; attempt++ {
+		resp, err := c.deployVirtualMachine(ctx, p)
+		if err == nil || timeout == 0 || !util.IsCloudStackTemplateNotReadyErr(err) {
+			return resp, err
+		}
+		wait := min(backoff, time.Until(deadline))
+		if wait <= 0 {
+			return nil, err
+		}
+		templateID, _ := p.GetTemplateid()
+		slog.Debug("CreateRunningInstance: template not ready, retrying deploy",
+			"template_id", templateID,
+			"attempt", attempt,
+			"backoff", wait,
+			"error", err)
+		if err := sleepWithContext(ctx, wait); err != nil {
+			return nil, err
+		}
+		backoff = min(backoff*2, maxTemplateRetryInterval)
+	}
+}
+
+// resolveNameCollision looks for VMs already named like spec would be, as set
+// by name_collision_policy. It returns the name to deploy with or, under the
+// reuse policy, the ID of the VM to return in place of deploying.
+func (c *CloudStackCli) resolveNameCollision(spec *spec.RunnerSpec) (string, string, error) {
+	name := util.SanitizeInstanceName(spec.BootstrapParams.Name, c.cfg.GetMaxNameLength())
+	policy := c.cfg.NameCollisionPolicy
+	if policy == "" {
+		return name, "", nil
+	}
+
+	p := c.client.VirtualMachine.NewListVirtualMachinesParams()
+	p.SetName(name)
+	p.SetListall(true)
+	if spec.ProjectID != "" {
+		p.SetProjectid(spec.ProjectID)
+	}
+	listed, err := c.listVirtualMachines(p)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to look for VMs named %s: %w", name, err)
+	}
+	var existing *cs.VirtualMachine
+	// Destroyed VMs keep their name until they are expunged, but don't block
+	// a new VM from taking it.
+	for _, vm := range liveVMs(uniqueVMs(listed)) {
+		// The name filter of listVirtualMachines is not an exact match on
+		// every CloudStack version.
+		if vm.Name == name {
+			existing = vm
+			break
+		}
+	}
+	if existing == nil {
+		return name, "", nil
+	}
+
+	slog.Debug("CreateRunningInstance: VM name already in use",
+		"instance_name", name,
+		"vm_id", existing.Id,
+		"state", existing.State,
+		"policy", policy)
+	switch policy {
+	case config.NameCollisionSuffix:
+		return util.SanitizeInstanceName(uniqueDisplayName(spec.BootstrapParams.Name), c.cfg.GetMaxNameLength()), "", nil
+	case config.NameCollisionReuse:
+		if util.GetTagValue(existing.Tags, "GARM_CONTROLLER_ID") == spec.ControllerID &&
+			util.GetTagValue(existing.Tags, "GARM_POOL_ID") == spec.BootstrapParams.PoolID &&
+			existing.State == "Running" {
+			return name, existing.Id, nil
+		}
+		return "", "", fmt.Errorf("VM name %s is taken by %s (%s), which can't be reused", name, existing.Id, existing.State)
+	}
+	return "", "", fmt.Errorf("VM name %s is already taken by %s", name, existing.Id)
+}
+
+// uniqueDisplayName appends a random 6 character hex suffix to name.
+func uniqueDisplayName(name string) string {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return name
+	}
+	return name + "-" + hex.EncodeToString(suffix)
+}
+
+// createGracePollInterval is how often recheckDeploy looks for the VM.
+var createGracePollInterval = 5 * time.Second
+
+// recheckDeploy looks for a VM that came up despite its deploy failing with
+// deployErr, for up to create_grace_period. It returns nil if the VM doesn't
+// turn up running in time, or if no grace period is configured. Only a VM
+// created since the deploy started, and not tagged for another controller, is
+// taken for the one that was deployed; other VMs of the same name are stale.
+// Parameter errors (4xx) are definitive, so no VM is looked for after them.
+func (c *CloudStackCli) recheckDeploy(ctx context.Context, name, controllerID string, started time.Time, deployErr error) *cs.VirtualMachine {
+	grace := c.cfg.GetCreateGracePeriod()
+	if grace == 0 {
+		return nil
+	}
+	if code, _ := util.ParseCloudStackError(deployErr); code >= 400 && code < 500 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, grace)
+	defer cancel()
+
+	for {
+		vm, err := c.FindOneInstance(ctx, "", name)
+		switch {
+		case err == nil && !deployedSince(vm, controllerID, started):
+			slog.Debug("recheckDeploy: ignoring VM that was not created by the deploy",
+				"instance_name", name,
+				"vm_id", vm.Id,
+				"created", vm.Created)
+		case err == nil && vm.State == "Running":
+			slog.Debug("recheckDeploy: VM is running despite deploy error",
+				"instance_name", name,
+				"vm_id", vm.Id,
+				"deploy_error", deployErr)
+			return vm
+		case err == nil && (vm.State == "Error" || vm.State == "Destroyed" || vm.State == "Expunging"):
+			return nil
+		case err != nil && !errors.Is(err, garmErrors.ErrNotFound):
+			slog.Debug("recheckDeploy: failed to look up VM",
+				"instance_name", name,
+				"error", err)
+		}
+		if err := sleepWithContext(ctx, createGracePollInterval); err != nil {
+			return nil
+		}
+	}
+}
+
+// deployedSince reports whether vm can be the VM of a deploy by controllerID
+// that started at started: it must be untagged or tagged for controllerID, and
+// created no earlier than the start, to the second CloudStack reports.
+func deployedSince(vm *cs.VirtualMachine, controllerID string, started time.Time) bool {
+	if owner := util.GetTagValue(vm.Tags, "GARM_CONTROLLER_ID"); owner != "" && owner != controllerID {
+		return false
+	}
+	created, err := util.ParseCloudStackTime(vm.Created)
+	if err != nil {
+		return false
+	}
+	return !created.Before(started.Truncate(time.Second))
+}
+
+// readinessPollInterval is how often waitForReadiness checks the VM tags.
+var readinessPollInterval = 10 * time.Second
+
+// waitForReadiness waits until the VM carries the configured readiness tag,
+// which the guest sets once cloud-init has finished.
+func (c *CloudStackCli) waitForReadiness(ctx context.Context, vmID string) error {
+	ready := func(vm *cs.VirtualMachine) bool {
+		if slices.ContainsFunc(vm.Tags, func(t cs.Tags) bool { return t.Key == c.cfg.ReadinessTag }) {
+			return true
+		}
+		slog.Debug("waitForReadiness: VM not ready yet",
+			"vm_id", vmID,
+			"readiness_tag", c.cfg.ReadinessTag)
+		return false
+	}
+	_, err := c.WaitForVMState(ctx, vmID, ready, VMStateOptions{
+		Interval: readinessPollInterval,
+		Timeout:  c.cfg.GetReadinessTimeout(),
+	})
+	if errors.Is(err, ErrVMStateNotReached) {
+		return fmt.Errorf("VM %s did not report ready (tag %s): %w", vmID, c.cfg.ReadinessTag, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check readiness of VM %s: %w", vmID, err)
+	}
+	return nil
+}
+
+// ipPollInterval is how often waitForIP checks the VM NICs.
+var ipPollInterval = 5 * time.Second
+
+// waitForIP waits until a NIC of the VM has an IPv4 or IPv6 address, or
+// ip_wait_timeout expires. With ipv6_only, only IPv6 addresses count.
+func (c *CloudStackCli) waitForIP(ctx context.Context, vmID string) error {
+	timeout := c.cfg.GetIPWaitTimeout()
+	assigned, missing := hasIP, "IP"
+	if c.cfg.IPv6Only {
+		assigned, missing = hasIPv6, "IPv6 address"
+	}
+
+	hasAddress := func(vm *cs.VirtualMachine) bool {
+		if assigned(vm) {
+			return true
+		}
+		slog.Debug("waitForIP: VM has no IP address yet",
+			"vm_id", vmID,
+			"nics", len(vm.Nic))
+		return false
+	}
+	_, err := c.WaitForVMState(ctx, vmID, hasAddress, VMStateOptions{
+		Interval: ipPollInterval,
+		Timeout:  timeout,
+	})
+	if errors.Is(err, ErrVMStateNotReached) {
+		return fmt.Errorf("VM %s running but no %s assigned after %s: %w", vmID, missing, timeout, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check IP address of VM %s: %w", vmID, err)
+	}
+	return nil
+}
+
+// ErrVMStateNotReached is returned by WaitForVMState when the wait ends
+// before the VM reaches the awaited state.
+var ErrVMStateNotReached = errors.New("VM did not reach the awaited state")
+
+// VMStateOptions configures how WaitForVMState polls a VM.
+type VMStateOptions struct {
+	// ControllerID, if set, restricts the lookup to VMs of that controller,
+	// like FindOneInstance does.
+	ControllerID string
+	// Interval is how long to wait between lookups.
+	Interval time.Duration
+	// Backoff, if greater than 1, multiplies the interval after every lookup,
+	// up to MaxInterval if that is set.
+	Backoff     float64
+	MaxInterval time.Duration
+	// Timeout, if set, bounds the whole wait.
+	Timeout time.Duration
+	// Attempts, if set, is how many times the VM is looked up at most.
+	Attempts int
+}
+
+// WaitForVMState looks a VM up until predicate reports true for it, and
+// returns the VM. The wait ends early when ctx is done, opts.Timeout expires
+// or opts.Attempts lookups were made; the error then wraps
+// ErrVMStateNotReached and, if the wait timed out or was canceled, the context
+// error. Lookup errors are returned as they are. On error, the VM is returned
+// as last seen, or nil if it was never found.
+func (c *CloudStackCli) WaitForVMState(ctx context.Context, identifier string, predicate func(*cs.VirtualMachine) bool, opts VMStateOptions) (*cs.VirtualMachine, error) {
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	var last *cs.VirtualMachine
+	interval := opts.Interval
+	for attempt := 1; ; attempt++ {
+		vm, err := c.FindOneInstance(ctx, opts.ControllerID, identifier)
+		if err != nil {
+			return last, err
+		}
+		if predicate(vm) {
+			return vm, nil
+		}
+		last = vm
+		if opts.Attempts > 0 && attempt >= opts.Attempts {
+			return last, fmt.Errorf("%w after %d lookups", ErrVMStateNotReached, attempt)
+		}
+		if err := sleepWithContext(ctx, interval); err != nil {
+			return last, fmt.Errorf("%w: %w", ErrVMStateNotReached, err)
+		}
+		if opts.Backoff > 1 {
+			interval = time.Duration(float64(interval) * opts.Backoff)
+			if opts.MaxInterval > 0 {
+				interval = min(interval, opts.MaxInterval)
+			}
+		}
+	}
+}
+
+// transitionalStates are the states a VM passes through while a job runs
+// against it.
+var transitionalStates = []string{"Starting", "Stopping", "Migrating"}
+
+// settled reports whether a VM is in none of the transitionalStates.
+func settled(vm *cs.VirtualMachine) bool {
+	return !slices.Contains(transitionalStates, vm.State)
+}
+
+// checkNetworkACL checks that every network of a deploy uses the network_acl
+// ACL list, and that the egress rules of the list let the runner reach the
+// garm controller. CloudStack enforces the ACL either way; the check only
+// turns runners that never call back into clear deploy errors.
+func (c *CloudStackCli) checkNetworkACL(networkIDs []string, spec *spec.RunnerSpec) error {
+	if len(networkIDs) == 0 {
+		return fmt.Errorf("network_acl requires network_ids")
+	}
+	var opts []cs.OptionFunc
+	if spec.ProjectID != "" {
+		opts = append(opts, cs.WithProject(spec.ProjectID))
+	}
+	var aclID string
+	for _, networkID := range networkIDs {
+		network, _, err := c.client.Network.GetNetworkByID(networkID, opts...)
+		if err != nil {
+			return fmt.Errorf("failed to get network %s: %w", networkID, err)
+		}
+		if network.Aclid == "" {
+			return fmt.Errorf("network %s (%s) has no network ACL, but network_acl is %s", network.Name, networkID, spec.NetworkACL)
+		}
+		if network.Aclid != spec.NetworkACL && network.Aclname != spec.NetworkACL {
+			return fmt.Errorf("network %s (%s) uses network ACL %s, not network_acl %s", network.Name, networkID, network.Aclname, spec.NetworkACL)
+		}
+		aclID = network.Aclid
+	}
+
+	port, ok := controllerPort(spec.BootstrapParams.CallbackURL)
+	if !ok {
+		return nil
+	}
+	p := c.client.NetworkACL.NewListNetworkACLsParams()
+	p.SetAclid(aclID)
+	p.SetTraffictype("Egress")
+	if spec.ProjectID != "" {
+		p.SetProjectid(spec.ProjectID)
+	}
+	resp, err := c.client.NetworkACL.ListNetworkACLs(p)
+	if err != nil {
+		return fmt.Errorf("failed to list the rules of network ACL %s: %w", spec.NetworkACL, err)
+	}
+	if !egressAllowed(resp.NetworkACLs, port) {
+		return fmt.Errorf("network ACL %s does not allow egress to TCP port %d of the garm controller", spec.NetworkACL, port)
+	}
+	return nil
+}
+
+// controllerPort returns the TCP port of the garm controller URL.
+func controllerPort(controllerURL string) (int, bool) {
+	u, err := url.Parse(controllerURL)
+	if err != nil || u.Host == "" {
+		return 0, false
+	}
+	if port := u.Port(); port != "" {
+		n, err := strconv.Atoi(port)
+		return n, err == nil
+	}
+	switch u.Scheme {
+	case "https":
+		return 443, true
+	case "http":
+		return 80, true
+	}
+	return 0, false
+}
+
+// egressAllowed reports whether the egress rules of a network ACL let TCP
+// traffic out to port. Like CloudStack, the rule with the lowest number that
+// matches decides; an ACL without egress rules allows all egress, while one
+// with egress rules denies what none of them match. The CIDRs of the rules are
+// not checked, as the address of the controller isn't known.
+func egressAllowed(rules []*cs.NetworkACL, port int) bool {
+	var egress []*cs.NetworkACL
+	for _, rule := range rules {
+		if strings.EqualFold(rule.Traffictype, "Egress") {
+			egress = append(egress, rule)
+		}
+	}
+	if len(egress) == 0 {
+		return true
+	}
+	slices.SortFunc(egress, func(a, b *cs.NetworkACL) int { return a.Number - b.Number })
+	for _, rule := range egress {
+		switch strings.ToLower(rule.Protocol) {
+		case "all":
+		case "tcp":
+			start, startErr := strconv.Atoi(rule.Startport)
+			end, endErr := strconv.Atoi(rule.Endport)
+			if startErr == nil && endErr == nil && (port < start || port > end) {
+				continue
+			}
+		default:
+			continue
+		}
+		return strings.EqualFold(rule.Action, "Allow")
+	}
+	return false
+}
+
+// hasIP reports whether a NIC of the VM has an IPv4 or IPv6 address.
+func hasIP(vm *cs.VirtualMachine) bool {
+	return slices.ContainsFunc(vm.Nic, func(n cs.Nic) bool { return n.Ipaddress != "" || n.Ip6address != "" })
+}
+
+// hasIPv6 reports whether a NIC of the VM has an IPv6 address.
+func hasIPv6(vm *cs.VirtualMachine) bool {
+	return slices.ContainsFunc(vm.Nic, func(n cs.Nic) bool { return n.Ip6address != "" })
+}
+
+// checkIPv6Networks makes sure every network of an ipv6_only deploy has an
+// IPv6 CIDR, so the VM can't end up without an IPv6 address. Without network
+// IDs, the zone's default network is checked: the only network usable for
+// deploy there, which CloudStack picks when none is given. All networks are
+// looked up with a single listNetworks call.
+func (c *CloudStackCli) checkIPv6Networks(networkIDs []string, zoneID, projectID string) error {
+	p := c.client.Network.NewListNetworksParams()
+	p.SetListall(true)
+	p.SetZoneid(zoneID)
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	if len(networkIDs) == 0 {
+		p.SetCanusefordeploy(true)
+	}
+	resp, err := c.client.Network.ListNetworks(p)
+	if err != nil {
+		return fmt.Errorf("failed to list networks: %w", err)
+	}
+	if len(networkIDs) == 0 {
+		if len(resp.Networks) != 1 {
+			return fmt.Errorf("zone %s has %d networks usable for deploy, so its default network can't be checked for ipv6_only; set network_ids", zoneID, len(resp.Networks))
+		}
+		networkIDs = []string{resp.Networks[0].Id}
+	}
+	networks := make(map[string]*cs.Network, len(resp.Networks))
+	for _, network := range resp.Networks {
+		networks[network.Id] = network
+	}
+	for _, networkID := range networkIDs {
+		network, ok := networks[networkID]
+		if !ok {
+			return fmt.Errorf("network %s not found in zone %s", networkID, zoneID)
+		}
+		if network.Ip6cidr == "" {
+			return fmt.Errorf("network %s (%s) has no IPv6 CIDR, but ipv6_only is set", network.Name, networkID)
+		}
+	}
+	return nil
+}
+
+// CreateRunningInstances deploys a batch of VMs concurrently. Deploys are
+// started BatchStartStagger apart, so the runners don't all hit shared
+// infrastructure such as the registration endpoint at the same time. The
+// returned IDs are in the order of specs; failed or skipped deploys leave an
+// empty ID and their errors are joined. If the context is canceled during the
+// stagger, the remaining deploys are not started. With batch_tags, each VM is
+// tagged with its immediateTags as soon as it is deployed, and with the tags it
+// shares with other VMs of the batch once all deploys are done, with one
+// createTags call per set of shared tags. Close
+// waits for the whole batch, including the tagging and its cleanup.
+func (c *CloudStackCli) CreateRunningInstances(ctx context.Context, specs []*spec.RunnerSpec) ([]string, error) {
+	stagger := c.cfg.BatchStartStagger.Duration
+	ids := make([]string, len(specs))
+	done, err := c.beginOperation()
+	if err != nil {
+		return ids, err
+	}
+	defer done()
+
+	errs := make([]error, len(specs))
+	pendingTags := make([]map[string]string, len(specs))
+
+	var wg sync.WaitGroup
+	for i, runnerSpec := range specs {
+		if i > 0 && stagger > 0 {
+			if err := sleepWithContext(ctx, stagger); err != nil {
+				for j := i; j < len(specs); j++ {
+					errs[j] = fmt.Errorf("deploy %d not started: %w", j, err)
+				}
+				break
+			}
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var deferTags func(map[string]string)
+			if c.cfg.BatchTags {
+				deferTags = func(tags map[string]string) { pendingTags[i] = tags }
+			}
+			ids[i], errs[i] = c.createRunningInstance(ctx, runnerSpec, deferTags)
+		}()
+	}
+	wg.Wait()
+	if c.cfg.BatchTags {
+		c.createBatchTags(ctx, ids, pendingTags, errs)
+	}
+	return ids, errors.Join(errs...)
+}
+
+// immediateTags are the tags a VM of a batch is tagged with as soon as it is
+// deployed, before the waits for its address and readiness: the ownership tags
+// ListInstancesByPool and ReapExpired find it by, and the tags that differ
+// between the VMs of a batch.
+var immediateTags = []string{"GARM_CONTROLLER_ID", "GARM_POOL_ID", "Name", expiresAtTag}
+
+// createBatchTags creates the tags deferred by CreateRunningInstances, with a
+// single createTags call for each group of VMs that share them. VMs that can't
+// be tagged are cleaned up like any other failed deploy, and their ID is
+// replaced by their error.
+func (c *CloudStackCli) createBatchTags(ctx context.Context, ids []string, pendingTags []map[string]string, errs []error) {
+	type tagGroup struct {
+		tags    map[string]string
+		members []int
+	}
+	var groups []*tagGroup
+	for i, tags := range pendingTags {
+		if len(tags) == 0 || ids[i] == "" || errs[i] != nil {
+			continue
+		}
+		idx := slices.IndexFunc(groups, func(g *tagGroup) bool { return maps.Equal(g.tags, tags) })
+		if idx < 0 {
+			groups = append(groups, &tagGroup{tags: tags})
+			idx = len(groups) - 1
+		}
+		groups[idx].members = append(groups[idx].members, i)
+	}
+
+	for _, group := range groups {
+		vmIDs := make([]string, 0, len(group.members))
+		for _, i := range group.members {
+			vmIDs = append(vmIDs, ids[i])
+		}
+		tp := c.client.Resourcetags.NewCreateTagsParams(vmIDs, "UserVm", group.tags)
+		if _, err := c.client.Resourcetags.CreateTags(tp); err != nil {
+			err = fmt.Errorf("failed to tag VM: %w", err)
+			for _, i := range group.members {
+				c.cleanupFailedDeploy(ctx, ids[i], err)
+				ids[i], errs[i] = "", err
+			}
+		}
+	}
+}
+
+// poolAffinityGroupType is the type of the per-pool affinity groups.
+const poolAffinityGroupType = "host anti-affinity"
+
+// zoneNetworking returns the zone with the given ID, looking it up only once.
+func (c *CloudStackCli) zoneNetworking(zoneID string) (*cs.Zone, error) {
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	if zone, ok := c.zones[zoneID]; ok {
+		return zone, nil
+	}
+	zone, _, err := c.client.Zone.GetZoneByID(zoneID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get zone %s: %w", zoneID, err)
+	}
+	if c.zones == nil {
+		c.zones = map[string]*cs.Zone{}
+	}
+	c.zones[zoneID] = zone
+	return zone, nil
+}
+
+// routeNetworking returns the networks and security groups to deploy the spec
+// with, chosen by the network type of its zone, so pools don't need to know
+// it. Basic zones have no guest networks to choose from, so every network_ids
+// entry is passed as a security group. Advanced zones with security groups
+// enabled attach the entries that name a network and apply the others as
+// security groups. Other advanced zones only take networks. Security groups
+// given explicitly with security_groups are passed as they are.
+//
+// Unless require_network is false, deploys into advanced zones without
+// security groups need at least one network, so the zone is looked up even
+// for deploys without any networking.
+func (c *CloudStackCli) routeNetworking(spec *spec.RunnerSpec) ([]string, []string, error) {
+	if len(spec.NetworkIDs) == 0 && len(spec.SecurityGroups) == 0 {
+		if !c.cfg.GetRequireNetwork() {
+			return nil, nil, nil
+		}
+	}
+	zone, err := c.zoneNetworking(spec.ZoneID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var networkIDs []string
+	groups := spec.SecurityGroups
+	switch {
+	case strings.EqualFold(zone.Networktype, "Basic"):
+		for _, entry := range spec.NetworkIDs {
+			if strings.Contains(entry, "/") {
+				return nil, nil, fmt.Errorf("zone %s uses basic networking, so network_ids are used as security groups, but %q is a VPC network", zone.Name, entry)
+			}
+		}
+		groups = slices.Concat(groups, spec.NetworkIDs)
+	case zone.Securitygroupsenabled:
+		var others []string
+		networkIDs, others, err = c.splitNetworks(spec.NetworkIDs, spec.ZoneID, spec.ProjectID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve networks: %w", err)
+		}
+		groups = slices.Concat(groups, others)
+	default:
+		if len(groups) > 0 {
+			return nil, nil, fmt.Errorf("zone %s does not have security groups enabled; use network_ids instead of security_groups", zone.Name)
+		}
+		networkIDs, err = c.ResolveNetworks(spec.NetworkIDs, spec.ZoneID, spec.ProjectID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to resolve networks: %w", err)
+		}
+		if len(networkIDs) == 0 && c.cfg.GetRequireNetwork() {
+			return nil, nil, fmt.Errorf("zone %s uses advanced networking and no networks are configured; set network_ids in the pool extra specs or networks in its profile, or set require_network = false to use the CloudStack default network", zone.Name)
+		}
+	}
+
+	if len(groups) > 0 {
+		byID := cs.IsID(groups[0])
+		for _, group := range groups[1:] {
+			if cs.IsID(group) != byID {
+				return nil, nil, fmt.Errorf("security groups must be either all names or all IDs")
+			}
+		}
+	}
+	return networkIDs, groups, nil
+}
+
+// splitNetworks splits network_ids entries into the IDs of the networks they
+// name and the entries that name no network, for zones that take both
+// networks and security groups. VPC-scoped names must be networks; the other
+// entries are matched by ID or name with a single listNetworks call.
+func (c *CloudStackCli) splitNetworks(namesOrIDs []string, zoneID, projectID string) ([]string, []string, error) {
+	if len(namesOrIDs) == 0 {
+		return nil, nil, nil
+	}
+	var networkIDs, others, plain []string
+	for _, nameOrID := range namesOrIDs {
+		if idx := strings.Index(nameOrID, "/"); idx > 0 && idx < len(nameOrID)-1 {
+			continue
+		}
+		plain = append(plain, nameOrID)
+	}
+	matches := map[string][]string{}
+	if len(plain) > 0 {
+		p := c.client.Network.NewListNetworksParams()
+		p.SetListall(true)
+		p.SetCanusefordeploy(true)
+		if zoneID != "" {
+			p.SetZoneid(zoneID)
+		}
+		if projectID != "" {
+			p.SetProjectid(projectID)
+		}
+		resp, err := c.client.Network.ListNetworks(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to list networks: %w", err)
+		}
+		for _, net := range resp.Networks {
+			matches[net.Id] = append(matches[net.Id], net.Id)
+			matches[net.Name] = append(matches[net.Name], net.Id)
+		}
+	}
+	for _, nameOrID := range namesOrIDs {
+		if !slices.Contains(plain, nameOrID) {
+			id, err := c.ResolveNetwork(nameOrID, zoneID, projectID)
+			if err != nil {
+				return nil, nil, err
+			}
+			networkIDs = append(networkIDs, id)
+			continue
+		}
+		switch ids := matches[nameOrID]; len(ids) {
+		case 0:
+			others = append(others, nameOrID)
+		case 1:
+			networkIDs = append(networkIDs, ids[0])
+		default:
+			return nil, nil, fmt.Errorf("ambiguous network name %q (%d networks)", nameOrID, len(ids))
+		}
+	}
+	return networkIDs, others, nil
+}
+
+// poolAffinityGroupName returns the name of the anti-affinity group of a pool.
+func poolAffinityGroupName(poolID string) string {
+	return "garm-pool-" + poolID
+}
+
+// poolAffinityGroup returns the ID of the pool's anti-affinity group, creating
+// it if it doesn't exist yet. If another provider process creates the group
+// first, its group is reused.
+func (c *CloudStackCli) poolAffinityGroup(poolID, projectID string) (string, error) {
+	if poolID == "" {
+		return "", fmt.Errorf("pool_anti_affinity requires a pool ID")
+	}
+	c.affinityMu.Lock()
+	defer c.affinityMu.Unlock()
+
+	name := poolAffinityGroupName(poolID)
+	id, err := c.findAffinityGroup(name, projectID)
+	if err != nil {
+		return "", err
+	}
+	if id != "" {
+		return id, nil
+	}
+
+	p := c.client.AffinityGroup.NewCreateAffinityGroupParams(name, poolAffinityGroupType)
+	p.SetDescription(fmt.Sprintf("Anti-affinity group of garm pool %s", poolID))
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	resp, createErr := c.client.AffinityGroup.CreateAffinityGroup(p)
+	if createErr == nil {
+		slog.Debug("poolAffinityGroup: created anti-affinity group",
+			"pool_id", poolID,
+			"affinity_group_id", resp.Id)
+		return resp.Id, nil
+	}
+	// The group may have been created concurrently; use it if so.
+	id, err = c.findAffinityGroup(name, projectID)
+	if err == nil && id != "" {
+		return id, nil
+	}
+	return "", fmt.Errorf("failed to create affinity group %s: %w", name, createErr)
+}
+
+// findAffinityGroup returns the ID of the named affinity group, or an empty
+// string if it doesn't exist.
+func (c *CloudStackCli) findAffinityGroup(name, projectID string) (string, error) {
+	p := c.client.AffinityGroup.NewListAffinityGroupsParams()
+	p.SetName(name)
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	resp, err := c.client.AffinityGroup.ListAffinityGroups(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to list affinity groups: %w", err)
+	}
+	for _, group := range resp.AffinityGroups {
+		if group.Name == name {
+			return group.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// dedicationAffinityGroup returns the ExplicitDedication affinity group that
+// CloudStack creates when hosts or clusters are dedicated to the account or
+// project, or "" if nothing is dedicated to them. VMs in the group are only
+// placed on the dedicated resources.
+func (c *CloudStackCli) dedicationAffinityGroup(projectID string) (string, error) {
+	p := c.client.AffinityGroup.NewListAffinityGroupsParams()
+	p.SetType("ExplicitDedication")
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	resp, err := c.client.AffinityGroup.ListAffinityGroups(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to list dedication affinity groups: %w", err)
+	}
+	for _, group := range resp.AffinityGroups {
+		if group.Type == "ExplicitDedication" {
+			return group.Id, nil
+		}
+	}
+	return "", nil
+}
+
+// instanceTags returns the tags every runner VM is expected to carry.
+func instanceTags(controllerID, poolID, name, osType, osArch string) map[string]string {
+	return map[string]string{
+		"GARM_CONTROLLER_ID": controllerID,
+		"GARM_POOL_ID":       poolID,
+		"Name":               name,
+		"OSType":             osType,
+		"OSArch":             osArch,
+	}
+}
+
+// tagRootVolume tags the ROOT volume of a VM with its controller and pool IDs.
+func (c *CloudStackCli) tagRootVolume(vmID, controllerID, poolID, projectID string) error {
+	volume, err := c.rootVolume(vmID, projectID)
+	if err != nil {
+		return err
+	}
+	tags := map[string]string{
+		"GARM_CONTROLLER_ID": controllerID,
+		"GARM_POOL_ID":       poolID,
+	}
+	tp := c.client.Resourcetags.NewCreateTagsParams([]string{volume.Id}, "Volume", tags)
+	if _, err := c.client.Resourcetags.CreateTags(tp); err != nil {
+		return fmt.Errorf("failed to tag volume %s: %w", volume.Id, err)
+	}
+	return nil
+}
+
+// renameRootVolume gives the ROOT volume of a VM the root_volume_name extra
+// spec. deployVirtualMachine has no parameter for it, so the volume is renamed
+// once the VM exists.
+func (c *CloudStackCli) renameRootVolume(vmID, name, projectID string) error {
+	volume, err := c.rootVolume(vmID, projectID)
+	if err != nil {
+		return err
+	}
+	if volume.Name == name {
+		return nil
+	}
+	p := c.client.Volume.NewUpdateVolumeParams()
+	p.SetId(volume.Id)
+	p.SetName(name)
+	if _, err := c.client.Volume.UpdateVolume(p); err != nil {
+		return fmt.Errorf("failed to rename volume %s: %w", volume.Id, err)
+	}
+	return nil
+}
+
+// checkKeypair looks up the SSH keypair of a deploy and applies
+// missing_keypair_policy if it doesn't exist. It returns the keypair to deploy
+// with, which is empty if the deploy should go ahead without one.
+func (c *CloudStackCli) checkKeypair(name, projectID string) (string, error) {
+	c.keypairMu.Lock()
+	defer c.keypairMu.Unlock()
+
+	p := c.client.SSH.NewListSSHKeyPairsParams()
+	p.SetName(name)
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	resp, err := c.client.SSH.ListSSHKeyPairs(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up SSH keypair %s: %w", name, err)
+	}
+	if slices.ContainsFunc(resp.SSHKeyPairs, func(k *cs.SSHKeyPair) bool { return k.Name == name }) {
+		return name, nil
+	}
+
+	switch c.cfg.MissingKeypairPolicy {
+	case config.MissingKeypairIgnore:
+		slog.Info("checkKeypair: SSH keypair does not exist, deploying without it",
+			"keypair", name,
+			"project_id", projectID)
+		return "", nil
+	case config.MissingKeypairCreate:
+		key, err := c.cfg.LoadSSHPrivateKey()
+		if err != nil {
+			return "", fmt.Errorf("failed to create missing SSH keypair %s: %w", name, err)
+		}
+		rp := c.client.SSH.NewRegisterSSHKeyPairParams(name, authorizedKey(&key.PublicKey))
+		if projectID != "" {
+			rp.SetProjectid(projectID)
+		}
+		if _, err := c.client.SSH.RegisterSSHKeyPair(rp); err != nil {
+			return "", fmt.Errorf("failed to create missing SSH keypair %s: %w", name, err)
+		}
+		slog.Info("checkKeypair: created missing SSH keypair from ssh_private_key_path",
+			"keypair", name,
+			"project_id", projectID)
+		return name, nil
+	}
+	return "", fmt.Errorf("SSH keypair %s does not exist", name)
+}
+
+// authorizedKey returns the authorized_keys line of an RSA public key.
+func authorizedKey(pub *rsa.PublicKey) string {
+	var blob []byte
+	appendString := func(b []byte) {
+		blob = binary.BigEndian.AppendUint32(blob, uint32(len(b)))
+		blob = append(blob, b...)
+	}
+	// mpints are two's complement, so positive values whose high bit is set
+	// get a leading zero byte.
+	appendMPInt := func(n *big.Int) {
+		b := n.Bytes()
+		if len(b) > 0 && b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		appendString(b)
+	}
+	appendString([]byte("ssh-rsa"))
+	appendMPInt(big.NewInt(int64(pub.E)))
+	appendMPInt(pub.N)
+	return "ssh-rsa " + base64.StdEncoding.EncodeToString(blob)
+}
+
+// transientKeypairName returns the name of the keypair registered for the
+// ssh_public_key extra spec of the VM named vmName.
+func transientKeypairName(vmName string) string {
+	return "garm-transient-" + vmName
+}
+
+// registerTransientKeypair registers publicKey as the keypair of the VM named
+// vmName and returns the keypair name.
+func (c *CloudStackCli) registerTransientKeypair(vmName, publicKey, projectID string) (string, error) {
+	name := transientKeypairName(vmName)
+	p := c.client.SSH.NewRegisterSSHKeyPairParams(name, publicKey)
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	if _, err := c.client.SSH.RegisterSSHKeyPair(p); err != nil {
+		return "", fmt.Errorf("failed to register SSH keypair %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// deleteTransientKeypair deletes a keypair registered by
+// registerTransientKeypair. Failures are logged, as the keypair grants no
+// access once its VM is gone.
+func (c *CloudStackCli) deleteTransientKeypair(name, projectID string) {
+	p := c.client.SSH.NewDeleteSSHKeyPairParams(name)
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	if _, err := c.client.SSH.DeleteSSHKeyPair(p); err != nil && !util.IsCloudStackNotFoundErr(err) {
+		slog.Error("deleteTransientKeypair: failed to delete SSH keypair",
+			"keypair", name,
+			"error", err)
+	}
+}
+
+// annotateInstance adds the annotation extra spec to a VM. Annotations are
+// informational, so failing to add one doesn't fail the deploy.
+func (c *CloudStackCli) annotateInstance(vmID, annotation string) {
+	p := c.client.Annotation.NewAddAnnotationParams()
+	p.SetEntityid(vmID)
+	p.SetEntitytype("VM")
+	p.SetAnnotation(annotation)
+	if _, err := c.client.Annotation.AddAnnotation(p); err != nil {
+		if util.IsCloudStackUnsupportedAPIErr(err) {
+			slog.Debug("CreateRunningInstance: annotations are not supported, skipping annotation",
+				"vm_id", vmID,
+				"error", err)
+			return
+		}
+		slog.Error("CreateRunningInstance: failed to annotate VM",
+			"vm_id", vmID,
+			"error", err)
+	}
+}
+
+// rootVolume returns the ROOT volume of a VM.
+func (c *CloudStackCli) rootVolume(vmID, projectID string) (*cs.Volume, error) {
+	p := c.client.Volume.NewListVolumesParams()
+	p.SetVirtualmachineid(vmID)
+	p.SetType("ROOT")
+	p.SetListall(true)
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	resp, err := c.client.Volume.ListVolumes(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes of VM %s: %w", vmID, err)
+	}
+	if resp.Count == 0 {
+		return nil, fmt.Errorf("VM %s has no ROOT volume", vmID)
+	}
+	return resp.Volumes[0], nil
+}
+
+// identityTags are the tags VMs are looked up by. They are never truncated,
+// since a shortened value would no longer match.
+var identityTags = []string{"GARM_CONTROLLER_ID", "GARM_POOL_ID", "Name"}
+
+// truncateTagValues shortens the tag values longer than maxLen in place, so
+// CloudStack doesn't reject the whole tag request. Identity tags are kept
+// whole.
+func truncateTagValues(tags map[string]string, maxLen int) {
+	for key, value := range tags {
+		if slices.Contains(identityTags, key) {
+			continue
+		}
+		if truncated := util.TruncateTagValue(value, maxLen); truncated != value {
+			slog.Debug("truncating tag value",
+				"key", key,
+				"length", len(value),
+				"max_length", maxLen)
+			tags[key] = truncated
+		}
+	}
+}
+
+// resourceTags returns the GARM_VCPU and GARM_MEMORY_MB tags used for
+// chargeback. Custom offerings take their size from the spec, others from the
+// offering itself. Sizes that aren't known are left out.
+func resourceTags(offering *cs.ServiceOffering, spec *spec.RunnerSpec) map[string]string {
+	vcpu, memory := offering.Cpunumber, offering.Memory
+	if offering.Iscustomized {
+		if spec.CPUNumber > 0 {
+			vcpu = spec.CPUNumber
+		}
+		if spec.MemoryMB > 0 {
+			memory = spec.MemoryMB
+		}
+	}
+
+	tags := map[string]string{}
+	if vcpu > 0 {
+		tags["GARM_VCPU"] = strconv.Itoa(vcpu)
+	}
+	if memory > 0 {
+		tags["GARM_MEMORY_MB"] = strconv.Itoa(memory)
+	}
+	return tags
+}
+
+// provenanceTags returns the GARM_FLAVOR and GARM_IMAGE tags naming the
+// service offering and template a VM was deployed from, next to their IDs in
+// GARM_FLAVOR_ID and GARM_IMAGE_ID. templateName is the name the template was
+// resolved from or CloudStack reported for the deploy; without one, only
+// GARM_IMAGE_ID is set. Snapshot deploys have no image tags.
+func provenanceTags(offering *cs.ServiceOffering, templateID, templateName string, spec *spec.RunnerSpec) map[string]string {
+	tags := map[string]string{
+		"GARM_FLAVOR":    offering.Name,
+		"GARM_FLAVOR_ID": offering.Id,
+	}
+	if spec.SnapshotID != "" {
+		return tags
+	}
+	tags["GARM_IMAGE_ID"] = templateID
+	if templateName != "" {
+		tags["GARM_IMAGE"] = templateName
+	}
+	return tags
+}
+
+// runnerContextTags returns the tags naming the entity a runner is registered
+// to, parsed from its repo URL: https://host/owner/repo for repositories,
+// https://host/owner for organizations and https://host/enterprises/name for
+// enterprises. URLs that don't look like any of these give no tags.
+func runnerContextTags(repoURL string) map[string]string {
+	u, err := url.Parse(repoURL)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "enterprises":
+		return map[string]string{"GARM_ENTITY_TYPE": "enterprise", "GARM_OWNER": parts[1]}
+	case len(parts) == 2:
+		return map[string]string{"GARM_ENTITY_TYPE": "repository", "GARM_OWNER": parts[0], "GARM_REPO": parts[1]}
+	case len(parts) == 1 && parts[0] != "":
+		return map[string]string{"GARM_ENTITY_TYPE": "organization", "GARM_OWNER": parts[0]}
+	}
+	return nil
+}
+
+// EnsureTags adds the tags a VM is missing. Tags that are already set are left
+// untouched, even if their value differs. It reports whether any were added.
+func (c *CloudStackCli) EnsureTags(ctx context.Context, vm *cs.VirtualMachine, tags map[string]string) (bool, error) {
+	missing := map[string]string{}
+	for key, value := range tags {
+		if value == "" {
+			continue
+		}
+		if !slices.ContainsFunc(vm.Tags, func(t cs.Tags) bool { return t.Key == key }) {
+			missing[key] = value
+		}
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+	truncateTagValues(missing, c.cfg.GetMaxTagValueLength())
+
+	slog.Debug("EnsureTags: adding missing tags",
+		"vm_id", vm.Id,
+		"vm_name", vm.Name,
+		"tags", missing)
+	tp := c.client.Resourcetags.NewCreateTagsParams([]string{vm.Id}, "UserVm", missing)
+	if _, err := c.client.Resourcetags.CreateTags(tp); err != nil {
+		return false, fmt.Errorf("failed to tag VM %s: %w", vm.Id, err)
+	}
+	return true, nil
+}
+
+// MoveInstanceToPool points the GARM_POOL_ID tag of a VM at newPoolID, so the
+// VM is listed under the pool garm moved it to. It does nothing if the VM is
+// already tagged with newPoolID.
+func (c *CloudStackCli) MoveInstanceToPool(ctx context.Context, identifier, newPoolID string) error {
+	if newPoolID == "" {
+		return fmt.Errorf("empty pool ID")
+	}
+	done, err := c.beginOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	vm, err := c.FindOneInstance(ctx, "", identifier)
+	if err != nil {
+		return err
+	}
+	current := util.GetTagValue(vm.Tags, "GARM_POOL_ID")
+	if current == newPoolID {
+		return nil
+	}
+
+	// CloudStack can't change the value of a tag in place, so the stale tag is
+	// deleted first and EnsureTags adds it back with the new value.
+	moved := *vm
+	if current != "" {
+		dp := c.client.Resourcetags.NewDeleteTagsParams([]string{vm.Id}, "UserVm")
+		dp.SetTags(map[string]string{"GARM_POOL_ID": current})
+		if _, err := c.client.Resourcetags.DeleteTags(dp); err != nil {
+			return fmt.Errorf("failed to remove pool tag of VM %s: %w", vm.Id, err)
+		}
+		moved.Tags = slices.DeleteFunc(slices.Clone(vm.Tags), func(t cs.Tags) bool { return t.Key == "GARM_POOL_ID" })
+	}
+	if _, err := c.EnsureTags(ctx, &moved, map[string]string{"GARM_POOL_ID": newPoolID}); err != nil {
+		return err
+	}
+
+	slog.Debug("MoveInstanceToPool: moved VM to pool",
+		"vm_id", vm.Id,
+		"vm_name", vm.Name,
+		"old_pool_id", current,
+		"pool_id", newPoolID)
+	return nil
+}
+
+// ReconcilePoolTags brings the tags of every VM in a pool up to the current tag
+// set, so VMs created by older versions carry all the tags newer code expects.
+// It returns the number of VMs that were updated.
+func (c *CloudStackCli) ReconcilePoolTags(ctx context.Context, controllerID, poolID string) (int, error) {
+	done, err := c.beginOperation()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	vms, err := c.ListInstancesByPool(ctx, controllerID, poolID)
+	if err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, vm := range vms {
+		// OS type and arch can't be derived from the VM itself; they are only
+		// added if the VM already has them, which EnsureTags then skips. The VM
+		// name may be sanitized and shortened, so a missing Name tag is taken
+		// from the display name, which is the runner name unless
+		// unique_display_names added a suffix to it.
+		name := util.GetTagValue(vm.Tags, "Name")
+		if name == "" && !c.cfg.UniqueDisplayNames {
+			name = vm.Displayname
+		}
+		tags := instanceTags(controllerID, poolID, name,
+			util.GetTagValue(vm.Tags, "OSType"), util.GetTagValue(vm.Tags, "OSArch"))
+		changed, err := c.EnsureTags(ctx, vm, tags)
+		if err != nil {
+			return updated, err
+		}
+		if changed {
+			updated++
+		}
+	}
+
+	slog.Debug("ReconcilePoolTags: completed",
+		"controller_id", controllerID,
+		"pool_id", poolID,
+		"total_instances", len(vms),
+		"updated", updated)
+	return updated, nil
+}
+
+// validateSnapshot checks that a snapshot exists, is usable and lives in the deploy zone.
+func (c *CloudStackCli) validateSnapshot(snapshotID, zoneID string) error {
+	snap, _, err := c.client.Snapshot.GetSnapshotByID(snapshotID)
+	if err != nil {
+		return fmt.Errorf("failed to get snapshot %s: %w", snapshotID, err)
+	}
+	if !strings.EqualFold(snap.State, "BackedUp") {
+		return fmt.Errorf("snapshot %s is not ready (state %s)", snapshotID, snap.State)
+	}
+	if snap.Zoneid != "" && snap.Zoneid != zoneID {
+		return fmt.Errorf("snapshot %s is in zone %s, but the instance is deployed in zone %s", snapshotID, snap.Zoneid, zoneID)
+	}
+	return nil
+}
+
+// checkTemplatePermissions checks that the account of the API key can deploy
+// a template: it must be public, shared with the project, owned by the
+// account or shared with it. Listing a template doesn't imply any of these.
+// Ownership is checked first, so the account is only looked up for templates
+// shared by another account.
+func (c *CloudStackCli) checkTemplatePermissions(templateID, projectID string) error {
+	perm, _, err := c.client.Template.GetTemplatePermissionByID(templateID)
+	if err != nil {
+		return fmt.Errorf("failed to get permissions of template %s: %w", templateID, err)
+	}
+	if perm.Ispublic || (projectID != "" && slices.Contains(perm.Projectids, projectID)) {
+		return nil
+	}
+
+	p := c.client.Template.NewListTemplatesParams("self")
+	p.SetId(templateID)
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	resp, err := c.client.Template.ListTemplates(p)
+	if err != nil {
+		return fmt.Errorf("failed to check owner of template %s: %w", templateID, err)
+	}
+	if resp.Count > 0 {
+		return nil
+	}
+
+	account, err := c.callerAccount()
+	if err != nil {
+		return err
+	}
+	if slices.Contains(perm.Account, account) {
+		return nil
+	}
+	return fmt.Errorf("%w: template %s is not public and not shared with account %s", ErrTemplateNotDeployable, templateID, account)
+}
+
+// callerAccount returns the name of the account the API key belongs to,
+// looking it up only once. listAccounts is used rather than getUser, which
+// only root admins may call. Without listall it returns the caller's own
+// account, or for admins the accounts of their domain, in which case the
+// account whose user holds the API key is picked.
+func (c *CloudStackCli) callerAccount() (string, error) {
+	c.accountMu.Lock()
+	defer c.accountMu.Unlock()
+	if c.account != "" {
+		return c.account, nil
+	}
+
+	p := c.client.Account.NewListAccountsParams()
+	resp, err := c.client.Account.ListAccounts(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to get the account of the API key: %w", err)
+	}
+	var account string
+	if len(resp.Accounts) == 1 {
+		account = resp.Accounts[0].Name
+	} else {
+		for _, acc := range resp.Accounts {
+			if slices.ContainsFunc(acc.User, func(u cs.AccountUser) bool { return u.Apikey == c.cfg.APIKey }) {
+				account = acc.Name
+				break
+			}
+		}
+	}
+	if account == "" {
+		return "", fmt.Errorf("no account found for the API key")
+	}
+	c.account = account
+	return c.account, nil
+}
+
+// validateStoragePool checks that a primary storage pool exists, is up and lives in the deploy zone.
+func (c *CloudStackCli) validateStoragePool(poolID, zoneID string) error {
+	pool, _, err := c.client.Pool.GetStoragePoolByID(poolID)
+	if err != nil {
+		return fmt.Errorf("failed to get storage pool %s: %w", poolID, err)
+	}
+	if pool.State != "" && !strings.EqualFold(pool.State, "Up") {
+		return fmt.Errorf("storage pool %s is not available (state %s)", poolID, pool.State)
+	}
+	if pool.Zoneid != "" && pool.Zoneid != zoneID {
+		return fmt.Errorf("storage pool %s is in zone %s, but the instance is deployed in zone %s", poolID, pool.Zoneid, zoneID)
+	}
+	return nil
+}
+
+// validateDiskOffering checks that a disk offering exists and that a data disk
+// size is given exactly when the offering is custom: custom offerings have no
+// size of their own, and the size of the others can't be overridden.
+func (c *CloudStackCli) validateDiskOffering(offeringID string, size int) error {
+	offering, _, err := c.client.DiskOffering.GetDiskOfferingByID(offeringID)
+	if err != nil {
+		return fmt.Errorf("failed to get disk offering %s: %w", offeringID, err)
+	}
+	if offering.Iscustomized && size == 0 {
+		return fmt.Errorf("disk offering %s (%s) is custom, so data_disk_size must be set", offering.Name, offeringID)
+	}
+	if !offering.Iscustomized && size > 0 {
+		return fmt.Errorf("disk offering %s (%s) has a fixed size of %d GB, so data_disk_size can't be set", offering.Name, offeringID, offering.Disksize)
+	}
+	return nil
+}
+
+// FindOneInstance returns a single VM either by ID (preferred) or by name+controller tag.
+func (c *CloudStackCli) FindOneInstance(ctx context.Context, controllerID, identifier string) (*cs.VirtualMachine, error) {
+	if strings.TrimSpace(identifier) == "" {
+		return nil, fmt.Errorf("empty identifier")
+	}
+	if cs.IsID(identifier) {
+		p := c.client.VirtualMachine.NewListVirtualMachinesParams()
+		p.SetId(identifier)
+		p.SetListall(true)
+		vms, err := c.listProjectVMs(p)
+		if err != nil {
+			// CloudStack returns an error for invalid/non-existent UUIDs
+			if util.IsCloudStackNotFoundErr(err) {
+				return nil, fmt.Errorf("no such instance %s: %w", identifier, garmErrors.ErrNotFound)
+			}
+			return nil, fmt.Errorf("failed to get instance %s: %w", identifier, err)
+		}
+		if len(vms) == 0 {
+			return nil, fmt.Errorf("no such instance %s: %w", identifier, garmErrors.ErrNotFound)
+		}
+		return verifyController(vms[0], controllerID, identifier)
+	}
+
+	p := c.client.VirtualMachine.NewListVirtualMachinesParams()
+	p.SetName(util.SanitizeInstanceName(identifier, c.cfg.GetMaxNameLength()))
+	p.SetListall(true)
+	// Only filter by controller tag if it's provided
+	if controllerID != "" {
+		tags := map[string]string{
+			"GARM_CONTROLLER_ID": controllerID,
+		}
+		p.SetTags(tags)
+	}
+
+	vms, err := c.listProjectVMs(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+	if len(vms) > 1 {
+		// A destroyed VM keeps its name until it is expunged, so it doesn't
+		// make the name ambiguous.
+		vms = liveVMs(vms)
+	}
+	if len(vms) == 0 {
+		return nil, fmt.Errorf("no such instance %s: %w", identifier, garmErrors.ErrNotFound)
+	}
+	for retry := 0; len(vms) > 1 && retry < c.cfg.DuplicateNameRetries; retry++ {
+		slog.Debug("FindOneInstance: found more than one instance, retrying",
+			"instance", identifier,
+			"count", len(vms),
+			"retry", retry+1)
+		if err := sleepWithContext(ctx, duplicateNameRetryInterval); err != nil {
+			return nil, err
+		}
+		listed, err := c.listProjectVMs(p)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list instances: %w", err)
+		}
+		vms = liveVMs(listed)
+		if len(vms) == 0 {
+			return nil, fmt.Errorf("no such instance %s: %w", identifier, garmErrors.ErrNotFound)
+		}
+	}
+	if len(vms) > 1 {
+		return nil, fmt.Errorf("found more than one instance with name %s", identifier)
+	}
+	return verifyController(vms[0], controllerID, identifier)
+}
+
+// duplicateNameRetryInterval is how long FindOneInstance waits before looking
+// a name up again that matched more than one VM.
+var duplicateNameRetryInterval = 2 * time.Second
+
+// instanceRefreshInterval is how long GetInstance waits between lookups of a
+// Running VM without an IP address, and instanceRefreshAttempts how many
+// lookups it retries.
+var instanceRefreshInterval = time.Second
+
+const instanceRefreshAttempts = 3
+
+// GetInstance looks a VM up like FindOneInstance. With refresh_instance_ip, a
+// Running VM without an IP address is looked up again a few times, so a VM
+// that just started is reported with the address it is being assigned.
+func (c *CloudStackCli) GetInstance(ctx context.Context, controllerID, identifier string) (*cs.VirtualMachine, error) {
+	if !c.cfg.RefreshInstanceIP {
+		return c.FindOneInstance(ctx, controllerID, identifier)
+	}
+	reported := func(vm *cs.VirtualMachine) bool {
+		if vm.State != "Running" || hasIP(vm) {
+			return true
+		}
+		slog.Debug("GetInstance: running VM has no IP address yet",
+			"vm_id", vm.Id)
+		return false
+	}
+	vm, err := c.WaitForVMState(ctx, identifier, reported, VMStateOptions{
+		ControllerID: controllerID,
+		Interval:     instanceRefreshInterval,
+		Attempts:     1 + instanceRefreshAttempts,
+	})
+	if err != nil && vm != nil {
+		// Report what is known rather than failing the lookup.
+		return vm, nil
+	}
+	return vm, err
+}
+
+// liveVMs drops the VMs that are being destroyed.
+func liveVMs(vms []*cs.VirtualMachine) []*cs.VirtualMachine {
+	out := make([]*cs.VirtualMachine, 0, len(vms))
+	for _, vm := range vms {
+		if vm.State != "Destroyed" && vm.State != "Expunging" {
+			out = append(out, vm)
+		}
+	}
+	return out
+}
+
+// uniqueVMs drops nil entries and repeated VM IDs from a listVirtualMachines
+// result. Some CloudStack versions return the same VM more than once when
+// listing within a project.
+func uniqueVMs(vms []*cs.VirtualMachine) []*cs.VirtualMachine {
+	seen := make(map[string]bool, len(vms))
+	out := make([]*cs.VirtualMachine, 0, len(vms))
+	for _, vm := range vms {
+		if vm == nil || seen[vm.Id] {
+			continue
+		}
+		seen[vm.Id] = true
+		out = append(out, vm)
+	}
+	return out
+}
+
+// listVirtualMachines runs a listVirtualMachines query page by page,
+// list_page_size VMs at a time, and returns the VMs of all pages. Without
+// paging, CloudStack silently truncates results at its default.page.size.
+func (c *CloudStackCli) listVirtualMachines(p *cs.ListVirtualMachinesParams) ([]*cs.VirtualMachine, error) {
+	pageSize := c.cfg.GetListPageSize()
+	p.SetPagesize(pageSize)
+	var vms []*cs.VirtualMachine
+	for page := 1; ; page++ {
+		p.SetPage(page)
+		resp, err := c.client.VirtualMachine.ListVirtualMachines(p)
+		if err != nil {
+			return nil, err
+		}
+		vms = append(vms, resp.VirtualMachines...)
+		if len(resp.VirtualMachines) < pageSize || len(vms) >= resp.Count {
+			return vms, nil
+		}
+	}
+}
+
+// allProjects is the projectid value that lists the resources of every project
+// the caller has access to.
+const allProjects = "-1"
+
+// vmProjectScopes returns the projectid values VM lookups have to cover. With
+// project_from_label, runners can live in any project named by a label, so
+// lookups span all projects, plus the caller's own resources when no default
+// project is configured.
+func (c *CloudStackCli) vmProjectScopes() []string {
+	if c.cfg.ProjectFromLabel == "" {
+		return []string{c.cfg.ProjectID()}
+	}
+	if c.cfg.ProjectID() != "" {
+		return []string{allProjects}
+	}
+	return []string{"", allProjects}
+}
+
+// listProjectVMs runs a listVirtualMachines query in every project scope VM
+// lookups have to cover and returns the distinct VMs found.
+func (c *CloudStackCli) listProjectVMs(p *cs.ListVirtualMachinesParams) ([]*cs.VirtualMachine, error) {
+	scopes := c.vmProjectScopes()
+	var vms []*cs.VirtualMachine
+	for _, project := range scopes {
+		if project != "" {
+			p.SetProjectid(project)
+		} else {
+			p.ResetProjectid()
+		}
+		listed, err := c.listVirtualMachines(p)
+		if err != nil {
+			// A lookup by ID fails in the scopes the VM is not in.
+			if len(scopes) > 1 && util.IsCloudStackNotFoundErr(err) {
+				continue
+			}
+			return nil, err
+		}
+		vms = append(vms, listed...)
+	}
+	return uniqueVMs(vms), nil
+}
+
+// verifyController makes sure a VM belongs to the given controller, so a lookup
+// can't return a foreign VM that happens to share a name or was passed by ID.
+// An empty controllerID skips the check.
+func verifyController(vm *cs.VirtualMachine, controllerID, identifier string) (*cs.VirtualMachine, error) {
+	if controllerID == "" {
+		return vm, nil
+	}
+	if util.GetTagValue(vm.Tags, "GARM_CONTROLLER_ID") != controllerID {
+		slog.Debug("FindOneInstance: instance belongs to another controller",
+			"instance", identifier,
+			"vm_id", vm.Id,
+			"controller_id", controllerID)
+		return nil, fmt.Errorf("no such instance %s: %w", identifier, garmErrors.ErrNotFound)
+	}
+	return vm, nil
+}
+
+// ListInstancesByPool lists all non-destroyed instances for a given pool, or
+// all instances if include_terminated is set. Stopped instances are left out
+// if include_stopped_in_list is false. If
+// statuses is not empty, only instances whose mapped garm status is one of
+// them are returned.
+func (c *CloudStackCli) ListInstancesByPool(ctx context.Context, controllerID, poolID string, statuses ...params.InstanceStatus) ([]*cs.VirtualMachine, error) {
+	slog.Debug("ListInstancesByPool: querying CloudStack",
+		"controller_id", controllerID,
+		"pool_id", poolID,
+		"projects", c.vmProjectScopes())
+
+	p := c.client.VirtualMachine.NewListVirtualMachinesParams()
+	p.SetListall(true)
+	// IMPORTANT: Only filter by GARM_CONTROLLER_ID here. CloudStack's tag filtering
+	// uses a logical OR when multiple tags are specified (not AND as one might expect).
+	// This undocumented behavior was confirmed by reading the CloudStack source code.
+	// We must filter by GARM_POOL_ID on the client side after receiving the results.
+	tags := map[string]string{
+		"GARM_CONTROLLER_ID": controllerID,
+	}
+	p.SetTags(tags)
+
+	vms, err := c.listProjectVMs(p)
+	if err != nil {
+		slog.Error("ListInstancesByPool: CloudStack API error",
+			"controller_id", controllerID,
+			"pool_id", poolID,
+			"error", err)
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	slog.Debug("ListInstancesByPool: CloudStack returned VMs",
+		"controller_id", controllerID,
+		"pool_id", poolID,
+		"total_count", len(vms))
+
+	var out []*cs.VirtualMachine
+	for _, vm := range vms {
+
+		// Extract pool_id tag for client-side filtering (see comment above about CloudStack OR behavior)
+		vmPoolID := util.GetTagValue(vm.Tags, "GARM_POOL_ID")
+
+		// Client-side filtering: only include VMs that match the requested pool_id
+		if vmPoolID != poolID {
+			slog.Debug("ListInstancesByPool: skipping VM with different pool_id",
+				"vm_name", vm.Name,
+				"vm_id", vm.Id,
+				"requested_pool_id", poolID,
+				"vm_pool_id", vmPoolID)
+			continue
+		}
+
+		// Filter out destroyed/expunging instances; garm is not interested in
+		// them unless include_terminated is set.
+		state := strings.ToLower(vm.State)
+		terminated := state == "destroyed" || state == "expunging"
+		if terminated && !c.cfg.IncludeTerminated {
+			slog.Debug("ListInstancesByPool: skipping destroyed/expunging VM",
+				"vm_name", vm.Name,
+				"vm_id", vm.Id,
+				"state", vm.State)
+			continue
+		}
+		if state == "error" {
+			if c.cfg.AutoReapErrored && c.reapErrored(ctx, vm) {
+				continue
+			}
+			if c.cfg.ErroredInstances == config.ErroredInstancesExclude {
+				slog.Debug("ListInstancesByPool: skipping VM in error state",
+					"vm_name", vm.Name,
+					"vm_id", vm.Id)
+				continue
+			}
+		}
+		status := util.CloudStackStateToStatus(vm.State, c.cfg.StatusOverrides())
+		if status == params.InstanceStopped && !terminated && !c.cfg.GetIncludeStoppedInList() {
+			slog.Debug("ListInstancesByPool: skipping stopped VM",
+				"vm_name", vm.Name,
+				"vm_id", vm.Id,
+				"state", vm.State)
+			continue
+		}
+		if len(statuses) > 0 && !slices.Contains(statuses, status) {
+			slog.Debug("ListInstancesByPool: skipping VM not matching status filter",
+				"vm_name", vm.Name,
+				"vm_id", vm.Id,
+				"state", vm.State)
+			continue
+		}
+		out = append(out, vm)
+	}
+
+	slog.Debug("ListInstancesByPool: completed",
+		"controller_id", controllerID,
+		"pool_id", poolID,
+		"returned_count", len(out))
+	return out, nil
+}
+
+// reapErrored destroys a VM found in the Error state and reports whether it
+// was destroyed.
+func (c *CloudStackCli) reapErrored(ctx context.Context, vm *cs.VirtualMachine) bool {
+	if isProtected(vm) {
+		slog.Debug("reapErrored: not reaping protected VM",
+			"vm_name", vm.Name,
+			"vm_id", vm.Id)
+		return false
+	}
+	if err := c.DestroyInstance(ctx, vm.Id, c.cfg.Expunge); err != nil {
+		slog.Error("reapErrored: failed to destroy VM in error state",
+			"vm_name", vm.Name,
+			"vm_id", vm.Id,
+			"error", err)
+		return false
+	}
+	slog.Debug("reapErrored: destroyed VM in error state",
+		"vm_name", vm.Name,
+		"vm_id", vm.Id)
+	return true
+}
+
+// ReapExpired destroys the VMs of a controller whose GARM_EXPIRES_AT tag lies
+// in the past, across all pools. Protected VMs and VMs without a valid expiry
+// are left alone. It returns the number of VMs destroyed; a failure to destroy
+// one VM doesn't stop the others from being reaped.
+func (c *CloudStackCli) ReapExpired(ctx context.Context, controllerID string) (int, error) {
+	done, err := c.beginOperation()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	p := c.client.VirtualMachine.NewListVirtualMachinesParams()
+	p.SetListall(true)
+	p.SetTags(map[string]string{"GARM_CONTROLLER_ID": controllerID})
+	vms, err := c.listProjectVMs(p)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	now := timeNow()
+	var reaped int
+	var errs []error
+	for _, vm := range vms {
+		if vm.State == "Destroyed" || vm.State == "Expunging" {
+			continue
+		}
+		value := util.GetTagValue(vm.Tags, expiresAtTag)
+		if value == "" {
+			continue
+		}
+		expiresAt, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			slog.Debug("ReapExpired: ignoring invalid expiry tag",
+				"vm_name", vm.Name,
+				"vm_id", vm.Id,
+				"value", value)
+			continue
+		}
+		if now.Before(expiresAt) {
+			continue
+		}
+		if isProtected(vm) {
+			slog.Debug("ReapExpired: not reaping protected VM",
+				"vm_name", vm.Name,
+				"vm_id", vm.Id)
+			continue
+		}
+		if err := c.destroyHeldInstance(ctx, vm.Id, c.cfg.Expunge, false); err != nil {
+			errs = append(errs, fmt.Errorf("failed to reap expired instance %s: %w", vm.Id, err))
+			continue
+		}
+		slog.Debug("ReapExpired: destroyed expired VM",
+			"vm_name", vm.Name,
+			"vm_id", vm.Id,
+			"expired_at", value)
+		reaped++
+	}
+	return reaped, errors.Join(errs...)
+}
+
+// RemoveAllInstances destroys every VM of a controller, across all pools,
+// running up to delete_concurrency destroys at once. Protected VMs are left
+// alone and VMs that are already gone count as removed. It returns the number
+// of VMs destroyed; a failure to destroy one VM doesn't stop the others.
+func (c *CloudStackCli) RemoveAllInstances(ctx context.Context, controllerID string) (int, error) {
+	done, err := c.beginOperation()
+	if err != nil {
+		return 0, err
+	}
+	defer done()
+
+	p := c.client.VirtualMachine.NewListVirtualMachinesParams()
+	p.SetListall(true)
+	p.SetTags(map[string]string{"GARM_CONTROLLER_ID": controllerID})
+	vms, err := c.listProjectVMs(p)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		removed int
+		errs    []error
+	)
+	sem := make(chan struct{}, c.cfg.GetDeleteConcurrency())
+	for _, vm := range vms {
+		if vm.State == "Destroyed" || vm.State == "Expunging" {
+			continue
+		}
+		if isProtected(vm) {
+			slog.Debug("RemoveAllInstances: not removing protected VM",
+				"vm_name", vm.Name,
+				"vm_id", vm.Id)
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			mu.Lock()
+			errs = append(errs, fmt.Errorf("removal of instance %s not started: %w", vm.Id, ctx.Err()))
+			mu.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			// A VM that is gone already counts as destroyed.
+			err := c.destroyHeldInstance(ctx, vm.Id, c.cfg.Expunge, false)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to remove instance %s: %w", vm.Id, err))
+				return
+			}
+			removed++
+		}()
+	}
+	wg.Wait()
+
+	slog.Debug("RemoveAllInstances: completed",
+		"controller_id", controllerID,
+		"removed", removed,
+		"failed", len(errs))
+	return removed, errors.Join(errs...)
+}
+
+// InventoryEntry describes one VM of a controller in an inventory dump. Created
+// and AgeSeconds are left out if CloudStack didn't report a parseable creation
+// time.
+type InventoryEntry struct {
+	ID                  string     `json:"id"`
+	Name                string     `json:"name"`
+	PoolID              string     `json:"pool_id"`
+	State               string     `json:"state"`
+	ZoneID              string     `json:"zone_id"`
+	ZoneName            string     `json:"zone_name"`
+	ServiceOfferingID   string     `json:"service_offering_id"`
+	ServiceOfferingName string     `json:"service_offering_name"`
+	Addresses           []string   `json:"addresses"`
+	Created             *time.Time `json:"created,omitempty"`
+	AgeSeconds          int64      `json:"age_seconds,omitempty"`
+}
+
+// DumpInventory returns every VM tagged with the controller ID, in any state,
+// sorted by name. It is meant for audits and fleet exports.
+func (c *CloudStackCli) DumpInventory(ctx context.Context, controllerID string) ([]InventoryEntry, error) {
+	p := c.client.VirtualMachine.NewListVirtualMachinesParams()
+	p.SetListall(true)
+	p.SetTags(map[string]string{"GARM_CONTROLLER_ID": controllerID})
+	vms, err := c.listProjectVMs(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list instances: %w", err)
+	}
+
+	out := make([]InventoryEntry, 0, len(vms))
+	for _, vm := range vms {
+		addresses := []string{}
+		for _, nic := range vm.Nic {
+			for _, addr := range []string{nic.Ipaddress, nic.Ip6address} {
+				if addr != "" {
+					addresses = append(addresses, addr)
+				}
+			}
+		}
+		if vm.Publicip != "" {
+			addresses = append(addresses, vm.Publicip)
+		}
+		entry := InventoryEntry{
+			ID:                  vm.Id,
+			Name:                vm.Name,
+			PoolID:              util.GetTagValue(vm.Tags, "GARM_POOL_ID"),
+			State:               vm.State,
+			ZoneID:              vm.Zoneid,
+			ZoneName:            vm.Zonename,
+			ServiceOfferingID:   vm.Serviceofferingid,
+			ServiceOfferingName: vm.Serviceofferingname,
+			Addresses:           addresses,
+		}
+		if created, err := util.ParseCloudStackTime(vm.Created); err == nil {
+			created = created.UTC()
+			entry.Created = &created
+			entry.AgeSeconds = int64(timeNow().Sub(created) / time.Second)
+		} else {
+			slog.Debug("DumpInventory: unknown VM creation time",
+				"vm_id", vm.Id,
+				"error", err)
+		}
+		out = append(out, entry)
+	}
+	slices.SortFunc(out, func(a, b InventoryEntry) int { return strings.Compare(a.Name, b.Name) })
+	return out, nil
+}
+
+// StartInstance starts a VM and waits for the start job to finish. It errors
+// if the VM isn't Running afterwards.
+func (c *CloudStackCli) StartInstance(ctx context.Context, identifier string) (err error) {
+	var vmID string
+	defer func() { c.auditLog.record(AuditStart, identifier, vmID, err) }()
+
+	done, err := c.beginOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	vm, err := c.FindOneInstance(ctx, "", identifier)
+	if err != nil {
+		return err
+	}
+	vmID = vm.Id
+	params := c.client.VirtualMachine.NewStartVirtualMachineParams(vm.Id)
+	state, err := c.startVirtualMachine(ctx, params)
+	if err != nil {
+		return fmt.Errorf("failed to start instance: %w", err)
+	}
+	return checkPowerState(vm.Id, "start", state, "Running")
+}
+
+// StopInstance stops a VM and waits for the stop job to finish. It errors if
+// the VM isn't Stopped afterwards. A VM that doesn't exist is not an error.
+func (c *CloudStackCli) StopInstance(ctx context.Context, identifier string, force bool) (err error) {
+	var vmID string
+	defer func() { c.auditLog.record(AuditStop, identifier, vmID, err) }()
+
+	done, err := c.beginOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	vm, err := c.FindOneInstance(ctx, "", identifier)
+	if err != nil {
+		if errors.Is(err, garmErrors.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	vmID = vm.Id
+	params := c.client.VirtualMachine.NewStopVirtualMachineParams(vm.Id)
+	params.SetForced(force)
+	state, err := c.stopVirtualMachine(ctx, params)
+	if err != nil {
+		if util.IsCloudStackNotFoundErr(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stop instance: %w", err)
+	}
+	return checkPowerState(vm.Id, "stop", state, "Stopped")
+}
+
+// powerStatePollInterval is how often EnsurePowerState checks a VM that is
+// moving to the other power state, and powerStateSettleTimeout how long it
+// waits for the VM to get there.
+var (
+	powerStatePollInterval  = 5 * time.Second
+	powerStateSettleTimeout = 5 * time.Minute
+)
+
+// EnsurePowerState brings a VM to the desired power state, which must be
+// running or stopped. It starts or stops the VM only if it is neither in that
+// state nor transitioning to it, waiting for a VM transitioning to the other
+// state to get there first, and errors if the VM is in a state it can't be
+// moved out of, such as Error or Migrating.
+func (c *CloudStackCli) EnsurePowerState(ctx context.Context, identifier string, desired params.InstanceStatus) error {
+	if desired != params.InstanceRunning && desired != params.InstanceStopped {
+		return fmt.Errorf("invalid desired power state %q: must be %s or %s", desired, params.InstanceRunning, params.InstanceStopped)
+	}
+	vm, err := c.FindOneInstance(ctx, "", identifier)
+	if err != nil {
+		return err
+	}
+	// A VM moving to the other power state can only be moved back once it
+	// got there.
+	if (desired == params.InstanceRunning && vm.State == "Stopping") || (desired == params.InstanceStopped && vm.State == "Starting") {
+		from := vm.State
+		vm, err = c.WaitForVMState(ctx, vm.Id, settled, VMStateOptions{
+			Interval: powerStatePollInterval,
+			Timeout:  powerStateSettleTimeout,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to wait for instance %s to leave state %s: %w", identifier, from, err)
+		}
+	}
+
+	switch {
+	case desired == params.InstanceRunning && (vm.State == "Running" || vm.State == "Starting"),
+		desired == params.InstanceStopped && (vm.State == "Stopped" || vm.State == "Stopping"):
+		slog.Debug("EnsurePowerState: VM already in desired state",
+			"vm_id", vm.Id,
+			"state", vm.State,
+			"desired", desired)
+		return nil
+	case desired == params.InstanceRunning && vm.State == "Stopped":
+		return c.StartInstance(ctx, vm.Id)
+	case desired == params.InstanceStopped && vm.State == "Running":
+		return c.StopInstance(ctx, vm.Id, false)
+	}
+	return fmt.Errorf("cannot bring instance %s from state %s to %s", vm.Id, vm.State, desired)
+}
+
+// RestartInstance reboots a VM and waits for the reboot job to finish. It
+// errors if the VM isn't Running afterwards.
+func (c *CloudStackCli) RestartInstance(ctx context.Context, identifier string) (err error) {
+	var vmID string
+	defer func() { c.auditLog.record(AuditRestart, identifier, vmID, err) }()
+
+	done, err := c.beginOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	vm, err := c.FindOneInstance(ctx, "", identifier)
+	if err != nil {
+		return err
+	}
+	vmID = vm.Id
+	params := c.client.VirtualMachine.NewRebootVirtualMachineParams(vm.Id)
+	state, err := c.rebootVirtualMachine(ctx, params)
+	if err != nil {
+		return fmt.Errorf("failed to restart instance: %w", err)
+	}
+	return checkPowerState(vm.Id, "restart", state, "Running")
+}
+
+// checkPowerState verifies the state a power operation job reported for a VM.
+func checkPowerState(vmID, op, state, want string) error {
+	slog.Debug("power operation finished", "vm_id", vmID, "operation", op, "state", state)
+	if state != want {
+		return fmt.Errorf("VM %s is %q after %s, expected %q", vmID, state, op, want)
+	}
+	return nil
+}
+
+// DestroyInstance destroys a VM. VMs carrying the GARM_PROTECTED tag are refused
+// with ErrProtected; use ForceDestroyInstance to delete them anyway.
+func (c *CloudStackCli) DestroyInstance(ctx context.Context, identifier string, expunge bool) error {
+	return c.destroyInstance(ctx, identifier, expunge, false)
+}
+
+// ForceDestroyInstance destroys a VM even if it carries the GARM_PROTECTED tag.
+func (c *CloudStackCli) ForceDestroyInstance(ctx context.Context, identifier string, expunge bool) error {
+	return c.destroyInstance(ctx, identifier, expunge, true)
+}
+
+func (c *CloudStackCli) destroyInstance(ctx context.Context, identifier string, expunge, force bool) error {
+	done, err := c.beginOperation()
+	if err != nil {
+		c.auditLog.record(AuditDelete, identifier, "", err)
+		return err
+	}
+	defer done()
+	return c.destroyHeldInstance(ctx, identifier, expunge, force)
+}
+
+// destroyHeldInstance destroys a VM for a caller that already holds an
+// operation, such as the cleanup of a failed create. It isn't gated by Close,
+// so the caller can finish what it started once Close is waiting for it.
+func (c *CloudStackCli) destroyHeldInstance(ctx context.Context, identifier string, expunge, force bool) (err error) {
+	var vmID string
+	defer func() { c.auditLog.record(AuditDelete, identifier, vmID, err) }()
+
+	vm, err := c.FindOneInstance(ctx, "", identifier)
+	if err != nil {
+		if errors.Is(err, garmErrors.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	vmID = vm.Id
+	if !force && isProtected(vm) {
+		return fmt.Errorf("refusing to destroy instance %s (%s): %w", vm.Name, vm.Id, ErrProtected)
+	}
+	if keypair := transientKeypairName(vm.Name); vm.Keypairs == keypair {
+		defer func() {
+			if err == nil {
+				c.deleteTransientKeypair(keypair, vm.Projectid)
+			}
+		}()
+	}
+	params := c.client.VirtualMachine.NewDestroyVirtualMachineParams(vm.Id)
+	// Expunging a VM that still has a job running against it fails with an
+	// "operation in progress" error. That usually clears quickly, so wait for
+	// a VM in a transitional state to settle, and retry it with a bounded
+	// backoff instead of failing the delete.
+	var retries int
+	backoff := c.cfg.GetExpungeRetryInterval()
+	if expunge {
+		params.SetExpunge(true)
+		retries = c.cfg.GetExpungeRetries()
+		if !settled(vm) {
+			c.waitToExpunge(ctx, vm, backoff)
+			if err := ctx.Err(); err != nil {
+				return fmt.Errorf("failed to destroy instance: %w", err)
+			}
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		err := c.destroyVirtualMachine(ctx, params)
+		if err == nil {
+			return nil
+		}
+		if util.IsCloudStackNotFoundErr(err) {
+			return nil
+		}
+		if !util.IsCloudStackOperationInProgressErr(err) || attempt >= retries {
+			return fmt.Errorf("failed to destroy instance: %w", err)
+		}
+		slog.Debug("DestroyInstance: operation in progress, retrying expunge",
+			"vm_id", vm.Id,
+			"attempt", attempt+1,
+			"backoff", backoff)
+		if err := sleepWithContext(ctx, backoff); err != nil {
+			return fmt.Errorf("failed to destroy instance: %w", err)
+		}
+		backoff = min(backoff*2, config.MaxExpungeRetryInterval)
+	}
+}
+
+// waitToExpunge waits for a VM in a transitional state to settle before it is
+// expunged, polling with the expunge retry backoff for at most
+// powerStateSettleTimeout. A VM that doesn't settle is expunged anyway.
+func (c *CloudStackCli) waitToExpunge(ctx context.Context, vm *cs.VirtualMachine, interval time.Duration) {
+	slog.Debug("DestroyInstance: waiting for VM to settle before expunging",
+		"vm_id", vm.Id,
+		"state", vm.State)
+	_, err := c.WaitForVMState(ctx, vm.Id, settled, VMStateOptions{
+		Interval:    interval,
+		Backoff:     2,
+		MaxInterval: config.MaxExpungeRetryInterval,
+		Timeout:     powerStateSettleTimeout,
+	})
+	if err != nil {
+		slog.Debug("DestroyInstance: VM did not settle, expunging anyway",
+			"vm_id", vm.Id,
+			"error", err)
+	}
+}
+
+// isProtected reports whether a VM carries the protectedTag tag.
+func isProtected(vm *cs.VirtualMachine) bool {
+	for _, tag := range vm.Tags {
+		if tag.Key == protectedTag {
+			return !strings.EqualFold(tag.Value, "false")
+		}
+	}
+	return false
+}
+
+// MigrateInstance live-migrates a VM to the given host and waits for the migration
+// to complete. The target host must be in the same zone as the VM. A VM that no
+// longer exists is treated as already migrated.
+func (c *CloudStackCli) MigrateInstance(ctx context.Context, identifier, hostID string) (err error) {
+	if strings.TrimSpace(hostID) == "" {
+		return fmt.Errorf("empty host id")
+	}
+	var vmID string
+	defer func() { c.auditLog.record(AuditMigrate, identifier, vmID, err) }()
+
+	done, err := c.beginOperation()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	vm, err := c.FindOneInstance(ctx, "", identifier)
+	if err != nil {
+		if errors.Is(err, garmErrors.ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	vmID = vm.Id
+	if vm.Hostid == hostID {
+		return nil
+	}
+
+	host, _, err := c.client.Host.GetHostByID(hostID)
+	if err != nil {
+		return fmt.Errorf("failed to get target host %s: %w", hostID, err)
+	}
+	if host.Zoneid != vm.Zoneid {
+		return fmt.Errorf("target host %s is in zone %s, but instance %s is in zone %s", hostID, host.Zoneid, vm.Id, vm.Zoneid)
+	}
 
-	// Resolve --flavor override from CLI if provided
-	serviceOfferingID := spec.ServiceOfferingID
-	if spec.BootstrapParams.Flavor != "" {
-		resolved, err := c.ResolveServiceOffering(spec.BootstrapParams.Flavor)
-		if err != nil {
-			return "", fmt.Errorf("failed to resolve flavor %q: %w", spec.BootstrapParams.Flavor, err)
+	params := c.client.VirtualMachine.NewMigrateVirtualMachineParams(vm.Id)
+	params.SetHostid(hostID)
+	if err := c.migrateVirtualMachine(ctx, params); err != nil {
+		if util.IsCloudStackNotFoundErr(err) {
+			return nil
 		}
-		serviceOfferingID = resolved
+		return fmt.Errorf("failed to migrate instance: %w", err)
 	}
+	return nil
+}
 
-	// Resolve --image override from CLI if provided
-	templateID := spec.TemplateID
-	if spec.BootstrapParams.Image != "" {
-		resolved, err := c.ResolveTemplate(spec.BootstrapParams.Image, spec.ZoneID, spec.ProjectID)
-		if err != nil {
-			return "", fmt.Errorf("failed to resolve image %q: %w", spec.BootstrapParams.Image, err)
-		}
-		templateID = resolved
+// AttachISO attaches an ISO, given by name or ID, to an instance, for example to
+// install drivers or guest tools on a Windows runner. The ISO must be ready in
+// the zone of the instance.
+func (c *CloudStackCli) AttachISO(ctx context.Context, identifier, isoNameOrID string) error {
+	if strings.TrimSpace(isoNameOrID) == "" {
+		return fmt.Errorf("empty iso")
 	}
-
-	udata, err := spec.ComposeUserData()
+	done, err := c.beginOperation()
 	if err != nil {
-		return "", fmt.Errorf("failed to compose user data: %w", err)
+		return err
 	}
+	defer done()
 
-	// Resolve network names to IDs (accepts both names and UUIDs)
-	networkIDs, err := c.ResolveNetworks(spec.NetworkIDs, spec.ZoneID, spec.ProjectID)
+	vm, err := c.FindOneInstance(ctx, "", identifier)
 	if err != nil {
-		return "", fmt.Errorf("failed to resolve networks: %w", err)
+		return err
 	}
-
-	params := c.client.VirtualMachine.NewDeployVirtualMachineParams(
-		serviceOfferingID,
-		templateID,
-		spec.ZoneID,
-	)
-	params.SetName(spec.BootstrapParams.Name)
-	params.SetDisplayname(spec.BootstrapParams.Name)
-	params.SetUserdata(udata)
-	if len(networkIDs) > 0 {
-		params.SetNetworkids(networkIDs)
+	isoID, err := c.resolveISO(isoNameOrID, vm.Zoneid, vm.Projectid)
+	if err != nil {
+		return err
 	}
-	if spec.SSHKeyName != "" {
-		params.SetKeypair(spec.SSHKeyName)
+	if vm.Isoid == isoID {
+		return nil
 	}
-	if spec.ProjectID != "" {
-		params.SetProjectid(spec.ProjectID)
+
+	params := c.client.ISO.NewAttachIsoParams(isoID, vm.Id)
+	if _, err := c.client.ISO.AttachIso(params); err != nil {
+		return fmt.Errorf("failed to attach ISO %s to instance %s: %w", isoID, vm.Id, err)
 	}
+	return nil
+}
 
-	resp, err := c.client.VirtualMachine.DeployVirtualMachine(params)
+// DetachISO detaches the ISO attached to an instance, if any.
+func (c *CloudStackCli) DetachISO(ctx context.Context, identifier string) error {
+	done, err := c.beginOperation()
 	if err != nil {
-		return "", fmt.Errorf("failed to deploy virtual machine: %w", err)
-	}
-	if resp.Id == "" {
-		return "", fmt.Errorf("empty VM id in deploy response")
+		return err
 	}
+	defer done()
 
-	tags := map[string]string{
-		"GARM_CONTROLLER_ID": spec.ControllerID,
-		"GARM_POOL_ID":       spec.BootstrapParams.PoolID,
-		"Name":               spec.BootstrapParams.Name,
-		"OSType":             string(spec.BootstrapParams.OSType),
-		"OSArch":             string(spec.BootstrapParams.OSArch),
+	vm, err := c.FindOneInstance(ctx, "", identifier)
+	if err != nil {
+		return err
 	}
-	tp := c.client.Resourcetags.NewCreateTagsParams([]string{resp.Id}, "UserVm", tags)
-	if _, err := c.client.Resourcetags.CreateTags(tp); err != nil {
-		return "", fmt.Errorf("failed to tag VM: %w", err)
+	if vm.Isoid == "" {
+		return nil
 	}
 
-	return resp.Id, nil
-}
-
-// FindOneInstance returns a single VM either by ID (preferred) or by name+controller tag.
-func (c *CloudStackCli) FindOneInstance(ctx context.Context, controllerID, identifier string) (*cs.VirtualMachine, error) {
-	if strings.TrimSpace(identifier) == "" {
-		return nil, fmt.Errorf("empty identifier")
-	}
-	if cs.IsID(identifier) {
-		p := c.client.VirtualMachine.NewListVirtualMachinesParams()
-		p.SetId(identifier)
-		p.SetListall(true)
-		if c.cfg.ProjectID() != "" {
-			p.SetProjectid(c.cfg.ProjectID())
-		}
-		resp, err := c.client.VirtualMachine.ListVirtualMachines(p)
-		if err != nil {
-			// CloudStack returns an error for invalid/non-existent UUIDs
-			if util.IsCloudStackNotFoundErr(err) {
-				return nil, fmt.Errorf("no such instance %s: %w", identifier, garmErrors.ErrNotFound)
-			}
-			return nil, fmt.Errorf("failed to get instance %s: %w", identifier, err)
-		}
-		if resp.Count == 0 {
-			return nil, fmt.Errorf("no such instance %s: %w", identifier, garmErrors.ErrNotFound)
-		}
-		return resp.VirtualMachines[0], nil
+	params := c.client.ISO.NewDetachIsoParams(vm.Id)
+	if _, err := c.client.ISO.DetachIso(params); err != nil {
+		return fmt.Errorf("failed to detach ISO %s from instance %s: %w", vm.Isoid, vm.Id, err)
 	}
+	return nil
+}
 
-	p := c.client.VirtualMachine.NewListVirtualMachinesParams()
-	p.SetName(identifier)
-	p.SetListall(true)
-	if c.cfg.ProjectID() != "" {
-		p.SetProjectid(c.cfg.ProjectID())
+// resolveISO returns the ID of an ISO, given by name or ID, that is ready in a
+// zone. Cross-zone ISOs are listed in every zone.
+func (c *CloudStackCli) resolveISO(nameOrID, zoneID, projectID string) (string, error) {
+	p := c.client.ISO.NewListIsosParams()
+	p.SetIsofilter("executable")
+	p.SetZoneid(zoneID)
+	if cs.IsID(nameOrID) {
+		p.SetId(nameOrID)
+	} else {
+		p.SetName(nameOrID)
 	}
-	// Only filter by controller tag if it's provided
-	if controllerID != "" {
-		tags := map[string]string{
-			"GARM_CONTROLLER_ID": controllerID,
-		}
-		p.SetTags(tags)
+	if projectID != "" {
+		p.SetProjectid(projectID)
 	}
-
-	resp, err := c.client.VirtualMachine.ListVirtualMachines(p)
+	resp, err := c.client.ISO.ListIsos(p)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list instances: %w", err)
+		if util.IsCloudStackNotFoundErr(err) {
+			return "", fmt.Errorf("ISO %q is not available in zone %s", nameOrID, zoneID)
+		}
+		return "", fmt.Errorf("failed to resolve ISO %q: %w", nameOrID, err)
 	}
 	if resp.Count == 0 {
-		return nil, fmt.Errorf("no such instance %s: %w", identifier, garmErrors.ErrNotFound)
+		return "", fmt.Errorf("ISO %q is not available in zone %s", nameOrID, zoneID)
 	}
-	if resp.Count > 1 {
-		return nil, fmt.Errorf("found more than one instance with name %s", identifier)
+	iso := resp.Isos[0]
+	if !iso.Isready {
+		return "", fmt.Errorf("ISO %s is not ready in zone %s", iso.Id, zoneID)
 	}
-	return resp.VirtualMachines[0], nil
+	return iso.Id, nil
 }
 
-// ListInstancesByPool lists all non-destroyed instances for a given pool.
-func (c *CloudStackCli) ListInstancesByPool(ctx context.Context, controllerID, poolID string) ([]*cs.VirtualMachine, error) {
-	slog.Debug("ListInstancesByPool: querying CloudStack",
-		"controller_id", controllerID,
-		"pool_id", poolID,
-		"project_id", c.cfg.ProjectID())
-
-	p := c.client.VirtualMachine.NewListVirtualMachinesParams()
-	p.SetListall(true)
-	// IMPORTANT: Only filter by GARM_CONTROLLER_ID here. CloudStack's tag filtering
-	// uses a logical OR when multiple tags are specified (not AND as one might expect).
-	// This undocumented behavior was confirmed by reading the CloudStack source code.
-	// We must filter by GARM_POOL_ID on the client side after receiving the results.
-	tags := map[string]string{
-		"GARM_CONTROLLER_ID": controllerID,
-	}
-	p.SetTags(tags)
-	if c.cfg.ProjectID() != "" {
-		p.SetProjectid(c.cfg.ProjectID())
-	}
+// operationJobPollInterval is how often deploy and destroy jobs are polled when
+// operation_timeout is set without a poll interval. The regular client waits
+// for jobs without a context, so only a polled job stops at the deadline.
+var operationJobPollInterval = 5 * time.Second
 
-	resp, err := c.client.VirtualMachine.ListVirtualMachines(p)
-	if err != nil {
-		slog.Error("ListInstancesByPool: CloudStack API error",
-			"controller_id", controllerID,
-			"pool_id", poolID,
-			"error", err)
-		return nil, fmt.Errorf("failed to list instances: %w", err)
+// operationPollInterval returns the interval to poll a deploy, destroy or
+// migration job with, given its configured poll interval.
+func (c *CloudStackCli) operationPollInterval(interval time.Duration) time.Duration {
+	if interval == 0 && c.cfg.GetOperationTimeout() > 0 {
+		return operationJobPollInterval
 	}
+	return interval
+}
 
-	slog.Debug("ListInstancesByPool: CloudStack returned VMs",
-		"controller_id", controllerID,
-		"pool_id", poolID,
-		"total_count", resp.Count)
+// deployVirtualMachine deploys a VM, polling the deploy job every
+// deploy_poll_interval when one is configured, or when operation_timeout is.
+func (c *CloudStackCli) deployVirtualMachine(ctx context.Context, p *cs.DeployVirtualMachineParams) (*cs.DeployVirtualMachineResponse, error) {
+	return runVMJob(ctx, c, c.operationPollInterval(c.cfg.GetDeployPollInterval()), p,
+		cs.VirtualMachineServiceIface.DeployVirtualMachine,
+		func(r *cs.DeployVirtualMachineResponse) string { return r.JobID })
+}
 
-	var out []*cs.VirtualMachine
-	for _, vm := range resp.VirtualMachines {
-		if vm == nil {
-			continue
-		}
+// destroyVirtualMachine destroys a VM, polling the destroy job every
+// delete_poll_interval when one is configured, or when operation_timeout is.
+func (c *CloudStackCli) destroyVirtualMachine(ctx context.Context, p *cs.DestroyVirtualMachineParams) error {
+	_, err := runVMJob(ctx, c, c.operationPollInterval(c.cfg.GetDeletePollInterval()), p,
+		cs.VirtualMachineServiceIface.DestroyVirtualMachine,
+		func(r *cs.DestroyVirtualMachineResponse) string { return r.JobID })
+	return err
+}
 
-		// Extract pool_id tag for client-side filtering (see comment above about CloudStack OR behavior)
-		var vmPoolID string
-		for _, tag := range vm.Tags {
-			if tag.Key == "GARM_POOL_ID" {
-				vmPoolID = tag.Value
-				break
-			}
-		}
+// startVirtualMachine starts a VM and returns its final state, polling the
+// start job every power_poll_interval when one is configured.
+func (c *CloudStackCli) startVirtualMachine(ctx context.Context, p *cs.StartVirtualMachineParams) (string, error) {
+	resp, err := runVMJob(ctx, c, c.cfg.GetPowerPollInterval(), p,
+		cs.VirtualMachineServiceIface.StartVirtualMachine,
+		func(r *cs.StartVirtualMachineResponse) string { return r.JobID })
+	if err != nil {
+		return "", err
+	}
+	return resp.State, nil
+}
 
-		// Client-side filtering: only include VMs that match the requested pool_id
-		if vmPoolID != poolID {
-			slog.Debug("ListInstancesByPool: skipping VM with different pool_id",
-				"vm_name", vm.Name,
-				"vm_id", vm.Id,
-				"requested_pool_id", poolID,
-				"vm_pool_id", vmPoolID)
-			continue
-		}
+// stopVirtualMachine stops a VM and returns its final state, polling the stop
+// job every power_poll_interval when one is configured.
+func (c *CloudStackCli) stopVirtualMachine(ctx context.Context, p *cs.StopVirtualMachineParams) (string, error) {
+	resp, err := runVMJob(ctx, c, c.cfg.GetPowerPollInterval(), p,
+		cs.VirtualMachineServiceIface.StopVirtualMachine,
+		func(r *cs.StopVirtualMachineResponse) string { return r.JobID })
+	if err != nil {
+		return "", err
+	}
+	return resp.State, nil
+}
 
-		// Filter out destroyed/expunging instances; garm is not interested in them.
-		state := strings.ToLower(vm.State)
-		if state == "destroyed" || state == "expunging" {
-			slog.Debug("ListInstancesByPool: skipping destroyed/expunging VM",
-				"vm_name", vm.Name,
-				"vm_id", vm.Id,
-				"state", vm.State)
-			continue
-		}
-		out = append(out, vm)
+// rebootVirtualMachine reboots a VM and returns its final state, polling the
+// reboot job every power_poll_interval when one is configured.
+func (c *CloudStackCli) rebootVirtualMachine(ctx context.Context, p *cs.RebootVirtualMachineParams) (string, error) {
+	resp, err := runVMJob(ctx, c, c.cfg.GetPowerPollInterval(), p,
+		cs.VirtualMachineServiceIface.RebootVirtualMachine,
+		func(r *cs.RebootVirtualMachineResponse) string { return r.JobID })
+	if err != nil {
+		return "", err
 	}
+	return resp.State, nil
+}
 
-	slog.Debug("ListInstancesByPool: completed",
-		"controller_id", controllerID,
-		"pool_id", poolID,
-		"returned_count", len(out))
-	return out, nil
+// migrateVirtualMachine live-migrates a VM, polling the migration job every
+// power_poll_interval when one is configured, or when operation_timeout is.
+func (c *CloudStackCli) migrateVirtualMachine(ctx context.Context, p *cs.MigrateVirtualMachineParams) error {
+	_, err := runVMJob(ctx, c, c.operationPollInterval(c.cfg.GetPowerPollInterval()), p,
+		cs.VirtualMachineServiceIface.MigrateVirtualMachine,
+		func(r *cs.MigrateVirtualMachineResponse) string { return r.JobID })
+	return err
 }
 
-func (c *CloudStackCli) StartInstance(ctx context.Context, identifier string) error {
-	vm, err := c.FindOneInstance(ctx, "", identifier)
+// runVMJob runs an async virtual machine API call. With no poll interval the
+// call goes through the regular client, which waits for the job itself.
+// Otherwise the call only starts the job, which is then polled every interval
+// with waitForJob, and its result is decoded into the response. If the wait
+// fails, the response of the call is returned with the error, as it already
+// carries the ID of the VM the job acts on.
+func runVMJob[P, R any](ctx context.Context, c *CloudStackCli, interval time.Duration, p P,
+	call func(cs.VirtualMachineServiceIface, P) (R, error), jobID func(R) string) (R, error) {
+	if interval == 0 {
+		return call(c.client.VirtualMachine, p)
+	}
+	var zero R
+	resp, err := call(c.jobs.VirtualMachine, p)
 	if err != nil {
-		return err
+		return zero, err
 	}
-	params := c.client.VirtualMachine.NewStartVirtualMachineParams(vm.Id)
-	if _, err := c.client.VirtualMachine.StartVirtualMachine(params); err != nil {
-		return fmt.Errorf("failed to start instance: %w", err)
+	if err := c.waitForJob(ctx, jobID(resp), interval, resp); err != nil {
+		return resp, err
 	}
-	return nil
+	return resp, nil
 }
 
-func (c *CloudStackCli) StopInstance(ctx context.Context, identifier string, force bool) error {
-	vm, err := c.FindOneInstance(ctx, "", identifier)
-	if err != nil {
-		if errors.Is(err, garmErrors.ErrNotFound) {
-			return nil
+// waitForJob polls an async job every interval until it finishes or
+// async_timeout passes, and decodes the job result into out. Failed jobs are
+// reported with the same errors as the async client, so util.ParseCloudStackError
+// and the error classifiers work on them unchanged.
+func (c *CloudStackCli) waitForJob(ctx context.Context, jobID string, interval time.Duration, out any) error {
+	deadline := time.Now().Add(time.Duration(c.cfg.GetAsyncTimeout()) * time.Second)
+	for {
+		r, err := c.jobs.Asyncjob.QueryAsyncJobResult(c.jobs.Asyncjob.NewQueryAsyncJobResultParams(jobID))
+		if err != nil {
+			return err
 		}
-		return err
-	}
-	params := c.client.VirtualMachine.NewStopVirtualMachineParams(vm.Id)
-	params.SetForced(force)
-	if _, err := c.client.VirtualMachine.StopVirtualMachine(params); err != nil {
-		if util.IsCloudStackNotFoundErr(err) {
+		switch r.Jobstatus {
+		case 1:
+			var result map[string]json.RawMessage
+			if err := json.Unmarshal(r.Jobresult, &result); err != nil {
+				return fmt.Errorf("failed to decode result of job %s: %w", jobID, err)
+			}
+			for _, v := range result {
+				if err := json.Unmarshal(v, out); err != nil {
+					return fmt.Errorf("failed to decode result of job %s: %w", jobID, err)
+				}
+			}
 			return nil
+		case 2:
+			if r.Jobresulttype == "text" {
+				return errors.New(string(r.Jobresult))
+			}
+			return fmt.Errorf("Undefined error: %s", string(r.Jobresult))
+		}
+		if time.Now().After(deadline) {
+			return cs.AsyncTimeoutErr
+		}
+		slog.Debug("waitForJob: job still running",
+			"job_id", jobID,
+			"interval", interval)
+		if err := sleepWithContext(ctx, interval); err != nil {
+			return err
 		}
-		return fmt.Errorf("failed to stop instance: %w", err)
 	}
-	return nil
 }
 
-func (c *CloudStackCli) DestroyInstance(ctx context.Context, identifier string, expunge bool) error {
+// sleepWithContext waits for the given duration or until the context is done.
+func sleepWithContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// GetInstancePassword returns the password of a VM deployed from a
+// password-enabled template. CloudStack encrypts it with the public key of the
+// VM's SSH keypair; it is decrypted with ssh_private_key_path. The password is
+// only returned, never stored.
+func (c *CloudStackCli) GetInstancePassword(ctx context.Context, identifier string) (string, error) {
+	key, err := c.cfg.LoadSSHPrivateKey()
+	if err != nil {
+		return "", err
+	}
 	vm, err := c.FindOneInstance(ctx, "", identifier)
 	if err != nil {
-		if errors.Is(err, garmErrors.ErrNotFound) {
-			return nil
-		}
-		return err
+		return "", err
 	}
-	params := c.client.VirtualMachine.NewDestroyVirtualMachineParams(vm.Id)
-	if expunge {
-		params.SetExpunge(true)
+
+	// The typed GetVMPassword call doesn't unwrap the "password" object of the
+	// response, so use a custom request instead.
+	custom, ok := c.client.Custom.(*cs.CustomService)
+	if !ok {
+		return "", fmt.Errorf("custom API requests are not supported by this client")
 	}
-	if _, err := c.client.VirtualMachine.DestroyVirtualMachine(params); err != nil {
-		if util.IsCloudStackNotFoundErr(err) {
-			return nil
-		}
-		return fmt.Errorf("failed to destroy instance: %w", err)
+	p := &cs.CustomServiceParams{}
+	p.SetParam("id", vm.Id)
+	var resp struct {
+		Password struct {
+			Encryptedpassword string `json:"encryptedpassword"`
+		} `json:"password"`
 	}
-	return nil
+	if err := custom.CustomRequest("getVMPassword", p, &resp); err != nil {
+		return "", fmt.Errorf("failed to get password of instance %s: %w", vm.Id, err)
+	}
+	if resp.Password.Encryptedpassword == "" {
+		return "", fmt.Errorf("instance %s has no password", vm.Id)
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(resp.Password.Encryptedpassword)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode password of instance %s: %w", vm.Id, err)
+	}
+	password, err := rsa.DecryptPKCS1v15(nil, key, encrypted)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt password of instance %s: %w", vm.Id, err)
+	}
+	return string(password), nil
 }
 
 // ResolveServiceOffering resolves a service offering name or UUID to a UUID.
@@ -319,11 +3032,19 @@ func (c *CloudStackCli) ResolveServiceOffering(nameOrID string) (string, error)
 	if cs.IsID(nameOrID) {
 		return nameOrID, nil
 	}
-	so, _, err := c.client.ServiceOffering.GetServiceOfferingByName(nameOrID)
+	id, err := c.cfg.LookupServiceOffering(c.client, nameOrID)
 	if err != nil {
 		return "", fmt.Errorf("failed to resolve service_offering %q: %w", nameOrID, err)
 	}
-	return so.Id, nil
+	return id, nil
+}
+
+// ResolveProject resolves a project name or UUID to a UUID.
+func (c *CloudStackCli) ResolveProject(nameOrID string) (string, error) {
+	if nameOrID == "" {
+		return "", fmt.Errorf("empty project")
+	}
+	return config.LookupProject(c.client, nameOrID)
 }
 
 // ResolveTemplate resolves a template name or UUID to a UUID.
@@ -335,7 +3056,7 @@ func (c *CloudStackCli) ResolveTemplate(nameOrID, zoneID, projectID string) (str
 	if cs.IsID(nameOrID) {
 		return nameOrID, nil
 	}
-	p := c.client.Template.NewListTemplatesParams("executable")
+	p := c.client.Template.NewListTemplatesParams(c.cfg.GetTemplateFilter())
 	p.SetName(nameOrID)
 	if zoneID != "" {
 		p.SetZoneid(zoneID)
@@ -353,6 +3074,62 @@ func (c *CloudStackCli) ResolveTemplate(nameOrID, zoneID, projectID string) (str
 	return resp.Templates[0].Id, nil
 }
 
+// TemplateInfo describes a deployable template for discovery. Many templates
+// share a name, so the display text, zone and hypervisor are included to tell
+// them apart when picking one for the config.
+type TemplateInfo struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayText string `json:"display_text"`
+	ZoneID      string `json:"zone_id"`
+	ZoneName    string `json:"zone_name"`
+	Hypervisor  string `json:"hypervisor"`
+	OSType      string `json:"os_type"`
+	Ready       bool   `json:"ready"`
+}
+
+// ListTemplates returns the templates matching template_filter in a zone (all
+// zones if zoneID is empty) and the configured project, sorted by name and zone.
+// Templates without a display text report their name instead.
+func (c *CloudStackCli) ListTemplates(ctx context.Context, zoneID string) ([]TemplateInfo, error) {
+	p := c.client.Template.NewListTemplatesParams(c.cfg.GetTemplateFilter())
+	if zoneID != "" {
+		p.SetZoneid(zoneID)
+	}
+	if c.cfg.ProjectID() != "" {
+		p.SetProjectid(c.cfg.ProjectID())
+	}
+	resp, err := c.client.Template.ListTemplates(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+
+	out := make([]TemplateInfo, 0, len(resp.Templates))
+	for _, tmpl := range resp.Templates {
+		displayText := tmpl.Displaytext
+		if displayText == "" {
+			displayText = tmpl.Name
+		}
+		out = append(out, TemplateInfo{
+			ID:          tmpl.Id,
+			Name:        tmpl.Name,
+			DisplayText: displayText,
+			ZoneID:      tmpl.Zoneid,
+			ZoneName:    tmpl.Zonename,
+			Hypervisor:  tmpl.Hypervisor,
+			OSType:      tmpl.Ostypename,
+			Ready:       tmpl.Isready,
+		})
+	}
+	slices.SortFunc(out, func(a, b TemplateInfo) int {
+		if n := strings.Compare(a.Name, b.Name); n != 0 {
+			return n
+		}
+		return strings.Compare(a.ZoneName, b.ZoneName)
+	})
+	return out, nil
+}
+
 // ResolveVPC resolves a VPC name or UUID to a UUID.
 // If the input is already a UUID, it's returned as-is.
 func (c *CloudStackCli) ResolveVPC(nameOrID, zoneID, projectID string) (string, error) {
@@ -442,18 +3219,72 @@ func (c *CloudStackCli) ResolveNetwork(nameOrID, zoneID, projectID string) (stri
 }
 
 // ResolveNetworks resolves a list of network names or UUIDs to UUIDs.
-// Supports "vpc-name/network-name" syntax for VPC-scoped networks.
+// Supports "vpc-name/network-name" syntax for VPC-scoped networks. Plain
+// names are resolved with a single listNetworks call; names that match no
+// network or more than one are reported together in one error.
 func (c *CloudStackCli) ResolveNetworks(namesOrIDs []string, zoneID, projectID string) ([]string, error) {
 	if len(namesOrIDs) == 0 {
 		return nil, nil
 	}
-	resolved := make([]string, 0, len(namesOrIDs))
-	for _, nameOrID := range namesOrIDs {
-		id, err := c.ResolveNetwork(nameOrID, zoneID, projectID)
-		if err != nil {
-			return nil, err
+	resolved := make([]string, len(namesOrIDs))
+	var names []string
+	for i, nameOrID := range namesOrIDs {
+		idx := strings.Index(nameOrID, "/")
+		if nameOrID == "" || cs.IsID(nameOrID) || (idx > 0 && idx < len(nameOrID)-1) {
+			id, err := c.ResolveNetwork(nameOrID, zoneID, projectID)
+			if err != nil {
+				return nil, err
+			}
+			resolved[i] = id
+			continue
+		}
+		names = append(names, nameOrID)
+	}
+	if len(names) == 0 {
+		return resolved, nil
+	}
+
+	p := c.client.Network.NewListNetworksParams()
+	p.SetListall(true)
+	p.SetCanusefordeploy(true)
+	if zoneID != "" {
+		p.SetZoneid(zoneID)
+	}
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	resp, err := c.client.Network.ListNetworks(p)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+	matches := make(map[string][]string, len(names))
+	for _, net := range resp.Networks {
+		matches[net.Name] = append(matches[net.Name], net.Id)
+	}
+
+	var missing, ambiguous []string
+	for i, nameOrID := range namesOrIDs {
+		if resolved[i] != "" {
+			continue
 		}
-		resolved = append(resolved, id)
+		switch ids := matches[nameOrID]; len(ids) {
+		case 1:
+			resolved[i] = ids[0]
+		case 0:
+			missing = append(missing, strconv.Quote(nameOrID))
+		default:
+			ambiguous = append(ambiguous, fmt.Sprintf("%q (%d networks)", nameOrID, len(ids)))
+		}
+	}
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, "networks not found: "+strings.Join(missing, ", "))
+	}
+	if len(ambiguous) > 0 {
+		problems = append(problems, "ambiguous network names: "+strings.Join(ambiguous, ", "))
+	}
+	if len(problems) > 0 {
+		return nil, errors.New(strings.Join(problems, "; "))
 	}
 	return resolved, nil
 }
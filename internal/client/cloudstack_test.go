@@ -0,0 +1,4739 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2024 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"maps"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cs "github.com/apache/cloudstack-go/v2/cloudstack"
+	"github.com/cloudbase/garm-provider-cloudstack/config"
+	"github.com/cloudbase/garm-provider-cloudstack/internal/spec"
+	"github.com/cloudbase/garm-provider-cloudstack/internal/util"
+	garmErrors "github.com/cloudbase/garm-provider-common/errors"
+	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testZoneID     = "11111111-1111-1111-1111-111111111111"
+	testOfferingID = "22222222-2222-2222-2222-222222222222"
+	testTemplateID = "33333333-3333-3333-3333-333333333333"
+	testVMID       = "44444444-4444-4444-4444-444444444444"
+)
+
+// fakeHandler answers a single CloudStack API command. Returning a *fakeAPIError
+// makes the fake respond with a CloudStack error payload.
+type fakeHandler func(params url.Values) (any, error)
+
+// fakeAPIError is a CloudStack API error returned by a fakeHandler.
+type fakeAPIError struct {
+	Code int
+	Text string
+}
+
+func (e *fakeAPIError) Error() string {
+	return e.Text
+}
+
+// fakeCloudStack is a minimal in-process CloudStack API used to exercise
+// CloudStackCli without a management server. Handlers are keyed by the
+// lowercased API command name. Commands registered with handleAsync return a
+// job ID that resolves immediately through queryAsyncJobResult.
+type fakeCloudStack struct {
+	t      *testing.T
+	server *httptest.Server
+
+	mu       sync.Mutex
+	handlers map[string]fakeHandler
+	async    map[string]bool
+	jobs     map[string]any
+	calls    map[string][]url.Values
+
+	// pending is how many polls the jobs of a command report themselves as
+	// still running for, set by delayJobs. polls tracks what is left per job.
+	pending map[string]int
+	polls   map[string]int
+}
+
+func newFakeCloudStack(t *testing.T) *fakeCloudStack {
+	t.Helper()
+	return newFakeCloudStackWith(t, httptest.NewServer)
+}
+
+// newFakeCloudStackTLS returns a fake served over HTTPS with a self-signed
+// certificate.
+func newFakeCloudStackTLS(t *testing.T) *fakeCloudStack {
+	t.Helper()
+	return newFakeCloudStackWith(t, httptest.NewTLSServer)
+}
+
+func newFakeCloudStackWith(t *testing.T, newServer func(http.Handler) *httptest.Server) *fakeCloudStack {
+	t.Helper()
+	f := &fakeCloudStack{
+		t:        t,
+		handlers: map[string]fakeHandler{},
+		async:    map[string]bool{},
+		jobs:     map[string]any{},
+		calls:    map[string][]url.Values{},
+		pending:  map[string]int{},
+		polls:    map[string]int{},
+	}
+	f.server = newServer(http.HandlerFunc(f.serveHTTP))
+	t.Cleanup(f.server.Close)
+	return f
+}
+
+func (f *fakeCloudStack) handle(command string, h fakeHandler) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[strings.ToLower(command)] = h
+}
+
+func (f *fakeCloudStack) handleAsync(command string, h fakeHandler) {
+	f.handle(command, h)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.async[strings.ToLower(command)] = true
+}
+
+// delayJobs makes the jobs of an async command report themselves as still
+// running for the given number of polls before they resolve.
+func (f *fakeCloudStack) delayJobs(command string, polls int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending[strings.ToLower(command)] = polls
+}
+
+// callsTo returns the parameters of every request made for the given command.
+func (f *fakeCloudStack) callsTo(command string) []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[strings.ToLower(command)]
+}
+
+func (f *fakeCloudStack) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	command := strings.ToLower(r.Form.Get("command"))
+	respKey := command + "response"
+
+	f.mu.Lock()
+	f.calls[command] = append(f.calls[command], r.Form)
+	if command == "queryasyncjobresult" {
+		jobID := r.Form.Get("jobid")
+		if f.polls[jobID] > 0 {
+			f.polls[jobID]--
+			f.mu.Unlock()
+			writeJSON(w, http.StatusOK, map[string]any{respKey: map[string]any{"jobid": jobID, "jobstatus": 0}})
+			return
+		}
+		result := f.jobs[jobID]
+		f.mu.Unlock()
+		writeJSON(w, http.StatusOK, map[string]any{respKey: map[string]any{
+			"jobstatus": 1,
+			"jobresult": map[string]any{"result": result},
+		}})
+		return
+	}
+	h, ok := f.handlers[command]
+	isAsync := f.async[command]
+	f.mu.Unlock()
+
+	if !ok {
+		f.t.Errorf("fake CloudStack: unexpected command %q", command)
+		writeJSON(w, 432, map[string]any{respKey: map[string]any{
+			"errorcode": 432, "errortext": "unknown command " + command,
+		}})
+		return
+	}
+
+	result, err := h(r.Form)
+	if err != nil {
+		code := 530
+		if apiErr, ok := err.(*fakeAPIError); ok && apiErr.Code != 0 {
+			code = apiErr.Code
+		}
+		writeJSON(w, code, map[string]any{respKey: map[string]any{
+			"errorcode": code, "cserrorcode": 9999, "errortext": err.Error(),
+		}})
+		return
+	}
+	if isAsync {
+		f.mu.Lock()
+		jobID := fmt.Sprintf("job-%d", len(f.jobs)+1)
+		f.jobs[jobID] = result
+		f.polls[jobID] = f.pending[command]
+		f.mu.Unlock()
+		// Like CloudStack, return the ID of the entity the job acts on along
+		// with the job ID.
+		started := map[string]any{"jobid": jobID}
+		if entity, ok := result.(map[string]any); ok && entity["id"] != nil {
+			started["id"] = entity["id"]
+		}
+		writeJSON(w, http.StatusOK, map[string]any{respKey: started})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{respKey: result})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func boolPtr(v bool) *bool { return &v }
+
+// listVMs builds a listVirtualMachines result from a set of VM objects.
+func listVMs(vms ...map[string]any) map[string]any {
+	if len(vms) == 0 {
+		return map[string]any{}
+	}
+	return map[string]any{"count": len(vms), "virtualmachine": vms}
+}
+
+// newTestCli returns a CloudStackCli pointed at the fake. The optional mutate
+// function can adjust the config before the client is built.
+func newTestCli(t *testing.T, f *fakeCloudStack, mutate func(cfg *config.Config)) *CloudStackCli {
+	t.Helper()
+	cfg := &config.Config{
+		APIURL:          f.server.URL,
+		APIKey:          "api-key",
+		Secret:          "secret",
+		Zone:            testZoneID,
+		ServiceOffering: testOfferingID,
+		Template:        testTemplateID,
+	}
+	cfg.SetResolvedIDs(testZoneID, testOfferingID, testTemplateID, "")
+	if mutate != nil {
+		mutate(cfg)
+	}
+	cli, err := NewCloudStackCli(cfg)
+	require.NoError(t, err)
+	return cli
+}
+
+// newTestRunnerSpec returns a minimal Linux runner spec that can be deployed against the fake.
+func newTestRunnerSpec() *spec.RunnerSpec {
+	filename := "actions-runner.tar.gz"
+	downloadURL := "https://example.com/actions-runner.tar.gz"
+	return &spec.RunnerSpec{
+		ZoneID:            testZoneID,
+		ServiceOfferingID: testOfferingID,
+		TemplateID:        testTemplateID,
+		Tools: params.RunnerApplicationDownload{
+			Filename:    &filename,
+			DownloadURL: &downloadURL,
+		},
+		BootstrapParams: params.BootstrapInstance{
+			Name:   "runner-1",
+			PoolID: "pool-1",
+			OSType: params.Linux,
+			OSArch: params.Amd64,
+		},
+		ControllerID: "controller-1",
+	}
+}
+
+// tagsFromParams decodes the tags of a createTags request.
+func tagsFromParams(p url.Values) map[string]string {
+	tags := map[string]string{}
+	for i := 0; p.Has(fmt.Sprintf("tags[%d].key", i)); i++ {
+		tags[p.Get(fmt.Sprintf("tags[%d].key", i))] = p.Get(fmt.Sprintf("tags[%d].value", i))
+	}
+	return tags
+}
+
+// handleServiceOffering registers a listServiceOfferings handler that returns
+// a standard 2 vCPU / 4096 MB offering for any ID.
+func handleServiceOffering(f *fakeCloudStack) {
+	f.handle("listServiceOfferings", func(p url.Values) (any, error) {
+		return map[string]any{"count": 1, "serviceoffering": []map[string]any{{
+			"id": p.Get("id"), "name": "2-4096", "cpunumber": 2, "memory": 4096,
+		}}}, nil
+	})
+}
+
+// handleZone registers a listZones handler that returns testZoneID with the
+// given network type.
+func handleZone(f *fakeCloudStack, networkType string, securityGroups bool) {
+	f.handle("listZones", func(url.Values) (any, error) {
+		return map[string]any{"count": 1, "zone": []map[string]any{{
+			"id": testZoneID, "name": "zone1", "networktype": networkType,
+			"securitygroupsenabled": securityGroups,
+		}}}, nil
+	})
+}
+
+// handleDedication registers a listAffinityGroups handler that returns the
+// ExplicitDedication group with the given ID, or no group if it is empty.
+func handleDedication(f *fakeCloudStack, groupID string) {
+	f.handle("listAffinityGroups", func(url.Values) (any, error) {
+		if groupID == "" {
+			return map[string]any{}, nil
+		}
+		return map[string]any{"count": 1, "affinitygroup": []map[string]any{{
+			"id": groupID, "name": "DedicatedGrp-ci", "type": "ExplicitDedication",
+		}}}, nil
+	})
+}
+
+// handleDeploy registers successful listServiceOfferings, deployVirtualMachine
+// and createTags handlers, and no dedicated resources.
+func handleDeploy(f *fakeCloudStack) {
+	handleServiceOffering(f)
+	handleDedication(f, "")
+	handleZone(f, "Advanced", true)
+	f.handleAsync("deployVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{"id": testVMID, "name": p.Get("name"), "state": "Running"}, nil
+	})
+	f.handleAsync("createTags", func(url.Values) (any, error) {
+		return map[string]any{"success": true}, nil
+	})
+}
+
+func TestDestroyInstanceRetriesExpungeInProgress(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running"}), nil
+	})
+	attempts := 0
+	f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+		attempts++
+		if attempts < 3 {
+			return nil, &fakeAPIError{Text: "Unable to destroy VM: another operation is in progress"}
+		}
+		return map[string]any{"id": p.Get("id"), "state": "Expunging"}, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.ExpungeRetryInterval = config.Duration{Duration: time.Millisecond}
+	})
+
+	require.NoError(t, cli.DestroyInstance(context.Background(), testVMID, true))
+	calls := f.callsTo("destroyVirtualMachine")
+	require.Len(t, calls, 3)
+	require.Equal(t, "true", calls[0].Get("expunge"))
+}
+
+func TestResolveNetworks(t *testing.T) {
+	const netID = "55555555-5555-5555-5555-555555555555"
+	tests := []struct {
+		name      string
+		networks  []string
+		want      []string
+		errString string
+	}{
+		{
+			name:     "all resolved",
+			networks: []string{"net-a", netID, "net-b"},
+			want:     []string{"net-a-id", netID, "net-b-id"},
+		},
+		{
+			name:      "some missing",
+			networks:  []string{"net-a", "net-x", "net-y"},
+			errString: `networks not found: "net-x", "net-y"`,
+		},
+		{
+			name:      "ambiguous",
+			networks:  []string{"net-a", "dup", "net-x"},
+			errString: `networks not found: "net-x"; ambiguous network names: "dup" (2 networks)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listNetworks", func(url.Values) (any, error) {
+				return map[string]any{"count": 4, "network": []map[string]any{
+					{"id": "net-a-id", "name": "net-a"},
+					{"id": "net-b-id", "name": "net-b"},
+					{"id": "dup-1", "name": "dup"},
+					{"id": "dup-2", "name": "dup"},
+				}}, nil
+			})
+			cli := newTestCli(t, f, nil)
+
+			got, err := cli.ResolveNetworks(tt.networks, testZoneID, "")
+			// All names are resolved with one listNetworks call.
+			calls := f.callsTo("listNetworks")
+			require.Len(t, calls, 1)
+			require.Equal(t, testZoneID, calls[0].Get("zoneid"))
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestOperationContext(t *testing.T) {
+	f := newFakeCloudStack(t)
+	cli := newTestCli(t, f, nil)
+	ctx, cancel := cli.OperationContext(context.Background())
+	defer cancel()
+	_, ok := ctx.Deadline()
+	require.False(t, ok)
+
+	interval := readinessPollInterval
+	readinessPollInterval = time.Millisecond
+	t.Cleanup(func() { readinessPollInterval = interval })
+
+	t.Run("create", func(t *testing.T) {
+		f := newFakeCloudStack(t)
+		handleDeploy(f)
+		f.handle("listVirtualMachines", func(url.Values) (any, error) {
+			return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Running"}), nil
+		})
+		f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+			return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+		})
+		cli := newTestCli(t, f, func(cfg *config.Config) {
+			// The readiness wait alone would fit in its own timeout, but not in
+			// the overall budget.
+			cfg.ReadinessTag = "GARM_READY"
+			cfg.ReadinessTimeout.Duration = time.Hour
+			cfg.OperationTimeout.Duration = 100 * time.Millisecond
+		})
+
+		ctx, cancel := cli.OperationContext(context.Background())
+		defer cancel()
+		_, err := cli.CreateRunningInstance(ctx, newTestRunnerSpec())
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		// The VM of the aborted create is still cleaned up.
+		require.Len(t, f.callsTo("destroyVirtualMachine"), 1)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		f := newFakeCloudStack(t)
+		f.handle("listVirtualMachines", func(url.Values) (any, error) {
+			return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running"}), nil
+		})
+		f.handleAsync("destroyVirtualMachine", func(url.Values) (any, error) {
+			return nil, &fakeAPIError{Text: "Unable to destroy VM: another operation is in progress"}
+		})
+		cli := newTestCli(t, f, func(cfg *config.Config) {
+			cfg.ExpungeRetryInterval.Duration = time.Hour
+			cfg.OperationTimeout.Duration = 100 * time.Millisecond
+		})
+
+		ctx, cancel := cli.OperationContext(context.Background())
+		defer cancel()
+		err := cli.DestroyInstance(ctx, testVMID, true)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Len(t, f.callsTo("destroyVirtualMachine"), 1)
+	})
+}
+
+func TestOperationTimeoutPollsJobs(t *testing.T) {
+	interval := operationJobPollInterval
+	operationJobPollInterval = 5 * time.Millisecond
+	t.Cleanup(func() { operationJobPollInterval = interval })
+
+	t.Run("deploy", func(t *testing.T) {
+		f := newFakeCloudStack(t)
+		handleDeploy(f)
+		f.delayJobs("deployVirtualMachine", 1000)
+		f.handle("listVirtualMachines", func(url.Values) (any, error) {
+			return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Starting"}), nil
+		})
+		f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+			return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+		})
+		cli := newTestCli(t, f, func(cfg *config.Config) {
+			cfg.OperationTimeout.Duration = 50 * time.Millisecond
+		})
+
+		ctx, cancel := cli.OperationContext(context.Background())
+		defer cancel()
+		start := time.Now()
+		_, err := cli.CreateRunningInstance(ctx, newTestRunnerSpec())
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		// Without polling, the client would wait for the job until
+		// async_timeout, ignoring the deadline.
+		require.Less(t, time.Since(start), time.Second)
+		require.Greater(t, len(f.callsTo("queryAsyncJobResult")), 1)
+		// The deploy returned the VM ID before its job timed out, so the VM
+		// is destroyed instead of being left running untagged.
+		destroys := f.callsTo("destroyVirtualMachine")
+		require.Len(t, destroys, 1)
+		require.Equal(t, testVMID, destroys[0].Get("id"))
+		require.Empty(t, f.callsTo("createTags"))
+	})
+
+	t.Run("destroy", func(t *testing.T) {
+		f := newFakeCloudStack(t)
+		f.delayJobs("destroyVirtualMachine", 1000)
+		f.handle("listVirtualMachines", func(url.Values) (any, error) {
+			return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running"}), nil
+		})
+		f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+			return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+		})
+		cli := newTestCli(t, f, func(cfg *config.Config) {
+			cfg.OperationTimeout.Duration = 50 * time.Millisecond
+		})
+
+		ctx, cancel := cli.OperationContext(context.Background())
+		defer cancel()
+		start := time.Now()
+		err := cli.DestroyInstance(ctx, testVMID, false)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(start), time.Second)
+		require.Greater(t, len(f.callsTo("queryAsyncJobResult")), 1)
+	})
+}
+
+func TestDeployPollInterval(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	f.delayJobs("deployVirtualMachine", 2)
+
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.DeployPollInterval = config.Duration{Duration: 20 * time.Millisecond}
+	})
+
+	start := time.Now()
+	id, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+	require.NoError(t, err)
+	elapsed := time.Since(start)
+	require.Equal(t, testVMID, id)
+
+	// Two pending polls at 20ms each; the client's own backoff would have
+	// waited 1s and then 2s.
+	var deployPolls int
+	for _, call := range f.callsTo("queryAsyncJobResult") {
+		if call.Get("jobid") == "job-1" {
+			deployPolls++
+		}
+	}
+	require.Equal(t, 3, deployPolls)
+	require.GreaterOrEqual(t, elapsed, 40*time.Millisecond)
+	require.Less(t, elapsed, time.Second)
+}
+
+func TestDeployPollIntervalCleansUpAbandonedDeploy(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	f.delayJobs("deployVirtualMachine", 1000)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Starting"}), nil
+	})
+	f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.DeployPollInterval = config.Duration{Duration: 10 * time.Millisecond}
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := cli.CreateRunningInstance(ctx, newTestRunnerSpec())
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	destroys := f.callsTo("destroyVirtualMachine")
+	require.Len(t, destroys, 1)
+	require.Equal(t, testVMID, destroys[0].Get("id"))
+	require.Empty(t, f.callsTo("createTags"))
+}
+
+func TestDeletePollInterval(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.delayJobs("destroyVirtualMachine", 2)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running"}), nil
+	})
+	f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.DeletePollInterval = config.Duration{Duration: 20 * time.Millisecond}
+	})
+
+	start := time.Now()
+	require.NoError(t, cli.DestroyInstance(context.Background(), testVMID, false))
+	elapsed := time.Since(start)
+
+	require.Len(t, f.callsTo("queryAsyncJobResult"), 3)
+	require.GreaterOrEqual(t, elapsed, 40*time.Millisecond)
+	require.Less(t, elapsed, time.Second)
+}
+
+func TestDeletePollIntervalHonorsContext(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.delayJobs("destroyVirtualMachine", 1000)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running"}), nil
+	})
+	f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.DeletePollInterval = config.Duration{Duration: time.Hour}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := cli.DestroyInstance(ctx, testVMID, false)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Len(t, f.callsTo("queryAsyncJobResult"), 1)
+}
+
+func TestPowerOperationsPollJobs(t *testing.T) {
+	ops := []struct {
+		name  string
+		cmd   string
+		state string
+		call  func(*CloudStackCli) error
+	}{
+		{"start", "startVirtualMachine", "Running", func(cli *CloudStackCli) error {
+			return cli.StartInstance(context.Background(), testVMID)
+		}},
+		{"stop", "stopVirtualMachine", "Stopped", func(cli *CloudStackCli) error {
+			return cli.StopInstance(context.Background(), testVMID, false)
+		}},
+		{"restart", "rebootVirtualMachine", "Running", func(cli *CloudStackCli) error {
+			return cli.RestartInstance(context.Background(), testVMID)
+		}},
+	}
+	for _, op := range ops {
+		t.Run(op.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.delayJobs(op.cmd, 2)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running"}), nil
+			})
+			f.handleAsync(op.cmd, func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": op.state}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.PowerPollInterval = config.Duration{Duration: 10 * time.Millisecond}
+			})
+			require.NoError(t, op.call(cli))
+			require.Len(t, f.callsTo(op.cmd), 1)
+			require.Len(t, f.callsTo("queryAsyncJobResult"), 3)
+		})
+	}
+}
+
+func TestPowerOperationsCheckFinalState(t *testing.T) {
+	for _, interval := range []time.Duration{0, 10 * time.Millisecond} {
+		t.Run(interval.String(), func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Stopped"}), nil
+			})
+			f.handleAsync("startVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Stopped"}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.PowerPollInterval = config.Duration{Duration: interval}
+			})
+			err := cli.StartInstance(context.Background(), testVMID)
+			require.ErrorContains(t, err, `is "Stopped" after start, expected "Running"`)
+		})
+	}
+}
+
+func TestPowerOperationsFailedJob(t *testing.T) {
+	for _, interval := range []time.Duration{0, 10 * time.Millisecond} {
+		t.Run(interval.String(), func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running"}), nil
+			})
+			f.handleAsync("stopVirtualMachine", func(url.Values) (any, error) {
+				return nil, &fakeAPIError{Code: 530, Text: "host is unreachable"}
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.PowerPollInterval = config.Duration{Duration: interval}
+			})
+			err := cli.StopInstance(context.Background(), testVMID, true)
+			require.ErrorContains(t, err, "host is unreachable")
+			require.Equal(t, "true", f.callsTo("stopVirtualMachine")[0].Get("forced"))
+		})
+	}
+}
+
+func TestEnsurePowerState(t *testing.T) {
+	interval := powerStatePollInterval
+	powerStatePollInterval = time.Millisecond
+	t.Cleanup(func() { powerStatePollInterval = interval })
+
+	tests := []struct {
+		name      string
+		state     string
+		settledAt int
+		desired   params.InstanceStatus
+		wantCmd   string
+		errString string
+	}{
+		{name: "already running", state: "Running", desired: params.InstanceRunning},
+		{name: "already starting", state: "Starting", desired: params.InstanceRunning},
+		{name: "already stopped", state: "Stopped", desired: params.InstanceStopped},
+		{name: "already stopping", state: "Stopping", desired: params.InstanceStopped},
+		{name: "start", state: "Stopped", desired: params.InstanceRunning, wantCmd: "startVirtualMachine"},
+		{name: "stop", state: "Running", desired: params.InstanceStopped, wantCmd: "stopVirtualMachine"},
+		{name: "start once stopped", state: "Stopping", settledAt: 3, desired: params.InstanceRunning, wantCmd: "startVirtualMachine"},
+		{name: "stop once started", state: "Starting", settledAt: 2, desired: params.InstanceStopped, wantCmd: "stopVirtualMachine"},
+		{name: "stuck state", state: "Error", desired: params.InstanceRunning, errString: "cannot bring instance " + testVMID + " from state Error to running"},
+		{name: "invalid desired state", state: "Running", desired: params.InstanceError, errString: `invalid desired power state "error": must be running or stopped`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			lookups := 0
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				lookups++
+				state := tt.state
+				if tt.settledAt > 0 && lookups >= tt.settledAt {
+					state = map[string]string{"Stopping": "Stopped", "Starting": "Running"}[state]
+				}
+				return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": state}), nil
+			})
+			f.handleAsync("startVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Running"}, nil
+			})
+			f.handleAsync("stopVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Stopped"}, nil
+			})
+			cli := newTestCli(t, f, nil)
+
+			err := cli.EnsurePowerState(context.Background(), "runner", tt.desired)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+			} else {
+				require.NoError(t, err)
+			}
+			for _, cmd := range []string{"startVirtualMachine", "stopVirtualMachine"} {
+				if cmd == tt.wantCmd {
+					require.Len(t, f.callsTo(cmd), 1)
+					require.Equal(t, testVMID, f.callsTo(cmd)[0].Get("id"))
+				} else {
+					require.Empty(t, f.callsTo(cmd))
+				}
+			}
+		})
+	}
+}
+
+func TestWaitForVMState(t *testing.T) {
+	tests := []struct {
+		name      string
+		runningAt int
+		opts      VMStateOptions
+		canceled  bool
+		wantState string
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "already satisfied", runningAt: 1, opts: VMStateOptions{Interval: time.Millisecond}, wantState: "Running", wantCalls: 1},
+		{name: "satisfied after polling", runningAt: 3, opts: VMStateOptions{Interval: time.Millisecond, Backoff: 2, MaxInterval: 2 * time.Millisecond}, wantState: "Running", wantCalls: 3},
+		{name: "timeout", opts: VMStateOptions{Interval: time.Millisecond, Timeout: 20 * time.Millisecond}, wantState: "Starting", wantErr: context.DeadlineExceeded},
+		{name: "attempts exhausted", opts: VMStateOptions{Interval: time.Millisecond, Attempts: 2}, wantState: "Starting", wantCalls: 2, wantErr: ErrVMStateNotReached},
+		{name: "context canceled", opts: VMStateOptions{Interval: time.Minute}, canceled: true, wantState: "Starting", wantCalls: 1, wantErr: context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			calls := 0
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				calls++
+				state := "Starting"
+				if tt.runningAt > 0 && calls >= tt.runningAt {
+					state = "Running"
+				}
+				if tt.canceled {
+					cancel()
+				}
+				return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": state}), nil
+			})
+			cli := newTestCli(t, f, nil)
+
+			running := func(vm *cs.VirtualMachine) bool { return vm.State == "Running" }
+			start := time.Now()
+			vm, err := cli.WaitForVMState(ctx, testVMID, running, tt.opts)
+			require.Less(t, time.Since(start), time.Second)
+			require.NotNil(t, vm)
+			require.Equal(t, tt.wantState, vm.State)
+			if tt.wantCalls > 0 {
+				require.Equal(t, tt.wantCalls, calls)
+			}
+			if tt.wantErr == nil {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrVMStateNotReached)
+			require.ErrorIs(t, err, tt.wantErr)
+		})
+	}
+
+	t.Run("lookup error", func(t *testing.T) {
+		f := newFakeCloudStack(t)
+		f.handle("listVirtualMachines", func(url.Values) (any, error) {
+			return listVMs(), nil
+		})
+		cli := newTestCli(t, f, nil)
+
+		vm, err := cli.WaitForVMState(context.Background(), testVMID, func(*cs.VirtualMachine) bool { return true }, VMStateOptions{Interval: time.Millisecond})
+		require.Nil(t, vm)
+		require.ErrorIs(t, err, garmErrors.ErrNotFound)
+		require.NotErrorIs(t, err, ErrVMStateNotReached)
+	})
+}
+
+func TestDestroyInstanceWaitsToExpunge(t *testing.T) {
+	f := newFakeCloudStack(t)
+	lookups := 0
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		lookups++
+		state := "Stopping"
+		if lookups >= 3 {
+			state = "Stopped"
+		}
+		return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": state}), nil
+	})
+	f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+		// The VM is expunged only once it has settled.
+		require.GreaterOrEqual(t, lookups, 3)
+		return map[string]any{"id": p.Get("id"), "state": "Expunging"}, nil
+	})
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.ExpungeRetryInterval = config.Duration{Duration: time.Millisecond}
+	})
+
+	require.NoError(t, cli.DestroyInstance(context.Background(), testVMID, true))
+	require.Equal(t, 3, lookups)
+	require.Len(t, f.callsTo("destroyVirtualMachine"), 1)
+}
+
+func TestDestroyInstanceExpungeRetryBounded(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running"}), nil
+	})
+	f.handleAsync("destroyVirtualMachine", func(url.Values) (any, error) {
+		return nil, &fakeAPIError{Text: "another operation is in progress"}
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.ExpungeRetries = 2
+		cfg.ExpungeRetryInterval = config.Duration{Duration: time.Millisecond}
+	})
+
+	err := cli.DestroyInstance(context.Background(), testVMID, true)
+	require.ErrorContains(t, err, "operation is in progress")
+	require.Len(t, f.callsTo("destroyVirtualMachine"), 3)
+}
+
+func TestDestroyInstancePermanentFailureNotRetried(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running"}), nil
+	})
+	f.handleAsync("destroyVirtualMachine", func(url.Values) (any, error) {
+		return nil, &fakeAPIError{Code: 431, Text: "permission denied"}
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.ExpungeRetryInterval = config.Duration{Duration: time.Millisecond}
+	})
+
+	err := cli.DestroyInstance(context.Background(), testVMID, true)
+	require.ErrorContains(t, err, "permission denied")
+	require.Len(t, f.callsTo("destroyVirtualMachine"), 1)
+}
+
+func TestMigrateInstance(t *testing.T) {
+	const hostID = "55555555-5555-5555-5555-555555555555"
+
+	tests := []struct {
+		name       string
+		hostZoneID string
+		errString  string
+		migrated   bool
+	}{
+		{
+			name:       "host in same zone",
+			hostZoneID: testZoneID,
+			migrated:   true,
+		},
+		{
+			name:       "host in another zone",
+			hostZoneID: "66666666-6666-6666-6666-666666666666",
+			errString:  "target host " + hostID + " is in zone 66666666-6666-6666-6666-666666666666",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running", "zoneid": testZoneID, "hostid": "old-host"}), nil
+			})
+			f.handle("listHosts", func(url.Values) (any, error) {
+				return map[string]any{"count": 1, "host": []map[string]any{{"id": hostID, "zoneid": tt.hostZoneID}}}, nil
+			})
+			f.handleAsync("migrateVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("virtualmachineid"), "hostid": p.Get("hostid")}, nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			err := cli.MigrateInstance(context.Background(), testVMID, hostID)
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+			} else {
+				require.NoError(t, err)
+			}
+
+			calls := f.callsTo("migrateVirtualMachine")
+			if !tt.migrated {
+				require.Empty(t, calls)
+				return
+			}
+			require.Len(t, calls, 1)
+			require.Equal(t, testVMID, calls[0].Get("virtualmachineid"))
+			require.Equal(t, hostID, calls[0].Get("hostid"))
+		})
+	}
+}
+
+func TestMigrateInstancePollsJob(t *testing.T) {
+	const hostID = "55555555-5555-5555-5555-555555555555"
+	newFake := func(t *testing.T, polls int) *fakeCloudStack {
+		f := newFakeCloudStack(t)
+		f.delayJobs("migrateVirtualMachine", polls)
+		f.handle("listVirtualMachines", func(url.Values) (any, error) {
+			return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running", "zoneid": testZoneID, "hostid": "old-host"}), nil
+		})
+		f.handle("listHosts", func(url.Values) (any, error) {
+			return map[string]any{"count": 1, "host": []map[string]any{{"id": hostID, "zoneid": testZoneID}}}, nil
+		})
+		f.handleAsync("migrateVirtualMachine", func(p url.Values) (any, error) {
+			return map[string]any{"id": p.Get("virtualmachineid"), "hostid": p.Get("hostid")}, nil
+		})
+		return f
+	}
+
+	t.Run("power_poll_interval", func(t *testing.T) {
+		f := newFake(t, 2)
+		cli := newTestCli(t, f, func(cfg *config.Config) {
+			cfg.PowerPollInterval = config.Duration{Duration: 10 * time.Millisecond}
+		})
+		require.NoError(t, cli.MigrateInstance(context.Background(), testVMID, hostID))
+		require.Len(t, f.callsTo("migrateVirtualMachine"), 1)
+		require.Len(t, f.callsTo("queryAsyncJobResult"), 3)
+	})
+
+	t.Run("operation_timeout", func(t *testing.T) {
+		interval := operationJobPollInterval
+		operationJobPollInterval = 5 * time.Millisecond
+		t.Cleanup(func() { operationJobPollInterval = interval })
+
+		f := newFake(t, 1000)
+		cli := newTestCli(t, f, func(cfg *config.Config) {
+			cfg.OperationTimeout.Duration = 50 * time.Millisecond
+		})
+		ctx, cancel := cli.OperationContext(context.Background())
+		defer cancel()
+		start := time.Now()
+		err := cli.MigrateInstance(ctx, testVMID, hostID)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		require.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestMigrateInstanceNotFound(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(), nil
+	})
+
+	cli := newTestCli(t, f, nil)
+	require.NoError(t, cli.MigrateInstance(context.Background(), testVMID, "55555555-5555-5555-5555-555555555555"))
+}
+
+func TestAttachISO(t *testing.T) {
+	const isoID = "55555555-5555-5555-5555-555555555555"
+
+	tests := []struct {
+		name      string
+		iso       string
+		isos      []map[string]any
+		errString string
+		attached  bool
+	}{
+		{
+			name:     "by name",
+			iso:      "virtio-win",
+			isos:     []map[string]any{{"id": isoID, "name": "virtio-win", "isready": true}},
+			attached: true,
+		},
+		{
+			name:     "by ID",
+			iso:      isoID,
+			isos:     []map[string]any{{"id": isoID, "name": "virtio-win", "isready": true}},
+			attached: true,
+		},
+		{
+			name:      "not in zone",
+			iso:       "virtio-win",
+			errString: `ISO "virtio-win" is not available in zone ` + testZoneID,
+		},
+		{
+			name:      "not ready",
+			iso:       "virtio-win",
+			isos:      []map[string]any{{"id": isoID, "name": "virtio-win", "isready": false}},
+			errString: "ISO " + isoID + " is not ready in zone " + testZoneID,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running", "zoneid": testZoneID}), nil
+			})
+			f.handle("listIsos", func(url.Values) (any, error) {
+				if len(tt.isos) == 0 {
+					return map[string]any{}, nil
+				}
+				return map[string]any{"count": len(tt.isos), "iso": tt.isos}, nil
+			})
+			f.handleAsync("attachIso", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("virtualmachineid"), "isoid": p.Get("id")}, nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			err := cli.AttachISO(context.Background(), testVMID, tt.iso)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+			} else {
+				require.NoError(t, err)
+			}
+
+			lookups := f.callsTo("listIsos")
+			require.Len(t, lookups, 1)
+			require.Equal(t, testZoneID, lookups[0].Get("zoneid"))
+			calls := f.callsTo("attachIso")
+			if !tt.attached {
+				require.Empty(t, calls)
+				return
+			}
+			require.Len(t, calls, 1)
+			require.Equal(t, testVMID, calls[0].Get("virtualmachineid"))
+			require.Equal(t, isoID, calls[0].Get("id"))
+		})
+	}
+}
+
+func TestDetachISO(t *testing.T) {
+	for _, isoID := range []string{"", "55555555-5555-5555-5555-555555555555"} {
+		f := newFakeCloudStack(t)
+		f.handle("listVirtualMachines", func(url.Values) (any, error) {
+			return listVMs(map[string]any{"id": testVMID, "name": "runner", "state": "Running", "isoid": isoID}), nil
+		})
+		f.handleAsync("detachIso", func(p url.Values) (any, error) {
+			return map[string]any{"id": p.Get("virtualmachineid")}, nil
+		})
+
+		cli := newTestCli(t, f, nil)
+		require.NoError(t, cli.DetachISO(context.Background(), testVMID))
+		calls := f.callsTo("detachIso")
+		if isoID == "" {
+			require.Empty(t, calls)
+			continue
+		}
+		require.Len(t, calls, 1)
+		require.Equal(t, testVMID, calls[0].Get("virtualmachineid"))
+	}
+}
+
+func TestCreateRunningInstanceFromSnapshot(t *testing.T) {
+	const snapshotID = "77777777-7777-7777-7777-777777777777"
+
+	tests := []struct {
+		name      string
+		snapshot  map[string]any
+		errString string
+	}{
+		{
+			name:     "snapshot in target zone",
+			snapshot: map[string]any{"id": snapshotID, "state": "BackedUp", "zoneid": testZoneID},
+		},
+		{
+			name:      "snapshot in another zone",
+			snapshot:  map[string]any{"id": snapshotID, "state": "BackedUp", "zoneid": "other-zone"},
+			errString: "snapshot " + snapshotID + " is in zone other-zone",
+		},
+		{
+			name:      "snapshot not backed up",
+			snapshot:  map[string]any{"id": snapshotID, "state": "Creating", "zoneid": testZoneID},
+			errString: "snapshot " + snapshotID + " is not ready (state Creating)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listSnapshots", func(url.Values) (any, error) {
+				return map[string]any{"count": 1, "snapshot": []map[string]any{tt.snapshot}}, nil
+			})
+			handleDeploy(f)
+
+			cli := newTestCli(t, f, nil)
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.SnapshotID = snapshotID
+
+			id, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+				require.Empty(t, f.callsTo("deployVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testVMID, id)
+
+			calls := f.callsTo("deployVirtualMachine")
+			require.Len(t, calls, 1)
+			require.Equal(t, snapshotID, calls[0].Get("snapshotid"))
+			require.False(t, calls[0].Has("templateid"))
+		})
+	}
+}
+
+func TestCloseWaitsForInFlightOperations(t *testing.T) {
+	cli := newTestCli(t, newFakeCloudStack(t), nil)
+
+	done, err := cli.beginOperation()
+	require.NoError(t, err)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- cli.Close(context.Background())
+	}()
+
+	select {
+	case <-closed:
+		t.Fatal("Close returned while an operation was still in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	done()
+	require.NoError(t, <-closed)
+
+	_, err = cli.beginOperation()
+	require.ErrorIs(t, err, ErrClosed)
+}
+
+func TestCloseContextExpires(t *testing.T) {
+	cli := newTestCli(t, newFakeCloudStack(t), nil)
+
+	done, err := cli.beginOperation()
+	require.NoError(t, err)
+	defer done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = cli.Close(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestCloseDuringFailingCreate(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Running"}), nil
+	})
+	f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+	})
+	cli := newTestCli(t, f, nil)
+
+	// Close starts while the create is tagging its VM, and the tagging fails.
+	closed := make(chan error, 1)
+	f.handleAsync("createTags", func(url.Values) (any, error) {
+		go func() { closed <- cli.Close(context.Background()) }()
+		require.Eventually(t, func() bool {
+			cli.opsMu.Lock()
+			defer cli.opsMu.Unlock()
+			return cli.closed
+		}, time.Second, time.Millisecond)
+		return nil, &fakeAPIError{Text: "tagging failed"}
+	})
+
+	_, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+	require.ErrorContains(t, err, "failed to tag VM")
+	require.NoError(t, <-closed)
+
+	// The cleanup of the failed create still went through.
+	destroys := f.callsTo("destroyVirtualMachine")
+	require.Len(t, destroys, 1)
+	require.Equal(t, testVMID, destroys[0].Get("id"))
+}
+
+func TestCreateRunningInstanceProjectFromLabel(t *testing.T) {
+	const labelProjectID = "66666666-6666-6666-6666-666666666666"
+	tests := []struct {
+		name        string
+		projectName string
+		wantProject string
+		wantLookups int
+	}{
+		{name: "label project name", projectName: "team-a", wantProject: labelProjectID, wantLookups: 1},
+		{name: "label project UUID", projectName: labelProjectID, wantProject: labelProjectID},
+		{name: "configured project", wantProject: "default-project-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listProjects", func(p url.Values) (any, error) {
+				return map[string]any{"count": 1, "project": []map[string]any{{"id": labelProjectID, "name": p.Get("name")}}}, nil
+			})
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.ProjectFromLabel = "cs-project" })
+
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.ProjectID = "default-project-id"
+			runnerSpec.ProjectName = tt.projectName
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			require.NoError(t, err)
+
+			lookups := f.callsTo("listProjects")
+			require.Len(t, lookups, tt.wantLookups)
+			if tt.wantLookups > 0 {
+				require.Equal(t, tt.projectName, lookups[0].Get("name"))
+			}
+			deploys := f.callsTo("deployVirtualMachine")
+			require.Len(t, deploys, 1)
+			require.Equal(t, tt.wantProject, deploys[0].Get("projectid"))
+		})
+	}
+}
+
+func TestProjectFromLabelLookups(t *testing.T) {
+	const labelProjectID = "66666666-6666-6666-6666-666666666666"
+	tests := []struct {
+		name          string
+		projectID     string
+		wantProjectID []string
+	}{
+		{name: "configured project", projectID: "default-project-id", wantProjectID: []string{"-1"}},
+		{name: "no configured project", wantProjectID: []string{"", "-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listProjects", func(p url.Values) (any, error) {
+				return map[string]any{"count": 1, "project": []map[string]any{{"id": labelProjectID, "name": p.Get("name")}}}, nil
+			})
+			var deployed bool
+			f.handleAsync("deployVirtualMachine", func(p url.Values) (any, error) {
+				deployed = true
+				return map[string]any{"id": testVMID, "name": p.Get("name"), "state": "Running"}, nil
+			})
+			// The VM only shows up when listing across projects.
+			f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+				if !deployed || p.Get("projectid") != "-1" {
+					return listVMs(), nil
+				}
+				return listVMs(map[string]any{
+					"id":        testVMID,
+					"name":      "runner-1",
+					"state":     "Running",
+					"projectid": labelProjectID,
+					"tags": []map[string]any{
+						{"key": "GARM_CONTROLLER_ID", "value": "controller-1"},
+						{"key": "GARM_POOL_ID", "value": "pool-1"},
+					},
+				}), nil
+			})
+			f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+			})
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.ProjectFromLabel = "cs-project"
+				cfg.Project = tt.projectID
+				cfg.SetResolvedIDs(testZoneID, testOfferingID, testTemplateID, tt.projectID)
+			})
+
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.ProjectID = tt.projectID
+			runnerSpec.ProjectName = "team-a"
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			require.NoError(t, err)
+			require.Equal(t, labelProjectID, f.callsTo("deployVirtualMachine")[0].Get("projectid"))
+
+			before := len(f.callsTo("listVirtualMachines"))
+			vms, err := cli.ListInstancesByPool(context.Background(), "controller-1", "pool-1")
+			require.NoError(t, err)
+			require.Len(t, vms, 1)
+			var projects []string
+			for _, call := range f.callsTo("listVirtualMachines")[before:] {
+				projects = append(projects, call.Get("projectid"))
+			}
+			require.Equal(t, tt.wantProjectID, projects)
+
+			require.NoError(t, cli.DestroyInstance(context.Background(), "runner-1", false))
+			destroyed := f.callsTo("destroyVirtualMachine")
+			require.Len(t, destroyed, 1)
+			require.Equal(t, testVMID, destroyed[0].Get("id"))
+		})
+	}
+}
+
+func TestTransientKeypair(t *testing.T) {
+	const publicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f runner"
+
+	t.Run("register on create", func(t *testing.T) {
+		f := newFakeCloudStack(t)
+		handleDeploy(f)
+		f.handle("registerSSHKeyPair", func(p url.Values) (any, error) {
+			return map[string]any{"keypair": map[string]any{"name": p.Get("name")}}, nil
+		})
+		cli := newTestCli(t, f, nil)
+
+		runnerSpec := newTestRunnerSpec()
+		runnerSpec.SSHPublicKey = publicKey
+		_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+		require.NoError(t, err)
+
+		registered := f.callsTo("registerSSHKeyPair")
+		require.Len(t, registered, 1)
+		require.Equal(t, "garm-transient-runner-1", registered[0].Get("name"))
+		require.Equal(t, publicKey, registered[0].Get("publickey"))
+		deploys := f.callsTo("deployVirtualMachine")
+		require.Len(t, deploys, 1)
+		require.Equal(t, "garm-transient-runner-1", deploys[0].Get("keypair"))
+	})
+
+	t.Run("deleted when deploy fails", func(t *testing.T) {
+		f := newFakeCloudStack(t)
+		handleServiceOffering(f)
+		handleZone(f, "Basic", false)
+		handleDedication(f, "")
+		f.handle("registerSSHKeyPair", func(p url.Values) (any, error) {
+			return map[string]any{"keypair": map[string]any{"name": p.Get("name")}}, nil
+		})
+		f.handle("deleteSSHKeyPair", func(url.Values) (any, error) {
+			return map[string]any{"success": true}, nil
+		})
+		f.handleAsync("deployVirtualMachine", func(url.Values) (any, error) {
+			return nil, &fakeAPIError{Code: 533, Text: "insufficient capacity"}
+		})
+		f.handle("listVirtualMachines", func(url.Values) (any, error) {
+			return listVMs(), nil
+		})
+		cli := newTestCli(t, f, nil)
+
+		runnerSpec := newTestRunnerSpec()
+		runnerSpec.SSHPublicKey = publicKey
+		_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+		require.Error(t, err)
+
+		deleted := f.callsTo("deleteSSHKeyPair")
+		require.Len(t, deleted, 1)
+		require.Equal(t, "garm-transient-runner-1", deleted[0].Get("name"))
+	})
+
+	t.Run("deleted with the VM of an abandoned deploy", func(t *testing.T) {
+		f := newFakeCloudStack(t)
+		handleDeploy(f)
+		f.delayJobs("deployVirtualMachine", 1000)
+		f.handle("registerSSHKeyPair", func(p url.Values) (any, error) {
+			return map[string]any{"keypair": map[string]any{"name": p.Get("name")}}, nil
+		})
+		f.handle("deleteSSHKeyPair", func(url.Values) (any, error) {
+			return map[string]any{"success": true}, nil
+		})
+		f.handle("listVirtualMachines", func(url.Values) (any, error) {
+			return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Starting", "keypairs": "garm-transient-runner-1"}), nil
+		})
+		f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+			return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+		})
+		cli := newTestCli(t, f, func(cfg *config.Config) {
+			cfg.DeployPollInterval = config.Duration{Duration: 10 * time.Millisecond}
+		})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		runnerSpec := newTestRunnerSpec()
+		runnerSpec.SSHPublicKey = publicKey
+		_, err := cli.CreateRunningInstance(ctx, runnerSpec)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+
+		// The VM is destroyed first, and its keypair with it.
+		require.Len(t, f.callsTo("destroyVirtualMachine"), 1)
+		deleted := f.callsTo("deleteSSHKeyPair")
+		require.Len(t, deleted, 1)
+		require.Equal(t, "garm-transient-runner-1", deleted[0].Get("name"))
+	})
+
+	t.Run("delete on destroy", func(t *testing.T) {
+		for _, keypair := range []string{"garm-transient-runner-1", "shared-key"} {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Running", "keypairs": keypair}), nil
+			})
+			f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+			})
+			f.handle("deleteSSHKeyPair", func(url.Values) (any, error) {
+				return map[string]any{"success": true}, nil
+			})
+			cli := newTestCli(t, f, nil)
+
+			require.NoError(t, cli.DestroyInstance(context.Background(), testVMID, false))
+			deleted := f.callsTo("deleteSSHKeyPair")
+			if keypair == "shared-key" {
+				// Keypairs not registered for the VM are left alone.
+				require.Empty(t, deleted)
+				continue
+			}
+			require.Len(t, deleted, 1)
+			require.Equal(t, keypair, deleted[0].Get("name"))
+		}
+	})
+}
+
+func TestGetInstanceRefreshIP(t *testing.T) {
+	interval := instanceRefreshInterval
+	instanceRefreshInterval = time.Millisecond
+	t.Cleanup(func() { instanceRefreshInterval = interval })
+
+	tests := []struct {
+		name      string
+		refresh   bool
+		ipOnCall  int
+		wantCalls int
+		wantIP    string
+	}{
+		{name: "disabled", ipOnCall: 2, wantCalls: 1},
+		{name: "IP on second call", refresh: true, ipOnCall: 2, wantCalls: 2, wantIP: "10.0.0.5"},
+		{name: "IP never assigned", refresh: true, wantCalls: 1 + instanceRefreshAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			calls := 0
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				calls++
+				vm := map[string]any{
+					"id":    testVMID,
+					"name":  "runner-1",
+					"state": "Running",
+					"tags":  []map[string]any{{"key": "GARM_CONTROLLER_ID", "value": "controller-1"}},
+				}
+				if tt.ipOnCall > 0 && calls >= tt.ipOnCall {
+					vm["nic"] = []map[string]any{{"ipaddress": "10.0.0.5"}}
+				}
+				return listVMs(vm), nil
+			})
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.RefreshInstanceIP = tt.refresh })
+
+			vm, err := cli.GetInstance(context.Background(), "controller-1", "runner-1")
+			require.NoError(t, err)
+			require.Equal(t, tt.wantCalls, calls)
+			if tt.wantIP == "" {
+				require.Empty(t, vm.Nic)
+				return
+			}
+			require.Len(t, vm.Nic, 1)
+			require.Equal(t, tt.wantIP, vm.Nic[0].Ipaddress)
+		})
+	}
+}
+
+func TestFindOneInstanceDuplicateNameRetries(t *testing.T) {
+	const oldVMID = "99999999-9999-9999-9999-999999999999"
+	interval := duplicateNameRetryInterval
+	duplicateNameRetryInterval = time.Millisecond
+	t.Cleanup(func() { duplicateNameRetryInterval = interval })
+
+	tests := []struct {
+		name      string
+		retries   int
+		settleAt  int
+		errString string
+	}{
+		{name: "no retries", retries: 0, settleAt: 2, errString: "found more than one instance with name runner"},
+		{name: "settles", retries: 3, settleAt: 2},
+		{name: "does not settle in time", retries: 1, settleAt: 3, errString: "found more than one instance with name runner"},
+		{name: "destroyed duplicate without retries", retries: 0, settleAt: 0},
+		{name: "destroyed duplicate is not retried", retries: 3, settleAt: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			lookups := 0
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				lookups++
+				oldState := "Running"
+				if lookups > tt.settleAt {
+					oldState = "Expunging"
+				}
+				return listVMs(
+					map[string]any{"id": oldVMID, "name": "runner", "state": oldState},
+					map[string]any{"id": testVMID, "name": "runner", "state": "Running"},
+				), nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.DuplicateNameRetries = tt.retries })
+			vm, err := cli.FindOneInstance(context.Background(), "", "runner")
+			require.Len(t, f.callsTo("listVirtualMachines"), min(tt.retries, tt.settleAt)+1)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testVMID, vm.Id)
+		})
+	}
+}
+
+func TestFindOneInstanceVerifiesController(t *testing.T) {
+	tests := []struct {
+		name         string
+		identifier   string
+		controllerID string
+		vmController string
+		wantNotFound bool
+	}{
+		{
+			name:         "by id with matching controller",
+			identifier:   testVMID,
+			controllerID: "controller-1",
+			vmController: "controller-1",
+		},
+		{
+			name:         "by id with foreign controller",
+			identifier:   testVMID,
+			controllerID: "controller-1",
+			vmController: "controller-2",
+			wantNotFound: true,
+		},
+		{
+			name:         "by name with foreign controller",
+			identifier:   "runner-1",
+			controllerID: "controller-1",
+			vmController: "controller-2",
+			wantNotFound: true,
+		},
+		{
+			name:         "no controller skips check",
+			identifier:   testVMID,
+			vmController: "controller-2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{
+					"id":    testVMID,
+					"name":  "runner-1",
+					"state": "Running",
+					"tags":  []map[string]any{{"key": "GARM_CONTROLLER_ID", "value": tt.vmController}},
+				}), nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			vm, err := cli.FindOneInstance(context.Background(), tt.controllerID, tt.identifier)
+			if tt.wantNotFound {
+				require.ErrorIs(t, err, garmErrors.ErrNotFound)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testVMID, vm.Id)
+		})
+	}
+}
+
+func TestCreateRunningInstanceDHCPOptions(t *testing.T) {
+	const networkID = "88888888-8888-8888-8888-888888888888"
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	handleZone(f, "Advanced", false)
+
+	cli := newTestCli(t, f, nil)
+	runnerSpec := newTestRunnerSpec()
+	runnerSpec.NetworkIDs = []string{networkID}
+	runnerSpec.DHCPOptions = map[string]string{"ntp-servers": "10.0.0.123"}
+
+	_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.NoError(t, err)
+
+	calls := f.callsTo("deployVirtualMachine")
+	require.Len(t, calls, 1)
+	require.Equal(t, networkID, calls[0].Get("dhcpoptionsnetworklist[0].networkid"))
+	require.Equal(t, "10.0.0.123", calls[0].Get("dhcpoptionsnetworklist[0].dhcp:42"))
+}
+
+func TestCreateRunningInstanceZoneNetworking(t *testing.T) {
+	const (
+		networkID = "88888888-8888-8888-8888-888888888888"
+		groupID   = "99999999-9999-9999-9999-999999999999"
+	)
+
+	tests := []struct {
+		name           string
+		networkType    string
+		securityGroups bool
+		networkIDs     []string
+		groups         []string
+		wantParams     map[string]string
+		errString      string
+	}{
+		{
+			name:        "advanced zone with networks",
+			networkType: "Advanced",
+			networkIDs:  []string{networkID},
+			wantParams:  map[string]string{"networkids": networkID},
+		},
+		{
+			name:        "advanced zone with a security group",
+			networkType: "Advanced",
+			networkIDs:  []string{networkID, "runners"},
+			errString:   `failed to resolve networks: networks not found: "runners"`,
+		},
+		{
+			name:           "advanced zone with security groups",
+			networkType:    "Advanced",
+			securityGroups: true,
+			networkIDs:     []string{networkID, "runners", "egress"},
+			wantParams:     map[string]string{"networkids": networkID, "securitygroupnames": "runners,egress"},
+		},
+		{
+			name:           "advanced zone with network names and security groups",
+			networkType:    "Advanced",
+			securityGroups: true,
+			networkIDs:     []string{"runners-net", "runners"},
+			wantParams:     map[string]string{"networkids": networkID, "securitygroupnames": "runners"},
+		},
+		{
+			name:           "advanced zone with explicit security groups",
+			networkType:    "Advanced",
+			securityGroups: true,
+			networkIDs:     []string{networkID},
+			groups:         []string{"runners"},
+			wantParams:     map[string]string{"networkids": networkID, "securitygroupnames": "runners"},
+		},
+		{
+			name:        "advanced zone without security groups",
+			networkType: "Advanced",
+			groups:      []string{"runners"},
+			errString:   "zone zone1 does not have security groups enabled; use network_ids instead of security_groups",
+		},
+		{
+			name:        "basic zone with security group IDs",
+			networkType: "Basic",
+			groups:      []string{groupID},
+			wantParams:  map[string]string{"securitygroupids": groupID},
+		},
+		{
+			name:        "basic zone routes network_ids to security groups",
+			networkType: "Basic",
+			networkIDs:  []string{"runners", "egress"},
+			wantParams:  map[string]string{"securitygroupnames": "runners,egress"},
+		},
+		{
+			name:        "basic zone with a VPC network",
+			networkType: "Basic",
+			networkIDs:  []string{"vpc/runners-net"},
+			errString:   `zone zone1 uses basic networking, so network_ids are used as security groups, but "vpc/runners-net" is a VPC network`,
+		},
+		{
+			name:        "mixed security group names and IDs",
+			networkType: "Basic",
+			groups:      []string{"runners", groupID},
+			errString:   "security groups must be either all names or all IDs",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			handleZone(f, tt.networkType, tt.securityGroups)
+			f.handle("listNetworks", func(url.Values) (any, error) {
+				return map[string]any{"count": 1, "network": []map[string]any{
+					{"id": networkID, "name": "runners-net"},
+				}}, nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.NetworkIDs = tt.networkIDs
+			runnerSpec.SecurityGroups = tt.groups
+
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				require.Empty(t, f.callsTo("deployVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+			calls := f.callsTo("deployVirtualMachine")
+			require.Len(t, calls, 1)
+			for key, want := range tt.wantParams {
+				require.Equal(t, want, calls[0].Get(key), key)
+			}
+		})
+	}
+}
+
+func TestCreateRunningInstanceRequireNetwork(t *testing.T) {
+	requireNetwork := false
+	tests := []struct {
+		name           string
+		securityGroups bool
+		groups         []string
+		requireNetwork *bool
+		errString      string
+	}{
+		{
+			name:      "advanced zone without networks",
+			errString: "zone zone1 uses advanced networking and no networks are configured; set network_ids in the pool extra specs or networks in its profile, or set require_network = false to use the CloudStack default network",
+		},
+		{name: "network not required", requireNetwork: &requireNetwork},
+		{name: "security group zone without networks", securityGroups: true},
+		{name: "security group zone with security groups only", securityGroups: true, groups: []string{"runners"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			handleZone(f, "Advanced", tt.securityGroups)
+
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.RequireNetwork = tt.requireNetwork })
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.SecurityGroups = tt.groups
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				require.Empty(t, f.callsTo("deployVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+			calls := f.callsTo("deployVirtualMachine")
+			require.Len(t, calls, 1)
+			require.False(t, calls[0].Has("networkids"))
+		})
+	}
+}
+
+func TestCreateRunningInstanceCachesZone(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	handleZone(f, "Basic", false)
+
+	cli := newTestCli(t, f, nil)
+	for range 2 {
+		runnerSpec := newTestRunnerSpec()
+		runnerSpec.SecurityGroups = []string{"runners"}
+		_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+		require.NoError(t, err)
+	}
+	require.Len(t, f.callsTo("listZones"), 1)
+	require.Len(t, f.callsTo("deployVirtualMachine"), 2)
+}
+
+func TestCreateRunningInstanceGracePeriod(t *testing.T) {
+	interval := createGracePollInterval
+	createGracePollInterval = time.Millisecond
+	t.Cleanup(func() { createGracePollInterval = interval })
+
+	stale := time.Now().Add(-time.Hour).UTC().Format("2006-01-02T15:04:05-0700")
+	tests := []struct {
+		name       string
+		grace      time.Duration
+		deployCode int
+		states     []string
+		created    string
+		controller string
+		wantID     string
+		wantLists  int
+		someLists  bool
+	}{
+		{
+			name:      "VM turns up running",
+			grace:     time.Second,
+			states:    []string{"", "Starting", "Running"},
+			wantID:    testVMID,
+			wantLists: 3,
+		},
+		{
+			name:       "VM of this controller turns up running",
+			grace:      time.Second,
+			states:     []string{"Running"},
+			controller: "controller-1",
+			wantID:     testVMID,
+			wantLists:  1,
+		},
+		{
+			name:      "VM ended in error",
+			grace:     time.Second,
+			states:    []string{"Error"},
+			wantLists: 1,
+		},
+		{
+			name:      "stale VM of the same name",
+			grace:     50 * time.Millisecond,
+			states:    []string{"Running"},
+			created:   stale,
+			someLists: true,
+		},
+		{
+			name:       "VM of another controller",
+			grace:      50 * time.Millisecond,
+			states:     []string{"Running"},
+			controller: "controller-2",
+			someLists:  true,
+		},
+		{
+			name:       "parameter error",
+			grace:      time.Second,
+			deployCode: 431,
+			states:     []string{"Running"},
+		},
+		{
+			name:   "no grace period",
+			states: []string{"Running"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			deployCode := tt.deployCode
+			if deployCode == 0 {
+				deployCode = 530
+			}
+			f := newFakeCloudStack(t)
+			handleServiceOffering(f)
+			handleDedication(f, "")
+			handleZone(f, "Advanced", true)
+			f.handleAsync("deployVirtualMachine", func(url.Values) (any, error) {
+				return nil, &fakeAPIError{Code: deployCode, Text: "Internal error executing command"}
+			})
+			var lists int
+			f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+				require.Equal(t, "runner-1", p.Get("name"))
+				state := tt.states[min(lists, len(tt.states)-1)]
+				lists++
+				if state == "" {
+					return listVMs(), nil
+				}
+				created := tt.created
+				if created == "" {
+					created = time.Now().UTC().Format("2006-01-02T15:04:05-0700")
+				}
+				vm := map[string]any{"id": testVMID, "name": "runner-1", "state": state, "created": created}
+				if tt.controller != "" {
+					vm["tags"] = []map[string]any{{"key": "GARM_CONTROLLER_ID", "value": tt.controller}}
+				}
+				return listVMs(vm), nil
+			})
+			f.handleAsync("createTags", func(url.Values) (any, error) {
+				return map[string]any{"success": true}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.CreateGracePeriod = config.Duration{Duration: tt.grace}
+			})
+			id, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+			if tt.someLists {
+				require.NotEmpty(t, f.callsTo("listVirtualMachines"))
+			} else {
+				require.Len(t, f.callsTo("listVirtualMachines"), tt.wantLists)
+			}
+			if tt.wantID == "" {
+				var deployErr *DeployError
+				require.ErrorAs(t, err, &deployErr)
+				require.Equal(t, deployCode, deployErr.Code)
+				require.Empty(t, f.callsTo("createTags"))
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantID, id)
+			calls := f.callsTo("createTags")
+			require.Len(t, calls, 1)
+			require.Equal(t, testVMID, calls[0].Get("resourceids"))
+		})
+	}
+}
+
+func TestCreateRunningInstanceDeployError(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleServiceOffering(f)
+	handleDedication(f, "")
+	handleZone(f, "Advanced", true)
+	f.handleAsync("deployVirtualMachine", func(url.Values) (any, error) {
+		return nil, &fakeAPIError{Code: 533, Text: "Insufficient capacity to deploy the VM"}
+	})
+
+	cli := newTestCli(t, f, nil)
+	_, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+
+	var deployErr *DeployError
+	require.ErrorAs(t, err, &deployErr)
+	require.Equal(t, 533, deployErr.Code)
+	require.Equal(t, "Insufficient capacity to deploy the VM", deployErr.Message)
+	require.EqualError(t, err, fmt.Sprintf(
+		"failed to deploy virtual machine (zone %s, service offering %s, template %s): CloudStack error 533: Insufficient capacity to deploy the VM",
+		testZoneID, testOfferingID, testTemplateID))
+}
+
+func TestNewCloudStackCliVerifySSL(t *testing.T) {
+	tests := []struct {
+		name      string
+		verifySSL bool
+		wantErr   bool
+	}{
+		{name: "verification enabled rejects self-signed cert", verifySSL: true, wantErr: true},
+		{name: "verification disabled accepts self-signed cert", verifySSL: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStackTLS(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{"id": testVMID, "name": "runner-1"}), nil
+			})
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.VerifySSL = tt.verifySSL })
+			require.Equal(t, !tt.verifySSL, cli.cfg.TLSConfig().InsecureSkipVerify)
+
+			_, err := cli.FindOneInstance(context.Background(), "", testVMID)
+			if tt.wantErr {
+				require.ErrorContains(t, err, "certificate")
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestListInstancesByPoolStatusFilter(t *testing.T) {
+	poolVM := func(id, state string) map[string]any {
+		return map[string]any{
+			"id":    id,
+			"name":  id,
+			"state": state,
+			"tags":  []map[string]any{{"key": "GARM_POOL_ID", "value": "pool-1"}},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		statuses []params.InstanceStatus
+		want     []string
+	}{
+		{
+			name: "default includes stopped",
+			want: []string{"vm-running", "vm-stopped", "vm-starting"},
+		},
+		{
+			name:     "running only",
+			statuses: []params.InstanceStatus{params.InstanceRunning},
+			want:     []string{"vm-running", "vm-starting"},
+		},
+		{
+			name:     "stopped only",
+			statuses: []params.InstanceStatus{params.InstanceStopped},
+			want:     []string{"vm-stopped"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(
+					poolVM("vm-running", "Running"),
+					poolVM("vm-stopped", "Stopped"),
+					poolVM("vm-starting", "Starting"),
+					poolVM("vm-destroyed", "Destroyed"),
+				), nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			vms, err := cli.ListInstancesByPool(context.Background(), "controller-1", "pool-1", tt.statuses...)
+			require.NoError(t, err)
+
+			var got []string
+			for _, vm := range vms {
+				got = append(got, vm.Id)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReconcilePoolTags(t *testing.T) {
+	tests := []struct {
+		name               string
+		uniqueDisplayNames bool
+		displayName        string
+		wantName           string
+	}{
+		{name: "name from display name", displayName: "runner_old", wantName: "runner_old"},
+		{name: "unique display names", uniqueDisplayNames: true, displayName: "runner_old-a1b2c3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(
+					map[string]any{
+						"id":          "vm-old",
+						"name":        "runner-old-3f2a9c",
+						"displayname": tt.displayName,
+						"tags": []map[string]any{
+							{"key": "GARM_CONTROLLER_ID", "value": "controller-1"},
+							{"key": "GARM_POOL_ID", "value": "pool-1"},
+							{"key": "OSType", "value": "linux"},
+						},
+					},
+					map[string]any{
+						"id":          "vm-new",
+						"name":        "runner-new",
+						"displayname": "runner-new",
+						"tags": []map[string]any{
+							{"key": "GARM_CONTROLLER_ID", "value": "controller-1"},
+							{"key": "GARM_POOL_ID", "value": "pool-1"},
+							{"key": "Name", "value": "custom-name"},
+							{"key": "OSType", "value": "linux"},
+							{"key": "OSArch", "value": "amd64"},
+						},
+					},
+				), nil
+			})
+			f.handleAsync("createTags", func(url.Values) (any, error) {
+				return map[string]any{"success": true}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.UniqueDisplayNames = tt.uniqueDisplayNames })
+			updated, err := cli.ReconcilePoolTags(context.Background(), "controller-1", "pool-1")
+			require.NoError(t, err)
+
+			calls := f.callsTo("createTags")
+			if tt.wantName == "" {
+				require.Zero(t, updated)
+				require.Empty(t, calls)
+				return
+			}
+			require.Equal(t, 1, updated)
+			require.Len(t, calls, 1)
+			require.Equal(t, "vm-old", calls[0].Get("resourceids"))
+			require.Equal(t, "Name", calls[0].Get("tags[0].key"))
+			require.Equal(t, tt.wantName, calls[0].Get("tags[0].value"))
+			require.Empty(t, calls[0].Get("tags[1].key"))
+		})
+	}
+}
+
+func TestMoveInstanceToPool(t *testing.T) {
+	tests := []struct {
+		name        string
+		poolID      string
+		wantDeleted bool
+		wantCreated bool
+	}{
+		{name: "stale pool tag", poolID: "pool-1", wantDeleted: true, wantCreated: true},
+		{name: "already in pool", poolID: "pool-2"},
+		{name: "untagged", wantCreated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tags := []map[string]any{{"key": "GARM_CONTROLLER_ID", "value": "controller-1"}}
+			if tt.poolID != "" {
+				tags = append(tags, map[string]any{"key": "GARM_POOL_ID", "value": tt.poolID})
+			}
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+				require.Equal(t, testVMID, p.Get("id"))
+				return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "tags": tags}), nil
+			})
+			f.handleAsync("deleteTags", func(url.Values) (any, error) {
+				return map[string]any{"success": true}, nil
+			})
+			f.handleAsync("createTags", func(url.Values) (any, error) {
+				return map[string]any{"success": true}, nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			require.NoError(t, cli.MoveInstanceToPool(context.Background(), testVMID, "pool-2"))
+
+			deletes := f.callsTo("deleteTags")
+			if tt.wantDeleted {
+				require.Len(t, deletes, 1)
+				require.Equal(t, testVMID, deletes[0].Get("resourceids"))
+				require.Equal(t, map[string]string{"GARM_POOL_ID": "pool-1"}, tagsFromParams(deletes[0]))
+			} else {
+				require.Empty(t, deletes)
+			}
+			creates := f.callsTo("createTags")
+			if tt.wantCreated {
+				require.Len(t, creates, 1)
+				require.Equal(t, map[string]string{"GARM_POOL_ID": "pool-2"}, tagsFromParams(creates[0]))
+			} else {
+				require.Empty(t, creates)
+			}
+		})
+	}
+}
+
+func TestDestroyInstanceProtected(t *testing.T) {
+	tests := []struct {
+		name        string
+		tagValue    string
+		force       bool
+		wantRefused bool
+	}{
+		{name: "protected instance is refused", tagValue: "true", wantRefused: true},
+		{name: "force overrides protection", tagValue: "true", force: true},
+		{name: "protection disabled", tagValue: "false"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{
+					"id":    testVMID,
+					"name":  "runner",
+					"state": "Running",
+					"tags":  []map[string]any{{"key": "GARM_PROTECTED", "value": tt.tagValue}},
+				}), nil
+			})
+			f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			var err error
+			if tt.force {
+				err = cli.ForceDestroyInstance(context.Background(), testVMID, false)
+			} else {
+				err = cli.DestroyInstance(context.Background(), testVMID, false)
+			}
+			if tt.wantRefused {
+				require.ErrorIs(t, err, ErrProtected)
+				require.Empty(t, f.callsTo("destroyVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, f.callsTo("destroyVirtualMachine"), 1)
+		})
+	}
+}
+
+func TestCreateRunningInstanceStoragePool(t *testing.T) {
+	const poolID = "88888888-8888-8888-8888-888888888888"
+
+	tests := []struct {
+		name       string
+		poolID     string
+		poolTag    string
+		pool       map[string]any
+		wantDetail [2]string
+		errString  string
+	}{
+		{
+			name:       "pool in target zone",
+			poolID:     poolID,
+			pool:       map[string]any{"id": poolID, "state": "Up", "zoneid": testZoneID},
+			wantDetail: [2]string{"details[0].rootdiskstoragepoolid", poolID},
+		},
+		{
+			name:      "pool in another zone",
+			poolID:    poolID,
+			pool:      map[string]any{"id": poolID, "state": "Up", "zoneid": "other-zone"},
+			errString: "storage pool " + poolID + " is in zone other-zone",
+		},
+		{
+			name:      "pool in maintenance",
+			poolID:    poolID,
+			pool:      map[string]any{"id": poolID, "state": "Maintenance", "zoneid": testZoneID},
+			errString: "storage pool " + poolID + " is not available (state Maintenance)",
+		},
+		{
+			name:       "storage tag",
+			poolTag:    "ssd",
+			wantDetail: [2]string{"details[0].rootdiskstoragetags", "ssd"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listStoragePools", func(url.Values) (any, error) {
+				return map[string]any{"count": 1, "storagepool": []map[string]any{tt.pool}}, nil
+			})
+			handleDeploy(f)
+
+			cli := newTestCli(t, f, nil)
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.StoragePoolID = tt.poolID
+			runnerSpec.StoragePoolTag = tt.poolTag
+
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+				require.Empty(t, f.callsTo("deployVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+
+			calls := f.callsTo("deployVirtualMachine")
+			require.Len(t, calls, 1)
+			require.Equal(t, tt.wantDetail[1], calls[0].Get(tt.wantDetail[0]))
+		})
+	}
+}
+
+func TestCreateRunningInstanceCPUPinning(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	cli := newTestCli(t, f, nil)
+
+	node := 0
+	runnerSpec := newTestRunnerSpec()
+	runnerSpec.CPUPinning = true
+	runnerSpec.NUMANode = &node
+	_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.NoError(t, err)
+
+	calls := f.callsTo("deployVirtualMachine")
+	require.Len(t, calls, 1)
+	require.Equal(t, "true", calls[0].Get("details[0].cpuPinning"))
+	require.Equal(t, "0", calls[0].Get("details[1].nodeId"))
+}
+
+func TestCreateRunningInstanceIOPS(t *testing.T) {
+	for _, customIOPS := range []bool{true, false} {
+		f := newFakeCloudStack(t)
+		handleDeploy(f)
+		f.handle("listServiceOfferings", func(p url.Values) (any, error) {
+			return map[string]any{"count": 1, "serviceoffering": []map[string]any{{
+				"id": p.Get("id"), "name": "qos", "iscustomizediops": customIOPS,
+			}}}, nil
+		})
+		cli := newTestCli(t, f, nil)
+
+		runnerSpec := newTestRunnerSpec()
+		runnerSpec.MinIOPS = 500
+		runnerSpec.MaxIOPS = 2000
+		_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+		calls := f.callsTo("deployVirtualMachine")
+		if !customIOPS {
+			require.EqualError(t, err, "service offering "+testOfferingID+" does not have custom IOPS, which min_iops and max_iops require")
+			require.Empty(t, calls)
+			continue
+		}
+		require.NoError(t, err)
+		require.Len(t, calls, 1)
+		require.Equal(t, "2000", calls[0].Get("details[0].maxIops"))
+		require.Equal(t, "500", calls[0].Get("details[1].minIops"))
+	}
+}
+
+func TestCreateRunningInstanceRootDiskSize(t *testing.T) {
+	for _, size := range []int{0, 100} {
+		f := newFakeCloudStack(t)
+		handleDeploy(f)
+		cli := newTestCli(t, f, nil)
+
+		runnerSpec := newTestRunnerSpec()
+		runnerSpec.RootDiskSize = size
+		_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+		require.NoError(t, err)
+
+		calls := f.callsTo("deployVirtualMachine")
+		require.Len(t, calls, 1)
+		if size == 0 {
+			require.False(t, calls[0].Has("rootdisksize"))
+			continue
+		}
+		require.Equal(t, "100", calls[0].Get("rootdisksize"))
+	}
+}
+
+func TestCreateRunningInstanceDataDisk(t *testing.T) {
+	const offeringID = "66666666-6666-6666-6666-666666666666"
+	tests := []struct {
+		name      string
+		custom    bool
+		size      int
+		wantSize  string
+		errString string
+	}{
+		{name: "fixed size offering"},
+		{name: "custom offering", custom: true, size: 200, wantSize: "200"},
+		{
+			name:      "custom offering without size",
+			custom:    true,
+			errString: "disk offering scratch (" + offeringID + ") is custom, so data_disk_size must be set",
+		},
+		{
+			name:      "size with a fixed size offering",
+			size:      200,
+			errString: "disk offering scratch (" + offeringID + ") has a fixed size of 50 GB, so data_disk_size can't be set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listDiskOfferings", func(p url.Values) (any, error) {
+				require.Equal(t, offeringID, p.Get("id"))
+				return map[string]any{"count": 1, "diskoffering": []map[string]any{{
+					"id": offeringID, "name": "scratch", "disksize": 50, "iscustomized": tt.custom,
+				}}}, nil
+			})
+			cli := newTestCli(t, f, nil)
+
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.DiskOfferingID = offeringID
+			runnerSpec.DataDiskSize = tt.size
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				require.Empty(t, f.callsTo("deployVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+
+			calls := f.callsTo("deployVirtualMachine")
+			require.Len(t, calls, 1)
+			require.Equal(t, offeringID, calls[0].Get("diskofferingid"))
+			require.Equal(t, tt.wantSize, calls[0].Get("size"))
+		})
+	}
+
+	t.Run("no data disk", func(t *testing.T) {
+		f := newFakeCloudStack(t)
+		handleDeploy(f)
+		cli := newTestCli(t, f, nil)
+
+		_, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+		require.NoError(t, err)
+		calls := f.callsTo("deployVirtualMachine")
+		require.Len(t, calls, 1)
+		require.False(t, calls[0].Has("diskofferingid"))
+		require.False(t, calls[0].Has("size"))
+	})
+}
+
+func TestCreateRunningInstanceDynamicScaling(t *testing.T) {
+	tests := []struct {
+		name           string
+		requested      bool
+		dynamicScaling bool
+		errString      string
+	}{
+		{name: "requested", requested: true, dynamicScaling: true},
+		{name: "not requested", dynamicScaling: true},
+		{
+			name:      "offering without dynamic scaling",
+			requested: true,
+			errString: "service offering " + testOfferingID + " does not have dynamic scaling enabled, which enable_dynamic_scaling requires",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listServiceOfferings", func(p url.Values) (any, error) {
+				return map[string]any{"count": 1, "serviceoffering": []map[string]any{{
+					"id": p.Get("id"), "name": "scalable", "dynamicscalingenabled": tt.dynamicScaling,
+				}}}, nil
+			})
+			cli := newTestCli(t, f, nil)
+
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.DynamicScaling = tt.requested
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			calls := f.callsTo("deployVirtualMachine")
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				require.Empty(t, calls)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, calls, 1)
+			if !tt.requested {
+				require.False(t, calls[0].Has("dynamicscalingenabled"))
+				return
+			}
+			require.Equal(t, "true", calls[0].Get("dynamicscalingenabled"))
+		})
+	}
+}
+
+func TestCreateRunningInstancesStagger(t *testing.T) {
+	const stagger = 50 * time.Millisecond
+
+	f := newFakeCloudStack(t)
+	handleServiceOffering(f)
+	handleDedication(f, "")
+	handleZone(f, "Advanced", true)
+	var (
+		mu     sync.Mutex
+		starts []time.Time
+	)
+	f.handleAsync("deployVirtualMachine", func(p url.Values) (any, error) {
+		mu.Lock()
+		starts = append(starts, time.Now())
+		mu.Unlock()
+		return map[string]any{"id": testVMID, "name": p.Get("name"), "state": "Running"}, nil
+	})
+	f.handleAsync("createTags", func(url.Values) (any, error) {
+		return map[string]any{"success": true}, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.BatchStartStagger.Duration = stagger })
+	specs := []*spec.RunnerSpec{newTestRunnerSpec(), newTestRunnerSpec(), newTestRunnerSpec()}
+	ids, err := cli.CreateRunningInstances(context.Background(), specs)
+	require.NoError(t, err)
+	require.Equal(t, []string{testVMID, testVMID, testVMID}, ids)
+
+	require.Len(t, starts, 3)
+	slices.SortFunc(starts, func(a, b time.Time) int { return a.Compare(b) })
+	for i := 1; i < len(starts); i++ {
+		require.GreaterOrEqual(t, starts[i].Sub(starts[i-1]), stagger-10*time.Millisecond)
+	}
+}
+
+func TestCreateRunningInstancesBatchTags(t *testing.T) {
+	tests := []struct {
+		name        string
+		failShared  bool
+		failVM      string
+		wantIDs     []string
+		wantShared  string
+		wantDestroy int
+	}{
+		{name: "tagged", wantIDs: []string{"vm-1", "vm-2", "vm-3", "vm-4"}, wantShared: "vm-1,vm-2,vm-3,vm-4"},
+		{name: "shared tags fail", failShared: true, wantIDs: []string{"", "", "", ""}, wantShared: "vm-1,vm-2,vm-3,vm-4", wantDestroy: 4},
+		{name: "per-VM tags fail", failVM: "runner-3", wantIDs: []string{"vm-1", "vm-2", "", "vm-4"}, wantShared: "vm-1,vm-2,vm-4", wantDestroy: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			var mu sync.Mutex
+			vmIDs := map[string]string{}
+			f.handleAsync("deployVirtualMachine", func(p url.Values) (any, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				// IDs follow the runner names, so they don't depend on the
+				// order the concurrent deploys run in.
+				id := "vm-" + strings.TrimPrefix(p.Get("name"), "runner-")
+				vmIDs[id] = p.Get("name")
+				return map[string]any{"id": id, "name": p.Get("name"), "state": "Running"}, nil
+			})
+			f.handleAsync("createTags", func(p url.Values) (any, error) {
+				tags := tagsFromParams(p)
+				if _, ok := tags["Name"]; !ok && tt.failShared {
+					return nil, &fakeAPIError{Text: "Internal error"}
+				}
+				if tags["Name"] != "" && tags["Name"] == tt.failVM {
+					return nil, &fakeAPIError{Text: "Internal error"}
+				}
+				return map[string]any{"success": true}, nil
+			})
+			f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+				mu.Lock()
+				defer mu.Unlock()
+				return listVMs(map[string]any{"id": p.Get("id"), "name": vmIDs[p.Get("id")], "state": "Running"}), nil
+			})
+			f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.BatchTags = true })
+			var specs []*spec.RunnerSpec
+			for i := 1; i <= 4; i++ {
+				runnerSpec := newTestRunnerSpec()
+				runnerSpec.BootstrapParams.Name = fmt.Sprintf("runner-%d", i)
+				if i == 2 {
+					runnerSpec.BootstrapParams.PoolID = "pool-2"
+				}
+				specs = append(specs, runnerSpec)
+			}
+			ids, err := cli.CreateRunningInstances(context.Background(), specs)
+			require.Equal(t, tt.wantIDs, ids)
+			require.Len(t, f.callsTo("destroyVirtualMachine"), tt.wantDestroy)
+			if tt.wantDestroy > 0 {
+				require.ErrorContains(t, err, "failed to tag VM")
+			} else {
+				require.NoError(t, err)
+			}
+
+			// Every VM gets its ownership tags and name right after its deploy,
+			// the tags they share, across pools, come in one call.
+			var shared, names []string
+			for _, call := range f.callsTo("createTags") {
+				tags := tagsFromParams(call)
+				if name, ok := tags["Name"]; ok {
+					require.Len(t, tags, 3)
+					require.Equal(t, "controller-1", tags["GARM_CONTROLLER_ID"])
+					require.NotEmpty(t, tags["GARM_POOL_ID"])
+					require.Equal(t, "vm-"+strings.TrimPrefix(name, "runner-"), call.Get("resourceids"))
+					names = append(names, name)
+					continue
+				}
+				require.NotContains(t, tags, "GARM_CONTROLLER_ID")
+				require.Equal(t, "linux", tags["OSType"])
+				shared = append(shared, call.Get("resourceids"))
+			}
+			require.Equal(t, []string{tt.wantShared}, shared)
+			slices.Sort(names)
+			require.Equal(t, []string{"runner-1", "runner-2", "runner-3", "runner-4"}, names)
+		})
+	}
+}
+
+func TestCreateRunningInstancesBatchTagsOwnershipBeforeWaits(t *testing.T) {
+	interval := readinessPollInterval
+	readinessPollInterval = time.Millisecond
+	t.Cleanup(func() { readinessPollInterval = interval })
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	var ownedWhileWaiting bool
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		for _, call := range f.callsTo("createTags") {
+			if tagsFromParams(call)["GARM_CONTROLLER_ID"] == "controller-1" {
+				ownedWhileWaiting = true
+			}
+		}
+		return listVMs(map[string]any{
+			"id": testVMID, "name": "runner-1", "state": "Running",
+			"tags": []map[string]any{{"key": "GARM_READY", "value": "true"}},
+		}), nil
+	})
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.BatchTags = true
+		cfg.ReadinessTag = "GARM_READY"
+		cfg.ReadinessTimeout.Duration = time.Second
+	})
+
+	ids, err := cli.CreateRunningInstances(context.Background(), []*spec.RunnerSpec{newTestRunnerSpec()})
+	require.NoError(t, err)
+	require.Equal(t, []string{testVMID}, ids)
+	// The VM already carried its ownership tags during the readiness wait.
+	require.True(t, ownedWhileWaiting)
+	require.Len(t, f.callsTo("createTags"), 2)
+}
+
+func TestCreateRunningInstancesStaggerCanceled(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.BatchStartStagger.Duration = time.Hour })
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	specs := []*spec.RunnerSpec{newTestRunnerSpec(), newTestRunnerSpec()}
+	ids, err := cli.CreateRunningInstances(ctx, specs)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, []string{testVMID, ""}, ids)
+	require.Len(t, f.callsTo("deployVirtualMachine"), 1)
+}
+
+func TestCreateRunningInstanceMappedFlavor(t *testing.T) {
+	const largeOfferingID = "99999999-9999-9999-9999-999999999999"
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.SetResolvedFlavorOfferings(map[string]string{"large": largeOfferingID})
+	})
+	runnerSpec := newTestRunnerSpec()
+	runnerSpec.ServiceOfferingID = largeOfferingID
+	runnerSpec.BootstrapParams.Flavor = "large"
+
+	_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.NoError(t, err)
+	// The mapped flavor is not looked up as a service offering name.
+	for _, call := range f.callsTo("listServiceOfferings") {
+		require.False(t, call.Has("name"))
+	}
+	calls := f.callsTo("deployVirtualMachine")
+	require.Len(t, calls, 1)
+	require.Equal(t, largeOfferingID, calls[0].Get("serviceofferingid"))
+}
+
+func TestCreateRunningInstanceResourceTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		offering   map[string]any
+		cpuNumber  int
+		memoryMB   int
+		wantVCPU   string
+		wantMemory string
+	}{
+		{
+			name:       "standard offering",
+			offering:   map[string]any{"cpunumber": 4, "memory": 8192},
+			cpuNumber:  16,
+			memoryMB:   32768,
+			wantVCPU:   "4",
+			wantMemory: "8192",
+		},
+		{
+			name:       "custom offering",
+			offering:   map[string]any{"iscustomized": true},
+			cpuNumber:  6,
+			memoryMB:   12288,
+			wantVCPU:   "6",
+			wantMemory: "12288",
+		},
+		{
+			name:     "custom offering without size",
+			offering: map[string]any{"iscustomized": true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listServiceOfferings", func(p url.Values) (any, error) {
+				offering := map[string]any{"id": p.Get("id"), "name": "offering"}
+				maps.Copy(offering, tt.offering)
+				return map[string]any{"count": 1, "serviceoffering": []map[string]any{offering}}, nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.CPUNumber = tt.cpuNumber
+			runnerSpec.MemoryMB = tt.memoryMB
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			require.NoError(t, err)
+
+			calls := f.callsTo("createTags")
+			require.Len(t, calls, 1)
+			tags := tagsFromParams(calls[0])
+			require.Equal(t, tt.wantVCPU, tags["GARM_VCPU"])
+			require.Equal(t, tt.wantMemory, tags["GARM_MEMORY_MB"])
+		})
+	}
+}
+
+func TestCreateRunningInstanceProvenanceTags(t *testing.T) {
+	const snapshotID = "77777777-7777-7777-7777-777777777777"
+	tests := []struct {
+		name             string
+		configTemplate   string
+		image            string
+		deployedTemplate string
+		snapshotID       string
+		want             map[string]string
+		wantUntagged     []string
+	}{
+		{
+			name:             "name from the deploy",
+			deployedTemplate: "ubuntu-24.04",
+			want: map[string]string{
+				"GARM_FLAVOR":    "2-4096",
+				"GARM_FLAVOR_ID": testOfferingID,
+				"GARM_IMAGE":     "ubuntu-24.04",
+				"GARM_IMAGE_ID":  testTemplateID,
+			},
+		},
+		{
+			name:           "name from the config",
+			configTemplate: "ubuntu-24.04",
+			want: map[string]string{
+				"GARM_IMAGE":    "ubuntu-24.04",
+				"GARM_IMAGE_ID": testTemplateID,
+			},
+		},
+		{
+			name:  "name from the image",
+			image: "ubuntu-22.04",
+			want: map[string]string{
+				"GARM_IMAGE":    "ubuntu-22.04",
+				"GARM_IMAGE_ID": "template-2204",
+			},
+		},
+		{
+			name: "name unknown",
+			want: map[string]string{
+				"GARM_FLAVOR":    "2-4096",
+				"GARM_FLAVOR_ID": testOfferingID,
+				"GARM_IMAGE_ID":  testTemplateID,
+			},
+			wantUntagged: []string{"GARM_IMAGE"},
+		},
+		{
+			name:       "snapshot",
+			snapshotID: snapshotID,
+			want: map[string]string{
+				"GARM_FLAVOR":    "2-4096",
+				"GARM_FLAVOR_ID": testOfferingID,
+			},
+			wantUntagged: []string{"GARM_IMAGE", "GARM_IMAGE_ID"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handleAsync("deployVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": testVMID, "name": p.Get("name"), "state": "Running", "templatename": tt.deployedTemplate}, nil
+			})
+			f.handle("listTemplates", func(p url.Values) (any, error) {
+				require.Equal(t, "ubuntu-22.04", p.Get("name"))
+				return map[string]any{"count": 1, "template": []map[string]any{{"id": "template-2204", "name": p.Get("name")}}}, nil
+			})
+			f.handle("listSnapshots", func(url.Values) (any, error) {
+				return map[string]any{"count": 1, "snapshot": []map[string]any{
+					{"id": snapshotID, "state": "BackedUp", "zoneid": testZoneID},
+				}}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				if tt.configTemplate != "" {
+					cfg.Template = tt.configTemplate
+				}
+			})
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.SnapshotID = tt.snapshotID
+			runnerSpec.BootstrapParams.Image = tt.image
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			require.NoError(t, err)
+
+			calls := f.callsTo("createTags")
+			require.Len(t, calls, 1)
+			tags := tagsFromParams(calls[0])
+			for key, value := range tt.want {
+				require.Equal(t, value, tags[key], key)
+			}
+			for _, key := range tt.wantUntagged {
+				require.NotContains(t, tags, key)
+			}
+			// The template name is never looked up just for the tags.
+			if tt.image == "" {
+				require.Empty(t, f.callsTo("listTemplates"))
+			}
+		})
+	}
+}
+
+func TestCreateRunningInstanceRunnerContextTags(t *testing.T) {
+	tests := []struct {
+		name     string
+		repoURL  string
+		disabled bool
+		want     map[string]string
+	}{
+		{
+			name:    "repository",
+			repoURL: "https://github.com/cloudbase/garm",
+			want:    map[string]string{"GARM_ENTITY_TYPE": "repository", "GARM_OWNER": "cloudbase", "GARM_REPO": "garm"},
+		},
+		{
+			name:    "organization",
+			repoURL: "https://github.com/cloudbase/",
+			want:    map[string]string{"GARM_ENTITY_TYPE": "organization", "GARM_OWNER": "cloudbase"},
+		},
+		{
+			name:    "enterprise",
+			repoURL: "https://ghes.example.com/enterprises/acme",
+			want:    map[string]string{"GARM_ENTITY_TYPE": "enterprise", "GARM_OWNER": "acme"},
+		},
+		{
+			name:    "no repo URL",
+			repoURL: "",
+		},
+		{
+			name:    "unrecognized URL",
+			repoURL: "https://github.com/a/b/c",
+		},
+		{
+			name:     "disabled",
+			repoURL:  "https://github.com/cloudbase/garm",
+			disabled: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.TagRunnerContext = !tt.disabled
+			})
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.BootstrapParams.RepoURL = tt.repoURL
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			require.NoError(t, err)
+
+			calls := f.callsTo("createTags")
+			require.Len(t, calls, 1)
+			tags := tagsFromParams(calls[0])
+			for _, key := range []string{"GARM_ENTITY_TYPE", "GARM_OWNER", "GARM_REPO"} {
+				want, ok := tt.want[key]
+				if !ok {
+					require.NotContains(t, tags, key)
+					continue
+				}
+				require.Equal(t, want, tags[key], key)
+			}
+		})
+	}
+}
+
+func TestCreateRunningInstanceWaitsForReadiness(t *testing.T) {
+	interval := readinessPollInterval
+	readinessPollInterval = time.Millisecond
+	t.Cleanup(func() { readinessPollInterval = interval })
+
+	tests := []struct {
+		name      string
+		readyPoll int
+		errString string
+	}{
+		{name: "becomes ready", readyPoll: 3},
+		{name: "never ready", errString: "did not report ready (tag GARM_READY)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			polls := 0
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				polls++
+				vm := map[string]any{"id": testVMID, "name": "runner-1", "state": "Running"}
+				if tt.readyPoll > 0 && polls >= tt.readyPoll {
+					vm["tags"] = []map[string]any{{"key": "GARM_READY", "value": "true"}}
+				}
+				return listVMs(vm), nil
+			})
+			f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.ReadinessTag = "GARM_READY"
+				cfg.ReadinessTimeout.Duration = 100 * time.Millisecond
+			})
+			id, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+				require.ErrorIs(t, err, context.DeadlineExceeded)
+				// The VM that never became ready is not left behind.
+				require.Len(t, f.callsTo("destroyVirtualMachine"), 1)
+				return
+			}
+			require.Empty(t, f.callsTo("destroyVirtualMachine"))
+			require.NoError(t, err)
+			require.Equal(t, testVMID, id)
+			require.Equal(t, tt.readyPoll, polls)
+		})
+	}
+}
+
+func TestListInstancesByPoolIncludeStopped(t *testing.T) {
+	tests := []struct {
+		name           string
+		includeStopped *bool
+		want           []string
+	}{
+		{name: "default includes stopped", want: []string{"vm-running", "vm-stopped"}},
+		{name: "explicitly included", includeStopped: boolPtr(true), want: []string{"vm-running", "vm-stopped"}},
+		{name: "excluded", includeStopped: boolPtr(false), want: []string{"vm-running"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				poolTags := []map[string]any{{"key": "GARM_POOL_ID", "value": "pool-1"}}
+				return listVMs(
+					map[string]any{"id": "vm-running", "state": "Running", "tags": poolTags},
+					map[string]any{"id": "vm-stopped", "state": "Stopped", "tags": poolTags},
+				), nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.IncludeStoppedInList = tt.includeStopped })
+			vms, err := cli.ListInstancesByPool(context.Background(), "controller-1", "pool-1")
+			require.NoError(t, err)
+
+			var got []string
+			for _, vm := range vms {
+				got = append(got, vm.Id)
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestListInstancesByPoolIncludeTerminated(t *testing.T) {
+	tests := []struct {
+		name              string
+		includeTerminated bool
+		want              []string
+	}{
+		{name: "default filters terminated", want: []string{"vm-running"}},
+		{name: "included", includeTerminated: true, want: []string{"vm-running", "vm-destroyed", "vm-expunging"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				poolTags := []map[string]any{{"key": "GARM_POOL_ID", "value": "pool-1"}}
+				return listVMs(
+					map[string]any{"id": "vm-running", "state": "Running", "tags": poolTags},
+					map[string]any{"id": "vm-destroyed", "state": "Destroyed", "tags": poolTags},
+					map[string]any{"id": "vm-expunging", "state": "Expunging", "tags": poolTags},
+				), nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.IncludeTerminated = tt.includeTerminated
+				// Terminated VMs are reported even when stopped ones are not.
+				cfg.IncludeStoppedInList = boolPtr(false)
+			})
+			vms, err := cli.ListInstancesByPool(context.Background(), "controller-1", "pool-1")
+			require.NoError(t, err)
+
+			var got []string
+			for _, vm := range vms {
+				got = append(got, vm.Id)
+				if vm.Id != "vm-running" {
+					require.Equal(t, params.InstanceStopped, util.CloudStackStateToStatus(vm.State, nil))
+				}
+			}
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestCreateRunningInstanceTagTemplates(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.TagTemplates = map[string]string{
+			"team":  "team-{{.Pool}}",
+			"Name":  "overridden",
+			"empty": "{{.Flavor}}",
+		}
+	})
+	_, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+	require.NoError(t, err)
+
+	calls := f.callsTo("createTags")
+	require.Len(t, calls, 1)
+	tags := tagsFromParams(calls[0])
+	require.Equal(t, "team-pool-1", tags["team"])
+	// Tags set by the provider win over templates.
+	require.Equal(t, "runner-1", tags["Name"])
+	require.NotContains(t, tags, "empty")
+}
+
+func TestGetInstancePassword(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "id_rsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0o600))
+
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, &key.PublicKey, []byte("s3cret-Passw0rd"))
+	require.NoError(t, err)
+
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Running"}), nil
+	})
+	f.handle("getVMPassword", func(p url.Values) (any, error) {
+		require.Equal(t, testVMID, p.Get("id"))
+		return map[string]any{"password": map[string]any{
+			"encryptedpassword": base64.StdEncoding.EncodeToString(encrypted),
+		}}, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.SSHPrivateKeyPath = keyPath })
+	password, err := cli.GetInstancePassword(context.Background(), "runner-1")
+	require.NoError(t, err)
+	require.Equal(t, "s3cret-Passw0rd", password)
+	// The password is never written to the VM tags.
+	require.Empty(t, f.callsTo("createTags"))
+
+	cli = newTestCli(t, f, nil)
+	_, err = cli.GetInstancePassword(context.Background(), "runner-1")
+	require.EqualError(t, err, "ssh_private_key_path is not set")
+}
+
+func TestCreateRunningInstanceMissingKeypair(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "id_rsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0o600))
+
+	tests := []struct {
+		name        string
+		policy      string
+		exists      bool
+		wantKeypair string
+		wantCreate  bool
+		errString   string
+	}{
+		{name: "no check", wantKeypair: "runners"},
+		{name: "existing keypair", policy: config.MissingKeypairFail, exists: true, wantKeypair: "runners"},
+		{name: "fail", policy: config.MissingKeypairFail, errString: "SSH keypair runners does not exist"},
+		{name: "ignore", policy: config.MissingKeypairIgnore},
+		{name: "create", policy: config.MissingKeypairCreate, wantKeypair: "runners", wantCreate: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listSSHKeyPairs", func(p url.Values) (any, error) {
+				require.Equal(t, "runners", p.Get("name"))
+				if !tt.exists {
+					return map[string]any{"count": 0}, nil
+				}
+				return map[string]any{"count": 1, "sshkeypair": []map[string]any{{"name": "runners"}}}, nil
+			})
+			f.handle("registerSSHKeyPair", func(p url.Values) (any, error) {
+				return map[string]any{"keypair": map[string]any{"name": p.Get("name")}}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.MissingKeypairPolicy = tt.policy
+				cfg.SSHPrivateKeyPath = keyPath
+			})
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.SSHKeyName = "runners"
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				require.Empty(t, f.callsTo("deployVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+			if tt.policy == "" {
+				require.Empty(t, f.callsTo("listSSHKeyPairs"))
+			}
+
+			calls := f.callsTo("deployVirtualMachine")
+			require.Len(t, calls, 1)
+			require.Equal(t, tt.wantKeypair, calls[0].Get("keypair"))
+
+			registered := f.callsTo("registerSSHKeyPair")
+			if !tt.wantCreate {
+				require.Empty(t, registered)
+				return
+			}
+			require.Len(t, registered, 1)
+			require.Equal(t, "runners", registered[0].Get("name"))
+			require.Equal(t, authorizedKey(&key.PublicKey), registered[0].Get("publickey"))
+		})
+	}
+}
+
+func TestAuthorizedKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	fields := strings.Fields(authorizedKey(&key.PublicKey))
+	require.Len(t, fields, 2)
+	require.Equal(t, "ssh-rsa", fields[0])
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	require.NoError(t, err)
+
+	// The blob holds the key type, the exponent and the modulus, each
+	// prefixed with its length.
+	var parts [][]byte
+	for len(blob) > 0 {
+		require.GreaterOrEqual(t, len(blob), 4)
+		n := int(binary.BigEndian.Uint32(blob))
+		require.GreaterOrEqual(t, len(blob)-4, n)
+		parts = append(parts, blob[4:4+n])
+		blob = blob[4+n:]
+	}
+	require.Len(t, parts, 3)
+	require.Equal(t, "ssh-rsa", string(parts[0]))
+	require.Equal(t, int64(key.PublicKey.E), new(big.Int).SetBytes(parts[1]).Int64())
+	require.Equal(t, key.PublicKey.N, new(big.Int).SetBytes(parts[2]))
+	// The modulus has its high bit set, so it needs a leading zero byte.
+	require.Equal(t, byte(0), parts[2][0])
+}
+
+func TestCreateRunningInstanceKeypairAndPassword(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyPath := filepath.Join(t.TempDir(), "id_rsa")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(keyPath, keyPEM, 0o600))
+	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, &key.PublicKey, []byte("s3cret-Passw0rd"))
+	require.NoError(t, err)
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	// The template is password-enabled, so CloudStack generates a password
+	// and encrypts it with the public key of the keypair.
+	f.handleAsync("deployVirtualMachine", func(p url.Values) (any, error) {
+		return map[string]any{
+			"id": testVMID, "name": p.Get("name"), "state": "Running",
+			"keypairs": p.Get("keypair"), "passwordenabled": true,
+		}, nil
+	})
+	f.handle("listVirtualMachines", func(url.Values) (any, error) {
+		return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Running", "keypairs": "runners", "passwordenabled": true}), nil
+	})
+	f.handle("getVMPassword", func(p url.Values) (any, error) {
+		require.Equal(t, testVMID, p.Get("id"))
+		return map[string]any{"password": map[string]any{
+			"encryptedpassword": base64.StdEncoding.EncodeToString(encrypted),
+		}}, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.SSHPrivateKeyPath = keyPath })
+	runnerSpec := newTestRunnerSpec()
+	runnerSpec.SSHKeyName = "runners"
+
+	id, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.NoError(t, err)
+	calls := f.callsTo("deployVirtualMachine")
+	require.Len(t, calls, 1)
+	require.Equal(t, "runners", calls[0].Get("keypair"))
+
+	// Setting the keypair doesn't suppress the generated password.
+	password, err := cli.GetInstancePassword(context.Background(), id)
+	require.NoError(t, err)
+	require.Equal(t, "s3cret-Passw0rd", password)
+	// The password is never written to the VM tags.
+	for _, call := range f.callsTo("createTags") {
+		for _, value := range tagsFromParams(call) {
+			require.NotContains(t, value, "Passw0rd")
+		}
+	}
+}
+
+func TestCreateRunningInstancePoolAntiAffinity(t *testing.T) {
+	const groupID = "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	var groups []map[string]any
+	f.handle("listAffinityGroups", func(url.Values) (any, error) {
+		if len(groups) == 0 {
+			return map[string]any{}, nil
+		}
+		return map[string]any{"count": len(groups), "affinitygroup": groups}, nil
+	})
+	f.handleAsync("createAffinityGroup", func(p url.Values) (any, error) {
+		require.Equal(t, "garm-pool-pool-1", p.Get("name"))
+		require.Equal(t, "host anti-affinity", p.Get("type"))
+		group := map[string]any{"id": groupID, "name": p.Get("name"), "type": p.Get("type")}
+		groups = append(groups, group)
+		return group, nil
+	})
+
+	cli := newTestCli(t, f, nil)
+	for range 2 {
+		runnerSpec := newTestRunnerSpec()
+		runnerSpec.PoolAntiAffinity = true
+		_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+		require.NoError(t, err)
+	}
+
+	require.Len(t, f.callsTo("createAffinityGroup"), 1)
+	calls := f.callsTo("deployVirtualMachine")
+	require.Len(t, calls, 2)
+	for _, call := range calls {
+		require.Equal(t, groupID, call.Get("affinitygroupids"))
+	}
+}
+
+func TestCreateRunningInstanceDedication(t *testing.T) {
+	const groupID = "bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb"
+
+	tests := []struct {
+		name             string
+		dedicationGroup  string
+		ignoreDedication bool
+		requireDedicated bool
+		wantGroups       string
+		errString        string
+	}{
+		{name: "no dedication"},
+		{name: "dedication", dedicationGroup: groupID, wantGroups: groupID},
+		{name: "ignored dedication", dedicationGroup: groupID, ignoreDedication: true},
+		{name: "required dedication", dedicationGroup: groupID, requireDedicated: true, wantGroups: groupID},
+		{name: "required over ignored", dedicationGroup: groupID, ignoreDedication: true, requireDedicated: true, wantGroups: groupID},
+		{
+			name:             "required without dedication",
+			requireDedicated: true,
+			errString:        "require_dedicated is set, but no hosts or clusters are dedicated to the account or project",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			handleDedication(f, tt.dedicationGroup)
+
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.IgnoreDedication = tt.ignoreDedication })
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.RequireDedicated = tt.requireDedicated
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				require.Empty(t, f.callsTo("deployVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+			if tt.ignoreDedication && !tt.requireDedicated {
+				require.Empty(t, f.callsTo("listAffinityGroups"))
+			} else {
+				require.Equal(t, "ExplicitDedication", f.callsTo("listAffinityGroups")[0].Get("type"))
+			}
+			calls := f.callsTo("deployVirtualMachine")
+			require.Len(t, calls, 1)
+			require.Equal(t, tt.wantGroups, calls[0].Get("affinitygroupids"))
+		})
+	}
+}
+
+func TestCreateRunningInstancePoolAntiAffinityCreateRace(t *testing.T) {
+	const groupID = "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	lists := 0
+	f.handle("listAffinityGroups", func(url.Values) (any, error) {
+		lists++
+		if lists == 1 {
+			return map[string]any{}, nil
+		}
+		// Another provider process created the group in the meantime.
+		return map[string]any{"count": 1, "affinitygroup": []map[string]any{
+			{"id": groupID, "name": "garm-pool-pool-1"},
+		}}, nil
+	})
+	f.handleAsync("createAffinityGroup", func(url.Values) (any, error) {
+		return nil, &fakeAPIError{Code: 431, Text: "Unable to create affinity group, a group with name garm-pool-pool-1 already exists"}
+	})
+
+	cli := newTestCli(t, f, nil)
+	runnerSpec := newTestRunnerSpec()
+	runnerSpec.PoolAntiAffinity = true
+	_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.NoError(t, err)
+
+	calls := f.callsTo("deployVirtualMachine")
+	require.Len(t, calls, 1)
+	require.Equal(t, groupID, calls[0].Get("affinitygroupids"))
+}
+
+func TestCreateRunningInstanceAffinityGroups(t *testing.T) {
+	const (
+		dedicationGroupID = "bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb"
+		groupID1          = "cccccccc-cccc-cccc-cccc-cccccccccccc"
+		groupID2          = "dddddddd-dddd-dddd-dddd-dddddddddddd"
+	)
+
+	tests := []struct {
+		name            string
+		dedicationGroup string
+		groups          []string
+		deployErr       *fakeAPIError
+		wantGroups      string
+		errString       string
+	}{
+		{name: "no groups"},
+		{name: "groups", groups: []string{groupID1, groupID2}, wantGroups: groupID1 + "," + groupID2},
+		{
+			name:            "groups and dedication",
+			dedicationGroup: dedicationGroupID,
+			groups:          []string{groupID1},
+			wantGroups:      dedicationGroupID + "," + groupID1,
+		},
+		{
+			name:       "missing group",
+			groups:     []string{groupID1},
+			deployErr:  &fakeAPIError{Code: 431, Text: "Unable to find affinity group by id " + groupID1},
+			wantGroups: groupID1,
+			errString:  "CloudStack error 431: Unable to find affinity group by id " + groupID1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			handleDedication(f, tt.dedicationGroup)
+			if tt.deployErr != nil {
+				f.handleAsync("deployVirtualMachine", func(url.Values) (any, error) {
+					return nil, tt.deployErr
+				})
+				f.handle("listVirtualMachines", func(url.Values) (any, error) {
+					return map[string]any{}, nil
+				})
+			}
+
+			cli := newTestCli(t, f, nil)
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.AffinityGroupIDs = tt.groups
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			calls := f.callsTo("deployVirtualMachine")
+			require.Len(t, calls, 1)
+			require.Equal(t, tt.wantGroups, calls[0].Get("affinitygroupids"))
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDumpInventory(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+		require.Equal(t, "GARM_CONTROLLER_ID", p.Get("tags[0].key"))
+		require.Equal(t, "controller-1", p.Get("tags[0].value"))
+		return listVMs(
+			map[string]any{
+				"id": "vm-2", "name": "runner-b", "state": "Stopped",
+				"zoneid": testZoneID, "zonename": "zone1",
+				"serviceofferingid": testOfferingID, "serviceofferingname": "2-4096",
+				"tags": []map[string]any{{"key": "GARM_POOL_ID", "value": "pool-2"}},
+			},
+			map[string]any{
+				"id": "vm-1", "name": "runner-a", "state": "Running",
+				"zoneid": testZoneID, "zonename": "zone1",
+				"serviceofferingid": testOfferingID, "serviceofferingname": "2-4096",
+				"created":  "2024-01-15T10:20:30+0000",
+				"publicip": "203.0.113.10",
+				"nic":      []map[string]any{{"ipaddress": "10.0.0.5", "ip6address": "fd00::5"}},
+				"tags":     []map[string]any{{"key": "GARM_POOL_ID", "value": "pool-1"}},
+			},
+		), nil
+	})
+
+	now := time.Date(2024, 1, 16, 10, 20, 30, 0, time.UTC)
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+
+	cli := newTestCli(t, f, nil)
+	inventory, err := cli.DumpInventory(context.Background(), "controller-1")
+	require.NoError(t, err)
+
+	data, err := json.Marshal(inventory)
+	require.NoError(t, err)
+	require.JSONEq(t, fmt.Sprintf(`[
+		{
+			"id": "vm-1", "name": "runner-a", "pool_id": "pool-1", "state": "Running",
+			"zone_id": %[1]q, "zone_name": "zone1",
+			"service_offering_id": %[2]q, "service_offering_name": "2-4096",
+			"addresses": ["10.0.0.5", "fd00::5", "203.0.113.10"],
+			"created": "2024-01-15T10:20:30Z", "age_seconds": 86400
+		},
+		{
+			"id": "vm-2", "name": "runner-b", "pool_id": "pool-2", "state": "Stopped",
+			"zone_id": %[1]q, "zone_name": "zone1",
+			"service_offering_id": %[2]q, "service_offering_name": "2-4096",
+			"addresses": []
+		}
+	]`, testZoneID, testOfferingID), string(data))
+}
+
+func TestListTemplates(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.handle("listTemplates", func(p url.Values) (any, error) {
+		require.Equal(t, "executable", p.Get("templatefilter"))
+		require.Equal(t, testZoneID, p.Get("zoneid"))
+		return map[string]any{"count": 3, "template": []map[string]any{
+			{
+				"id": "tmpl-3", "name": "ubuntu-22.04", "displaytext": "Ubuntu 22.04 (KVM)",
+				"zoneid": testZoneID, "zonename": "zone2", "hypervisor": "KVM",
+				"ostypename": "Ubuntu 22.04 LTS", "isready": true,
+			},
+			{
+				"id": "tmpl-2", "name": "ubuntu-22.04", "displaytext": "Ubuntu 22.04 (VMware)",
+				"zoneid": testZoneID, "zonename": "zone1", "hypervisor": "VMware",
+				"ostypename": "Ubuntu 22.04 LTS", "isready": false,
+			},
+			{
+				"id": "tmpl-1", "name": "debian-12",
+				"zoneid": testZoneID, "zonename": "zone1", "hypervisor": "KVM",
+				"ostypename": "Debian GNU/Linux 12", "isready": true,
+			},
+		}}, nil
+	})
+
+	cli := newTestCli(t, f, nil)
+	templates, err := cli.ListTemplates(context.Background(), testZoneID)
+	require.NoError(t, err)
+	require.Equal(t, []TemplateInfo{
+		{
+			ID: "tmpl-1", Name: "debian-12", DisplayText: "debian-12",
+			ZoneID: testZoneID, ZoneName: "zone1", Hypervisor: "KVM",
+			OSType: "Debian GNU/Linux 12", Ready: true,
+		},
+		{
+			ID: "tmpl-2", Name: "ubuntu-22.04", DisplayText: "Ubuntu 22.04 (VMware)",
+			ZoneID: testZoneID, ZoneName: "zone1", Hypervisor: "VMware",
+			OSType: "Ubuntu 22.04 LTS",
+		},
+		{
+			ID: "tmpl-3", Name: "ubuntu-22.04", DisplayText: "Ubuntu 22.04 (KVM)",
+			ZoneID: testZoneID, ZoneName: "zone2", Hypervisor: "KVM",
+			OSType: "Ubuntu 22.04 LTS", Ready: true,
+		},
+	}, templates)
+}
+
+func TestListTemplatesFilter(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.handle("listTemplates", func(p url.Values) (any, error) {
+		return map[string]any{"count": 1, "template": []map[string]any{
+			{"id": "tmpl-1", "name": "ubuntu-24.04", "zoneid": testZoneID, "isready": true},
+		}}, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.TemplateFilter = "community" })
+	_, err := cli.ListTemplates(context.Background(), testZoneID)
+	require.NoError(t, err)
+	_, err = cli.ResolveTemplate("ubuntu-24.04", testZoneID, "")
+	require.NoError(t, err)
+
+	calls := f.callsTo("listTemplates")
+	require.Len(t, calls, 2)
+	for _, call := range calls {
+		require.Equal(t, "community", call.Get("templatefilter"))
+	}
+}
+
+func TestListInstancesByPoolErrored(t *testing.T) {
+	const erroredID = "77777777-7777-7777-7777-777777777777"
+
+	tests := []struct {
+		name         string
+		errored      string
+		autoReap     bool
+		destroyFails bool
+		want         []string
+		wantStatus   params.InstanceStatus
+		wantDestroys int
+	}{
+		{name: "reported by default", want: []string{"vm-running", erroredID}, wantStatus: params.InstanceStatusUnknown},
+		{name: "excluded", errored: config.ErroredInstancesExclude, want: []string{"vm-running"}},
+		{name: "flagged", errored: config.ErroredInstancesFlag, want: []string{"vm-running", erroredID}, wantStatus: params.InstanceError},
+		{name: "reaped", autoReap: true, want: []string{"vm-running"}, wantDestroys: 1},
+		{
+			name:         "reap failure falls back to errored_instances",
+			errored:      config.ErroredInstancesExclude,
+			autoReap:     true,
+			destroyFails: true,
+			want:         []string{"vm-running"},
+			wantDestroys: 1,
+		},
+		{
+			name:         "reap failure is reported",
+			autoReap:     true,
+			destroyFails: true,
+			want:         []string{"vm-running", erroredID},
+			wantStatus:   params.InstanceStatusUnknown,
+			wantDestroys: 1,
+		},
+		{
+			name:         "reap failure is flagged",
+			errored:      config.ErroredInstancesFlag,
+			autoReap:     true,
+			destroyFails: true,
+			want:         []string{"vm-running", erroredID},
+			wantStatus:   params.InstanceError,
+			wantDestroys: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			poolTags := []map[string]any{{"key": "GARM_POOL_ID", "value": "pool-1"}}
+			errored := map[string]any{"id": erroredID, "name": "runner-error", "state": "Error", "tags": poolTags}
+			f := newFakeCloudStack(t)
+			f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+				if p.Get("id") != "" {
+					return listVMs(errored), nil
+				}
+				return listVMs(
+					map[string]any{"id": "vm-running", "state": "Running", "tags": poolTags},
+					errored,
+				), nil
+			})
+			f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+				if tt.destroyFails {
+					return nil, &fakeAPIError{Text: "Failed to destroy vm"}
+				}
+				return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.ErroredInstances = tt.errored
+				cfg.AutoReapErrored = tt.autoReap
+			})
+			vms, err := cli.ListInstancesByPool(context.Background(), "controller-1", "pool-1")
+			require.NoError(t, err)
+
+			var got []string
+			for _, vm := range vms {
+				got = append(got, vm.Id)
+				if vm.Id == erroredID {
+					require.Equal(t, tt.wantStatus, util.CloudStackStateToStatus(vm.State, cli.Config().StatusOverrides()))
+				}
+			}
+			require.Equal(t, tt.want, got)
+			calls := f.callsTo("destroyVirtualMachine")
+			require.Len(t, calls, tt.wantDestroys)
+			if tt.wantDestroys > 0 {
+				require.Equal(t, erroredID, calls[0].Get("id"))
+			}
+		})
+	}
+}
+
+func TestCreateRunningInstanceMaxNameLength(t *testing.T) {
+	longName := "garm-" + strings.Repeat("x", 40)
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.MaxNameLength = 20 })
+
+	runnerSpec := newTestRunnerSpec()
+	runnerSpec.BootstrapParams.Name = longName
+	_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.NoError(t, err)
+
+	calls := f.callsTo("deployVirtualMachine")
+	require.Len(t, calls, 1)
+	vmName := calls[0].Get("name")
+	require.Len(t, vmName, 20)
+	require.True(t, strings.HasPrefix(vmName, "garm-xxxxxx-"))
+	require.Equal(t, longName, calls[0].Get("displayname"))
+
+	// Looking the VM up by its garm name uses the same shortened name.
+	f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+		require.Equal(t, vmName, p.Get("name"))
+		return listVMs(map[string]any{"id": testVMID, "name": vmName, "displayname": longName}), nil
+	})
+	vm, err := cli.FindOneInstance(context.Background(), "", longName)
+	require.NoError(t, err)
+	require.Equal(t, testVMID, vm.Id)
+}
+
+func TestCreateRunningInstanceTagVolumes(t *testing.T) {
+	tests := []struct {
+		name        string
+		tagVolumes  bool
+		listFails   bool
+		wantVolTags bool
+	}{
+		{name: "disabled"},
+		{name: "enabled", tagVolumes: true, wantVolTags: true},
+		{name: "volume lookup failure is not fatal", tagVolumes: true, listFails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listVolumes", func(p url.Values) (any, error) {
+				if tt.listFails {
+					return nil, &fakeAPIError{Text: "Internal error"}
+				}
+				require.Equal(t, testVMID, p.Get("virtualmachineid"))
+				require.Equal(t, "ROOT", p.Get("type"))
+				return map[string]any{"count": 1, "volume": []map[string]any{{"id": "vol-1", "type": "ROOT"}}}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.TagVolumes = tt.tagVolumes })
+			id, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+			require.NoError(t, err)
+			require.Equal(t, testVMID, id)
+
+			if !tt.tagVolumes {
+				require.Empty(t, f.callsTo("listVolumes"))
+			}
+			calls := f.callsTo("createTags")
+			if !tt.wantVolTags {
+				require.Len(t, calls, 1)
+				return
+			}
+			require.Len(t, calls, 2)
+			require.Equal(t, "Volume", calls[1].Get("resourcetype"))
+			require.Equal(t, "vol-1", calls[1].Get("resourceids"))
+			require.Equal(t, map[string]string{
+				"GARM_CONTROLLER_ID": "controller-1",
+				"GARM_POOL_ID":       "pool-1",
+			}, tagsFromParams(calls[1]))
+		})
+	}
+}
+
+func TestCreateRunningInstanceProfileTags(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+
+	cli := newTestCli(t, f, nil)
+	runnerSpec := newTestRunnerSpec()
+	runnerSpec.Tags = map[string]string{"team": "ml", "GARM_POOL_ID": "spoofed"}
+	_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.NoError(t, err)
+
+	calls := f.callsTo("createTags")
+	require.Len(t, calls, 1)
+	tags := tagsFromParams(calls[0])
+	require.Equal(t, "ml", tags["team"])
+	require.Equal(t, "pool-1", tags["GARM_POOL_ID"])
+}
+
+func TestListMethodsDeduplicateVMs(t *testing.T) {
+	poolTags := []map[string]any{
+		{"key": "GARM_CONTROLLER_ID", "value": "controller-1"},
+		{"key": "GARM_POOL_ID", "value": "pool-1"},
+	}
+	runner1 := map[string]any{"id": testVMID, "name": "runner-1", "state": "Running", "tags": poolTags}
+	runner2 := map[string]any{"id": "vm-2", "name": "runner-2", "state": "Running", "tags": poolTags}
+
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+		if p.Get("name") != "" {
+			return listVMs(runner1, runner1), nil
+		}
+		return listVMs(runner1, runner2, runner1), nil
+	})
+	cli := newTestCli(t, f, nil)
+
+	vms, err := cli.ListInstancesByPool(context.Background(), "controller-1", "pool-1")
+	require.NoError(t, err)
+	var ids []string
+	for _, vm := range vms {
+		ids = append(ids, vm.Id)
+	}
+	require.Equal(t, []string{testVMID, "vm-2"}, ids)
+
+	inventory, err := cli.DumpInventory(context.Background(), "controller-1")
+	require.NoError(t, err)
+	require.Len(t, inventory, 2)
+
+	vm, err := cli.FindOneInstance(context.Background(), "controller-1", "runner-1")
+	require.NoError(t, err)
+	require.Equal(t, testVMID, vm.Id)
+}
+
+func TestCreateRunningInstanceLeaseTTL(t *testing.T) {
+	now := time.Date(2024, 5, 1, 10, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+	prev := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = prev })
+
+	for _, ttl := range []time.Duration{0, 12 * time.Hour} {
+		f := newFakeCloudStack(t)
+		handleDeploy(f)
+		cli := newTestCli(t, f, func(cfg *config.Config) { cfg.LeaseTTL = config.Duration{Duration: ttl} })
+		_, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+		require.NoError(t, err)
+
+		calls := f.callsTo("createTags")
+		require.Len(t, calls, 1)
+		expiresAt, ok := tagsFromParams(calls[0])["GARM_EXPIRES_AT"]
+		if ttl == 0 {
+			require.False(t, ok)
+			continue
+		}
+		require.Equal(t, "2024-05-01T20:00:00Z", expiresAt)
+	}
+}
+
+func TestReapExpired(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	prev := timeNow
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = prev })
+
+	vm := func(id, state string, tags map[string]string) map[string]any {
+		vmTags := []map[string]any{{"key": "GARM_CONTROLLER_ID", "value": "controller-1"}}
+		for key, value := range tags {
+			vmTags = append(vmTags, map[string]any{"key": key, "value": value})
+		}
+		return map[string]any{"id": id, "name": "runner-" + id[:1], "state": state, "tags": vmTags}
+	}
+	const (
+		expiredID   = "11111111-1111-1111-1111-111111111111"
+		failingID   = "22222222-2222-2222-2222-222222222222"
+		activeID    = "33333333-3333-3333-3333-333333333333"
+		protectedID = "44444444-4444-4444-4444-444444444444"
+		noLeaseID   = "55555555-5555-5555-5555-555555555555"
+		invalidID   = "66666666-6666-6666-6666-666666666666"
+		destroyedID = "77777777-7777-7777-7777-777777777777"
+	)
+	expired := now.Add(-time.Minute).Format(time.RFC3339)
+	vms := []map[string]any{
+		vm(expiredID, "Running", map[string]string{"GARM_EXPIRES_AT": expired}),
+		vm(failingID, "Stopped", map[string]string{"GARM_EXPIRES_AT": expired}),
+		vm(activeID, "Running", map[string]string{"GARM_EXPIRES_AT": now.Add(time.Hour).Format(time.RFC3339)}),
+		vm(protectedID, "Running", map[string]string{"GARM_EXPIRES_AT": expired, "GARM_PROTECTED": "true"}),
+		vm(noLeaseID, "Running", nil),
+		vm(invalidID, "Running", map[string]string{"GARM_EXPIRES_AT": "tomorrow"}),
+		vm(destroyedID, "Destroyed", map[string]string{"GARM_EXPIRES_AT": expired}),
+	}
+
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+		if id := p.Get("id"); id != "" {
+			for _, v := range vms {
+				if v["id"] == id {
+					return listVMs(v), nil
+				}
+			}
+			return listVMs(), nil
+		}
+		require.Equal(t, "GARM_CONTROLLER_ID", p.Get("tags[0].key"))
+		require.Equal(t, "controller-1", p.Get("tags[0].value"))
+		return listVMs(vms...), nil
+	})
+	f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+		if p.Get("id") == failingID {
+			return nil, &fakeAPIError{Text: "Failed to destroy vm"}
+		}
+		return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+	})
+
+	cli := newTestCli(t, f, nil)
+	reaped, err := cli.ReapExpired(context.Background(), "controller-1")
+	require.ErrorContains(t, err, "failed to reap expired instance "+failingID)
+	require.Equal(t, 1, reaped)
+
+	var destroyed []string
+	for _, call := range f.callsTo("destroyVirtualMachine") {
+		destroyed = append(destroyed, call.Get("id"))
+	}
+	require.Equal(t, []string{expiredID, failingID}, destroyed)
+}
+
+func TestRemoveAllInstances(t *testing.T) {
+	vmID := func(i int) string { return fmt.Sprintf("%08d-0000-0000-0000-000000000000", i) }
+	var (
+		failingID   = vmID(1)
+		goneID      = vmID(2)
+		protectedID = vmID(3)
+		destroyedID = vmID(4)
+	)
+	var vms []map[string]any
+	for i := range 12 {
+		tags := []map[string]any{{"key": "GARM_CONTROLLER_ID", "value": "controller-1"}}
+		state := "Running"
+		switch vmID(i) {
+		case protectedID:
+			tags = append(tags, map[string]any{"key": "GARM_PROTECTED", "value": "true"})
+		case destroyedID:
+			state = "Destroyed"
+		}
+		vms = append(vms, map[string]any{"id": vmID(i), "name": fmt.Sprintf("runner-%d", i), "state": state, "tags": tags})
+	}
+
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+		if id := p.Get("id"); id != "" {
+			for _, v := range vms {
+				if v["id"] == id && id != goneID {
+					return listVMs(v), nil
+				}
+			}
+			return listVMs(), nil
+		}
+		require.Equal(t, "GARM_CONTROLLER_ID", p.Get("tags[0].key"))
+		require.Equal(t, "controller-1", p.Get("tags[0].value"))
+		return listVMs(vms...), nil
+	})
+	var inFlight, maxInFlight atomic.Int32
+	f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			peak := maxInFlight.Load()
+			if n <= peak || maxInFlight.CompareAndSwap(peak, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		if p.Get("id") == failingID {
+			return nil, &fakeAPIError{Text: "Failed to destroy vm"}
+		}
+		return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.DeleteConcurrency = 3 })
+	removed, err := cli.RemoveAllInstances(context.Background(), "controller-1")
+	require.ErrorContains(t, err, "failed to remove instance "+failingID)
+	require.ErrorContains(t, err, "Failed to destroy vm")
+	// The gone VM counts as removed; the protected and destroyed ones are skipped.
+	require.Equal(t, 9, removed)
+	require.Len(t, f.callsTo("destroyVirtualMachine"), 9)
+	require.Equal(t, int32(3), maxInFlight.Load())
+
+	for _, call := range f.callsTo("destroyVirtualMachine") {
+		require.NotContains(t, []string{goneID, protectedID, destroyedID}, call.Get("id"))
+	}
+}
+
+func TestResolveServiceOfferingScoped(t *testing.T) {
+	const domainID = "66666666-6666-6666-6666-666666666666"
+
+	f := newFakeCloudStack(t)
+	f.handle("listServiceOfferings", func(p url.Values) (any, error) {
+		require.Equal(t, "large", p.Get("name"))
+		require.Equal(t, domainID, p.Get("domainid"))
+		require.Equal(t, "ci", p.Get("account"))
+		return map[string]any{"count": 1, "serviceoffering": []map[string]any{{"id": testOfferingID, "name": "large"}}}, nil
+	})
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.Domain = domainID
+		cfg.Account = "ci"
+		cfg.SetResolvedDomainID(domainID)
+	})
+	id, err := cli.ResolveServiceOffering("large")
+	require.NoError(t, err)
+	require.Equal(t, testOfferingID, id)
+}
+
+func TestCreateRunningInstanceUniqueDisplayNames(t *testing.T) {
+	for _, unique := range []bool{false, true} {
+		f := newFakeCloudStack(t)
+		handleDeploy(f)
+		cli := newTestCli(t, f, func(cfg *config.Config) { cfg.UniqueDisplayNames = unique })
+		_, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+		require.NoError(t, err)
+		_, err = cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+		require.NoError(t, err)
+
+		calls := f.callsTo("deployVirtualMachine")
+		require.Len(t, calls, 2)
+		for _, call := range calls {
+			require.Equal(t, "runner-1", call.Get("name"))
+			if unique {
+				require.Regexp(t, `^runner-1-[0-9a-f]{6}$`, call.Get("displayname"))
+			} else {
+				require.Equal(t, "runner-1", call.Get("displayname"))
+			}
+		}
+		if unique {
+			require.NotEqual(t, calls[0].Get("displayname"), calls[1].Get("displayname"))
+		}
+		// The Name tag keeps the runner name either way.
+		for _, call := range f.callsTo("createTags") {
+			require.Equal(t, "runner-1", tagsFromParams(call)["Name"])
+		}
+	}
+}
+
+func TestCreateRunningInstanceTruncatesTagValues(t *testing.T) {
+	labels := strings.Repeat("gpu-runner,", 30)
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.MaxTagValueLength = 64 })
+	runnerSpec := newTestRunnerSpec()
+	runnerSpec.BootstrapParams.Name = "garm-" + strings.Repeat("r", 70)
+	runnerSpec.Tags = map[string]string{"labels": labels, "team": "ci"}
+	_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.NoError(t, err)
+
+	calls := f.callsTo("createTags")
+	require.Len(t, calls, 1)
+	tags := tagsFromParams(calls[0])
+	require.True(t, strings.HasPrefix(labels, tags["labels"][:55]))
+	require.Len(t, tags["labels"], 64)
+	require.Regexp(t, `^gpu-runner,.*-[0-9a-f]{8}$`, tags["labels"])
+	require.Equal(t, "ci", tags["team"])
+	// Identity tags are never shortened.
+	require.Equal(t, runnerSpec.BootstrapParams.Name, tags["Name"])
+	require.Equal(t, "controller-1", tags["GARM_CONTROLLER_ID"])
+}
+
+func TestEnsureTagsTruncatesTagValues(t *testing.T) {
+	f := newFakeCloudStack(t)
+	f.handleAsync("createTags", func(url.Values) (any, error) {
+		return map[string]any{"success": true}, nil
+	})
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.MaxTagValueLength = 40 })
+
+	name := "garm-" + strings.Repeat("r", 50)
+	vm := &cs.VirtualMachine{Id: "vm-1"}
+	changed, err := cli.EnsureTags(context.Background(), vm, map[string]string{
+		"Name":   name,
+		"labels": strings.Repeat("gpu-runner,", 10),
+	})
+	require.NoError(t, err)
+	require.True(t, changed)
+
+	calls := f.callsTo("createTags")
+	require.Len(t, calls, 1)
+	tags := tagsFromParams(calls[0])
+	require.Equal(t, name, tags["Name"])
+	require.Len(t, tags["labels"], 40)
+	require.Regexp(t, `^gpu-runner,.*-[0-9a-f]{8}$`, tags["labels"])
+}
+
+func TestCreateRunningInstanceNameCollision(t *testing.T) {
+	const otherVMID = "99999999-9999-9999-9999-999999999999"
+	ownTags := []map[string]any{
+		{"key": "GARM_CONTROLLER_ID", "value": "controller-1"},
+		{"key": "GARM_POOL_ID", "value": "pool-1"},
+	}
+
+	tests := []struct {
+		name          string
+		policy        string
+		existing      []map[string]any
+		wantID        string
+		wantName      string
+		wantDeploy    bool
+		errorContains string
+	}{
+		{
+			name:       "no policy",
+			existing:   []map[string]any{{"id": otherVMID, "name": "runner-1", "state": "Running"}},
+			wantID:     testVMID,
+			wantName:   `^runner-1$`,
+			wantDeploy: true,
+		},
+		{
+			name:       "fail without collision",
+			policy:     config.NameCollisionFail,
+			existing:   []map[string]any{{"id": otherVMID, "name": "runner-10", "state": "Running"}},
+			wantID:     testVMID,
+			wantName:   `^runner-1$`,
+			wantDeploy: true,
+		},
+		{
+			name:          "fail",
+			policy:        config.NameCollisionFail,
+			existing:      []map[string]any{{"id": otherVMID, "name": "runner-1", "state": "Running"}},
+			errorContains: "VM name runner-1 is already taken by " + otherVMID,
+		},
+		{
+			name:   "fail ignores destroyed VMs",
+			policy: config.NameCollisionFail,
+			existing: []map[string]any{
+				{"id": otherVMID, "name": "runner-1", "state": "Destroyed"},
+				{"id": "vm-expunging", "name": "runner-1", "state": "Expunging"},
+			},
+			wantID:     testVMID,
+			wantName:   `^runner-1$`,
+			wantDeploy: true,
+		},
+		{
+			name:       "suffix ignores destroyed VMs",
+			policy:     config.NameCollisionSuffix,
+			existing:   []map[string]any{{"id": otherVMID, "name": "runner-1", "state": "Destroyed"}},
+			wantID:     testVMID,
+			wantName:   `^runner-1$`,
+			wantDeploy: true,
+		},
+		{
+			name:       "suffix",
+			policy:     config.NameCollisionSuffix,
+			existing:   []map[string]any{{"id": otherVMID, "name": "runner-1", "state": "Running"}},
+			wantID:     testVMID,
+			wantName:   `^runner-1-[0-9a-f]{6}$`,
+			wantDeploy: true,
+		},
+		{
+			name:     "reuse",
+			policy:   config.NameCollisionReuse,
+			existing: []map[string]any{{"id": otherVMID, "name": "runner-1", "state": "Running", "tags": ownTags}},
+			wantID:   otherVMID,
+		},
+		{
+			name:          "reuse stopped VM",
+			policy:        config.NameCollisionReuse,
+			existing:      []map[string]any{{"id": otherVMID, "name": "runner-1", "state": "Stopped", "tags": ownTags}},
+			errorContains: "can't be reused",
+		},
+		{
+			name:          "reuse foreign VM",
+			policy:        config.NameCollisionReuse,
+			existing:      []map[string]any{{"id": otherVMID, "name": "runner-1", "state": "Running"}},
+			errorContains: "can't be reused",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(tt.existing...), nil
+			})
+			cli := newTestCli(t, f, func(cfg *config.Config) { cfg.NameCollisionPolicy = tt.policy })
+
+			id, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+			deploys := f.callsTo("deployVirtualMachine")
+			if tt.errorContains != "" {
+				require.ErrorContains(t, err, tt.errorContains)
+				require.Empty(t, deploys)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantID, id)
+			if tt.policy == "" {
+				require.Empty(t, f.callsTo("listVirtualMachines"))
+			}
+			if !tt.wantDeploy {
+				require.Empty(t, deploys)
+				return
+			}
+			require.Len(t, deploys, 1)
+			require.Regexp(t, tt.wantName, deploys[0].Get("name"))
+			require.Equal(t, "runner-1", tagsFromParams(f.callsTo("createTags")[0])["Name"])
+		})
+	}
+}
+
+func TestNameCollisionSuffixGracePeriod(t *testing.T) {
+	interval := createGracePollInterval
+	createGracePollInterval = time.Millisecond
+	t.Cleanup(func() { createGracePollInterval = interval })
+
+	const otherVMID = "99999999-9999-9999-9999-999999999999"
+	stale := time.Now().Add(-time.Hour).UTC().Format("2006-01-02T15:04:05-0700")
+	f := newFakeCloudStack(t)
+	handleServiceOffering(f)
+	handleDedication(f, "")
+	handleZone(f, "Advanced", true)
+	f.handleAsync("deployVirtualMachine", func(url.Values) (any, error) {
+		return nil, &fakeAPIError{Code: 530, Text: "Internal error executing command"}
+	})
+	f.handleAsync("createTags", func(url.Values) (any, error) {
+		return map[string]any{"success": true}, nil
+	})
+	f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+		// The colliding VM keeps the original name, the deployed one came up
+		// under the suffixed name despite the deploy error.
+		if p.Get("name") == "runner-1" {
+			return listVMs(map[string]any{"id": otherVMID, "name": "runner-1", "state": "Running", "created": stale}), nil
+		}
+		return listVMs(map[string]any{
+			"id": testVMID, "name": p.Get("name"), "state": "Running",
+			"created": time.Now().UTC().Format("2006-01-02T15:04:05-0700"),
+		}), nil
+	})
+	cli := newTestCli(t, f, func(cfg *config.Config) {
+		cfg.NameCollisionPolicy = config.NameCollisionSuffix
+		cfg.CreateGracePeriod = config.Duration{Duration: time.Second}
+	})
+
+	id, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+	require.NoError(t, err)
+	require.Equal(t, testVMID, id)
+	deployed := f.callsTo("deployVirtualMachine")[0].Get("name")
+	require.Regexp(t, `^runner-1-[0-9a-f]{6}$`, deployed)
+	lists := f.callsTo("listVirtualMachines")
+	require.Len(t, lists, 2)
+	require.Equal(t, deployed, lists[1].Get("name"))
+	calls := f.callsTo("createTags")
+	require.Len(t, calls, 1)
+	require.Equal(t, testVMID, calls[0].Get("resourceids"))
+}
+
+func TestCreateRunningInstanceDeploySummary(t *testing.T) {
+	const networkID = "88888888-8888-8888-8888-888888888888"
+
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	handleZone(f, "Advanced", false)
+	cli := newTestCli(t, f, nil)
+	var summaries []DeploySummary
+	cli.SetDeploySummaryHook(func(s DeploySummary) { summaries = append(summaries, s) })
+
+	runnerSpec := newTestRunnerSpec()
+	runnerSpec.NetworkIDs = []string{networkID}
+	id, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.NoError(t, err)
+
+	calls := f.callsTo("deployVirtualMachine")
+	require.Len(t, calls, 1)
+	udata, err := base64.StdEncoding.DecodeString(calls[0].Get("userdata"))
+	require.NoError(t, err)
+
+	require.Equal(t, []DeploySummary{{
+		VMID:                id,
+		Name:                "runner-1",
+		PoolID:              "pool-1",
+		ZoneID:              testZoneID,
+		ServiceOfferingID:   testOfferingID,
+		TemplateID:          testTemplateID,
+		NetworkIDs:          []string{networkID},
+		UserDataSize:        len(udata),
+		UserDataCompression: "none",
+	}}, summaries)
+
+	// Failed deploys produce no summary.
+	f.handleAsync("deployVirtualMachine", func(url.Values) (any, error) {
+		return nil, &fakeAPIError{Text: "Insufficient capacity"}
+	})
+	_, err = cli.CreateRunningInstance(context.Background(), runnerSpec)
+	require.Error(t, err)
+	require.Len(t, summaries, 1)
+}
+
+func TestCreateRunningInstanceTemplatePermissions(t *testing.T) {
+	const projectID = "77777777-7777-7777-7777-777777777777"
+
+	tests := []struct {
+		name       string
+		permission map[string]any
+		projectID  string
+		owned      bool
+		accounts   []map[string]any
+		errString  string
+	}{
+		{
+			name:       "public template",
+			permission: map[string]any{"ispublic": true},
+		},
+		{
+			name:       "shared with the account",
+			permission: map[string]any{"account": []string{"other", "runners"}},
+		},
+		{
+			name:       "shared with the project",
+			permission: map[string]any{"projectids": []string{projectID}},
+			projectID:  projectID,
+		},
+		{
+			name:       "owned by the account",
+			permission: map[string]any{},
+			owned:      true,
+		},
+		{
+			name:       "shared with the account, admin key",
+			permission: map[string]any{"account": []string{"runners"}},
+			accounts: []map[string]any{
+				{"name": "admin", "user": []map[string]any{{"apikey": "other-key"}}},
+				{"name": "runners", "user": []map[string]any{{"apikey": "key"}}},
+			},
+		},
+		{
+			name:       "private to another account",
+			permission: map[string]any{"account": []string{"other"}},
+			errString:  "template not deployable by this account: template " + testTemplateID + " is not public and not shared with account runners",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listTemplatePermissions", func(p url.Values) (any, error) {
+				permission := map[string]any{"id": p.Get("id")}
+				maps.Copy(permission, tt.permission)
+				return map[string]any{"count": 1, "templatepermission": []map[string]any{permission}}, nil
+			})
+			// getUser is only allowed for root admins.
+			f.handle("getUser", func(url.Values) (any, error) {
+				return nil, &fakeAPIError{Code: 432, Text: "The given command does not exist or it is not available for the user"}
+			})
+			f.handle("listAccounts", func(url.Values) (any, error) {
+				accounts := tt.accounts
+				if accounts == nil {
+					accounts = []map[string]any{{"name": "runners"}}
+				}
+				return map[string]any{"count": len(accounts), "account": accounts}, nil
+			})
+			f.handle("listTemplates", func(p url.Values) (any, error) {
+				require.Equal(t, "self", p.Get("templatefilter"))
+				if !tt.owned {
+					return map[string]any{"count": 0}, nil
+				}
+				return map[string]any{"count": 1, "template": []map[string]any{{"id": p.Get("id"), "account": "runners"}}}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.APIKey = "key"
+				cfg.CheckTemplatePermissions = true
+			})
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.ProjectID = tt.projectID
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				require.ErrorIs(t, err, ErrTemplateNotDeployable)
+				require.Empty(t, f.callsTo("deployVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, f.callsTo("deployVirtualMachine"), 1)
+			require.Empty(t, f.callsTo("getUser"))
+			// The account is only looked up when the template isn't public,
+			// shared with the project or owned by the account.
+			_, shared := tt.permission["account"]
+			require.Equal(t, shared, len(f.callsTo("listAccounts")) == 1)
+		})
+	}
+}
+
+func TestCreateRunningInstanceTemplateNotReady(t *testing.T) {
+	interval := templateRetryInterval
+	templateRetryInterval = time.Millisecond
+	t.Cleanup(func() { templateRetryInterval = interval })
+
+	notReady := &fakeAPIError{Code: 431, Text: "Template " + testTemplateID + " has not been completely downloaded to zone 1"}
+	tests := []struct {
+		name        string
+		timeout     time.Duration
+		failures    int
+		deployErr   *fakeAPIError
+		wantDeploys int
+		errString   string
+	}{
+		{name: "ready after retries", timeout: time.Minute, failures: 2, deployErr: notReady, wantDeploys: 3},
+		{name: "not retried by default", failures: 1, deployErr: notReady, wantDeploys: 1, errString: "has not been completely downloaded"},
+		{name: "budget exhausted", timeout: 20 * time.Millisecond, failures: 1000, deployErr: notReady, errString: "has not been completely downloaded"},
+		{
+			name:        "missing template is not retried",
+			timeout:     time.Minute,
+			failures:    1,
+			deployErr:   &fakeAPIError{Code: 431, Text: "Unable to use template " + testTemplateID},
+			wantDeploys: 1,
+			errString:   "Unable to use template",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			deploys := 0
+			f.handleAsync("deployVirtualMachine", func(url.Values) (any, error) {
+				deploys++
+				if deploys <= tt.failures {
+					return nil, tt.deployErr
+				}
+				return map[string]any{"id": testVMID, "state": "Running"}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.TemplateReadyTimeout = config.Duration{Duration: tt.timeout}
+			})
+			id, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+			if tt.wantDeploys > 0 {
+				require.Equal(t, tt.wantDeploys, deploys)
+			}
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testVMID, id)
+		})
+	}
+}
+
+func TestCreateRunningInstanceCleansUpOnFailure(t *testing.T) {
+	interval := readinessPollInterval
+	readinessPollInterval = time.Millisecond
+	t.Cleanup(func() { readinessPollInterval = interval })
+
+	tests := []struct {
+		name           string
+		leaveOnFailure bool
+		tagFails       bool
+		cancel         bool
+		errString      string
+		wantDestroys   int
+	}{
+		{name: "tagging fails", tagFails: true, errString: "failed to tag VM", wantDestroys: 1},
+		{name: "cancelled while waiting for readiness", cancel: true, errString: "context canceled", wantDestroys: 1},
+		{name: "leave_on_failure", leaveOnFailure: true, tagFails: true, errString: "failed to tag VM"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			if tt.tagFails {
+				f.handleAsync("createTags", func(url.Values) (any, error) {
+					return nil, &fakeAPIError{Text: "Internal error"}
+				})
+			}
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				if tt.cancel {
+					cancel()
+				}
+				return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Running"}), nil
+			})
+			f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.LeaveOnFailure = tt.leaveOnFailure
+				cfg.ReadinessTag = "GARM_READY"
+			})
+			_, err := cli.CreateRunningInstance(ctx, newTestRunnerSpec())
+			require.ErrorContains(t, err, tt.errString)
+
+			calls := f.callsTo("destroyVirtualMachine")
+			require.Len(t, calls, tt.wantDestroys)
+			if tt.wantDestroys > 0 {
+				require.Equal(t, testVMID, calls[0].Get("id"))
+			}
+		})
+	}
+}
+
+func TestCreateRunningInstanceNoCleanupWithoutVM(t *testing.T) {
+	f := newFakeCloudStack(t)
+	handleDeploy(f)
+	f.handleAsync("deployVirtualMachine", func(url.Values) (any, error) {
+		return nil, &fakeAPIError{Text: "Insufficient capacity"}
+	})
+	cli := newTestCli(t, f, nil)
+	_, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+	require.Error(t, err)
+	require.Empty(t, f.callsTo("destroyVirtualMachine"))
+}
+
+func TestListInstancesByPoolPaginates(t *testing.T) {
+	poolTags := []map[string]any{{"key": "GARM_POOL_ID", "value": "pool-1"}}
+	var all []map[string]any
+	for i := range 5 {
+		all = append(all, map[string]any{"id": fmt.Sprintf("vm-%d", i), "state": "Running", "tags": poolTags})
+	}
+
+	f := newFakeCloudStack(t)
+	f.handle("listVirtualMachines", func(p url.Values) (any, error) {
+		page, err := strconv.Atoi(p.Get("page"))
+		require.NoError(t, err)
+		pageSize, err := strconv.Atoi(p.Get("pagesize"))
+		require.NoError(t, err)
+		start := min((page-1)*pageSize, len(all))
+		end := min(start+pageSize, len(all))
+		resp := listVMs(all[start:end]...)
+		resp["count"] = len(all)
+		return resp, nil
+	})
+
+	cli := newTestCli(t, f, func(cfg *config.Config) { cfg.ListPageSize = 2 })
+	vms, err := cli.ListInstancesByPool(context.Background(), "controller-1", "pool-1")
+	require.NoError(t, err)
+	require.Len(t, vms, 5)
+
+	calls := f.callsTo("listVirtualMachines")
+	require.Len(t, calls, 3)
+	for i, call := range calls {
+		require.Equal(t, "2", call.Get("pagesize"))
+		require.Equal(t, strconv.Itoa(i+1), call.Get("page"))
+	}
+
+	// The default page size is CloudStack's default.page.size.
+	cli = newTestCli(t, f, nil)
+	_, err = cli.DumpInventory(context.Background(), "controller-1")
+	require.NoError(t, err)
+	calls = f.callsTo("listVirtualMachines")
+	require.Equal(t, "500", calls[len(calls)-1].Get("pagesize"))
+}
+
+func TestCreateRunningInstanceRootVolumeName(t *testing.T) {
+	tests := []struct {
+		name        string
+		volumeName  string
+		currentName string
+		updateFails bool
+		wantRenames int
+	}{
+		{name: "not set"},
+		{name: "renamed", volumeName: "runner-1-root", currentName: "ROOT-42", wantRenames: 1},
+		{name: "already named", volumeName: "runner-1-root", currentName: "runner-1-root"},
+		{name: "rename failure is not fatal", volumeName: "runner-1-root", currentName: "ROOT-42", updateFails: true, wantRenames: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("listVolumes", func(p url.Values) (any, error) {
+				require.Equal(t, testVMID, p.Get("virtualmachineid"))
+				require.Equal(t, "ROOT", p.Get("type"))
+				return map[string]any{"count": 1, "volume": []map[string]any{{"id": "vol-1", "name": tt.currentName, "type": "ROOT"}}}, nil
+			})
+			f.handleAsync("updateVolume", func(p url.Values) (any, error) {
+				if tt.updateFails {
+					return nil, &fakeAPIError{Text: "Internal error"}
+				}
+				return map[string]any{"id": p.Get("id"), "name": p.Get("name")}, nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.RootVolumeName = tt.volumeName
+			id, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			require.NoError(t, err)
+			require.Equal(t, testVMID, id)
+
+			if tt.volumeName == "" {
+				require.Empty(t, f.callsTo("listVolumes"))
+			}
+			calls := f.callsTo("updateVolume")
+			require.Len(t, calls, tt.wantRenames)
+			if tt.wantRenames > 0 {
+				require.Equal(t, "vol-1", calls[0].Get("id"))
+				require.Equal(t, tt.volumeName, calls[0].Get("name"))
+			}
+		})
+	}
+}
+
+func TestCreateRunningInstanceAnnotation(t *testing.T) {
+	tests := []struct {
+		name       string
+		annotation string
+		err        error
+	}{
+		{name: "not set"},
+		{name: "annotated", annotation: "Owned by the CI team"},
+		{name: "unsupported", annotation: "Owned by the CI team", err: &fakeAPIError{Code: 432, Text: "The given command does not exist or it is not available for the user"}},
+		{name: "failure is not fatal", annotation: "Owned by the CI team", err: &fakeAPIError{Text: "Internal error"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			f.handle("addAnnotation", func(p url.Values) (any, error) {
+				if tt.err != nil {
+					return nil, tt.err
+				}
+				return map[string]any{"annotation": map[string]any{
+					"id": "annotation-1", "entityid": p.Get("entityid"), "annotation": p.Get("annotation"),
+				}}, nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.Annotation = tt.annotation
+			id, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			require.NoError(t, err)
+			require.Equal(t, testVMID, id)
+
+			calls := f.callsTo("addAnnotation")
+			if tt.annotation == "" {
+				require.Empty(t, calls)
+				return
+			}
+			require.Len(t, calls, 1)
+			require.Equal(t, testVMID, calls[0].Get("entityid"))
+			require.Equal(t, "VM", calls[0].Get("entitytype"))
+			require.Equal(t, tt.annotation, calls[0].Get("annotation"))
+			require.Empty(t, f.callsTo("destroyVirtualMachine"))
+		})
+	}
+}
+
+func TestCreateRunningInstanceWaitsForIP(t *testing.T) {
+	interval := ipPollInterval
+	ipPollInterval = time.Millisecond
+	t.Cleanup(func() { ipPollInterval = interval })
+
+	tests := []struct {
+		name      string
+		ipPoll    int
+		ipv6      bool
+		ipv6Only  bool
+		errString string
+	}{
+		{name: "gets an IPv4 address", ipPoll: 3},
+		{name: "gets an IPv6 address", ipPoll: 2, ipv6: true},
+		{name: "never gets an IP", errString: "VM " + testVMID + " running but no IP assigned after 50ms"},
+		{name: "ipv6_only gets an IPv6 address", ipPoll: 2, ipv6: true, ipv6Only: true},
+		{name: "ipv6_only ignores IPv4 addresses", ipPoll: 1, ipv6Only: true, errString: "VM " + testVMID + " running but no IPv6 address assigned after 50ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			handleZone(f, "Advanced", true)
+			f.handle("listNetworks", func(url.Values) (any, error) {
+				return map[string]any{"count": 1, "network": []map[string]any{{"id": "net-a-id", "name": "net-a", "ip6cidr": "fd00::/64"}}}, nil
+			})
+			polls := 0
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				polls++
+				nic := map[string]any{"id": "nic-1"}
+				if tt.ipPoll > 0 && polls >= tt.ipPoll {
+					if tt.ipv6 {
+						nic["ip6address"] = "fd00::5"
+					} else {
+						nic["ipaddress"] = "10.0.0.5"
+					}
+				}
+				return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Running", "nic": []map[string]any{nic}}), nil
+			})
+			f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.IPWaitTimeout.Duration = 50 * time.Millisecond
+				cfg.IPv6Only = tt.ipv6Only
+			})
+			id, err := cli.CreateRunningInstance(context.Background(), newTestRunnerSpec())
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+				require.ErrorIs(t, err, context.DeadlineExceeded)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testVMID, id)
+			require.Equal(t, tt.ipPoll, polls)
+		})
+	}
+}
+
+func TestCreateRunningInstanceIPv6Only(t *testing.T) {
+	const networkID = "88888888-8888-8888-8888-888888888888"
+	ipv6Network := map[string]any{"id": networkID, "name": "net-a", "ip6cidr": "fd00::/64"}
+	requireNetwork := false
+
+	tests := []struct {
+		name       string
+		networkIDs []string
+		networks   []map[string]any
+		nic        map[string]any
+		errString  string
+	}{
+		{
+			name:       "network with an IPv6 CIDR",
+			networkIDs: []string{networkID},
+			networks:   []map[string]any{ipv6Network},
+			nic:        map[string]any{"id": "nic-1", "ip6address": "fd00::5"},
+		},
+		{
+			name:       "network without an IPv6 CIDR",
+			networkIDs: []string{networkID},
+			networks:   []map[string]any{{"id": networkID, "name": "net-a"}},
+			errString:  "network net-a (" + networkID + ") has no IPv6 CIDR, but ipv6_only is set",
+		},
+		{
+			name:       "network not in the zone",
+			networkIDs: []string{networkID},
+			errString:  "network " + networkID + " not found in zone " + testZoneID,
+		},
+		{
+			name:     "default network with an IPv6 CIDR",
+			networks: []map[string]any{ipv6Network},
+			nic:      map[string]any{"id": "nic-1", "ip6address": "fd00::5"},
+		},
+		{
+			name:      "default network without an IPv6 CIDR",
+			networks:  []map[string]any{{"id": networkID, "name": "net-a"}},
+			errString: "network net-a (" + networkID + ") has no IPv6 CIDR, but ipv6_only is set",
+		},
+		{
+			name:      "no single default network",
+			networks:  []map[string]any{ipv6Network, {"id": "net-b-id", "name": "net-b", "ip6cidr": "fd01::/64"}},
+			errString: "zone " + testZoneID + " has 2 networks usable for deploy",
+		},
+		{
+			name:       "VM without an IPv6 address",
+			networkIDs: []string{networkID},
+			networks:   []map[string]any{ipv6Network},
+			nic:        map[string]any{"id": "nic-1", "ipaddress": "10.0.0.5"},
+			errString:  "VM " + testVMID + " has no IPv6 address, but ipv6_only is set",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			handleZone(f, "Advanced", false)
+			f.handle("listNetworks", func(p url.Values) (any, error) {
+				require.Equal(t, testZoneID, p.Get("zoneid"))
+				return map[string]any{"count": len(tt.networks), "network": tt.networks}, nil
+			})
+			f.handle("listVirtualMachines", func(url.Values) (any, error) {
+				return listVMs(map[string]any{"id": testVMID, "name": "runner-1", "state": "Running", "nic": []map[string]any{tt.nic}}), nil
+			})
+			f.handleAsync("destroyVirtualMachine", func(p url.Values) (any, error) {
+				return map[string]any{"id": p.Get("id"), "state": "Destroyed"}, nil
+			})
+
+			cli := newTestCli(t, f, func(cfg *config.Config) {
+				cfg.IPv6Only = true
+				if len(tt.networkIDs) == 0 {
+					cfg.RequireNetwork = &requireNetwork
+				}
+			})
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.NetworkIDs = tt.networkIDs
+
+			id, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			// All networks are checked with one listNetworks call.
+			calls := f.callsTo("listNetworks")
+			require.Len(t, calls, 1)
+			if len(tt.networkIDs) == 0 {
+				require.Equal(t, "true", calls[0].Get("canusefordeploy"))
+			}
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+				if tt.nic == nil {
+					require.Empty(t, f.callsTo("deployVirtualMachine"))
+				}
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testVMID, id)
+		})
+	}
+}
+
+func TestCreateRunningInstanceNetworkACL(t *testing.T) {
+	const (
+		networkID = "88888888-8888-8888-8888-888888888888"
+		aclID     = "acl-1"
+	)
+	allowHTTPS := map[string]any{"number": 10, "traffictype": "Egress", "protocol": "tcp", "startport": "443", "endport": "443", "action": "Allow"}
+
+	tests := []struct {
+		name        string
+		networkACL  string
+		network     map[string]any
+		rules       []map[string]any
+		callbackURL string
+		errString   string
+	}{
+		{
+			name:       "ACL allows the controller port",
+			networkACL: "runners-acl",
+			rules:      []map[string]any{allowHTTPS},
+		},
+		{
+			name:       "ACL referenced by ID",
+			networkACL: aclID,
+			rules:      []map[string]any{allowHTTPS},
+		},
+		{
+			name:       "ACL without egress rules",
+			networkACL: "runners-acl",
+			rules: []map[string]any{
+				{"number": 1, "traffictype": "Ingress", "protocol": "tcp", "startport": "22", "endport": "22", "action": "Allow"},
+			},
+		},
+		{
+			name:       "lower numbered rule denies the port",
+			networkACL: "runners-acl",
+			rules: []map[string]any{
+				{"number": 20, "traffictype": "Egress", "protocol": "all", "action": "Allow"},
+				{"number": 5, "traffictype": "Egress", "protocol": "tcp", "startport": "1", "endport": "1024", "action": "Deny"},
+			},
+			errString: "network ACL runners-acl does not allow egress to TCP port 443 of the garm controller",
+		},
+		{
+			name:        "no rule matches the controller port",
+			networkACL:  "runners-acl",
+			rules:       []map[string]any{allowHTTPS},
+			callbackURL: "http://garm.example.com:9997/api/v1/callbacks",
+			errString:   "network ACL runners-acl does not allow egress to TCP port 9997 of the garm controller",
+		},
+		{
+			name:       "network uses another ACL",
+			networkACL: "other-acl",
+			errString:  "network runners (" + networkID + ") uses network ACL runners-acl, not network_acl other-acl",
+		},
+		{
+			name:       "network without ACL",
+			networkACL: "runners-acl",
+			network:    map[string]any{"id": networkID, "name": "runners"},
+			errString:  "network runners (" + networkID + ") has no network ACL, but network_acl is runners-acl",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeCloudStack(t)
+			handleDeploy(f)
+			handleZone(f, "Advanced", false)
+			f.handle("listNetworks", func(p url.Values) (any, error) {
+				require.Equal(t, networkID, p.Get("id"))
+				network := tt.network
+				if network == nil {
+					network = map[string]any{"id": networkID, "name": "runners", "aclid": aclID, "aclname": "runners-acl"}
+				}
+				return map[string]any{"count": 1, "network": []map[string]any{network}}, nil
+			})
+			f.handle("listNetworkACLs", func(p url.Values) (any, error) {
+				require.Equal(t, aclID, p.Get("aclid"))
+				return map[string]any{"count": len(tt.rules), "networkacl": tt.rules}, nil
+			})
+
+			cli := newTestCli(t, f, nil)
+			runnerSpec := newTestRunnerSpec()
+			runnerSpec.NetworkIDs = []string{networkID}
+			runnerSpec.NetworkACL = tt.networkACL
+			runnerSpec.BootstrapParams.CallbackURL = "https://garm.example.com/api/v1/callbacks"
+			if tt.callbackURL != "" {
+				runnerSpec.BootstrapParams.CallbackURL = tt.callbackURL
+			}
+
+			_, err := cli.CreateRunningInstance(context.Background(), runnerSpec)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				require.Empty(t, f.callsTo("deployVirtualMachine"))
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, f.callsTo("deployVirtualMachine"), 1)
+		})
+	}
+}
@@ -0,0 +1,321 @@
+// SPDX-License-Identifier: Apache-2.0
+// Copyright 2024 Cloudbase Solutions SRL
+//
+//    Licensed under the Apache License, Version 2.0 (the "License"); you may
+//    not use this file except in compliance with the License. You may obtain
+//    a copy of the License at
+//
+//         http://www.apache.org/licenses/LICENSE-2.0
+//
+//    Unless required by applicable law or agreed to in writing, software
+//    distributed under the License is distributed on an "AS IS" BASIS, WITHOUT
+//    WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied. See the
+//    License for the specific language governing permissions and limitations
+//    under the License.
+
+package spec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/cloudbase/garm-provider-common/cloudconfig"
+	"github.com/cloudbase/garm-provider-common/defaults"
+	"github.com/cloudbase/garm-provider-common/params"
+)
+
+// posixNameRegex matches valid Linux user and group names.
+var posixNameRegex = regexp.MustCompile(`^[a-z_][a-z0-9_-]{0,31}$`)
+
+// validateRunnerUser checks the runner_user and runner_groups extra specs.
+func (r *RunnerSpec) validateRunnerUser() error {
+	if r.RunnerUser != "" {
+		if !posixNameRegex.MatchString(r.RunnerUser) {
+			return fmt.Errorf("invalid runner_user %q", r.RunnerUser)
+		}
+		if r.RunnerUser == "root" {
+			return fmt.Errorf("runner_user cannot be root")
+		}
+	}
+	for _, group := range r.RunnerGroups {
+		if !posixNameRegex.MatchString(group) {
+			return fmt.Errorf("invalid runner group %q", group)
+		}
+	}
+	return nil
+}
+
+// sshKeyTypes lists the public key algorithms accepted in authorized_keys.
+var sshKeyTypes = map[string]bool{
+	"ssh-rsa":                            true,
+	"ssh-dss":                            true,
+	"ssh-ed25519":                        true,
+	"ecdsa-sha2-nistp256":                true,
+	"ecdsa-sha2-nistp384":                true,
+	"ecdsa-sha2-nistp521":                true,
+	"sk-ssh-ed25519@openssh.com":         true,
+	"sk-ecdsa-sha2-nistp256@openssh.com": true,
+}
+
+// validateAuthorizedKey checks that key looks like an OpenSSH public key: a
+// known key type followed by a base64 blob that encodes the same type.
+func validateAuthorizedKey(key string) error {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return fmt.Errorf("invalid authorized key %q: expected \"<type> <base64-key> [comment]\"", key)
+	}
+	keyType := fields[0]
+	if !sshKeyTypes[keyType] {
+		return fmt.Errorf("invalid authorized key: unsupported key type %q", keyType)
+	}
+	blob, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil {
+		return fmt.Errorf("invalid authorized key of type %q: %w", keyType, err)
+	}
+	if len(blob) < 4 {
+		return fmt.Errorf("invalid authorized key of type %q: key data too short", keyType)
+	}
+	typeLen := binary.BigEndian.Uint32(blob)
+	if uint64(len(blob)-4) < uint64(typeLen) || !bytes.Equal(blob[4:4+typeLen], []byte(keyType)) {
+		return fmt.Errorf("invalid authorized key: key data does not match type %q", keyType)
+	}
+	return nil
+}
+
+// runnerUser returns the user the runner is installed as.
+func (r *RunnerSpec) runnerUser() string {
+	if r.RunnerUser != "" {
+		return r.RunnerUser
+	}
+	return defaults.DefaultUser
+}
+
+// runnerGroups returns the supplementary groups of the runner user.
+func (r *RunnerSpec) runnerGroups() []string {
+	if len(r.RunnerGroups) > 0 {
+		return r.RunnerGroups
+	}
+	return defaults.DefaultUserGroups
+}
+
+// runnerInstallScript renders the runner install script. It mirrors
+// cloudconfig.GetRunnerInstallScript, which always installs the runner as
+// defaults.DefaultUser.
+func (r *RunnerSpec) runnerInstallScript(bootstrapParams params.BootstrapInstance) ([]byte, error) {
+	if r.Tools.GetFilename() == "" {
+		return nil, fmt.Errorf("missing tools filename")
+	}
+	if r.Tools.GetDownloadURL() == "" {
+		return nil, fmt.Errorf("missing tools download URL")
+	}
+
+	specs, err := cloudconfig.GetSpecs(bootstrapParams)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get cloud config specs: %w", err)
+	}
+
+	user := r.runnerUser()
+	installParams := cloudconfig.InstallRunnerParams{
+		FileName:          r.Tools.GetFilename(),
+		DownloadURL:       r.Tools.GetDownloadURL(),
+		TempDownloadToken: r.Tools.GetTempDownloadToken(),
+		MetadataURL:       bootstrapParams.MetadataURL,
+		RunnerUsername:    user,
+		RunnerGroup:       user,
+		RepoURL:           bootstrapParams.RepoURL,
+		RunnerName:        bootstrapParams.Name,
+		RunnerLabels:      strings.Join(bootstrapParams.Labels, ","),
+		CallbackURL:       bootstrapParams.CallbackURL,
+		CallbackToken:     bootstrapParams.InstanceToken,
+		GitHubRunnerGroup: bootstrapParams.GitHubRunnerGroup,
+		ExtraContext:      specs.ExtraContext,
+		EnableBootDebug:   bootstrapParams.UserDataOptions.EnableBootDebug,
+		UseJITConfig:      bootstrapParams.JitConfigEnabled,
+	}
+	if len(bootstrapParams.CACertBundle) > 0 {
+		installParams.CABundle = string(bootstrapParams.CACertBundle)
+	}
+
+	script, err := cloudconfig.InstallRunnerScript(installParams, bootstrapParams.OSType, string(specs.RunnerInstallTemplate))
+	if err != nil {
+		return nil, fmt.Errorf("failed to render runner install script: %w", err)
+	}
+	return script, nil
+}
+
+// linuxCloudConfig builds the cloud-init config for Linux runners. It mirrors
+// cloudconfig.GetCloudInitConfig, but lets the runner user and its groups be
+// customized.
+func (r *RunnerSpec) linuxCloudConfig(bootstrapParams params.BootstrapInstance) (string, error) {
+	installScript, err := r.runnerInstallScript(bootstrapParams)
+	if err != nil {
+		return "", err
+	}
+	specs, err := cloudconfig.GetSpecs(bootstrapParams)
+	if err != nil {
+		return "", fmt.Errorf("failed to get cloud config specs: %w", err)
+	}
+
+	user := r.runnerUser()
+	cloudCfg := cloudconfig.NewDefaultCloudInitConfig()
+	cloudCfg.SystemInfo.DefaultUser.Name = user
+	cloudCfg.SystemInfo.DefaultUser.Home = fmt.Sprintf("/home/%s", user)
+	cloudCfg.SystemInfo.DefaultUser.Groups = r.runnerGroups()
+
+	if bootstrapParams.UserDataOptions.DisableUpdatesOnBoot {
+		cloudCfg.PackageUpgrade = false
+		cloudCfg.Packages = []string{}
+	}
+	cloudCfg.AddPackage(bootstrapParams.UserDataOptions.ExtraPackages...)
+
+	names := make([]string, 0, len(specs.PreInstallScripts))
+	for name := range specs.PreInstallScripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := fmt.Sprintf("/garm-pre-install/%s", name)
+		cloudCfg.AddFile(specs.PreInstallScripts[name], path, "root:root", "755")
+		cloudCfg.AddRunCmd(path)
+	}
+	cloudCfg.AddRunCmd("rm -rf /garm-pre-install")
+
+	cloudCfg.AddSSHKey(bootstrapParams.SSHKeys...)
+	cloudCfg.AddSSHKey(r.AuthorizedKeys...)
+	dropIn := r.mountsDropIn()
+	installsDropIn := false
+	if dropIn != nil {
+		cloudCfg.AddFile(dropIn, mountsDropInStagingPath, "root:root", "644")
+		installScript, installsDropIn = withMountsDropIn(installScript)
+	}
+	cloudCfg.AddFile(installScript, "/install_runner.sh", "root:root", "755")
+	cloudCfg.AddRunCmd(fmt.Sprintf("su -l -c /install_runner.sh %s", user))
+	cloudCfg.AddRunCmd("rm -f /install_runner.sh")
+	if dropIn != nil && !installsDropIn {
+		// A custom runner_install_template starts the service in a way
+		// withMountsDropIn doesn't know, so the drop-in can only be added
+		// once the install script is done.
+		cloudCfg.AddRunCmd(installMountsDropInCmd(user))
+	}
+	if len(bootstrapParams.CACertBundle) > 0 {
+		if err := cloudCfg.AddCACert(bootstrapParams.CACertBundle); err != nil {
+			return "", fmt.Errorf("failed to add CA cert bundle: %w", err)
+		}
+	}
+
+	asStr, err := cloudCfg.Serialize()
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize cloud config: %w", err)
+	}
+	return asStr, nil
+}
+
+// mountsDropInStagingPath is where the runner service drop-in of
+// wait_for_mounts is written to until the service name is known.
+const mountsDropInStagingPath = "/etc/garm/runner-mounts.conf"
+
+// mountsDropIn returns a systemd drop-in that makes the runner service require
+// the NFS mounts, or nil if wait_for_mounts is off or there are no mounts.
+func (r *RunnerSpec) mountsDropIn() []byte {
+	if !r.WaitForMounts {
+		return nil
+	}
+	mounts := r.nfsMounts()
+	if len(mounts) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(mounts))
+	for _, mount := range mounts {
+		paths = append(paths, mount.MountPath)
+	}
+	return fmt.Appendf(nil, "[Unit]\nRequiresMountsFor=%s\nAfter=remote-fs.target\n", strings.Join(paths, " "))
+}
+
+// installMountsDropInCmd returns the command moving the wait_for_mounts drop-in
+// into place. The runner service is named after the runner registration, so
+// its name is only known once the install script wrote it to .service.
+func installMountsDropInCmd(user string) string {
+	return fmt.Sprintf(`svc=$(cat /home/%s/actions-runner/.service) && mkdir -p "/etc/systemd/system/$svc.d" && mv %s "/etc/systemd/system/$svc.d/10-garm-mounts.conf" && systemctl daemon-reload`,
+		user, mountsDropInStagingPath)
+}
+
+// runnerServiceStartCmds are the lines of the default runner install script
+// that start the runner service, with and without JIT config.
+var runnerServiceStartCmds = []string{
+	"sudo systemctl start $SVC_NAME",
+	"sudo ./svc.sh start",
+}
+
+// withMountsDropIn inserts the wait_for_mounts drop-in install into the runner
+// install script, right before the runner service is first started, so that
+// start already waits for the mounts. It reports whether the script starts
+// the service in a known way, and so got the drop-in.
+func withMountsDropIn(script []byte) ([]byte, bool) {
+	install := fmt.Sprintf(`svc=$(cat "$RUN_HOME"/.service) && sudo mkdir -p "/etc/systemd/system/$svc.d" && sudo mv %s "/etc/systemd/system/$svc.d/10-garm-mounts.conf" && sudo systemctl daemon-reload || fail "failed to install mounts drop-in"`,
+		mountsDropInStagingPath)
+	found := false
+	for _, start := range runnerServiceStartCmds {
+		if bytes.Contains(script, []byte(start)) {
+			script = bytes.Replace(script, []byte(start), []byte(install+"\n"+start), 1)
+			found = true
+		}
+	}
+	return script, found
+}
+
+// vendorDataContentType returns the cloud-init MIME type of a vendor_data
+// payload, which must be a cloud-config document or a script.
+func vendorDataContentType(data []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("#cloud-config")):
+		return "text/cloud-config", nil
+	case bytes.HasPrefix(data, []byte("#!")):
+		return "text/x-shellscript", nil
+	}
+	return "", fmt.Errorf("invalid vendor_data: must be a #cloud-config document or a script starting with #!")
+}
+
+// withVendorData combines the runner cloud-config and the vendor_data payload
+// into a multipart MIME user data, so cloud-init processes the vendor data as
+// a document of its own instead of having it merged into the runner config.
+func withVendorData(cloudCfg string, vendorData []byte) (string, error) {
+	vendorType, err := vendorDataContentType(vendorData)
+	if err != nil {
+		return "", err
+	}
+
+	var body bytes.Buffer
+	mp := multipart.NewWriter(&body)
+	parts := []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{name: "garm-runner", contentType: "text/cloud-config", data: []byte(cloudCfg)},
+		{name: "vendor-data", contentType: vendorType, data: vendorData},
+	}
+	for _, part := range parts {
+		w, err := mp.CreatePart(textproto.MIMEHeader{
+			"Content-Type":        {part.contentType + `; charset="utf-8"`},
+			"Content-Disposition": {fmt.Sprintf("attachment; filename=%q", part.name)},
+		})
+		if err != nil {
+			return "", err
+		}
+		if _, err := w.Write(part.data); err != nil {
+			return "", err
+		}
+	}
+	if err := mp.Close(); err != nil {
+		return "", err
+	}
+	header := fmt.Sprintf("Content-Type: multipart/mixed; boundary=%q\nMIME-Version: 1.0\n\n", mp.Boundary())
+	return header + body.String(), nil
+}
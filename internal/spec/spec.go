@@ -19,10 +19,18 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
 	"github.com/cloudbase/garm-provider-cloudstack/config"
 	"github.com/cloudbase/garm-provider-common/cloudconfig"
@@ -36,6 +44,93 @@ type ToolFetchFunc func(osType params.OSType, osArch params.OSArch, tools []para
 
 var DefaultToolFetch ToolFetchFunc = util.GetTools
 
+// ToolFetchRetries is how many times DefaultToolFetch is retried when it fails
+// transiently, with exponential backoff starting at a second (default: 0 - no
+// retries). util.GetTools never does, so this is only for programs that plug
+// in a DefaultToolFetch that fetches the tools over the network.
+var ToolFetchRetries int
+
+// DiskOfferingResolveFunc returns the UUID of the disk offering name or UUID
+// of the disk_offering_id extra spec.
+type DiskOfferingResolveFunc func(cfg *config.Config, nameOrID string) (string, error)
+
+// DefaultDiskOfferingResolve looks disk offering names up with a client of the
+// provider config, like the config does for its zone and template names.
+var DefaultDiskOfferingResolve DiskOfferingResolveFunc = func(cfg *config.Config, nameOrID string) (string, error) {
+	return cfg.LookupDiskOffering(cfg.NewClient(), nameOrID)
+}
+
+// TemplateArchFunc returns the architecture a template name or UUID reports,
+// or an empty string if it reports none.
+type TemplateArchFunc func(cfg *config.Config, nameOrID string) (string, error)
+
+// DefaultTemplateArch looks the template up with a client of the provider
+// config. It is only called for runners without an architecture.
+var DefaultTemplateArch TemplateArchFunc = func(cfg *config.Config, nameOrID string) (string, error) {
+	return cfg.TemplateArch(cfg.NewClient(), nameOrID)
+}
+
+// toolFetchBackoff is how long fetchTools waits before its first retry. The
+// wait doubles with every retry.
+var toolFetchBackoff = time.Second
+
+// ErrTransientToolFetch marks a DefaultToolFetch error as transient. Only
+// errors wrapping it, or implementing Temporary() bool and reporting true, are
+// retried ToolFetchRetries times.
+var ErrTransientToolFetch = errors.New("transient tool fetch failure")
+
+// fetchTools picks the runner tools with DefaultToolFetch, retrying transient
+// failures up to retries times with exponential backoff, for as long as ctx
+// allows. Other failures are returned at once.
+func fetchTools(ctx context.Context, data params.BootstrapInstance, retries int) (params.RunnerApplicationDownload, error) {
+	backoff := toolFetchBackoff
+	for attempt := 0; ; attempt++ {
+		tools, err := DefaultToolFetch(data.OSType, data.OSArch, data.Tools)
+		if err == nil || attempt >= retries || !isTransientToolFetchErr(err) {
+			return tools, err
+		}
+		slog.Debug("fetchTools: retrying tool fetch",
+			"instance_name", data.Name,
+			"attempt", attempt+1,
+			"backoff", backoff,
+			"error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return tools, fmt.Errorf("%w (gave up retrying: %w)", err, ctx.Err())
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func isTransientToolFetchErr(err error) bool {
+	if errors.Is(err, ErrTransientToolFetch) {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// filterToolsByVersion returns the tools of runner version, as named in their
+// file names, such as actions-runner-linux-x64-2.311.0.tar.gz. A leading "v"
+// of version is ignored.
+func filterToolsByVersion(tools []params.RunnerApplicationDownload, version string) ([]params.RunnerApplicationDownload, error) {
+	suffix := "-" + strings.TrimPrefix(version, "v")
+	var matching []params.RunnerApplicationDownload
+	for _, tool := range tools {
+		name := strings.TrimSuffix(strings.TrimSuffix(tool.GetFilename(), ".tar.gz"), ".zip")
+		if strings.HasSuffix(name, suffix) {
+			matching = append(matching, tool)
+		}
+	}
+	if len(matching) == 0 {
+		return nil, fmt.Errorf("no runner tools of runner_version %s", version)
+	}
+	return matching, nil
+}
+
 // NFSMount defines an NFS mount to be configured on the runner VM.
 type NFSMount struct {
 	Server     string `json:"server" jsonschema:"description=NFS server hostname or IP address,required"`
@@ -43,20 +138,57 @@ type NFSMount struct {
 	MountPath  string `json:"mount_path" jsonschema:"description=Local mount point on the runner VM,required"`
 	Options    string `json:"options,omitempty" jsonschema:"description=Mount options (default: nfsvers=4,ro,soft,timeo=30)"`
 	ReadWrite  bool   `json:"read_write,omitempty" jsonschema:"description=Mount as read-write instead of read-only (default: false)"`
+	OSType     string `json:"os_type,omitempty" jsonschema:"enum=linux,enum=windows,description=Only apply the mount to runners of this OS type (default: all)"`
 }
 
 // extraSpecs defines CloudStack-specific extensions to BootstrapInstance.ExtraSpecs.
 type extraSpecs struct {
-	ZoneID            *string    `json:"zone_id,omitempty" jsonschema:"description=Override the default zone ID."`
-	ServiceOfferingID *string    `json:"service_offering_id,omitempty" jsonschema:"description=Override the default service offering ID."`
-	TemplateID        *string    `json:"template_id,omitempty" jsonschema:"description=Override the default template ID."`
-	NetworkIDs        []string   `json:"network_ids,omitempty" jsonschema:"description=List of network IDs to attach to the instance."`
-	SSHKeyName        *string    `json:"ssh_key_name,omitempty" jsonschema:"description=Name of the SSH keypair to use for the instance."`
-	ProjectID         *string    `json:"project_id,omitempty" jsonschema:"description=CloudStack project ID to deploy the instance into."`
-	DisableUpdates    *bool      `json:"disable_updates,omitempty" jsonschema:"description=Disable automatic updates on the VM."`
-	EnableBootDebug   *bool      `json:"enable_boot_debug,omitempty" jsonschema:"description=Enable boot debug on the VM."`
-	ExtraPackages     []string   `json:"extra_packages,omitempty" jsonschema:"description=Extra packages to install on the VM."`
-	NFSMounts         []NFSMount `json:"nfs_mounts,omitempty" jsonschema:"description=List of NFS mounts to configure on the runner VM."`
+	Profile           *string           `json:"profile,omitempty" jsonschema:"description=Name of a deployment profile from the provider config. Explicit extra specs override its settings."`
+	ZoneID            *string           `json:"zone_id,omitempty" jsonschema:"description=Override the default zone ID."`
+	ServiceOfferingID *string           `json:"service_offering_id,omitempty" jsonschema:"description=Override the default service offering ID."`
+	TemplateID        *string           `json:"template_id,omitempty" jsonschema:"description=Override the default template ID."`
+	NetworkIDs        []string          `json:"network_ids,omitempty" jsonschema:"description=List of network IDs to attach to the instance."`
+	NetworkACL        *string           `json:"network_acl,omitempty" jsonschema:"description=Name or ID of the network ACL list the network_ids must use. Its egress rules must allow the runner to reach the garm controller."`
+	SecurityGroups    []string          `json:"security_groups,omitempty" jsonschema:"description=Security group names or IDs to apply to the instance. Used in basic zones and security group enabled advanced zones."`
+	SSHKeyName        *string           `json:"ssh_key_name,omitempty" jsonschema:"description=Name of the SSH keypair to use for the instance."`
+	SSHPublicKey      *string           `json:"ssh_public_key,omitempty" jsonschema:"description=OpenSSH public key registered as a keypair for this runner only. It is deleted when the runner is destroyed."`
+	ProjectID         *string           `json:"project_id,omitempty" jsonschema:"description=CloudStack project ID to deploy the instance into."`
+	DisableUpdates    *bool             `json:"disable_updates,omitempty" jsonschema:"description=Disable automatic updates on the VM."`
+	EnableBootDebug   *bool             `json:"enable_boot_debug,omitempty" jsonschema:"description=Enable boot debug on the VM."`
+	ExtraPackages     []string          `json:"extra_packages,omitempty" jsonschema:"description=Extra packages to install on the VM."`
+	MergeStrategy     *string           `json:"merge_strategy,omitempty" jsonschema:"enum=append,enum=replace,description=How extra_packages and pre_install_scripts combine with the config defaults: append to them (default) or replace them."`
+	NFSMounts         []NFSMount        `json:"nfs_mounts,omitempty" jsonschema:"description=List of NFS mounts to configure on the runner VM."`
+	WaitForMounts     *bool             `json:"wait_for_mounts,omitempty" jsonschema:"description=Make the runner service require the nfs_mounts so jobs only run once they are mounted. Linux only."`
+	DHCPOptions       map[string]string `json:"dhcp_options,omitempty" jsonschema:"description=DHCP options to set on the instance NICs. Keys are option codes (e.g. 114 or dhcp:114) or well-known option names."`
+	SnapshotID        *string           `json:"snapshot_id,omitempty" jsonschema:"description=ID of a ROOT volume snapshot to create the root disk from instead of the template."`
+	CPUNumber         *int              `json:"cpu_number,omitempty" jsonschema:"description=Number of vCPUs for a custom service offering."`
+	MemoryMB          *int              `json:"memory_mb,omitempty" jsonschema:"description=Memory in MB for a custom service offering."`
+	RootDiskSize      *int              `json:"root_disk_size,omitempty" jsonschema:"minimum=0,description=Size of the root disk in GB. Overrides the size of the template."`
+	DiskOfferingID    *string           `json:"disk_offering_id,omitempty" jsonschema:"description=Name or ID of a disk offering to attach a data disk with."`
+	DataDiskSize      *int              `json:"data_disk_size,omitempty" jsonschema:"minimum=0,description=Size of the data disk in GB. Requires disk_offering_id with a custom disk offering."`
+	CPUPinning        *bool             `json:"cpu_pinning,omitempty" jsonschema:"description=Pin the vCPUs of the instance to dedicated host CPUs."`
+	NUMANode          *int              `json:"numa_node,omitempty" jsonschema:"minimum=0,description=Host NUMA node the pinned vCPUs and memory are placed on. Requires cpu_pinning."`
+	MinIOPS           *int64            `json:"min_iops,omitempty" jsonschema:"minimum=1,description=Minimum IOPS of the root disk. Requires a service offering with custom IOPS and max_iops."`
+	MaxIOPS           *int64            `json:"max_iops,omitempty" jsonschema:"minimum=1,description=Maximum IOPS of the root disk. Requires a service offering with custom IOPS and min_iops."`
+	DynamicScaling    *bool             `json:"enable_dynamic_scaling,omitempty" jsonschema:"description=Deploy the instance with dynamic scaling enabled so it can be resized while running. Requires a service offering with dynamic scaling."`
+	StoragePoolID     *string           `json:"storage_pool_id,omitempty" jsonschema:"description=ID of the primary storage pool to place the root volume on. Must be in the deploy zone."`
+	StoragePoolTag    *string           `json:"storage_pool_tag,omitempty" jsonschema:"description=Storage tag selecting the primary storage the root volume is placed on."`
+	Annotation        *string           `json:"annotation,omitempty" jsonschema:"description=Note added to the instance with the CloudStack annotation API after the deploy. Skipped on CloudStack versions without annotations."`
+	RootVolumeName    *string           `json:"root_volume_name,omitempty" jsonschema:"description=Name to give the ROOT volume of the instance. Supports the tag_templates placeholders such as {{.Name}}."`
+	Details           map[string]string `json:"details,omitempty" jsonschema:"description=Extra details passed to deployVirtualMachine. Keys must be in the allowed details list."`
+	PoolAntiAffinity  *bool             `json:"pool_anti_affinity,omitempty" jsonschema:"description=Spread the runners of the pool across hosts with an automatically managed host anti-affinity group."`
+	AffinityGroupIDs  []string          `json:"affinity_group_ids,omitempty" jsonschema:"description=IDs of existing affinity groups to deploy the instance into."`
+	RequireDedicated  *bool             `json:"require_dedicated,omitempty" jsonschema:"description=Fail the deploy unless hosts or clusters are explicitly dedicated to the account or project."`
+	RunnerVersion     *string           `json:"runner_version,omitempty" jsonschema:"description=Runner version to install (e.g. 2.311.0) instead of the one garm picks. Must be among the tools garm offers."`
+	RunnerUser        *string           `json:"runner_user,omitempty" jsonschema:"description=Linux user the runner is installed and run as (default: runner)."`
+	RunnerGroups      []string          `json:"runner_groups,omitempty" jsonschema:"description=Supplementary groups of the Linux runner user. Replaces the default group list."`
+	VendorData        []byte            `json:"vendor_data,omitempty" jsonschema:"description=Base64 encoded cloud-init vendor-data (a #cloud-config document or a script) added to the Linux user data as a separate part."`
+	AuthorizedKeys    []string          `json:"authorized_keys,omitempty" jsonschema:"description=Additional SSH public keys to authorize for the Linux runner user on top of the keypair."`
+	WindowsUserdata   *string           `json:"windows_userdata_mode,omitempty" jsonschema:"enum=powershell,enum=cloudconfig,description=How Windows user data is packaged: a <powershell> block (default) or a cloudbase-init #cloud-config document. Ignored for Linux."`
+	WindowsTimezone   *string           `json:"windows_timezone,omitempty" jsonschema:"description=Windows time zone ID to set on boot (e.g. W. Europe Standard Time). Ignored for Linux."`
+	WindowsKeyboard   *string           `json:"windows_keyboard_layout,omitempty" jsonschema:"description=Language tag whose keyboard layout is set on boot (e.g. de-DE). Ignored for Linux."`
+	WindowsLocale     *string           `json:"windows_locale,omitempty" jsonschema:"description=Windows system locale and culture to set on boot (e.g. en-GB). Ignored for Linux."`
+	WindowsFallback   []byte            `json:"windows_fallback_userdata,omitempty" jsonschema:"description=Base64 encoded user data sent as-is when generating the Windows user data fails. Ignored for Linux."`
 	cloudconfig.CloudConfigSpec
 }
 
@@ -83,6 +215,205 @@ func ValidateExtraSpecs(extraspecs string) error {
 	return jsonSchemaValidation(json.RawMessage(extraspecs))
 }
 
+// ValidatePoolExtraSpecs validates extra specs against the schema and checks
+// that the profile they reference exists in the config.
+func ValidatePoolExtraSpecs(cfg *config.Config, extraspecs string) error {
+	if err := ValidateExtraSpecs(extraspecs); err != nil {
+		return err
+	}
+	if extraspecs == "" {
+		return nil
+	}
+	var extra extraSpecs
+	if err := json.Unmarshal([]byte(extraspecs), &extra); err != nil {
+		return fmt.Errorf("failed to unmarshal extra specs: %w", err)
+	}
+	requested, err := requestedSpec(cfg, &extra)
+	if err != nil {
+		return err
+	}
+	if err := validateSpecConflicts(requested); err != nil {
+		return err
+	}
+	if err := validateNICCount(requested.NetworkIDs, cfg.MaxNICs); err != nil {
+		return err
+	}
+	if extra.RootVolumeName != nil && *extra.RootVolumeName != "" {
+		// Rendering with sample data catches syntax errors and unknown fields.
+		if _, err := renderRootVolumeName(*extra.RootVolumeName, sampleBootstrapInstance, "controller"); err != nil {
+			return err
+		}
+	}
+	return ValidateDetails(extra.Details, cfg.AllowedDetails)
+}
+
+// extraSpecConflicts lists the extra spec combinations that can't be used
+// together. Each check runs on the spec requested by the pool, which is its
+// profile with the extra specs merged over it, and reports whether it has the
+// conflict.
+var extraSpecConflicts = []struct {
+	message  string
+	conflict func(r *RunnerSpec) bool
+}{
+	{
+		// The root disk is created from the snapshot, so the template is unused.
+		message: "snapshot_id and template_id are mutually exclusive",
+		conflict: func(r *RunnerSpec) bool {
+			return r.SnapshotID != "" && r.TemplateID != ""
+		},
+	},
+	{
+		message: "ssh_key_name and ssh_public_key are mutually exclusive",
+		conflict: func(r *RunnerSpec) bool {
+			return r.SSHKeyName != "" && r.SSHPublicKey != ""
+		},
+	},
+	{
+		// Zones with security groups take them from network_ids, next to the
+		// networks, so listing them twice is ambiguous.
+		message: "network_ids and security_groups are mutually exclusive",
+		conflict: func(r *RunnerSpec) bool {
+			return len(r.NetworkIDs) > 0 && len(r.SecurityGroups) > 0
+		},
+	},
+	{
+		message: "dhcp_options requires network_ids",
+		conflict: func(r *RunnerSpec) bool {
+			return len(r.DHCPOptions) > 0 && len(r.NetworkIDs) == 0
+		},
+	},
+	{
+		message: "storage_pool_id and storage_pool_tag are mutually exclusive",
+		conflict: func(r *RunnerSpec) bool {
+			return r.StoragePoolID != "" && r.StoragePoolTag != ""
+		},
+	},
+	{
+		// The NUMA placement only applies to pinned vCPUs.
+		message: "numa_node requires cpu_pinning",
+		conflict: func(r *RunnerSpec) bool {
+			return r.NUMANode != nil && !r.CPUPinning
+		},
+	},
+	{
+		message: "min_iops and max_iops must be set together",
+		conflict: func(r *RunnerSpec) bool {
+			return (r.MinIOPS == 0) != (r.MaxIOPS == 0)
+		},
+	},
+	{
+		message: "data_disk_size requires disk_offering_id",
+		conflict: func(r *RunnerSpec) bool {
+			return r.DataDiskSize != 0 && r.DiskOfferingID == ""
+		},
+	},
+	{
+		message: "wait_for_mounts requires nfs_mounts",
+		conflict: func(r *RunnerSpec) bool {
+			return r.WaitForMounts && len(r.NFSMounts) == 0
+		},
+	},
+}
+
+// isSet reports whether an optional string extra spec has a value.
+func isSet(value *string) bool {
+	return value != nil && *value != ""
+}
+
+// validateSpecConflicts checks r against every known conflicting combination,
+// and reports all the conflicts it finds in one error.
+func validateSpecConflicts(r *RunnerSpec) error {
+	var conflicts []string
+	for _, check := range extraSpecConflicts {
+		if check.conflict(r) {
+			conflicts = append(conflicts, check.message)
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting extra specs: %s", strings.Join(conflicts, "; "))
+	}
+	return nil
+}
+
+// requestedSpec returns the spec a pool asks for: its profile, if it names
+// one, with the extra specs merged over it. Config defaults are left out, so
+// that validateSpecConflicts only reports settings the pool chose.
+func requestedSpec(cfg *config.Config, extra *extraSpecs) (*RunnerSpec, error) {
+	spec := &RunnerSpec{}
+	if isSet(extra.Profile) {
+		profile, ok := cfg.Profile(*extra.Profile)
+		if !ok {
+			return nil, fmt.Errorf("unknown profile %q", *extra.Profile)
+		}
+		spec.ApplyProfile(profile)
+	}
+	spec.MergeExtraSpecs(extra)
+	return spec, nil
+}
+
+// checkUnsetArch refuses a runner without an architecture whose template
+// reports one. The runner tools are picked by architecture, so such a runner
+// could be deployed with tools it can't run. Templates that report no
+// architecture, and deploys from a snapshot, keep deploying without one.
+func checkUnsetArch(cfg *config.Config, spec *RunnerSpec, data params.BootstrapInstance) error {
+	if data.OSArch != "" || spec.SnapshotID != "" {
+		return nil
+	}
+	template := data.Image
+	if template == "" {
+		template = spec.TemplateID
+	}
+	if template == "" {
+		template = cfg.TemplateID()
+	}
+	arch, err := DefaultTemplateArch(cfg, template)
+	if err != nil {
+		return fmt.Errorf("failed to get the architecture of template %s: %w", template, err)
+	}
+	if arch != "" {
+		return fmt.Errorf("bootstrap params have no os_arch and default_os_arch is not set, but template %s is built for %s", template, arch)
+	}
+	return nil
+}
+
+// sampleBootstrapInstance fills every template field, so that pool level
+// validation can render root_volume_name before any instance exists.
+var sampleBootstrapInstance = params.BootstrapInstance{
+	Name:   "runner",
+	PoolID: "pool",
+	OSType: params.Linux,
+	OSArch: params.Amd64,
+	Flavor: "flavor",
+	Image:  "image",
+}
+
+// renderRootVolumeName renders the root_volume_name extra spec with the same
+// data as tag_templates.
+func renderRootVolumeName(text string, data params.BootstrapInstance, controllerID string) (string, error) {
+	tmpl, err := template.New("root_volume_name").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid root_volume_name: %w", err)
+	}
+	var b strings.Builder
+	err = tmpl.Execute(&b, config.NewTagTemplateData(data, controllerID))
+	if err != nil {
+		return "", fmt.Errorf("failed to render root_volume_name: %w", err)
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("root_volume_name %q renders to an empty name", text)
+	}
+	return b.String(), nil
+}
+
+// validateNICCount checks that networkIDs doesn't exceed the max_nics limit.
+// A limit of 0 disables the check.
+func validateNICCount(networkIDs []string, maxNICs int) error {
+	if maxNICs > 0 && len(networkIDs) > maxNICs {
+		return fmt.Errorf("too many networks: %d network_ids requested but at most %d NICs are supported (max_nics)", len(networkIDs), maxNICs)
+	}
+	return nil
+}
+
 func jsonSchemaValidation(schema json.RawMessage) error {
 	jsonSchema := generateJSONSchema()
 	schemaLoader := gojsonschema.NewGoLoader(jsonSchema)
@@ -117,47 +448,215 @@ type RunnerSpec struct {
 	ServiceOfferingID string
 	TemplateID        string
 	NetworkIDs        []string
+	NetworkACL        string
+	SecurityGroups    []string
 	SSHKeyName        string
+	SSHPublicKey      string
 	ProjectID         string
+	ProjectName       string
 	DisableUpdates    bool
 	EnableBootDebug   bool
 	ExtraPackages     []string
+	PreInstallScripts map[string][]byte
 	NFSMounts         []NFSMount
+	WaitForMounts     bool
+	DHCPOptions       map[string]string
+	SnapshotID        string
+	CPUNumber         int
+	MemoryMB          int
+	RootDiskSize      int
+	DiskOfferingID    string
+	DataDiskSize      int
+	CPUPinning        bool
+	NUMANode          *int
+	MinIOPS           int64
+	MaxIOPS           int64
+	DynamicScaling    bool
+	StoragePoolID     string
+	StoragePoolTag    string
+	RootVolumeName    string
+	Annotation        string
+	PoolAntiAffinity  bool
+	AffinityGroupIDs  []string
+	RequireDedicated  bool
+	Details           map[string]string
+	Tags              map[string]string
+	RunnerUser        string
+	RunnerGroups      []string
+	AuthorizedKeys    []string
+	VendorData        []byte
+	WindowsUserdata   string
+	WindowsTimezone   string
+	WindowsKeyboard   string
+	WindowsLocale     string
+	WindowsFallback   []byte
 	Tools             params.RunnerApplicationDownload
 	BootstrapParams   params.BootstrapInstance
 	ControllerID      string
 }
 
 // GetRunnerSpecFromBootstrapParams builds a RunnerSpec from bootstrap parameters and provider config.
-func GetRunnerSpecFromBootstrapParams(cfg *config.Config, data params.BootstrapInstance, controllerID string) (*RunnerSpec, error) {
-	tools, err := DefaultToolFetch(data.OSType, data.OSArch, data.Tools)
-	if err != nil {
-		return nil, fmt.Errorf("failed to get tools: %s", err)
+func GetRunnerSpecFromBootstrapParams(ctx context.Context, cfg *config.Config, data params.BootstrapInstance, controllerID string) (*RunnerSpec, error) {
+	if data.OSArch == "" && cfg.DefaultOSArch != "" {
+		data.OSArch = params.OSArch(cfg.DefaultOSArch)
 	}
 	extraSpecs, err := newExtraSpecsFromBootstrapData(data)
 	if err != nil {
 		return nil, fmt.Errorf("error loading extra specs: %w", err)
 	}
-
-	spec := &RunnerSpec{
-		ZoneID:            cfg.ZoneID(),
-		ServiceOfferingID: cfg.ServiceOfferingID(),
-		TemplateID:        cfg.TemplateID(),
-		SSHKeyName:        cfg.SSHKeyName,
-		ProjectID:         cfg.ProjectID(),
-		ExtraPackages:     extraSpecs.ExtraPackages,
-		Tools:             tools,
-		BootstrapParams:   data,
-		ControllerID:      controllerID,
+	spec, err := requestedSpec(cfg, extraSpecs)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateSpecConflicts(spec); err != nil {
+		return nil, fmt.Errorf("error validating extra specs: %w", err)
+	}
+	if err := checkUnsetArch(cfg, spec, data); err != nil {
+		return nil, err
+	}
+	toolsData := data
+	if isSet(extraSpecs.RunnerVersion) {
+		toolsData.Tools, err = filterToolsByVersion(data.Tools, *extraSpecs.RunnerVersion)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tools, err := fetchTools(ctx, toolsData, ToolFetchRetries)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tools: %s", err)
 	}
 
-	spec.MergeExtraSpecs(extraSpecs)
+	// The config provides what neither the profile nor the extra specs set.
+	if spec.ZoneID == "" {
+		spec.ZoneID = cfg.ZoneID()
+	}
+	if spec.ServiceOfferingID == "" {
+		spec.ServiceOfferingID = cfg.ServiceOfferingID()
+	}
+	if spec.TemplateID == "" {
+		spec.TemplateID = cfg.TemplateID()
+	}
+	if spec.ProjectID == "" {
+		spec.ProjectID = cfg.ProjectID()
+	}
+	spec.ExtraPackages = extraSpecs.ExtraPackages
+	spec.Tools = tools
+	spec.BootstrapParams = data
+	spec.ControllerID = controllerID
+	if cfg.ProjectFromLabel != "" && !isSet(extraSpecs.ProjectID) {
+		if project, ok := labelValue(data.Labels, cfg.ProjectFromLabel); ok {
+			spec.ProjectName = project
+		}
+	}
+	// The keypair depends on the deploy zone, unless the pool sets one or
+	// brings its own public key.
+	if spec.SSHKeyName == "" && spec.SSHPublicKey == "" {
+		spec.SSHKeyName = cfg.ZoneSSHKeyName(spec.ZoneID)
+	}
+	if err := spec.mergeDefaults(cfg, extraSpecs); err != nil {
+		return nil, fmt.Errorf("error validating spec: %w", err)
+	}
+	// A mapped flavor selects the service offering, like an unmapped flavor
+	// does when it's resolved as an offering name at deploy time.
+	if offeringID, ok := cfg.FlavorServiceOfferingID(data.Flavor); ok {
+		spec.ServiceOfferingID = offeringID
+	}
 	if err := spec.Validate(); err != nil {
 		return nil, fmt.Errorf("error validating spec: %w", err)
 	}
+	if err := ValidateDetails(spec.Details, cfg.AllowedDetails); err != nil {
+		return nil, fmt.Errorf("error validating spec: %w", err)
+	}
+	if err := validateNICCount(spec.NetworkIDs, cfg.MaxNICs); err != nil {
+		return nil, fmt.Errorf("error validating spec: %w", err)
+	}
+	if spec.RootVolumeName != "" {
+		spec.RootVolumeName, err = renderRootVolumeName(spec.RootVolumeName, data, controllerID)
+		if err != nil {
+			return nil, fmt.Errorf("error validating spec: %w", err)
+		}
+	}
+	if spec.DiskOfferingID != "" {
+		spec.DiskOfferingID, err = DefaultDiskOfferingResolve(cfg, spec.DiskOfferingID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve disk_offering_id: %w", err)
+		}
+	}
 	return spec, nil
 }
 
+// labelValue returns the value of the first "<key>=<value>" label with the
+// given key, and whether there is one.
+func labelValue(labels []string, key string) (string, bool) {
+	for _, label := range labels {
+		if k, v, ok := strings.Cut(label, "="); ok && k == key && v != "" {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// Values of the merge_strategy extra spec.
+const (
+	MergeStrategyAppend  = "append"
+	MergeStrategyReplace = "replace"
+)
+
+// mergeDefaults combines the default_extra_packages and
+// default_pre_install_scripts of the config with the extra_packages and
+// pre_install_scripts of the pool, as selected by merge_strategy. The pool
+// scripts stay in the bootstrap extra specs; PreInstallScripts only holds the
+// default scripts to add to them.
+func (r *RunnerSpec) mergeDefaults(cfg *config.Config, extra *extraSpecs) error {
+	strategy := MergeStrategyAppend
+	if extra.MergeStrategy != nil && *extra.MergeStrategy != "" {
+		strategy = *extra.MergeStrategy
+	}
+	if strategy != MergeStrategyAppend && strategy != MergeStrategyReplace {
+		return fmt.Errorf("invalid merge_strategy %q: must be append or replace", strategy)
+	}
+	if r.BootstrapParams.OSType != params.Linux {
+		return nil
+	}
+
+	if len(cfg.DefaultExtraPackages) > 0 && (strategy == MergeStrategyAppend || len(r.ExtraPackages) == 0) {
+		packages := slices.Clone(cfg.DefaultExtraPackages)
+		for _, pkg := range r.ExtraPackages {
+			if !slices.Contains(packages, pkg) {
+				packages = append(packages, pkg)
+			}
+		}
+		r.ExtraPackages = packages
+	}
+	if len(cfg.DefaultPreInstallScripts) > 0 && (strategy == MergeStrategyAppend || len(extra.PreInstallScripts) == 0) {
+		r.PreInstallScripts = make(map[string][]byte, len(cfg.DefaultPreInstallScripts))
+		for name, script := range cfg.DefaultPreInstallScripts {
+			r.PreInstallScripts[name] = []byte(script)
+		}
+	}
+	return nil
+}
+
+// ApplyProfile applies the settings of a deployment profile. It is applied
+// before MergeExtraSpecs, so explicit extra specs take precedence.
+func (r *RunnerSpec) ApplyProfile(profile *config.Profile) {
+	if id := profile.ServiceOfferingID(); id != "" {
+		r.ServiceOfferingID = id
+	}
+	if id := profile.TemplateID(); id != "" {
+		r.TemplateID = id
+	}
+	if len(profile.Networks) > 0 {
+		r.NetworkIDs = profile.Networks
+	}
+	if profile.StoragePoolTag != "" {
+		r.StoragePoolTag = profile.StoragePoolTag
+	}
+	if len(profile.Tags) > 0 {
+		r.Tags = profile.Tags
+	}
+}
+
 // MergeExtraSpecs applies extra specs over the base RunnerSpec.
 func (r *RunnerSpec) MergeExtraSpecs(extra *extraSpecs) {
 	if extra == nil {
@@ -175,9 +674,18 @@ func (r *RunnerSpec) MergeExtraSpecs(extra *extraSpecs) {
 	if len(extra.NetworkIDs) > 0 {
 		r.NetworkIDs = extra.NetworkIDs
 	}
+	if isSet(extra.NetworkACL) {
+		r.NetworkACL = *extra.NetworkACL
+	}
+	if len(extra.SecurityGroups) > 0 {
+		r.SecurityGroups = extra.SecurityGroups
+	}
 	if extra.SSHKeyName != nil && *extra.SSHKeyName != "" {
 		r.SSHKeyName = *extra.SSHKeyName
 	}
+	if extra.SSHPublicKey != nil && *extra.SSHPublicKey != "" {
+		r.SSHPublicKey = *extra.SSHPublicKey
+	}
 	if extra.ProjectID != nil && *extra.ProjectID != "" {
 		r.ProjectID = *extra.ProjectID
 	}
@@ -190,6 +698,96 @@ func (r *RunnerSpec) MergeExtraSpecs(extra *extraSpecs) {
 	if len(extra.NFSMounts) > 0 {
 		r.NFSMounts = extra.NFSMounts
 	}
+	if extra.WaitForMounts != nil {
+		r.WaitForMounts = *extra.WaitForMounts
+	}
+	if len(extra.DHCPOptions) > 0 {
+		r.DHCPOptions = extra.DHCPOptions
+	}
+	if extra.SnapshotID != nil && *extra.SnapshotID != "" {
+		r.SnapshotID = *extra.SnapshotID
+	}
+	if extra.CPUNumber != nil {
+		r.CPUNumber = *extra.CPUNumber
+	}
+	if extra.MemoryMB != nil {
+		r.MemoryMB = *extra.MemoryMB
+	}
+	if extra.RootDiskSize != nil {
+		r.RootDiskSize = *extra.RootDiskSize
+	}
+	if extra.DiskOfferingID != nil {
+		r.DiskOfferingID = *extra.DiskOfferingID
+	}
+	if extra.DataDiskSize != nil {
+		r.DataDiskSize = *extra.DataDiskSize
+	}
+	if extra.CPUPinning != nil {
+		r.CPUPinning = *extra.CPUPinning
+	}
+	if extra.NUMANode != nil {
+		r.NUMANode = extra.NUMANode
+	}
+	if extra.MinIOPS != nil {
+		r.MinIOPS = *extra.MinIOPS
+	}
+	if extra.MaxIOPS != nil {
+		r.MaxIOPS = *extra.MaxIOPS
+	}
+	if extra.DynamicScaling != nil {
+		r.DynamicScaling = *extra.DynamicScaling
+	}
+	if extra.StoragePoolID != nil && *extra.StoragePoolID != "" {
+		r.StoragePoolID = *extra.StoragePoolID
+	}
+	if extra.StoragePoolTag != nil && *extra.StoragePoolTag != "" {
+		r.StoragePoolTag = *extra.StoragePoolTag
+	}
+	if extra.RootVolumeName != nil {
+		r.RootVolumeName = *extra.RootVolumeName
+	}
+	if extra.Annotation != nil {
+		r.Annotation = *extra.Annotation
+	}
+	if len(extra.Details) > 0 {
+		r.Details = extra.Details
+	}
+	if extra.PoolAntiAffinity != nil {
+		r.PoolAntiAffinity = *extra.PoolAntiAffinity
+	}
+	if len(extra.AffinityGroupIDs) > 0 {
+		r.AffinityGroupIDs = extra.AffinityGroupIDs
+	}
+	if extra.RequireDedicated != nil {
+		r.RequireDedicated = *extra.RequireDedicated
+	}
+	if extra.RunnerUser != nil && *extra.RunnerUser != "" {
+		r.RunnerUser = *extra.RunnerUser
+	}
+	if len(extra.RunnerGroups) > 0 {
+		r.RunnerGroups = extra.RunnerGroups
+	}
+	if len(extra.AuthorizedKeys) > 0 {
+		r.AuthorizedKeys = extra.AuthorizedKeys
+	}
+	if len(extra.VendorData) > 0 {
+		r.VendorData = extra.VendorData
+	}
+	if extra.WindowsUserdata != nil {
+		r.WindowsUserdata = *extra.WindowsUserdata
+	}
+	if extra.WindowsTimezone != nil {
+		r.WindowsTimezone = *extra.WindowsTimezone
+	}
+	if extra.WindowsKeyboard != nil {
+		r.WindowsKeyboard = *extra.WindowsKeyboard
+	}
+	if extra.WindowsLocale != nil {
+		r.WindowsLocale = *extra.WindowsLocale
+	}
+	if len(extra.WindowsFallback) > 0 {
+		r.WindowsFallback = extra.WindowsFallback
+	}
 }
 
 // Validate performs basic validation of the runner spec.
@@ -206,12 +804,220 @@ func (r *RunnerSpec) Validate() error {
 	if r.BootstrapParams.Name == "" {
 		return fmt.Errorf("missing bootstrap params")
 	}
+	if r.CPUNumber < 0 {
+		return fmt.Errorf("invalid cpu_number %d", r.CPUNumber)
+	}
+	if r.MemoryMB < 0 {
+		return fmt.Errorf("invalid memory_mb %d", r.MemoryMB)
+	}
+	if r.RootDiskSize < 0 {
+		return fmt.Errorf("invalid root_disk_size %d", r.RootDiskSize)
+	}
+	if r.DataDiskSize < 0 {
+		return fmt.Errorf("invalid data_disk_size %d", r.DataDiskSize)
+	}
+	if r.NUMANode != nil && *r.NUMANode < 0 {
+		return fmt.Errorf("invalid numa_node %d", *r.NUMANode)
+	}
+	if r.MinIOPS < 0 {
+		return fmt.Errorf("invalid min_iops %d", r.MinIOPS)
+	}
+	if r.MaxIOPS < 0 {
+		return fmt.Errorf("invalid max_iops %d", r.MaxIOPS)
+	}
+	if r.MaxIOPS > 0 && r.MinIOPS > r.MaxIOPS {
+		return fmt.Errorf("min_iops %d is greater than max_iops %d", r.MinIOPS, r.MaxIOPS)
+	}
+	if err := r.validateRunnerUser(); err != nil {
+		return err
+	}
+	if r.SSHPublicKey != "" {
+		if err := validateAuthorizedKey(r.SSHPublicKey); err != nil {
+			return fmt.Errorf("invalid ssh_public_key: %w", err)
+		}
+	}
+	for _, key := range r.AuthorizedKeys {
+		if err := validateAuthorizedKey(key); err != nil {
+			return err
+		}
+	}
+	if len(r.VendorData) > 0 {
+		if _, err := vendorDataContentType(r.VendorData); err != nil {
+			return err
+		}
+	}
+	for name := range r.DHCPOptions {
+		if _, err := dhcpOptionKey(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dhcpOptionCodes maps well-known DHCP option names to their option codes.
+var dhcpOptionCodes = map[string]int{
+	"router":                 3,
+	"dns-servers":            6,
+	"domain-name":            15,
+	"ntp-servers":            42,
+	"tftp-server-name":       66,
+	"bootfile-name":          67,
+	"captive-portal":         114,
+	"domain-search":          119,
+	"classless-static-route": 121,
+}
+
+// dhcpOptionKey converts a DHCP option name or code into the "dhcp:<code>" key
+// CloudStack expects in dhcpoptionsnetworklist.
+func dhcpOptionKey(name string) (string, error) {
+	if code, ok := dhcpOptionCodes[strings.ToLower(name)]; ok {
+		return fmt.Sprintf("dhcp:%d", code), nil
+	}
+	code, err := strconv.Atoi(strings.TrimPrefix(strings.ToLower(name), "dhcp:"))
+	if err != nil || code < 1 || code > 254 {
+		return "", fmt.Errorf("invalid dhcp option %q: must be an option code between 1 and 254 or a known option name", name)
+	}
+	return fmt.Sprintf("dhcp:%d", code), nil
+}
+
+// DHCPOptionsNetworkList builds the deploy dhcpoptionsnetworklist parameter,
+// applying the configured DHCP options to each of the given networks.
+func (r *RunnerSpec) DHCPOptionsNetworkList(networkIDs []string) ([]map[string]string, error) {
+	if len(r.DHCPOptions) == 0 {
+		return nil, nil
+	}
+	options := make(map[string]string, len(r.DHCPOptions))
+	for name, value := range r.DHCPOptions {
+		key, err := dhcpOptionKey(name)
+		if err != nil {
+			return nil, err
+		}
+		options[key] = value
+	}
+
+	list := make([]map[string]string, 0, len(networkIDs))
+	for _, networkID := range networkIDs {
+		entry := map[string]string{"networkid": networkID}
+		for key, value := range options {
+			entry[key] = value
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
+
+// Deploy detail keys used to steer the root volume onto a primary storage.
+const (
+	storagePoolIDDetail  = "rootdiskstoragepoolid"
+	storagePoolTagDetail = "rootdiskstoragetags"
+)
+
+// Deploy detail keys used to size a VM with a custom service offering.
+const (
+	cpuNumberDetail = "cpuNumber"
+	memoryDetail    = "memory"
+)
+
+// Deploy detail keys used to pin the vCPUs of a VM.
+const (
+	cpuPinningDetail = "cpuPinning"
+	numaNodeDetail   = "nodeId"
+)
+
+// Deploy detail keys used to set the IOPS of the root disk.
+const (
+	minIOPSDetail = "minIops"
+	maxIOPSDetail = "maxIops"
+)
+
+// DefaultAllowedDetails lists the deployVirtualMachine details the details
+// extra spec may set. The allowed_details config option adds to it.
+var DefaultAllowedDetails = []string{
+	"cpuNumber",
+	"cpuSpeed",
+	"memory",
+	"minCpuNumber",
+	"maxCpuNumber",
+	"minMemory",
+	"maxMemory",
+	"rootdisksize",
+	"rootDiskController",
+	"dataDiskController",
+	"nicAdapter",
+	"keyboard",
+	"iothreads",
+	"io.policy",
+}
+
+// ValidateDetails checks that every key of details is in DefaultAllowedDetails
+// or in extraAllowed. CloudStack rejects deploys with unknown details, so this
+// catches typos before any API call is made.
+func ValidateDetails(details map[string]string, extraAllowed []string) error {
+	for key := range details {
+		if slices.Contains(DefaultAllowedDetails, key) || slices.Contains(extraAllowed, key) {
+			continue
+		}
+		allowed := slices.Concat(DefaultAllowedDetails, extraAllowed)
+		slices.Sort(allowed)
+		return fmt.Errorf("details key %q is not allowed (allowed keys: %s)", key, strings.Join(slices.Compact(allowed), ", "))
+	}
 	return nil
 }
 
+// DeployDetails returns the details passed to deployVirtualMachine. Details
+// derived from dedicated extra specs take precedence over the details extra
+// spec.
+func (r *RunnerSpec) DeployDetails() map[string]string {
+	details := maps.Clone(r.Details)
+	if details == nil {
+		details = map[string]string{}
+	}
+	if r.StoragePoolID != "" {
+		details[storagePoolIDDetail] = r.StoragePoolID
+	}
+	if r.StoragePoolTag != "" {
+		details[storagePoolTagDetail] = r.StoragePoolTag
+	}
+	if r.CPUNumber > 0 {
+		details[cpuNumberDetail] = strconv.Itoa(r.CPUNumber)
+	}
+	if r.MemoryMB > 0 {
+		details[memoryDetail] = strconv.Itoa(r.MemoryMB)
+	}
+	if r.CPUPinning {
+		details[cpuPinningDetail] = "true"
+	}
+	if r.NUMANode != nil {
+		details[numaNodeDetail] = strconv.Itoa(*r.NUMANode)
+	}
+	if r.MinIOPS > 0 {
+		details[minIOPSDetail] = strconv.FormatInt(r.MinIOPS, 10)
+		details[maxIOPSDetail] = strconv.FormatInt(r.MaxIOPS, 10)
+	}
+	return details
+}
+
+// nfsMounts returns the NFS mounts set up on the runner.
+func (r *RunnerSpec) nfsMounts() []NFSMount {
+	if r.BootstrapParams.OSType == params.Windows {
+		return nil
+	}
+	var mounts []NFSMount
+	for _, mount := range r.NFSMounts {
+		if mount.OSType != "" && params.OSType(mount.OSType) != r.BootstrapParams.OSType {
+			continue
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts
+}
+
 // generateNFSMountScript creates a shell script to mount NFS shares.
+// Mounts are only set up on Linux runners, since the script is bash; mounts
+// with an os_type guard are skipped unless it matches the runner OS type.
 func (r *RunnerSpec) generateNFSMountScript() []byte {
-	if len(r.NFSMounts) == 0 {
+	mounts := r.nfsMounts()
+	if len(mounts) == 0 {
 		return nil
 	}
 
@@ -222,7 +1028,7 @@ func (r *RunnerSpec) generateNFSMountScript() []byte {
 	script.WriteString("    apt-get update && apt-get install -y nfs-common\n")
 	script.WriteString("fi\n\n")
 
-	for _, mount := range r.NFSMounts {
+	for _, mount := range mounts {
 		options := mount.Options
 		if options == "" {
 			if mount.ReadWrite {
@@ -233,13 +1039,124 @@ func (r *RunnerSpec) generateNFSMountScript() []byte {
 		}
 		script.WriteString(fmt.Sprintf("# Mount %s:%s\n", mount.Server, mount.ServerPath))
 		script.WriteString(fmt.Sprintf("mkdir -p %s\n", mount.MountPath))
-		script.WriteString(fmt.Sprintf("mount -t nfs -o %s %s:%s %s\n", options, mount.Server, mount.ServerPath, mount.MountPath))
+		if r.WaitForMounts {
+			// The runner service drop-in requires the mount units systemd
+			// generates from fstab, which also remount the share on reboot.
+			script.WriteString(fmt.Sprintf("echo '%s:%s %s nfs %s,_netdev 0 0' >> /etc/fstab\n", mount.Server, mount.ServerPath, mount.MountPath, options))
+			script.WriteString(fmt.Sprintf("mount %s\n", mount.MountPath))
+		} else {
+			script.WriteString(fmt.Sprintf("mount -t nfs -o %s %s:%s %s\n", options, mount.Server, mount.ServerPath, mount.MountPath))
+		}
 		script.WriteString(fmt.Sprintf("echo 'Mounted %s:%s to %s'\n\n", mount.Server, mount.ServerPath, mount.MountPath))
 	}
+	if r.WaitForMounts {
+		script.WriteString("# Generate the mount units for the new fstab entries\n")
+		script.WriteString("systemctl daemon-reload\n")
+	}
 
 	return []byte(script.String())
 }
 
+// Values of the windows_userdata_mode extra spec.
+const (
+	WindowsUserdataPowerShell  = "powershell"
+	WindowsUserdataCloudConfig = "cloudconfig"
+)
+
+// windowsInstallScriptPath is where windowsCloudConfig writes the runner
+// install script.
+const windowsInstallScriptPath = `C:\garm\install_runner.ps1`
+
+// windowsRunnerScript renders the Windows runner install script. Missing
+// runner tools, which come from the tools fetch when the spec is built, are
+// reported apart from failures to render the install template.
+func (r *RunnerSpec) windowsRunnerScript(bootstrapParams params.BootstrapInstance) (string, error) {
+	if r.Tools.GetFilename() == "" || r.Tools.GetDownloadURL() == "" {
+		return "", fmt.Errorf("no runner tools for %s/%s: the tools fetch returned no filename or download URL",
+			bootstrapParams.OSType, bootstrapParams.OSArch)
+	}
+	script, err := cloudconfig.GetCloudConfig(bootstrapParams, r.Tools, bootstrapParams.Name)
+	if err != nil {
+		if specs, specsErr := cloudconfig.GetSpecs(bootstrapParams); specsErr == nil && len(specs.RunnerInstallTemplate) > 0 {
+			return "", fmt.Errorf("failed to render the runner_install_template extra spec: %w", err)
+		}
+		return "", fmt.Errorf("failed to render the runner install script: %w", err)
+	}
+	return script, nil
+}
+
+// windowsUserdata packages the Windows runner install script as selected by
+// windows_userdata_mode, with the locale settings first.
+func (r *RunnerSpec) windowsUserdata(script string) []byte {
+	// The runner install script starts with a Param() block, which must be the
+	// first statement of a script. Run it as a script block so the locale
+	// settings can go first.
+	if locale := r.generateWindowsLocaleScript(); locale != "" {
+		script = fmt.Sprintf("%s& {\n%s\n}\n", locale, script)
+	}
+	if r.WindowsUserdata == WindowsUserdataCloudConfig {
+		return []byte(windowsCloudConfig(script))
+	}
+	return fmt.Appendf(nil, "<powershell>%s</powershell>", script)
+}
+
+// windowsCloudConfig packages the Windows runner install script as a
+// cloudbase-init cloud-config document, for images that don't handle EC2 style
+// <powershell> user data. The script is written to disk and run from there, as
+// cloud-config has no way to run an inline PowerShell script.
+func windowsCloudConfig(script string) string {
+	var b strings.Builder
+	b.WriteString("#cloud-config\n")
+	b.WriteString("write_files:\n")
+	b.WriteString(fmt.Sprintf("  - path: %s\n", windowsInstallScriptPath))
+	b.WriteString("    encoding: b64\n")
+	b.WriteString(fmt.Sprintf("    content: %s\n", base64.StdEncoding.EncodeToString([]byte(script))))
+	b.WriteString("runcmd:\n")
+	b.WriteString(fmt.Sprintf("  - powershell.exe -NoProfile -NonInteractive -ExecutionPolicy Bypass -File %s\n", windowsInstallScriptPath))
+	return b.String()
+}
+
+// generateWindowsLocaleScript creates PowerShell commands that apply the requested
+// time zone, keyboard layout and locale. It returns an empty string if none are set.
+func (r *RunnerSpec) generateWindowsLocaleScript() string {
+	quote := func(v string) string {
+		return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+	}
+
+	var script strings.Builder
+	if r.WindowsTimezone != "" {
+		script.WriteString(fmt.Sprintf("Set-TimeZone -Id %s\n", quote(r.WindowsTimezone)))
+	}
+	if r.WindowsKeyboard != "" {
+		script.WriteString(fmt.Sprintf("Set-WinUserLanguageList -LanguageList %s -Force\n", quote(r.WindowsKeyboard)))
+	}
+	if r.WindowsLocale != "" {
+		script.WriteString(fmt.Sprintf("Set-WinSystemLocale -SystemLocale %s\n", quote(r.WindowsLocale)))
+		script.WriteString(fmt.Sprintf("Set-Culture -CultureInfo %s\n", quote(r.WindowsLocale)))
+	}
+	return script.String()
+}
+
+// Keys of the extra_context values describing the garm controller, available
+// to runner_install_template as {{ .ExtraContext.<key> }}.
+const (
+	ExtraContextControllerID = "GARMControllerID"
+	ExtraContextMetadataURL  = "GARMMetadataURL"
+	ExtraContextCallbackURL  = "GARMCallbackURL"
+)
+
+// controllerContext returns the extra_context values of the controller the
+// runner is bootstrapped by. URLs garm didn't pass are left out.
+func (r *RunnerSpec) controllerContext() map[string]string {
+	values := map[string]string{
+		ExtraContextControllerID: r.ControllerID,
+		ExtraContextMetadataURL:  r.BootstrapParams.MetadataURL,
+		ExtraContextCallbackURL:  r.BootstrapParams.CallbackURL,
+	}
+	maps.DeleteFunc(values, func(_, value string) bool { return value == "" })
+	return values
+}
+
 // ComposeUserData renders and compresses cloud-init / userdata for the VM.
 func (r *RunnerSpec) ComposeUserData() (string, error) {
 	bootstrapParams := r.BootstrapParams
@@ -247,45 +1164,78 @@ func (r *RunnerSpec) ComposeUserData() (string, error) {
 	bootstrapParams.UserDataOptions.ExtraPackages = r.ExtraPackages
 	bootstrapParams.UserDataOptions.EnableBootDebug = r.EnableBootDebug
 
-	// Add NFS mount script as a pre-install script if NFS mounts are specified
-	if nfsScript := r.generateNFSMountScript(); nfsScript != nil {
-		// Get existing extra specs to preserve any user-defined pre-install scripts
-		specs, err := cloudconfig.GetSpecs(bootstrapParams)
-		if err != nil {
-			return "", fmt.Errorf("failed to get cloud config specs: %w", err)
-		}
+	specs, err := cloudconfig.GetSpecs(bootstrapParams)
+	if err != nil {
+		return "", fmt.Errorf("failed to get cloud config specs: %w", err)
+	}
+
+	// Add the default pre-install scripts and the NFS mount script, if NFS
+	// mounts are specified, to the pre-install scripts of the pool
+	if nfsScript := r.generateNFSMountScript(); nfsScript != nil || len(r.PreInstallScripts) > 0 {
 		if specs.PreInstallScripts == nil {
 			specs.PreInstallScripts = make(map[string][]byte)
 		}
-		// Use 00-nfs-mounts.sh to ensure it runs early
-		specs.PreInstallScripts["00-nfs-mounts.sh"] = nfsScript
+		// Pool scripts win over default scripts of the same name
+		for name, script := range r.PreInstallScripts {
+			if _, ok := specs.PreInstallScripts[name]; !ok {
+				specs.PreInstallScripts[name] = script
+			}
+		}
+		if nfsScript != nil {
+			// Use 00-nfs-mounts.sh to ensure it runs early
+			specs.PreInstallScripts["00-nfs-mounts.sh"] = nfsScript
+		}
+	}
 
-		// Re-marshal the extra specs back to JSON
-		extraSpecsJSON, err := json.Marshal(specs)
-		if err != nil {
-			return "", fmt.Errorf("failed to marshal updated extra specs: %w", err)
+	// Let install templates reference the controller without hardcoding it.
+	// Values set in the extra_context extra spec win.
+	if specs.ExtraContext == nil {
+		specs.ExtraContext = make(map[string]string)
+	}
+	for key, value := range r.controllerContext() {
+		if _, ok := specs.ExtraContext[key]; !ok {
+			specs.ExtraContext[key] = value
 		}
-		bootstrapParams.ExtraSpecs = extraSpecsJSON
 	}
 
+	// Re-marshal the extra specs back to JSON
+	extraSpecsJSON, err := json.Marshal(specs)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal updated extra specs: %w", err)
+	}
+	bootstrapParams.ExtraSpecs = extraSpecsJSON
+
 	var udata []byte
 	switch bootstrapParams.OSType {
-	case params.Linux, params.Windows:
-		cloudCfg, err := cloudconfig.GetCloudConfig(bootstrapParams, r.Tools, bootstrapParams.Name)
+	case params.Linux:
+		cloudCfg, err := r.linuxCloudConfig(bootstrapParams)
 		if err != nil {
 			return "", fmt.Errorf("failed to generate userdata: %w", err)
 		}
-		if bootstrapParams.OSType == params.Windows {
-			wrapped := fmt.Sprintf("<powershell>%s</powershell>", cloudCfg)
-			udata = []byte(wrapped)
-		} else {
-			udata = []byte(cloudCfg)
+		if len(r.VendorData) > 0 {
+			cloudCfg, err = withVendorData(cloudCfg, r.VendorData)
+			if err != nil {
+				return "", fmt.Errorf("failed to add vendor data: %w", err)
+			}
+		}
+		udata = []byte(cloudCfg)
+	case params.Windows:
+		script, err := r.windowsRunnerScript(bootstrapParams)
+		switch {
+		case err != nil && len(r.WindowsFallback) > 0:
+			slog.Error("ComposeUserData: failed to generate Windows userdata, using windows_fallback_userdata",
+				"instance_name", bootstrapParams.Name,
+				"error", err)
+			udata = r.WindowsFallback
+		case err != nil:
+			return "", fmt.Errorf("failed to generate Windows userdata: %w", err)
+		default:
+			udata = r.windowsUserdata(script)
 		}
 	default:
 		return "", fmt.Errorf("unsupported OS type for cloud config: %s", bootstrapParams.OSType)
 	}
 
-	var err error
 	udata, err = maybeCompressUserdata(udata, bootstrapParams.OSType)
 	if err != nil {
 		return "", err
@@ -295,6 +1245,18 @@ func (r *RunnerSpec) ComposeUserData() (string, error) {
 	return asBase64, nil
 }
 
+// UserDataCompression reports how ComposeUserData compressed decoded user
+// data: "gzip", "zip" or "none".
+func UserDataCompression(udata []byte) string {
+	switch {
+	case bytes.HasPrefix(udata, []byte{0x1f, 0x8b}):
+		return "gzip"
+	case bytes.HasPrefix(udata, []byte("PK\x03\x04")):
+		return "zip"
+	}
+	return "none"
+}
+
 func maybeCompressUserdata(udata []byte, targetOS params.OSType) ([]byte, error) {
 	if len(udata) < 1<<14 {
 		return udata, nil
@@ -16,24 +16,68 @@
 package spec
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/cloudbase/garm-provider-cloudstack/config"
 	"github.com/cloudbase/garm-provider-common/cloudconfig"
 	"github.com/cloudbase/garm-provider-common/params"
+	"github.com/cloudbase/garm-provider-common/util"
 	"github.com/stretchr/testify/require"
 )
 
 func strPtr(v string) *string { return &v }
 func boolPtr(v bool) *bool    { return &v }
 
+var testTools = params.RunnerApplicationDownload{
+	Filename:    strPtr("actions-runner.tar.gz"),
+	DownloadURL: strPtr("https://example.com/actions-runner.tar.gz"),
+}
+
+// decodeUserData reverses the base64 encoding and optional compression applied by ComposeUserData.
+func decodeUserData(t *testing.T, udata string) string {
+	t.Helper()
+	raw, err := base64.StdEncoding.DecodeString(udata)
+	require.NoError(t, err)
+	switch {
+	case bytes.HasPrefix(raw, []byte{0x1f, 0x8b}):
+		r, err := gzip.NewReader(bytes.NewReader(raw))
+		require.NoError(t, err)
+		raw, err = io.ReadAll(r)
+		require.NoError(t, err)
+	case bytes.HasPrefix(raw, []byte("PK")):
+		zr, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+		require.NoError(t, err)
+		require.Len(t, zr.File, 1)
+		fd, err := zr.File[0].Open()
+		require.NoError(t, err)
+		defer fd.Close()
+		raw, err = io.ReadAll(fd)
+		require.NoError(t, err)
+	}
+	return string(raw)
+}
+
 func TestNewExtraSpecsFromBootstrapData(t *testing.T) {
 	validExtra := json.RawMessage(`{
 		"zone_id": "zone-1",
 		"service_offering_id": "off",
 		"template_id": "tmpl",
 		"network_ids": ["net1", "net2"],
+		"security_groups": ["runners"],
 		"disable_updates": true,
 		"enable_boot_debug": true,
 		"extra_packages": ["pkg1", "pkg2"],
@@ -55,6 +99,7 @@ func TestNewExtraSpecsFromBootstrapData(t *testing.T) {
 		ServiceOfferingID: strPtr("off"),
 		TemplateID:        strPtr("tmpl"),
 		NetworkIDs:        []string{"net1", "net2"},
+		SecurityGroups:    []string{"runners"},
 		DisableUpdates:    boolPtr(true),
 		EnableBootDebug:   boolPtr(true),
 		ExtraPackages:     []string{"pkg1", "pkg2"},
@@ -103,7 +148,7 @@ func TestGetRunnerSpecFromBootstrapParams(t *testing.T) {
 	// Set resolved IDs directly for testing (normally set by ResolveNames())
 	cfg.SetResolvedIDs("zone-default", "service-offering-id", "template-id", "")
 
-	spec, err := GetRunnerSpecFromBootstrapParams(cfg, data, "controller-id")
+	spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
 	require.NoError(t, err)
 	require.Equal(t, &RunnerSpec{
 		ZoneID:            "zone-override",
@@ -234,8 +279,1676 @@ func TestGenerateNFSMountScript(t *testing.T) {
 	require.Contains(t, scriptStr, "mount -t nfs -o nfsvers=4,rw,hard,timeo=60 nfs.example.com:/exports/artifacts /mnt/artifacts")
 }
 
+func TestGenerateNFSMountScriptWaitForMounts(t *testing.T) {
+	spec := &RunnerSpec{
+		NFSMounts: []NFSMount{
+			{Server: "nfs.example.com", ServerPath: "/exports/cache", MountPath: "/mnt/cache"},
+		},
+		WaitForMounts: true,
+	}
+
+	script := string(spec.generateNFSMountScript())
+	// The mounts go to fstab, so systemd has mount units for the drop-in.
+	fstab := strings.Index(script, "echo 'nfs.example.com:/exports/cache /mnt/cache nfs nfsvers=4,ro,soft,timeo=30,_netdev 0 0' >> /etc/fstab")
+	mount := strings.Index(script, "mount /mnt/cache\n")
+	reload := strings.Index(script, "systemctl daemon-reload")
+	require.NotEqual(t, -1, fstab)
+	require.Less(t, fstab, mount)
+	require.Less(t, mount, reload)
+	require.NotContains(t, script, "mount -t nfs")
+}
+
 func TestGenerateNFSMountScriptEmpty(t *testing.T) {
 	spec := &RunnerSpec{}
 	script := spec.generateNFSMountScript()
 	require.Nil(t, script)
 }
+
+func TestComposeUserDataWaitForMounts(t *testing.T) {
+	mounts := []NFSMount{
+		{Server: "nfs.example.com", ServerPath: "/exports/cache", MountPath: "/mnt/cache"},
+		{Server: "nfs.example.com", ServerPath: "/exports/tools", MountPath: "/opt/tools"},
+	}
+	dropIn := base64.StdEncoding.EncodeToString([]byte("[Unit]\nRequiresMountsFor=/mnt/cache /opt/tools\nAfter=remote-fs.target\n"))
+
+	tests := []struct {
+		name          string
+		mounts        []NFSMount
+		waitForMounts bool
+		wantDropIn    bool
+	}{
+		{name: "mounts", mounts: mounts, waitForMounts: true, wantDropIn: true},
+		{name: "disabled", mounts: mounts, waitForMounts: false},
+		{name: "no mounts", waitForMounts: true},
+		{name: "no linux mounts", mounts: []NFSMount{{Server: "nfs", ServerPath: "/x", MountPath: "/mnt/x", OSType: "windows"}}, waitForMounts: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{
+				ZoneID:            "zone",
+				ServiceOfferingID: "off",
+				TemplateID:        "tmpl",
+				NFSMounts:         tt.mounts,
+				WaitForMounts:     tt.waitForMounts,
+				Tools:             testTools,
+				BootstrapParams: params.BootstrapInstance{
+					Name:   "runner",
+					OSType: params.Linux,
+				},
+			}
+			udata, err := spec.ComposeUserData()
+			require.NoError(t, err)
+			cloudCfg := decodeUserData(t, udata)
+			if !tt.wantDropIn {
+				require.NotContains(t, cloudCfg, "/etc/garm/runner-mounts.conf")
+				return
+			}
+			require.Contains(t, cloudCfg, dropIn)
+			require.Contains(t, cloudCfg, "path: /etc/garm/runner-mounts.conf")
+			// The default install script installs the drop-in itself.
+			require.NotContains(t, cloudCfg, `svc=$(cat /home/runner/actions-runner/.service)`)
+		})
+	}
+}
+
+func TestWithMountsDropIn(t *testing.T) {
+	customTemplate := base64.StdEncoding.EncodeToString([]byte("#!/bin/bash\necho custom install\n"))
+
+	tests := []struct {
+		name       string
+		jit        bool
+		extraSpecs string
+		wantStart  string
+	}{
+		{name: "registration token", wantStart: "sudo ./svc.sh start"},
+		{name: "jit", jit: true, wantStart: "sudo systemctl start $SVC_NAME"},
+		{name: "custom template", extraSpecs: `{"runner_install_template": "` + customTemplate + `"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{
+				NFSMounts:     []NFSMount{{Server: "nfs.example.com", ServerPath: "/exports/cache", MountPath: "/mnt/cache"}},
+				WaitForMounts: true,
+				Tools:         testTools,
+				BootstrapParams: params.BootstrapInstance{
+					Name:             "runner",
+					OSType:           params.Linux,
+					JitConfigEnabled: tt.jit,
+					ExtraSpecs:       json.RawMessage(tt.extraSpecs),
+				},
+			}
+			if tt.extraSpecs == "" {
+				spec.BootstrapParams.ExtraSpecs = nil
+			}
+			script, err := spec.runnerInstallScript(spec.BootstrapParams)
+			require.NoError(t, err)
+			withDropIn, found := withMountsDropIn(script)
+
+			cloudCfg, err := spec.linuxCloudConfig(spec.BootstrapParams)
+			require.NoError(t, err)
+			if tt.wantStart == "" {
+				// Unknown install scripts get the drop-in once they are done.
+				require.False(t, found)
+				require.Equal(t, script, withDropIn)
+				require.Contains(t, cloudCfg, `svc=$(cat /home/runner/actions-runner/.service)`)
+				require.Less(t, strings.Index(cloudCfg, "su -l -c /install_runner.sh"), strings.Index(cloudCfg, "svc=$(cat"))
+				return
+			}
+			require.True(t, found)
+			require.NotContains(t, cloudCfg, `svc=$(cat /home/runner/actions-runner/.service)`)
+
+			rendered := string(withDropIn)
+			move := strings.Index(rendered, `sudo mv /etc/garm/runner-mounts.conf "/etc/systemd/system/$svc.d/10-garm-mounts.conf"`)
+			reload := strings.Index(rendered, `sudo systemctl daemon-reload || fail "failed to install mounts drop-in"`)
+			start := strings.Index(rendered, tt.wantStart)
+			require.NotEqual(t, -1, move)
+			require.Less(t, move, reload)
+			require.Less(t, reload, start)
+			require.Equal(t, 1, strings.Count(rendered, "10-garm-mounts.conf"))
+		})
+	}
+}
+
+func TestComposeUserDataWindowsErrors(t *testing.T) {
+	badTemplate := base64.StdEncoding.EncodeToString([]byte("{{ .FileName"))
+	fallback := []byte("<powershell>Write-Host fallback</powershell>")
+
+	tests := []struct {
+		name          string
+		tools         params.RunnerApplicationDownload
+		extraSpecs    string
+		fallback      []byte
+		errorContains string
+	}{
+		{
+			name:          "missing tools",
+			errorContains: "failed to generate Windows userdata: no runner tools for windows/amd64",
+		},
+		{
+			name:          "bad install template",
+			tools:         testTools,
+			extraSpecs:    `{"runner_install_template": "` + badTemplate + `"}`,
+			errorContains: "failed to generate Windows userdata: failed to render the runner_install_template extra spec",
+		},
+		{
+			name:     "fallback",
+			fallback: fallback,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{
+				Tools:           tt.tools,
+				WindowsFallback: tt.fallback,
+				BootstrapParams: params.BootstrapInstance{
+					Name:       "runner",
+					OSType:     params.Windows,
+					OSArch:     params.Amd64,
+					ExtraSpecs: json.RawMessage(tt.extraSpecs),
+				},
+			}
+			udata, err := spec.ComposeUserData()
+			if tt.errorContains != "" {
+				require.ErrorContains(t, err, tt.errorContains)
+				return
+			}
+			require.NoError(t, err)
+			decoded, err := base64.StdEncoding.DecodeString(udata)
+			require.NoError(t, err)
+			require.Equal(t, tt.fallback, decoded)
+		})
+	}
+}
+
+func TestComposeUserDataWindowsLocale(t *testing.T) {
+	spec := &RunnerSpec{
+		WindowsTimezone: "W. Europe Standard Time",
+		WindowsKeyboard: "de-DE",
+		WindowsLocale:   "en-GB",
+		Tools:           testTools,
+		BootstrapParams: params.BootstrapInstance{
+			Name:   "runner",
+			OSType: params.Windows,
+		},
+	}
+
+	udata, err := spec.ComposeUserData()
+	require.NoError(t, err)
+	script := decodeUserData(t, udata)
+	require.Contains(t, script, "<powershell>Set-TimeZone -Id 'W. Europe Standard Time'\n")
+	require.Contains(t, script, "Set-WinUserLanguageList -LanguageList 'de-DE' -Force")
+	require.Contains(t, script, "Set-WinSystemLocale -SystemLocale 'en-GB'")
+	require.Contains(t, script, "& {\n#ps1_sysnative")
+
+	// The same settings are ignored for Linux runners.
+	spec.BootstrapParams.OSType = params.Linux
+	udata, err = spec.ComposeUserData()
+	require.NoError(t, err)
+	require.NotContains(t, decodeUserData(t, udata), "Set-TimeZone")
+}
+
+func TestComposeUserDataWindowsUserdataMode(t *testing.T) {
+	tests := []struct {
+		name string
+		mode string
+	}{
+		{name: "default", mode: ""},
+		{name: "powershell", mode: WindowsUserdataPowerShell},
+		{name: "cloudconfig", mode: WindowsUserdataCloudConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{
+				WindowsUserdata: tt.mode,
+				Tools:           testTools,
+				BootstrapParams: params.BootstrapInstance{
+					Name:   "runner",
+					OSType: params.Windows,
+				},
+			}
+			udata, err := spec.ComposeUserData()
+			require.NoError(t, err)
+			out := decodeUserData(t, udata)
+
+			if tt.mode != WindowsUserdataCloudConfig {
+				require.True(t, strings.HasPrefix(out, "<powershell>#ps1_sysnative"))
+				require.True(t, strings.HasSuffix(out, "</powershell>"))
+				return
+			}
+			require.NotContains(t, out, "<powershell>")
+			lines := strings.Split(out, "\n")
+			require.Equal(t, []string{
+				"#cloud-config",
+				"write_files:",
+				`  - path: C:\garm\install_runner.ps1`,
+				"    encoding: b64",
+			}, lines[:4])
+			content, ok := strings.CutPrefix(lines[4], "    content: ")
+			require.True(t, ok)
+			script, err := base64.StdEncoding.DecodeString(content)
+			require.NoError(t, err)
+			require.True(t, strings.HasPrefix(string(script), "#ps1_sysnative"))
+			require.Equal(t, []string{
+				"runcmd:",
+				`  - powershell.exe -NoProfile -NonInteractive -ExecutionPolicy Bypass -File C:\garm\install_runner.ps1`,
+				"",
+			}, lines[5:])
+		})
+	}
+}
+
+func TestDHCPOptionsNetworkList(t *testing.T) {
+	spec := &RunnerSpec{
+		ZoneID:            "zone",
+		ServiceOfferingID: "off",
+		TemplateID:        "tmpl",
+		NetworkIDs:        []string{"net-1"},
+		DHCPOptions: map[string]string{
+			"domain-search": "ci.example.com",
+			"114":           "https://portal.example.com",
+		},
+		BootstrapParams: params.BootstrapInstance{Name: "name"},
+	}
+	require.NoError(t, spec.Validate())
+
+	list, err := spec.DHCPOptionsNetworkList([]string{"net-1-uuid", "net-2-uuid"})
+	require.NoError(t, err)
+	require.Equal(t, []map[string]string{
+		{"networkid": "net-1-uuid", "dhcp:119": "ci.example.com", "dhcp:114": "https://portal.example.com"},
+		{"networkid": "net-2-uuid", "dhcp:119": "ci.example.com", "dhcp:114": "https://portal.example.com"},
+	}, list)
+
+	spec.DHCPOptions = map[string]string{"not-an-option": "x"}
+	require.EqualError(t, spec.Validate(), `invalid dhcp option "not-an-option": must be an option code between 1 and 254 or a known option name`)
+
+	spec.DHCPOptions = map[string]string{"dhcp:300": "x"}
+	require.ErrorContains(t, spec.Validate(), `invalid dhcp option "dhcp:300"`)
+
+	spec.DHCPOptions = map[string]string{"router": "10.0.0.1"}
+	spec.NetworkIDs = nil
+	require.EqualError(t, validateSpecConflicts(spec), "conflicting extra specs: dhcp_options requires network_ids")
+}
+
+func TestLinuxCloudConfigMatchesCommon(t *testing.T) {
+	bootstrapParams := params.BootstrapInstance{
+		Name:          "runner",
+		OSType:        params.Linux,
+		OSArch:        params.Amd64,
+		RepoURL:       "https://github.com/example/repo",
+		CallbackURL:   "https://garm.example.com/callback",
+		MetadataURL:   "https://garm.example.com/metadata",
+		InstanceToken: "token",
+		Labels:        []string{"self-hosted", "linux"},
+		SSHKeys:       []string{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f test"},
+		ExtraSpecs:    json.RawMessage(`{"pre_install_scripts": {"10-b.sh": "ZWNobyBi", "01-a.sh": "ZWNobyBh"}}`),
+	}
+	spec := &RunnerSpec{Tools: testTools, BootstrapParams: bootstrapParams}
+
+	got, err := spec.linuxCloudConfig(bootstrapParams)
+	require.NoError(t, err)
+	want, err := cloudconfig.GetCloudConfig(bootstrapParams, testTools, bootstrapParams.Name)
+	require.NoError(t, err)
+	require.Equal(t, want, got)
+}
+
+func TestComposeUserDataRunnerUser(t *testing.T) {
+	spec := &RunnerSpec{
+		RunnerUser:   "ci",
+		RunnerGroups: []string{"docker", "kvm"},
+		Tools:        testTools,
+		BootstrapParams: params.BootstrapInstance{
+			Name:   "runner",
+			OSType: params.Linux,
+		},
+	}
+
+	udata, err := spec.ComposeUserData()
+	require.NoError(t, err)
+	cloudCfg := decodeUserData(t, udata)
+	require.Contains(t, cloudCfg, "name: ci\n")
+	require.Contains(t, cloudCfg, "home: /home/ci\n")
+	require.Contains(t, cloudCfg, "- docker\n")
+	require.Contains(t, cloudCfg, "- kvm\n")
+	require.NotContains(t, cloudCfg, "- sudo\n")
+	require.Contains(t, cloudCfg, "su -l -c /install_runner.sh ci")
+}
+
+func TestValidateRunnerUser(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		groups  []string
+		wantErr string
+	}{
+		{name: "defaults"},
+		{name: "custom user and groups", user: "ci_runner", groups: []string{"docker", "kvm"}},
+		{name: "root user", user: "root", wantErr: "runner_user cannot be root"},
+		{name: "invalid user", user: "Bad User", wantErr: `invalid runner_user "Bad User"`},
+		{name: "invalid group", groups: []string{"docker", "-wheel"}, wantErr: `invalid runner group "-wheel"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{RunnerUser: tt.user, RunnerGroups: tt.groups}
+			err := spec.validateRunnerUser()
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestComposeUserDataAuthorizedKeys(t *testing.T) {
+	const (
+		bootstrapKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f garm"
+		extraKey     = "ssh-rsa AAAAB3NzaC1yc2EAAAADAQAB break-glass"
+	)
+	spec := &RunnerSpec{
+		ZoneID:            "zone",
+		ServiceOfferingID: "off",
+		TemplateID:        "tmpl",
+		AuthorizedKeys:    []string{extraKey},
+		Tools:             testTools,
+		BootstrapParams: params.BootstrapInstance{
+			Name:    "runner",
+			OSType:  params.Linux,
+			SSHKeys: []string{bootstrapKey},
+		},
+	}
+	require.NoError(t, spec.Validate())
+
+	udata, err := spec.ComposeUserData()
+	require.NoError(t, err)
+	cloudCfg := decodeUserData(t, udata)
+	require.Contains(t, cloudCfg, bootstrapKey)
+	require.Contains(t, cloudCfg, extraKey)
+}
+
+func TestComposeUserDataVendorData(t *testing.T) {
+	const vendorData = "#cloud-config\nntp:\n  servers: [ntp.example.com]\n"
+	extra, err := newExtraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"vendor_data": "` + base64.StdEncoding.EncodeToString([]byte(vendorData)) + `"}`),
+	})
+	require.NoError(t, err)
+
+	spec := &RunnerSpec{
+		ZoneID:            "zone",
+		ServiceOfferingID: "off",
+		TemplateID:        "tmpl",
+		Tools:             testTools,
+		BootstrapParams: params.BootstrapInstance{
+			Name:   "runner",
+			OSType: params.Linux,
+		},
+	}
+	spec.MergeExtraSpecs(extra)
+	require.NoError(t, spec.Validate())
+
+	udata, err := spec.ComposeUserData()
+	require.NoError(t, err)
+	msg, err := mail.ReadMessage(strings.NewReader(decodeUserData(t, udata)))
+	require.NoError(t, err)
+	mediaType, mediaParams, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	require.Equal(t, "multipart/mixed", mediaType)
+
+	var types []string
+	var bodies []string
+	mr := multipart.NewReader(msg.Body, mediaParams["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		body, err := io.ReadAll(part)
+		require.NoError(t, err)
+		types = append(types, part.Header.Get("Content-Type"))
+		bodies = append(bodies, string(body))
+	}
+	require.Equal(t, []string{`text/cloud-config; charset="utf-8"`, `text/cloud-config; charset="utf-8"`}, types)
+	require.Contains(t, bodies[0], "/install_runner.sh")
+	require.NotContains(t, bodies[0], "ntp.example.com")
+	require.Equal(t, vendorData, bodies[1])
+}
+
+func TestValidateVendorData(t *testing.T) {
+	spec := &RunnerSpec{
+		ZoneID:            "zone",
+		ServiceOfferingID: "off",
+		TemplateID:        "tmpl",
+		BootstrapParams:   params.BootstrapInstance{Name: "runner"},
+	}
+	spec.VendorData = []byte("#!/bin/sh\necho vendor\n")
+	require.NoError(t, spec.Validate())
+
+	spec.VendorData = []byte("packages: [htop]\n")
+	require.EqualError(t, spec.Validate(), "invalid vendor_data: must be a #cloud-config document or a script starting with #!")
+
+	_, err := newExtraSpecsFromBootstrapData(params.BootstrapInstance{
+		ExtraSpecs: json.RawMessage(`{"vendor_data": "not base64!"}`),
+	})
+	require.Error(t, err)
+}
+
+func TestValidateAuthorizedKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		wantErr string
+	}{
+		{name: "ed25519", key: "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f"},
+		{name: "rsa with comment", key: "ssh-rsa AAAAB3NzaC1yc2EAAAADAQAB user@host"},
+		{name: "missing key data", key: "ssh-rsa", wantErr: "expected"},
+		{name: "unsupported type", key: "ssh-foo AAAAB3NzaC1yc2EAAAADAQAB", wantErr: `unsupported key type "ssh-foo"`},
+		{name: "invalid base64", key: "ssh-rsa not-base64!", wantErr: "illegal base64 data"},
+		{name: "type mismatch", key: "ssh-ed25519 AAAAB3NzaC1yc2EAAAADAQAB", wantErr: `key data does not match type "ssh-ed25519"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAuthorizedKey(tt.key)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestStoragePoolExtraSpecs(t *testing.T) {
+	spec := &RunnerSpec{
+		ZoneID:            "zone",
+		ServiceOfferingID: "off",
+		TemplateID:        "tmpl",
+		BootstrapParams:   params.BootstrapInstance{Name: "name"},
+	}
+	spec.MergeExtraSpecs(&extraSpecs{StoragePoolTag: strPtr("ssd")})
+	require.NoError(t, spec.Validate())
+	require.Equal(t, map[string]string{"rootdiskstoragetags": "ssd"}, spec.DeployDetails())
+
+	spec.MergeExtraSpecs(&extraSpecs{StoragePoolID: strPtr("pool-uuid")})
+	require.EqualError(t, validateSpecConflicts(spec), "conflicting extra specs: storage_pool_id and storage_pool_tag are mutually exclusive")
+}
+
+func TestGetRunnerSpecFlavorMap(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+
+	cfg := &config.Config{
+		APIURL:          "https://cloudstack.example.com/client/api",
+		APIKey:          "api-key",
+		Secret:          "secret",
+		Zone:            "zone-default",
+		ServiceOffering: "service-offering-id",
+		Template:        "template-id",
+		FlavorMap:       map[string]string{"large": "8-16384"},
+	}
+	cfg.SetResolvedIDs("zone-default", "service-offering-id", "template-id", "")
+	cfg.SetResolvedFlavorOfferings(map[string]string{"large": "large-offering-id"})
+
+	tests := []struct {
+		name   string
+		flavor string
+		want   string
+	}{
+		{name: "mapped flavor", flavor: "large", want: "large-offering-id"},
+		{name: "unmapped flavor", flavor: "small", want: "service-offering-id"},
+		{name: "no flavor", want: "service-offering-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:   "runner-name",
+				OSType: params.Linux,
+				OSArch: params.Amd64,
+				Flavor: tt.flavor,
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			require.NoError(t, err)
+			require.Equal(t, tt.want, spec.ServiceOfferingID)
+		})
+	}
+}
+
+// temporaryError is a tool fetch error that reports whether it is temporary.
+type temporaryError struct{ temporary bool }
+
+func (e temporaryError) Error() string   { return "connection reset" }
+func (e temporaryError) Temporary() bool { return e.temporary }
+
+func TestGetRunnerSpecToolFetchRetries(t *testing.T) {
+	backoff := toolFetchBackoff
+	toolFetchBackoff = time.Millisecond
+	t.Cleanup(func() {
+		toolFetchBackoff = backoff
+		ToolFetchRetries = 0
+	})
+
+	transient := fmt.Errorf("connection reset: %w", ErrTransientToolFetch)
+	tests := []struct {
+		name      string
+		retries   int
+		failures  int
+		err       error
+		canceled  bool
+		wantCalls int
+		errString string
+	}{
+		{name: "succeeds on retry", retries: 3, failures: 2, err: transient, wantCalls: 3},
+		{name: "temporary error", retries: 3, failures: 2, err: temporaryError{temporary: true}, wantCalls: 3},
+		{
+			name:      "retries exhausted",
+			retries:   1,
+			failures:  5,
+			err:       transient,
+			wantCalls: 2,
+			errString: "failed to get tools: connection reset: transient tool fetch failure",
+		},
+		{
+			name:      "no retries by default",
+			failures:  1,
+			err:       transient,
+			wantCalls: 1,
+			errString: "failed to get tools: connection reset: transient tool fetch failure",
+		},
+		{
+			name:      "not temporary",
+			retries:   3,
+			failures:  5,
+			err:       temporaryError{},
+			wantCalls: 1,
+			errString: "failed to get tools: connection reset",
+		},
+		{
+			name:      "unmarked error",
+			retries:   3,
+			failures:  5,
+			err:       errors.New("failed to find tools for OS linux and arch amd64"),
+			wantCalls: 1,
+			errString: "failed to get tools: failed to find tools for OS linux and arch amd64",
+		},
+		{
+			name:      "context canceled",
+			retries:   3,
+			failures:  5,
+			err:       transient,
+			canceled:  true,
+			wantCalls: 1,
+			errString: "failed to get tools: connection reset: transient tool fetch failure (gave up retrying: context canceled)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+				calls++
+				if calls <= tt.failures {
+					return params.RunnerApplicationDownload{}, tt.err
+				}
+				return testTools, nil
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.canceled {
+				cancel()
+			}
+			ToolFetchRetries = tt.retries
+			cfg := &config.Config{}
+			cfg.SetResolvedIDs("zone-id", "service-offering-id", "template-id", "")
+			data := params.BootstrapInstance{
+				Name:   "runner-name",
+				OSType: params.Linux,
+				OSArch: params.Amd64,
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(ctx, cfg, data, "controller-id")
+			require.Equal(t, tt.wantCalls, calls)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, testTools, spec.Tools)
+		})
+	}
+}
+
+func TestGetRunnerSpecRunnerVersion(t *testing.T) {
+	DefaultToolFetch = util.GetTools
+
+	tool := func(osType, arch, version string) params.RunnerApplicationDownload {
+		filename := fmt.Sprintf("actions-runner-%s-%s-%s.tar.gz", osType, arch, version)
+		return params.RunnerApplicationDownload{
+			OS:           strPtr(osType),
+			Architecture: strPtr(arch),
+			Filename:     strPtr(filename),
+			DownloadURL:  strPtr("https://github.com/actions/runner/releases/download/v" + version + "/" + filename),
+		}
+	}
+	tools := []params.RunnerApplicationDownload{
+		tool("linux", "x64", "2.312.0"),
+		tool("linux", "arm64", "2.312.0"),
+		tool("linux", "x64", "2.311.0"),
+		tool("linux", "arm64", "2.311.0"),
+		tool("win", "x64", "2.310.2"),
+	}
+
+	cfg := &config.Config{}
+	cfg.SetResolvedIDs("zone-id", "service-offering-id", "template-id", "")
+
+	tests := []struct {
+		name         string
+		extraSpecs   string
+		wantFilename string
+		errString    string
+	}{
+		{name: "no pin", wantFilename: "actions-runner-linux-x64-2.312.0.tar.gz"},
+		{name: "pinned", extraSpecs: `{"runner_version": "2.311.0"}`, wantFilename: "actions-runner-linux-x64-2.311.0.tar.gz"},
+		{name: "pinned with v prefix", extraSpecs: `{"runner_version": "v2.311.0"}`, wantFilename: "actions-runner-linux-x64-2.311.0.tar.gz"},
+		{name: "unknown version", extraSpecs: `{"runner_version": "2.300.0"}`, errString: "no runner tools of runner_version 2.300.0"},
+		{
+			name:       "version without tools for the OS",
+			extraSpecs: `{"runner_version": "2.310.2"}`,
+			errString:  "failed to get tools: failed to find tools for OS linux and arch amd64",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:   "runner-name",
+				OSType: params.Linux,
+				OSArch: params.Amd64,
+				Tools:  tools,
+			}
+			if tt.extraSpecs != "" {
+				data.ExtraSpecs = json.RawMessage(tt.extraSpecs)
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantFilename, spec.Tools.GetFilename())
+			// The bootstrap params keep every tool garm offered.
+			require.Len(t, spec.BootstrapParams.Tools, len(tools))
+		})
+	}
+}
+
+func TestGetRunnerSpecZoneSSHKeyName(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+
+	cfg := &config.Config{
+		APIURL:          "https://cloudstack.example.com/client/api",
+		APIKey:          "api-key",
+		Secret:          "secret",
+		Zone:            "zone-default",
+		ServiceOffering: "service-offering-id",
+		Template:        "template-id",
+		SSHKeyName:      "global-key",
+	}
+	cfg.SetResolvedIDs("zone-default", "service-offering-id", "template-id", "")
+	cfg.SetResolvedZoneSSHKeyNames(map[string]string{"zone-default": "default-zone-key", "zone-2": "zone-2-key"})
+
+	tests := []struct {
+		name       string
+		extraSpecs string
+		want       string
+	}{
+		{name: "default zone", want: "default-zone-key"},
+		{name: "extra spec zone", extraSpecs: `{"zone_id": "zone-2"}`, want: "zone-2-key"},
+		{name: "zone without key", extraSpecs: `{"zone_id": "zone-3"}`, want: "global-key"},
+		{name: "extra spec key wins", extraSpecs: `{"zone_id": "zone-2", "ssh_key_name": "pool-key"}`, want: "pool-key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:   "runner-name",
+				OSType: params.Linux,
+				OSArch: params.Amd64,
+			}
+			if tt.extraSpecs != "" {
+				data.ExtraSpecs = json.RawMessage(tt.extraSpecs)
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			require.NoError(t, err)
+			require.Equal(t, tt.want, spec.SSHKeyName)
+		})
+	}
+}
+
+func TestGetRunnerSpecProjectFromLabel(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+
+	cfg := &config.Config{
+		APIURL:           "https://cloudstack.example.com/client/api",
+		APIKey:           "api-key",
+		Secret:           "secret",
+		Zone:             "zone-default",
+		ServiceOffering:  "service-offering-id",
+		Template:         "template-id",
+		Project:          "default-project",
+		ProjectFromLabel: "cs-project",
+	}
+	cfg.SetResolvedIDs("zone-default", "service-offering-id", "template-id", "default-project-id")
+
+	tests := []struct {
+		name        string
+		labels      []string
+		extraSpecs  string
+		wantName    string
+		wantProject string
+	}{
+		{name: "from label", labels: []string{"linux", "cs-project=team-a"}, wantName: "team-a", wantProject: "default-project-id"},
+		{name: "no label", labels: []string{"linux", "other=team-a"}, wantProject: "default-project-id"},
+		{name: "empty value", labels: []string{"cs-project="}, wantProject: "default-project-id"},
+		{name: "project_id extra spec wins", labels: []string{"cs-project=team-a"}, extraSpecs: `{"project_id": "pool-project-id"}`, wantProject: "pool-project-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:   "runner-name",
+				OSType: params.Linux,
+				OSArch: params.Amd64,
+				Labels: tt.labels,
+			}
+			if tt.extraSpecs != "" {
+				data.ExtraSpecs = json.RawMessage(tt.extraSpecs)
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			require.NoError(t, err)
+			require.Equal(t, tt.wantName, spec.ProjectName)
+			require.Equal(t, tt.wantProject, spec.ProjectID)
+		})
+	}
+}
+
+func TestSSHPublicKeyExtraSpec(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+
+	cfg := &config.Config{
+		APIURL:          "https://cloudstack.example.com/client/api",
+		APIKey:          "api-key",
+		Secret:          "secret",
+		Zone:            "zone-default",
+		ServiceOffering: "service-offering-id",
+		Template:        "template-id",
+		SSHKeyName:      "global-key",
+	}
+	cfg.SetResolvedIDs("zone-default", "service-offering-id", "template-id", "")
+
+	const key = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIAABAgMEBQYHCAkKCwwNDg8QERITFBUWFxgZGhscHR4f runner"
+	tests := []struct {
+		name       string
+		extraSpecs string
+		errString  string
+	}{
+		{name: "valid key", extraSpecs: `{"ssh_public_key": "` + key + `"}`},
+		{
+			name:       "invalid key",
+			extraSpecs: `{"ssh_public_key": "ssh-ed25519 not-base64"}`,
+			errString:  `invalid ssh_public_key: invalid authorized key of type "ssh-ed25519"`,
+		},
+		{
+			name:       "with ssh_key_name",
+			extraSpecs: `{"ssh_public_key": "` + key + `", "ssh_key_name": "pool-key"}`,
+			errString:  "ssh_key_name and ssh_public_key are mutually exclusive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:       "runner-name",
+				OSType:     params.Linux,
+				OSArch:     params.Amd64,
+				ExtraSpecs: json.RawMessage(tt.extraSpecs),
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, key, spec.SSHPublicKey)
+			// The transient keypair replaces the configured one.
+			require.Empty(t, spec.SSHKeyName)
+		})
+	}
+}
+
+func TestGenerateNFSMountScriptOSType(t *testing.T) {
+	mounts := []NFSMount{
+		{Server: "nfs.example.com", ServerPath: "/exports/any", MountPath: "/mnt/any"},
+		{Server: "nfs.example.com", ServerPath: "/exports/linux", MountPath: "/mnt/linux", OSType: "linux"},
+		{Server: "nfs.example.com", ServerPath: "/exports/windows", MountPath: "/mnt/windows", OSType: "windows"},
+	}
+
+	spec := &RunnerSpec{
+		NFSMounts:       mounts,
+		BootstrapParams: params.BootstrapInstance{OSType: params.Linux},
+	}
+	script := string(spec.generateNFSMountScript())
+	require.Contains(t, script, "mkdir -p /mnt/any")
+	require.Contains(t, script, "mkdir -p /mnt/linux")
+	require.NotContains(t, script, "/mnt/windows")
+
+	spec.NFSMounts = mounts[2:]
+	require.Nil(t, spec.generateNFSMountScript())
+}
+
+func TestComposeUserDataWindowsSkipsNFSMounts(t *testing.T) {
+	spec := &RunnerSpec{
+		NFSMounts: []NFSMount{
+			{Server: "nfs.example.com", ServerPath: "/exports/cache", MountPath: "/mnt/cache"},
+		},
+		Tools: testTools,
+		BootstrapParams: params.BootstrapInstance{
+			Name:   "runner",
+			OSType: params.Windows,
+		},
+	}
+	require.Nil(t, spec.generateNFSMountScript())
+
+	udata, err := spec.ComposeUserData()
+	require.NoError(t, err)
+	script := decodeUserData(t, udata)
+	require.NotContains(t, script, "#!/bin/bash")
+	require.NotContains(t, script, "mount -t nfs")
+}
+
+func TestCustomOfferingExtraSpecs(t *testing.T) {
+	spec := &RunnerSpec{
+		ZoneID:            "zone",
+		ServiceOfferingID: "off",
+		TemplateID:        "tmpl",
+		BootstrapParams:   params.BootstrapInstance{Name: "name"},
+	}
+	cpu, memory := 4, 8192
+	spec.MergeExtraSpecs(&extraSpecs{CPUNumber: &cpu, MemoryMB: &memory})
+	require.NoError(t, spec.Validate())
+	require.Equal(t, map[string]string{"cpuNumber": "4", "memory": "8192"}, spec.DeployDetails())
+
+	spec.MemoryMB = -1
+	require.EqualError(t, spec.Validate(), "invalid memory_mb -1")
+}
+
+func TestRootDiskSizeExtraSpecs(t *testing.T) {
+	size, zero, negative := 100, 0, -5
+	tests := []struct {
+		name      string
+		initial   int
+		extra     extraSpecs
+		want      int
+		errString string
+	}{
+		{name: "unset keeps the template default", extra: extraSpecs{}, want: 0},
+		{name: "unset keeps an earlier value", initial: 50, extra: extraSpecs{}, want: 50},
+		{name: "set", extra: extraSpecs{RootDiskSize: &size}, want: 100},
+		{name: "set to zero", initial: 50, extra: extraSpecs{RootDiskSize: &zero}, want: 0},
+		{name: "negative", extra: extraSpecs{RootDiskSize: &negative}, want: -5, errString: "invalid root_disk_size -5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{
+				ZoneID:            "zone",
+				ServiceOfferingID: "off",
+				TemplateID:        "tmpl",
+				RootDiskSize:      tt.initial,
+				BootstrapParams:   params.BootstrapInstance{Name: "name"},
+			}
+			spec.MergeExtraSpecs(&tt.extra)
+			require.Equal(t, tt.want, spec.RootDiskSize)
+			if tt.errString != "" {
+				require.EqualError(t, spec.Validate(), tt.errString)
+				return
+			}
+			require.NoError(t, spec.Validate())
+		})
+	}
+}
+
+func TestGetRunnerSpecDataDisk(t *testing.T) {
+	const offeringID = "66666666-6666-6666-6666-666666666666"
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return testTools, nil
+	}
+	resolve := DefaultDiskOfferingResolve
+	t.Cleanup(func() { DefaultDiskOfferingResolve = resolve })
+
+	cfg := &config.Config{}
+	cfg.SetResolvedIDs("zone-id", "service-offering-id", "template-id", "")
+
+	tests := []struct {
+		name         string
+		extraSpecs   string
+		wantOffering string
+		wantSize     int
+		wantResolved []string
+		errString    string
+	}{
+		{name: "no data disk"},
+		{
+			name:         "offering by name",
+			extraSpecs:   `{"disk_offering_id": "scratch"}`,
+			wantOffering: offeringID,
+			wantResolved: []string{"scratch"},
+		},
+		{
+			name:         "offering by UUID with size",
+			extraSpecs:   `{"disk_offering_id": "` + offeringID + `", "data_disk_size": 200}`,
+			wantOffering: offeringID,
+			wantSize:     200,
+			wantResolved: []string{offeringID},
+		},
+		{
+			name:       "size without offering",
+			extraSpecs: `{"data_disk_size": 200}`,
+			errString:  "error validating extra specs: conflicting extra specs: data_disk_size requires disk_offering_id",
+		},
+		{
+			name:         "unknown offering",
+			extraSpecs:   `{"disk_offering_id": "missing"}`,
+			wantResolved: []string{"missing"},
+			errString:    `failed to resolve disk_offering_id: disk offering "missing" not found`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resolved []string
+			DefaultDiskOfferingResolve = func(_ *config.Config, nameOrID string) (string, error) {
+				resolved = append(resolved, nameOrID)
+				switch nameOrID {
+				case "scratch", offeringID:
+					return offeringID, nil
+				}
+				return "", fmt.Errorf("disk offering %q not found", nameOrID)
+			}
+			data := params.BootstrapInstance{
+				Name:   "runner-name",
+				OSType: params.Linux,
+				OSArch: params.Amd64,
+			}
+			if tt.extraSpecs != "" {
+				data.ExtraSpecs = json.RawMessage(tt.extraSpecs)
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			require.Equal(t, tt.wantResolved, resolved)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantOffering, spec.DiskOfferingID)
+			require.Equal(t, tt.wantSize, spec.DataDiskSize)
+		})
+	}
+}
+
+func TestAffinityGroupExtraSpecs(t *testing.T) {
+	tests := []struct {
+		name    string
+		initial []string
+		extra   extraSpecs
+		want    []string
+	}{
+		{name: "unset", extra: extraSpecs{}},
+		{name: "unset keeps an earlier list", initial: []string{"group-1"}, extra: extraSpecs{}, want: []string{"group-1"}},
+		{name: "set", extra: extraSpecs{AffinityGroupIDs: []string{"group-1", "group-2"}}, want: []string{"group-1", "group-2"}},
+		{name: "set replaces an earlier list", initial: []string{"group-1"}, extra: extraSpecs{AffinityGroupIDs: []string{"group-2"}}, want: []string{"group-2"}},
+		{name: "empty keeps an earlier list", initial: []string{"group-1"}, extra: extraSpecs{AffinityGroupIDs: []string{}}, want: []string{"group-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{AffinityGroupIDs: tt.initial}
+			spec.MergeExtraSpecs(&tt.extra)
+			require.Equal(t, tt.want, spec.AffinityGroupIDs)
+		})
+	}
+}
+
+func TestCPUPinningExtraSpecs(t *testing.T) {
+	pin, node, badNode := true, 1, -1
+	tests := []struct {
+		name        string
+		extra       extraSpecs
+		wantDetails map[string]string
+		errString   string
+	}{
+		{
+			name:        "pinning",
+			extra:       extraSpecs{CPUPinning: &pin},
+			wantDetails: map[string]string{"cpuPinning": "true"},
+		},
+		{
+			name:        "pinning on a NUMA node",
+			extra:       extraSpecs{CPUPinning: &pin, NUMANode: &node},
+			wantDetails: map[string]string{"cpuPinning": "true", "nodeId": "1"},
+		},
+		{
+			name:      "NUMA node without pinning",
+			extra:     extraSpecs{NUMANode: &node},
+			errString: "conflicting extra specs: numa_node requires cpu_pinning",
+		},
+		{
+			name:      "negative NUMA node",
+			extra:     extraSpecs{CPUPinning: &pin, NUMANode: &badNode},
+			errString: "invalid numa_node -1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{
+				ZoneID:            "zone",
+				ServiceOfferingID: "off",
+				TemplateID:        "tmpl",
+				BootstrapParams:   params.BootstrapInstance{Name: "name"},
+			}
+			spec.MergeExtraSpecs(&tt.extra)
+			err := validateSpecConflicts(spec)
+			if err == nil {
+				err = spec.Validate()
+			}
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantDetails, spec.DeployDetails())
+		})
+	}
+}
+
+func TestIOPSExtraSpecs(t *testing.T) {
+	minIOPS, maxIOPS, badIOPS := int64(500), int64(2000), int64(-1)
+	tests := []struct {
+		name        string
+		extra       extraSpecs
+		wantDetails map[string]string
+		errString   string
+	}{
+		{
+			name:        "min and max",
+			extra:       extraSpecs{MinIOPS: &minIOPS, MaxIOPS: &maxIOPS},
+			wantDetails: map[string]string{"minIops": "500", "maxIops": "2000"},
+		},
+		{
+			name:      "min only",
+			extra:     extraSpecs{MinIOPS: &minIOPS},
+			errString: "conflicting extra specs: min_iops and max_iops must be set together",
+		},
+		{
+			name:      "max only",
+			extra:     extraSpecs{MaxIOPS: &maxIOPS},
+			errString: "conflicting extra specs: min_iops and max_iops must be set together",
+		},
+		{
+			name:      "negative",
+			extra:     extraSpecs{MinIOPS: &badIOPS, MaxIOPS: &maxIOPS},
+			errString: "invalid min_iops -1",
+		},
+		{
+			name:      "min above max",
+			extra:     extraSpecs{MinIOPS: &maxIOPS, MaxIOPS: &minIOPS},
+			errString: "min_iops 2000 is greater than max_iops 500",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{
+				ZoneID:            "zone",
+				ServiceOfferingID: "off",
+				TemplateID:        "tmpl",
+				BootstrapParams:   params.BootstrapInstance{Name: "name"},
+			}
+			spec.MergeExtraSpecs(&tt.extra)
+			err := validateSpecConflicts(spec)
+			if err == nil {
+				err = spec.Validate()
+			}
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantDetails, spec.DeployDetails())
+		})
+	}
+}
+
+func TestGetRunnerSpecProfile(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+
+	cfg := &config.Config{
+		APIURL:          "https://cloudstack.example.com/client/api",
+		APIKey:          "api-key",
+		Secret:          "secret",
+		Zone:            "zone-default",
+		ServiceOffering: "service-offering-id",
+		Template:        "template-id",
+		Profiles: []config.Profile{{
+			Name:            "gpu",
+			ServiceOffering: "gpu-offering-id",
+			Template:        "gpu-template-id",
+			Networks:        []string{"gpu-net"},
+			StoragePoolTag:  "ssd",
+			Tags:            map[string]string{"team": "ml"},
+		}},
+	}
+	cfg.SetResolvedIDs("zone-default", "service-offering-id", "template-id", "")
+
+	tests := []struct {
+		name       string
+		extraSpecs string
+		want       *RunnerSpec
+		errString  string
+	}{
+		{
+			name:       "no profile",
+			extraSpecs: `{}`,
+			want: &RunnerSpec{
+				ServiceOfferingID: "service-offering-id",
+				TemplateID:        "template-id",
+			},
+		},
+		{
+			name:       "profile applied",
+			extraSpecs: `{"profile": "gpu"}`,
+			want: &RunnerSpec{
+				ServiceOfferingID: "gpu-offering-id",
+				TemplateID:        "gpu-template-id",
+				NetworkIDs:        []string{"gpu-net"},
+				StoragePoolTag:    "ssd",
+				Tags:              map[string]string{"team": "ml"},
+			},
+		},
+		{
+			name:       "extra specs override the profile",
+			extraSpecs: `{"profile": "gpu", "template_id": "explicit-template-id", "network_ids": ["explicit-net"]}`,
+			want: &RunnerSpec{
+				ServiceOfferingID: "gpu-offering-id",
+				TemplateID:        "explicit-template-id",
+				NetworkIDs:        []string{"explicit-net"},
+				StoragePoolTag:    "ssd",
+				Tags:              map[string]string{"team": "ml"},
+			},
+		},
+		{
+			name:       "unknown profile",
+			extraSpecs: `{"profile": "tpu"}`,
+			errString:  `unknown profile "tpu"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:       "runner-name",
+				OSType:     params.Linux,
+				OSArch:     params.Amd64,
+				ExtraSpecs: json.RawMessage(tt.extraSpecs),
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				require.EqualError(t, ValidatePoolExtraSpecs(cfg, tt.extraSpecs), tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, ValidatePoolExtraSpecs(cfg, tt.extraSpecs))
+			require.Equal(t, tt.want.ServiceOfferingID, spec.ServiceOfferingID)
+			require.Equal(t, tt.want.TemplateID, spec.TemplateID)
+			require.Equal(t, tt.want.NetworkIDs, spec.NetworkIDs)
+			require.Equal(t, tt.want.StoragePoolTag, spec.StoragePoolTag)
+			require.Equal(t, tt.want.Tags, spec.Tags)
+		})
+	}
+}
+
+func TestValidateDetails(t *testing.T) {
+	tests := []struct {
+		name      string
+		details   map[string]string
+		extra     []string
+		errString string
+	}{
+		{name: "no details"},
+		{name: "default keys", details: map[string]string{"rootdisksize": "50", "nicAdapter": "vmxnet3"}},
+		{name: "configured key", details: map[string]string{"hypervisortoolsversion": "1"}, extra: []string{"hypervisortoolsversion"}},
+		{
+			name:      "unknown key",
+			details:   map[string]string{"rootdisksise": "50"},
+			extra:     []string{"hypervisortoolsversion"},
+			errString: `details key "rootdisksise" is not allowed (allowed keys: cpuNumber, cpuSpeed, dataDiskController, hypervisortoolsversion, io.policy, iothreads, keyboard, maxCpuNumber, maxMemory, memory, minCpuNumber, minMemory, nicAdapter, rootDiskController, rootdisksize)`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateDetails(tt.details, tt.extra)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestDetailsExtraSpec(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+	cfg := &config.Config{}
+	cfg.SetResolvedIDs("zone", "off", "tmpl", "")
+
+	data := params.BootstrapInstance{
+		Name:       "runner-name",
+		OSType:     params.Linux,
+		OSArch:     params.Amd64,
+		ExtraSpecs: json.RawMessage(`{"details": {"nicAdapter": "vmxnet3", "memory": "1024"}, "memory_mb": 8192}`),
+	}
+	spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.NoError(t, err)
+	// memory_mb wins over the free-form memory detail.
+	require.Equal(t, map[string]string{"nicAdapter": "vmxnet3", "memory": "8192"}, spec.DeployDetails())
+
+	data.ExtraSpecs = json.RawMessage(`{"details": {"bogus": "1"}}`)
+	_, err = GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.ErrorContains(t, err, `details key "bogus" is not allowed`)
+	require.ErrorContains(t, ValidatePoolExtraSpecs(cfg, string(data.ExtraSpecs)), `details key "bogus" is not allowed`)
+
+	cfg.AllowedDetails = []string{"bogus"}
+	_, err = GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.NoError(t, err)
+}
+
+func TestDefaultOSArch(t *testing.T) {
+	var fetchedArch params.OSArch
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		fetchedArch = osArch
+		return params.RunnerApplicationDownload{}, nil
+	}
+	data := params.BootstrapInstance{
+		Name:   "runner-name",
+		OSType: params.Linux,
+	}
+
+	templateArch := DefaultTemplateArch
+	t.Cleanup(func() { DefaultTemplateArch = templateArch })
+	var arch string
+	var lookups []string
+	DefaultTemplateArch = func(_ *config.Config, nameOrID string) (string, error) {
+		lookups = append(lookups, nameOrID)
+		return arch, nil
+	}
+
+	cfg := &config.Config{}
+	cfg.SetResolvedIDs("zone", "off", "tmpl", "")
+	// Without a default the arch is left empty, as before default_os_arch, as
+	// long as the template reports no architecture either.
+	spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.NoError(t, err)
+	require.Empty(t, spec.BootstrapParams.OSArch)
+	require.Empty(t, fetchedArch)
+	require.Equal(t, []string{"tmpl"}, lookups)
+
+	// A template built for an architecture fails clearly, rather than getting
+	// a runner with tools picked without one.
+	arch = "aarch64"
+	_, err = GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.EqualError(t, err, "bootstrap params have no os_arch and default_os_arch is not set, but template tmpl is built for aarch64")
+	withImage := data
+	withImage.Image = "ubuntu-arm"
+	_, err = GetRunnerSpecFromBootstrapParams(context.Background(), cfg, withImage, "controller-id")
+	require.EqualError(t, err, "bootstrap params have no os_arch and default_os_arch is not set, but template ubuntu-arm is built for aarch64")
+	// Snapshot deploys don't use the template.
+	withSnapshot := data
+	withSnapshot.ExtraSpecs = json.RawMessage(`{"snapshot_id": "snap-1"}`)
+	_, err = GetRunnerSpecFromBootstrapParams(context.Background(), cfg, withSnapshot, "controller-id")
+	require.NoError(t, err)
+	require.Equal(t, []string{"tmpl", "tmpl", "ubuntu-arm"}, lookups)
+
+	lookups = nil
+	cfg.DefaultOSArch = "arm64"
+	spec, err = GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.NoError(t, err)
+	require.Equal(t, params.Arm64, spec.BootstrapParams.OSArch)
+	require.Equal(t, params.Arm64, fetchedArch)
+
+	// An arch in the bootstrap params wins over the default.
+	data.OSArch = params.Amd64
+	spec, err = GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.NoError(t, err)
+	require.Equal(t, params.Amd64, spec.BootstrapParams.OSArch)
+	require.Equal(t, params.Amd64, fetchedArch)
+	// The template is only looked up for runners without an architecture.
+	require.Empty(t, lookups)
+}
+
+func TestMergeStrategy(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+	cfg := &config.Config{
+		DefaultExtraPackages:     []string{"jq", "git"},
+		DefaultPreInstallScripts: map[string]string{"10-motd.sh": "#!/bin/sh\necho default\n"},
+	}
+	cfg.SetResolvedIDs("zone", "off", "tmpl", "")
+	poolScript := base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\necho pool\n"))
+	defaultScript := base64.StdEncoding.EncodeToString([]byte("#!/bin/sh\necho default\n"))
+
+	tests := []struct {
+		name          string
+		extraSpecs    string
+		wantPackages  []string
+		wantDefault   bool
+		wantPool      bool
+		errorContains string
+	}{
+		{
+			name:         "defaults only",
+			extraSpecs:   `{}`,
+			wantPackages: []string{"jq", "git"},
+			wantDefault:  true,
+		},
+		{
+			name:         "append",
+			extraSpecs:   `{"extra_packages": ["git", "make"], "pre_install_scripts": {"20-pool.sh": "` + poolScript + `"}}`,
+			wantPackages: []string{"jq", "git", "make"},
+			wantDefault:  true,
+			wantPool:     true,
+		},
+		{
+			name:         "replace",
+			extraSpecs:   `{"merge_strategy": "replace", "extra_packages": ["make"], "pre_install_scripts": {"20-pool.sh": "` + poolScript + `"}}`,
+			wantPackages: []string{"make"},
+			wantPool:     true,
+		},
+		{
+			name:         "replace without pool entries",
+			extraSpecs:   `{"merge_strategy": "replace"}`,
+			wantPackages: []string{"jq", "git"},
+			wantDefault:  true,
+		},
+		{
+			name:         "pool script overrides default of the same name",
+			extraSpecs:   `{"pre_install_scripts": {"10-motd.sh": "` + poolScript + `"}}`,
+			wantPackages: []string{"jq", "git"},
+			wantPool:     true,
+		},
+		{
+			name:          "invalid strategy",
+			extraSpecs:    `{"merge_strategy": "prepend"}`,
+			errorContains: "merge_strategy",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:       "runner-name",
+				OSType:     params.Linux,
+				OSArch:     params.Amd64,
+				ExtraSpecs: json.RawMessage(tt.extraSpecs),
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			if tt.errorContains != "" {
+				require.ErrorContains(t, err, tt.errorContains)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantPackages, spec.ExtraPackages)
+
+			spec.Tools = testTools
+			udata, err := spec.ComposeUserData()
+			require.NoError(t, err)
+			cloudCfg := decodeUserData(t, udata)
+			for _, pkg := range tt.wantPackages {
+				require.Contains(t, cloudCfg, "- "+pkg+"\n")
+			}
+			if tt.wantDefault {
+				require.Contains(t, cloudCfg, defaultScript)
+			} else {
+				require.NotContains(t, cloudCfg, defaultScript)
+			}
+			if tt.wantPool {
+				require.Contains(t, cloudCfg, poolScript)
+			} else {
+				require.NotContains(t, cloudCfg, poolScript)
+			}
+		})
+	}
+}
+
+func TestExtraSpecConflicts(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+	cfg := &config.Config{
+		Profiles: []config.Profile{{
+			Name:           "fast",
+			Networks:       []string{"fast-net"},
+			StoragePoolTag: "ssd",
+		}},
+	}
+	cfg.SetResolvedIDs("zone", "off", "tmpl", "")
+
+	tests := []struct {
+		name      string
+		extra     string
+		errString string
+	}{
+		{
+			name:  "no conflicts",
+			extra: `{"snapshot_id": "snap", "storage_pool_tag": "ssd", "cpu_pinning": true, "numa_node": 0}`,
+		},
+		{
+			name:      "single conflict",
+			extra:     `{"snapshot_id": "snap", "template_id": "tmpl"}`,
+			errString: "conflicting extra specs: snapshot_id and template_id are mutually exclusive",
+		},
+		{
+			name: "several conflicts",
+			extra: `{"snapshot_id": "snap", "template_id": "tmpl", "storage_pool_id": "pool", "storage_pool_tag": "ssd",
+				"numa_node": 1, "cpu_pinning": false, "wait_for_mounts": true}`,
+			errString: "conflicting extra specs: snapshot_id and template_id are mutually exclusive; " +
+				"storage_pool_id and storage_pool_tag are mutually exclusive; numa_node requires cpu_pinning; " +
+				"wait_for_mounts requires nfs_mounts",
+		},
+		{
+			name:      "networks and security groups",
+			extra:     `{"network_ids": ["net"], "security_groups": ["sg"], "dhcp_options": {"router": "10.0.0.1"}}`,
+			errString: "conflicting extra specs: network_ids and security_groups are mutually exclusive",
+		},
+		{
+			name:      "dhcp options without networks",
+			extra:     `{"dhcp_options": {"router": "10.0.0.1"}}`,
+			errString: "conflicting extra specs: dhcp_options requires network_ids",
+		},
+		{
+			name:  "profile provides the networks",
+			extra: `{"profile": "fast", "dhcp_options": {"router": "10.0.0.1"}}`,
+		},
+		{
+			name:  "extra specs conflict with the profile",
+			extra: `{"profile": "fast", "storage_pool_id": "pool", "security_groups": ["sg"]}`,
+			errString: "conflicting extra specs: network_ids and security_groups are mutually exclusive; " +
+				"storage_pool_id and storage_pool_tag are mutually exclusive",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:       "runner-name",
+				OSType:     params.Linux,
+				OSArch:     params.Amd64,
+				ExtraSpecs: json.RawMessage(tt.extra),
+			}
+			_, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			poolErr := ValidatePoolExtraSpecs(cfg, tt.extra)
+			if tt.errString == "" {
+				require.NoError(t, err)
+				require.NoError(t, poolErr)
+				return
+			}
+			require.EqualError(t, err, "error validating extra specs: "+tt.errString)
+			require.EqualError(t, poolErr, tt.errString)
+		})
+	}
+}
+
+func TestMaxNICs(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+	cfg := &config.Config{MaxNICs: 2}
+	cfg.SetResolvedIDs("zone", "off", "tmpl", "")
+
+	extraSpecs := `{"network_ids": ["net-1", "net-2", "net-3"]}`
+	data := params.BootstrapInstance{
+		Name:       "runner-name",
+		OSType:     params.Linux,
+		OSArch:     params.Amd64,
+		ExtraSpecs: json.RawMessage(extraSpecs),
+	}
+	errString := "too many networks: 3 network_ids requested but at most 2 NICs are supported (max_nics)"
+	_, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.EqualError(t, err, "error validating spec: "+errString)
+	require.EqualError(t, ValidatePoolExtraSpecs(cfg, extraSpecs), errString)
+
+	data.ExtraSpecs = json.RawMessage(`{"network_ids": ["net-1", "net-2"]}`)
+	_, err = GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.NoError(t, err)
+
+	cfg.MaxNICs = 0
+	data.ExtraSpecs = json.RawMessage(extraSpecs)
+	_, err = GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+	require.NoError(t, err)
+}
+
+func TestUserDataCompression(t *testing.T) {
+	small := []byte("#cloud-config\n")
+	large := bytes.Repeat([]byte("x"), 1<<15)
+	for _, tt := range []struct {
+		udata  []byte
+		osType params.OSType
+		want   string
+	}{
+		{udata: small, osType: params.Linux, want: "none"},
+		{udata: large, osType: params.Linux, want: "gzip"},
+		{udata: large, osType: params.Windows, want: "zip"},
+	} {
+		compressed, err := maybeCompressUserdata(tt.udata, tt.osType)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, UserDataCompression(compressed))
+	}
+}
+
+func TestRootVolumeName(t *testing.T) {
+	DefaultToolFetch = func(osType params.OSType, osArch params.OSArch, tools []params.RunnerApplicationDownload) (params.RunnerApplicationDownload, error) {
+		return params.RunnerApplicationDownload{}, nil
+	}
+	cfg := &config.Config{}
+	cfg.SetResolvedIDs("zone", "off", "tmpl", "")
+
+	tests := []struct {
+		name      string
+		extra     string
+		want      string
+		errString string
+	}{
+		{name: "not set", extra: `{}`},
+		{name: "literal", extra: `{"root_volume_name": "runner-disk"}`, want: "runner-disk"},
+		{name: "template", extra: `{"root_volume_name": "{{.Pool}}-{{.Name}}-root"}`, want: "pool-1-runner-name-root"},
+		{name: "pool only", extra: `{"root_volume_name": "{{.Pool}}"}`, want: "pool-1"},
+		{name: "controller", extra: `{"root_volume_name": "{{.Controller}}-{{.OSArch}}"}`, want: "controller-id-amd64"},
+		{name: "unknown field", extra: `{"root_volume_name": "{{.Zone}}"}`, errString: "failed to render root_volume_name"},
+		{name: "invalid template", extra: `{"root_volume_name": "{{.Name"}`, errString: "invalid root_volume_name"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := params.BootstrapInstance{
+				Name:       "runner-name",
+				PoolID:     "pool-1",
+				OSType:     params.Linux,
+				OSArch:     params.Amd64,
+				ExtraSpecs: json.RawMessage(tt.extra),
+			}
+			spec, err := GetRunnerSpecFromBootstrapParams(context.Background(), cfg, data, "controller-id")
+			poolErr := ValidatePoolExtraSpecs(cfg, tt.extra)
+			if tt.errString != "" {
+				require.ErrorContains(t, err, tt.errString)
+				require.ErrorContains(t, poolErr, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.NoError(t, poolErr)
+			require.Equal(t, tt.want, spec.RootVolumeName)
+		})
+	}
+}
+
+func TestComposeUserDataControllerContext(t *testing.T) {
+	tmpl := "{{ .ExtraContext.GARMControllerID }} {{ .ExtraContext.GARMMetadataURL }} {{ .ExtraContext.GARMCallbackURL }}"
+	encoded := base64.StdEncoding.EncodeToString([]byte(tmpl))
+
+	tests := []struct {
+		name       string
+		osType     params.OSType
+		extraSpecs string
+		want       string
+	}{
+		{
+			name:       "linux",
+			osType:     params.Linux,
+			extraSpecs: `{"runner_install_template": "` + encoded + `"}`,
+			want:       "controller-1 https://garm.example.com/api/v1/metadata https://garm.example.com/api/v1/callbacks",
+		},
+		{
+			name:       "windows",
+			osType:     params.Windows,
+			extraSpecs: `{"runner_install_template": "` + encoded + `"}`,
+			want:       "controller-1 https://garm.example.com/api/v1/metadata https://garm.example.com/api/v1/callbacks",
+		},
+		{
+			name:       "extra_context wins",
+			osType:     params.Linux,
+			extraSpecs: `{"runner_install_template": "` + encoded + `", "extra_context": {"GARMMetadataURL": "https://metadata.example.com"}}`,
+			want:       "controller-1 https://metadata.example.com https://garm.example.com/api/v1/callbacks",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := &RunnerSpec{
+				Tools:        testTools,
+				ControllerID: "controller-1",
+				BootstrapParams: params.BootstrapInstance{
+					Name:        "runner",
+					OSType:      tt.osType,
+					OSArch:      params.Amd64,
+					MetadataURL: "https://garm.example.com/api/v1/metadata",
+					CallbackURL: "https://garm.example.com/api/v1/callbacks",
+					ExtraSpecs:  json.RawMessage(tt.extraSpecs),
+				},
+			}
+			udata, err := spec.ComposeUserData()
+			require.NoError(t, err)
+			decoded := decodeUserData(t, udata)
+			if tt.osType == params.Windows {
+				require.Equal(t, "<powershell>"+tt.want+"</powershell>", decoded)
+				return
+			}
+			// Linux install scripts are base64 encoded in the cloud-config.
+			require.Contains(t, decoded, base64.StdEncoding.EncodeToString([]byte(tt.want)))
+		})
+	}
+}
@@ -16,16 +16,26 @@
 package util
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	cs "github.com/apache/cloudstack-go/v2/cloudstack"
 	"github.com/cloudbase/garm-provider-common/params"
 )
 
 // CloudStackInstanceToParamsInstance converts a CloudStack VM into a ProviderInstance.
-func CloudStackInstanceToParamsInstance(vm *cs.VirtualMachine) (params.ProviderInstance, error) {
+// overrides maps lowercased CloudStack states to garm statuses and takes
+// precedence over the built-in mapping.
+func CloudStackInstanceToParamsInstance(vm *cs.VirtualMachine, overrides map[string]params.InstanceStatus) (params.ProviderInstance, error) {
 	if vm == nil {
 		return params.ProviderInstance{}, fmt.Errorf("nil virtual machine")
 	}
@@ -33,17 +43,13 @@ func CloudStackInstanceToParamsInstance(vm *cs.VirtualMachine) (params.ProviderI
 		return params.ProviderInstance{}, fmt.Errorf("virtual machine has empty id")
 	}
 
+	// The Name tag holds the runner name. The display name may carry a
+	// unique_display_names suffix, so it is only used for untagged VMs.
 	inst := params.ProviderInstance{ProviderID: vm.Id}
-	if vm.Displayname != "" {
-		inst.Name = vm.Displayname
-	}
-
 	for _, tag := range vm.Tags {
 		switch tag.Key {
 		case "Name":
-			if inst.Name == "" {
-				inst.Name = tag.Value
-			}
+			inst.Name = tag.Value
 		case "OSType":
 			inst.OSType = params.OSType(tag.Value)
 		case "OSArch":
@@ -51,17 +57,165 @@ func CloudStackInstanceToParamsInstance(vm *cs.VirtualMachine) (params.ProviderI
 		}
 	}
 
-	s := strings.ToLower(vm.State)
-	switch s {
+	if inst.Name == "" {
+		inst.Name = vm.Displayname
+	}
+	// VMs that weren't tagged by the provider fall back to what CloudStack
+	// knows about the guest OS.
+	if inst.OSType == "" {
+		inst.OSType = GuestOSType(vm.Osdisplayname)
+	}
+	if inst.OSArch == "" {
+		inst.OSArch = GuestOSArch(vm.Arch)
+	}
+
+	for _, nic := range vm.Nic {
+		for _, addr := range []string{nic.Ipaddress, nic.Ip6address} {
+			if addr != "" {
+				inst.Addresses = append(inst.Addresses, params.Address{Address: addr, Type: params.PrivateAddress})
+			}
+		}
+	}
+	if vm.Publicip != "" {
+		inst.Addresses = append(inst.Addresses, params.Address{Address: vm.Publicip, Type: params.PublicAddress})
+	}
+
+	inst.Status = CloudStackStateToStatus(vm.State, overrides)
+
+	return inst, nil
+}
+
+// linuxGuestOSNames are the substrings of the lowercased CloudStack guest OS
+// names that mark a Linux guest.
+var linuxGuestOSNames = []string{
+	"linux", "ubuntu", "debian", "centos", "red hat", "rhel", "rocky", "alma",
+	"fedora", "suse", "flatcar", "coreos", "alpine",
+}
+
+// GuestOSType maps the display name of a CloudStack guest OS type, such as
+// "Ubuntu 22.04 LTS" or "Windows Server 2022 (64-bit)", to a garm OS type. It
+// returns an empty OS type for names it doesn't recognize.
+func GuestOSType(osDisplayName string) params.OSType {
+	name := strings.ToLower(osDisplayName)
+	switch {
+	case name == "":
+		return ""
+	case strings.Contains(name, "windows"):
+		return params.Windows
+	case slices.ContainsFunc(linuxGuestOSNames, func(n string) bool { return strings.Contains(name, n) }):
+		return params.Linux
+	}
+	return ""
+}
+
+// GuestOSArch maps the architecture CloudStack reports for a VM to a garm OS
+// architecture. It returns an empty architecture for values it doesn't
+// recognize.
+func GuestOSArch(arch string) params.OSArch {
+	switch strings.ToLower(arch) {
+	case "x86_64", "amd64":
+		return params.Amd64
+	case "aarch64", "arm64":
+		return params.Arm64
+	}
+	return ""
+}
+
+// CloudStackStateToStatus maps a CloudStack VM state to a garm instance status,
+// using overrides first and falling back to the built-in mapping.
+func CloudStackStateToStatus(state string, overrides map[string]params.InstanceStatus) params.InstanceStatus {
+	state = strings.ToLower(state)
+	if status, ok := overrides[state]; ok {
+		return status
+	}
+	switch state {
 	case "running", "starting", "migrating", "restoring", "stopping":
-		inst.Status = params.InstanceRunning
+		return params.InstanceRunning
 	case "stopped", "shutdown", "destroyed", "expunging":
-		inst.Status = params.InstanceStopped
+		return params.InstanceStopped
 	default:
-		inst.Status = params.InstanceStatusUnknown
+		return params.InstanceStatusUnknown
 	}
+}
 
-	return inst, nil
+// invalidNameChars matches the characters CloudStack does not accept in a VM
+// name, which doubles as the guest host name.
+var invalidNameChars = regexp.MustCompile(`[^a-zA-Z0-9-]`)
+
+// SanitizeInstanceName turns a garm instance name into a valid CloudStack VM
+// name of at most maxLen characters. Invalid characters become hyphens. Names
+// that are too long are cut short and end in a hash of the full name, so two
+// long names with the same prefix still get different VM names. The result is
+// deterministic, so it can be used to look a VM up by its garm name.
+func SanitizeInstanceName(name string, maxLen int) string {
+	sanitized := invalidNameChars.ReplaceAllString(name, "-")
+	if maxLen <= 0 || len(sanitized) <= maxLen {
+		return sanitized
+	}
+	suffix := shortHash(name)
+	prefix := strings.TrimRight(sanitized[:max(maxLen-len(suffix)-1, 0)], "-")
+	if prefix == "" {
+		return suffix[:min(len(suffix), maxLen)]
+	}
+	return prefix + "-" + suffix
+}
+
+// TruncateTagValue shortens a tag value to at most maxLen bytes. Values that
+// are too long are cut short, on a UTF-8 character boundary, and end in a hash
+// of the full value, so two long values with the same prefix stay distinct.
+func TruncateTagValue(value string, maxLen int) string {
+	if maxLen <= 0 || len(value) <= maxLen {
+		return value
+	}
+	suffix := shortHash(value)
+	cut := max(maxLen-len(suffix)-1, 0)
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	if cut == 0 {
+		return suffix[:min(len(suffix), maxLen)]
+	}
+	return value[:cut] + "-" + suffix
+}
+
+// shortHash returns the first 8 hex characters of the SHA-256 of s.
+func shortHash(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+// GetTagValue returns the value of the tag with the given key, or an empty string if it is not set.
+func GetTagValue(tags []cs.Tags, key string) string {
+	for _, tag := range tags {
+		if tag.Key == key {
+			return tag.Value
+		}
+	}
+	return ""
+}
+
+// cloudStackTimeLayouts are the timestamp formats CloudStack responses use.
+// Most versions send a numeric zone offset without a colon, like
+// 2024-01-15T10:20:30+0000; some proxies and newer versions send RFC 3339.
+var cloudStackTimeLayouts = []string{
+	"2006-01-02T15:04:05Z0700",
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05",
+}
+
+// ParseCloudStackTime parses a timestamp from a CloudStack response, such as
+// the created field of a VM.
+func ParseCloudStackTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, fmt.Errorf("empty timestamp")
+	}
+	for _, layout := range cloudStackTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", value)
 }
 
 // IsCloudStackNotFoundErr attempts to detect "not found" errors returned by the CloudStack client.
@@ -79,3 +233,70 @@ func IsCloudStackNotFoundErr(err error) bool {
 	return strings.Contains(errLower, "no match found for") ||
 		strings.Contains(errLower, "entity does not exist")
 }
+
+// IsCloudStackOperationInProgressErr detects errors returned when CloudStack refuses an
+// operation because another job is still running against the same resource. These are
+// transient and usually clear within a few seconds.
+func IsCloudStackOperationInProgressErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	errLower := strings.ToLower(err.Error())
+	return strings.Contains(errLower, "operation is in progress") ||
+		strings.Contains(errLower, "operation in progress")
+}
+
+// IsCloudStackTemplateNotReadyErr detects deploy errors caused by a template that
+// exists but is still being downloaded or copied to the zone. Unlike errors for a
+// missing template, these clear once the template is ready.
+func IsCloudStackTemplateNotReadyErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	errLower := strings.ToLower(err.Error())
+	return strings.Contains(errLower, "has not been completely downloaded") ||
+		(strings.Contains(errLower, "template") && strings.Contains(errLower, "is not ready"))
+}
+
+// IsCloudStackUnsupportedAPIErr detects errors returned for API commands the
+// CloudStack version doesn't have, or that the account isn't allowed to call.
+func IsCloudStackUnsupportedAPIErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	if code, _ := ParseCloudStackError(err); code == 432 {
+		return true
+	}
+	return strings.Contains(strings.ToLower(err.Error()), "does not exist or it is not available")
+}
+
+var (
+	// csAPIErrorRegex matches errors produced by cs.CSError for failed synchronous calls.
+	csAPIErrorRegex = regexp.MustCompile(`(?s)CloudStack API error (\d+) \(CSExceptionErrorCode: \d+\): (.*)`)
+	// csJobErrorRegex matches errors produced for failed async jobs, which carry the raw job result.
+	csJobErrorRegex = regexp.MustCompile(`(?s)Undefined error: (\{.*\})`)
+)
+
+// ParseCloudStackError extracts the CloudStack error code and error text from an error
+// returned by the CloudStack client. If the error doesn't come from the CloudStack API,
+// the code is 0 and the message is the full error string.
+func ParseCloudStackError(err error) (int, string) {
+	if err == nil {
+		return 0, ""
+	}
+	msg := err.Error()
+	if m := csAPIErrorRegex.FindStringSubmatch(msg); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code, strings.TrimSpace(m[2])
+	}
+	if m := csJobErrorRegex.FindStringSubmatch(msg); m != nil {
+		var jobErr struct {
+			ErrorCode int    `json:"errorcode"`
+			ErrorText string `json:"errortext"`
+		}
+		if json.Unmarshal([]byte(m[1]), &jobErr) == nil && jobErr.ErrorText != "" {
+			return jobErr.ErrorCode, strings.TrimSpace(jobErr.ErrorText)
+		}
+	}
+	return 0, strings.TrimSpace(msg)
+}
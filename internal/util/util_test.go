@@ -17,7 +17,10 @@ package util
 
 import (
 	"errors"
+	"strings"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	cs "github.com/apache/cloudstack-go/v2/cloudstack"
 	"github.com/cloudbase/garm-provider-common/params"
@@ -35,7 +38,7 @@ func TestCloudStackInstanceToParamsInstance(t *testing.T) {
 			name: "valid instance with tags",
 			vm: &cs.VirtualMachine{
 				Id:          "vm-id",
-				Displayname: "vm-name",
+				Displayname: "tag-name-3f9a1c",
 				Tags: []cs.Tags{
 					{Key: "Name", Value: "tag-name"},
 					{Key: "OSType", Value: "linux"},
@@ -45,12 +48,74 @@ func TestCloudStackInstanceToParamsInstance(t *testing.T) {
 			},
 			want: params.ProviderInstance{
 				ProviderID: "vm-id",
-				Name:       "vm-name",
+				Name:       "tag-name",
 				OSType:     params.OSType("linux"),
 				OSArch:     params.OSArch("amd64"),
 				Status:     params.InstanceRunning,
 			},
 		},
+		{
+			name: "tags win over the guest OS",
+			vm: &cs.VirtualMachine{
+				Id:            "vm-id",
+				Displayname:   "name",
+				Osdisplayname: "Windows Server 2022 (64-bit)",
+				Arch:          "aarch64",
+				Tags: []cs.Tags{
+					{Key: "OSType", Value: "linux"},
+					{Key: "OSArch", Value: "amd64"},
+				},
+				State: "Running",
+			},
+			want: params.ProviderInstance{
+				ProviderID: "vm-id",
+				Name:       "name",
+				OSType:     params.Linux,
+				OSArch:     params.Amd64,
+				Status:     params.InstanceRunning,
+			},
+		},
+		{
+			name: "untagged instance with a guest OS",
+			vm: &cs.VirtualMachine{
+				Id:            "vm-id",
+				Displayname:   "name",
+				Osdisplayname: "Windows Server 2022 (64-bit)",
+				Arch:          "x86_64",
+				State:         "Running",
+			},
+			want: params.ProviderInstance{
+				ProviderID: "vm-id",
+				Name:       "name",
+				OSType:     params.Windows,
+				OSArch:     params.Amd64,
+				Status:     params.InstanceRunning,
+			},
+		},
+		{
+			name: "instance with addresses",
+			vm: &cs.VirtualMachine{
+				Id:          "vm-id",
+				Displayname: "name",
+				State:       "Running",
+				Nic: []cs.Nic{
+					{Ipaddress: "10.0.0.5", Ip6address: "fd00::5"},
+					{Ip6address: "fd01::5"},
+				},
+				Publicip: "203.0.113.5",
+			},
+			want: params.ProviderInstance{
+				ProviderID: "vm-id",
+				Name:       "name",
+				Status:     params.InstanceRunning,
+				Addresses: []params.Address{
+					{Address: "10.0.0.5", Type: params.PrivateAddress},
+					{Address: "fd00::5", Type: params.PrivateAddress},
+					{Address: "fd01::5", Type: params.PrivateAddress},
+					{Address: "203.0.113.5", Type: params.PublicAddress},
+				},
+			},
+		},
 		{
 			name:      "nil virtual machine",
 			vm:        nil,
@@ -83,7 +148,7 @@ func TestCloudStackInstanceToParamsInstance(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := CloudStackInstanceToParamsInstance(tt.vm)
+			got, err := CloudStackInstanceToParamsInstance(tt.vm, nil)
 			if tt.errString == "" {
 				require.NoError(t, err)
 			} else {
@@ -94,6 +159,31 @@ func TestCloudStackInstanceToParamsInstance(t *testing.T) {
 	}
 }
 
+func TestGuestOSType(t *testing.T) {
+	tests := []struct {
+		name string
+		want params.OSType
+	}{
+		{name: "Ubuntu 22.04 LTS", want: params.Linux},
+		{name: "Red Hat Enterprise Linux 9", want: params.Linux},
+		{name: "Rocky Linux 9", want: params.Linux},
+		{name: "Debian GNU/Linux 12 (64-bit)", want: params.Linux},
+		{name: "Windows Server 2022 (64-bit)", want: params.Windows},
+		{name: "Other PV (64-bit)"},
+		{name: ""},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.want, GuestOSType(tt.name), tt.name)
+	}
+}
+
+func TestGuestOSArch(t *testing.T) {
+	require.Equal(t, params.Amd64, GuestOSArch("x86_64"))
+	require.Equal(t, params.Arm64, GuestOSArch("aarch64"))
+	require.Equal(t, params.OSArch(""), GuestOSArch("s390x"))
+	require.Equal(t, params.OSArch(""), GuestOSArch(""))
+}
+
 func TestIsCloudStackNotFoundErr(t *testing.T) {
 	tests := []struct {
 		name string
@@ -134,3 +224,257 @@ func TestIsCloudStackNotFoundErr(t *testing.T) {
 		})
 	}
 }
+
+func TestIsCloudStackOperationInProgressErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "nil error",
+			err:  nil,
+			want: false,
+		},
+		{
+			name: "another operation is in progress",
+			err:  errors.New("CloudStack API error 530 (CSExceptionErrorCode: 4250): Another operation is in progress on this VM"),
+			want: true,
+		},
+		{
+			name: "operation in progress",
+			err:  errors.New("Operation in progress, please retry"),
+			want: true,
+		},
+		{
+			name: "permanent error",
+			err:  errors.New("permission denied"),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, IsCloudStackOperationInProgressErr(tt.err))
+		})
+	}
+}
+
+func TestIsCloudStackUnsupportedAPIErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "nil error", err: nil, want: false},
+		{
+			name: "unknown command",
+			err:  errors.New("CloudStack API error 432 (CSExceptionErrorCode: 9999): The given command does not exist or it is not available for the user"),
+			want: true,
+		},
+		{
+			name: "other API error",
+			err:  errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): Unable to find entity"),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, IsCloudStackUnsupportedAPIErr(tt.err))
+		})
+	}
+}
+
+func TestIsCloudStackTemplateNotReadyErr(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{
+			name: "nil error",
+			err:  nil,
+			want: false,
+		},
+		{
+			name: "template still downloading",
+			err:  errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): Template ubuntu-22.04 has not been completely downloaded to zone 1"),
+			want: true,
+		},
+		{
+			name: "template not ready",
+			err:  errors.New("Undefined error: {\"errortext\":\"Template 42 is not ready for deployment\"}"),
+			want: true,
+		},
+		{
+			name: "missing template",
+			err:  errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): Unable to use template 33333333-3333-3333-3333-333333333333"),
+			want: false,
+		},
+		{
+			name: "entity does not exist",
+			err:  errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): entity does not exist"),
+			want: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, IsCloudStackTemplateNotReadyErr(tt.err))
+		})
+	}
+}
+
+func TestGetTagValue(t *testing.T) {
+	tags := []cs.Tags{
+		{Key: "GARM_POOL_ID", Value: "pool-1"},
+		{Key: "Name", Value: "runner"},
+	}
+	require.Equal(t, "pool-1", GetTagValue(tags, "GARM_POOL_ID"))
+	require.Equal(t, "", GetTagValue(tags, "GARM_CONTROLLER_ID"))
+	require.Equal(t, "", GetTagValue(nil, "Name"))
+}
+
+func TestSanitizeInstanceName(t *testing.T) {
+	long := "garm-" + strings.Repeat("a", 70)
+	tests := []struct {
+		name   string
+		input  string
+		maxLen int
+		want   string
+	}{
+		{name: "valid name unchanged", input: "garm-AbC123", maxLen: 63, want: "garm-AbC123"},
+		{name: "invalid characters", input: "garm_runner.1", maxLen: 63, want: "garm-runner-1"},
+		{name: "no limit", input: long, maxLen: 0, want: long},
+		{name: "at limit", input: long[:63], maxLen: 63, want: long[:63]},
+		{name: "truncated", input: long, maxLen: 63, want: long[:54] + "-73e368b7"},
+		{name: "truncated to stricter limit", input: long, maxLen: 20, want: long[:11] + "-73e368b7"},
+		{name: "trailing hyphens trimmed", input: "garm---------------------x", maxLen: 20, want: "garm-9e818735"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := SanitizeInstanceName(tt.input, tt.maxLen)
+			require.Equal(t, tt.want, got)
+			if tt.maxLen > 0 {
+				require.LessOrEqual(t, len(got), tt.maxLen)
+			}
+		})
+	}
+
+	// Names sharing a long prefix stay distinct.
+	require.NotEqual(t, SanitizeInstanceName(long+"1", 20), SanitizeInstanceName(long+"2", 20))
+}
+
+func TestTruncateTagValue(t *testing.T) {
+	long := strings.Repeat("label,", 60)
+	tests := []struct {
+		name   string
+		input  string
+		maxLen int
+		want   string
+	}{
+		{name: "short value unchanged", input: "self-hosted,linux", maxLen: 255, want: "self-hosted,linux"},
+		{name: "no limit", input: long, maxLen: 0, want: long},
+		{name: "at limit", input: long[:255], maxLen: 255, want: long[:255]},
+		{name: "truncated", input: long, maxLen: 255, want: long[:246] + "-" + shortHash(long)},
+		{name: "multi-byte characters kept whole", input: "ab" + strings.Repeat("é", 10), maxLen: 16, want: "abéé-" + shortHash("ab"+strings.Repeat("é", 10))},
+		{name: "limit shorter than hash", input: long, maxLen: 4, want: shortHash(long)[:4]},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := TruncateTagValue(tt.input, tt.maxLen)
+			require.Equal(t, tt.want, got)
+			if tt.maxLen > 0 {
+				require.LessOrEqual(t, len(got), tt.maxLen)
+			}
+			require.True(t, utf8.ValidString(got))
+		})
+	}
+
+	// Values sharing a long prefix stay distinct.
+	require.NotEqual(t, TruncateTagValue(long+"a", 255), TruncateTagValue(long+"b", 255))
+}
+
+func TestParseCloudStackTime(t *testing.T) {
+	want := time.Date(2024, 1, 15, 10, 20, 30, 0, time.UTC)
+	tests := []struct {
+		name      string
+		input     string
+		want      time.Time
+		errString string
+	}{
+		{name: "numeric offset", input: "2024-01-15T10:20:30+0000", want: want},
+		{name: "non-UTC offset", input: "2024-01-15T12:20:30+0200", want: want},
+		{name: "RFC 3339", input: "2024-01-15T10:20:30Z", want: want},
+		{name: "RFC 3339 with offset", input: "2024-01-15T11:20:30+01:00", want: want},
+		{name: "no zone", input: "2024-01-15 10:20:30", want: want},
+		{name: "surrounding spaces", input: " 2024-01-15T10:20:30+0000 ", want: want},
+		{name: "empty", input: "", errString: "empty timestamp"},
+		{name: "garbage", input: "yesterday", errString: `invalid timestamp "yesterday"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCloudStackTime(tt.input)
+			if tt.errString != "" {
+				require.EqualError(t, err, tt.errString)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, tt.want.Equal(got), "got %s", got)
+		})
+	}
+}
+
+func TestParseCloudStackError(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		wantCode int
+		wantMsg  string
+	}{
+		{
+			name:     "api error",
+			err:      errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): Unable to find service offering"),
+			wantCode: 431,
+			wantMsg:  "Unable to find service offering",
+		},
+		{
+			name:     "async job error",
+			err:      errors.New(`Undefined error: {"errorcode":533,"errortext":"Insufficient capacity in zone"}`),
+			wantCode: 533,
+			wantMsg:  "Insufficient capacity in zone",
+		},
+		{
+			name:    "other error",
+			err:     errors.New("connection refused"),
+			wantMsg: "connection refused",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, msg := ParseCloudStackError(tt.err)
+			require.Equal(t, tt.wantCode, code)
+			require.Equal(t, tt.wantMsg, msg)
+		})
+	}
+}
+
+func TestCloudStackStateToStatus(t *testing.T) {
+	require.Equal(t, params.InstanceRunning, CloudStackStateToStatus("Running", nil))
+	require.Equal(t, params.InstanceRunning, CloudStackStateToStatus("migrating", nil))
+	require.Equal(t, params.InstanceStopped, CloudStackStateToStatus("Stopped", nil))
+	require.Equal(t, params.InstanceStopped, CloudStackStateToStatus("Expunging", nil))
+	require.Equal(t, params.InstanceStatusUnknown, CloudStackStateToStatus("Error", nil))
+}
+
+func TestCloudStackStateToStatusOverrides(t *testing.T) {
+	overrides := map[string]params.InstanceStatus{"stopping": params.InstanceStopped}
+	require.Equal(t, params.InstanceStopped, CloudStackStateToStatus("Stopping", overrides))
+	require.Equal(t, params.InstanceRunning, CloudStackStateToStatus("Running", overrides))
+
+	inst, err := CloudStackInstanceToParamsInstance(&cs.VirtualMachine{Id: "vm-1", State: "Stopping"}, overrides)
+	require.NoError(t, err)
+	require.Equal(t, params.InstanceStopped, inst.Status)
+}
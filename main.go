@@ -21,6 +21,7 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/cloudbase/garm-provider-cloudstack/provider"
 	"github.com/cloudbase/garm-provider-common/execution"
@@ -31,6 +32,14 @@ var signals = []os.Signal{
 	syscall.SIGTERM,
 }
 
+// shutdownTimeout bounds how long we wait for in-flight operations on exit.
+const shutdownTimeout = 30 * time.Second
+
+// closer is implemented by providers that track in-flight operations.
+type closer interface {
+	Close(ctx context.Context) error
+}
+
 func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), signals...)
 	defer stop()
@@ -48,6 +57,13 @@ func main() {
 	}
 
 	result, err := executionEnv.Run(ctx, prov)
+	if c, ok := prov.(closer); ok {
+		closeCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		if closeErr := c.Close(closeCtx); closeErr != nil {
+			fmt.Fprintf(os.Stderr, "failed to shut down cleanly: %+v\n", closeErr)
+		}
+		cancel()
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "failed to run command: %+v\n", err)
 		os.Exit(1)
@@ -42,14 +42,33 @@ type CloudStackProvider struct {
 }
 
 func NewCloudStackProvider(ctx context.Context, configPath, controllerID string) (execution.ExternalProvider, error) {
-	conf, err := config.NewConfig(configPath)
+	conf, err := config.LoadConfig(configPath)
 	if err != nil {
 		return nil, fmt.Errorf("error loading config: %w", err)
 	}
+	if conf.UserAgent == "" {
+		conf.UserAgent = fmt.Sprintf("%s/%s", config.DefaultUserAgent, Version)
+	}
+	if err := conf.ResolveNames(); err != nil {
+		return nil, fmt.Errorf("error resolving names: %w", err)
+	}
+	slog.Debug("CloudStackProvider: resolved config",
+		"controller_id", controllerID,
+		"config", conf.ResolvedSummary())
 	cli, err := client.NewCloudStackCli(conf)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get CloudStack CLI: %w", err)
 	}
+	if conf.AuditLogPath != "" {
+		auditLog, err := client.NewAuditLog(conf.AuditLogPath, controllerID)
+		if err != nil {
+			slog.Error("CloudStackProvider: audit log disabled",
+				"audit_log_path", conf.AuditLogPath,
+				"error", err)
+		} else {
+			cli.SetAuditLog(auditLog)
+		}
+	}
 	return &CloudStackProvider{
 		controllerID: controllerID,
 		cli:          cli,
@@ -57,12 +76,15 @@ func NewCloudStackProvider(ctx context.Context, configPath, controllerID string)
 }
 
 func (p *CloudStackProvider) CreateInstance(ctx context.Context, bootstrapParams params.BootstrapInstance) (params.ProviderInstance, error) {
+	ctx, cancel := p.cli.OperationContext(ctx)
+	defer cancel()
+
 	slog.Debug("CloudStackProvider.CreateInstance: starting",
 		"instance_name", bootstrapParams.Name,
 		"pool_id", bootstrapParams.PoolID,
 		"controller_id", p.controllerID)
 
-	spec, err := spec.GetRunnerSpecFromBootstrapParams(p.cli.Config(), bootstrapParams, p.controllerID)
+	spec, err := spec.GetRunnerSpecFromBootstrapParams(ctx, p.cli.Config(), bootstrapParams, p.controllerID)
 	if err != nil {
 		return params.ProviderInstance{}, fmt.Errorf("failed to get runner spec: %w", err)
 	}
@@ -92,6 +114,9 @@ func (p *CloudStackProvider) CreateInstance(ctx context.Context, bootstrapParams
 }
 
 func (p *CloudStackProvider) DeleteInstance(ctx context.Context, instance string) error {
+	ctx, cancel := p.cli.OperationContext(ctx)
+	defer cancel()
+
 	slog.Debug("CloudStackProvider.DeleteInstance: deleting instance",
 		"instance", instance,
 		"controller_id", p.controllerID,
@@ -114,7 +139,7 @@ func (p *CloudStackProvider) GetInstance(ctx context.Context, instance string) (
 		"instance", instance,
 		"controller_id", p.controllerID)
 
-	vm, err := p.cli.FindOneInstance(ctx, p.controllerID, instance)
+	vm, err := p.cli.GetInstance(ctx, p.controllerID, instance)
 	if err != nil {
 		if errors.Is(err, garmErrors.ErrNotFound) {
 			slog.Debug("CloudStackProvider.GetInstance: instance not found",
@@ -123,7 +148,7 @@ func (p *CloudStackProvider) GetInstance(ctx context.Context, instance string) (
 		}
 		return params.ProviderInstance{}, fmt.Errorf("failed to get VM details: %w", err)
 	}
-	providerInstance, err := util.CloudStackInstanceToParamsInstance(vm)
+	providerInstance, err := util.CloudStackInstanceToParamsInstance(vm, p.cli.Config().StatusOverrides())
 	if err != nil {
 		return params.ProviderInstance{}, fmt.Errorf("failed to convert instance: %w", err)
 	}
@@ -150,7 +175,7 @@ func (p *CloudStackProvider) ListInstances(ctx context.Context, poolID string) (
 
 	providerInstances := make([]params.ProviderInstance, 0, len(vms))
 	for _, vm := range vms {
-		inst, err := util.CloudStackInstanceToParamsInstance(vm)
+		inst, err := util.CloudStackInstanceToParamsInstance(vm, p.cli.Config().StatusOverrides())
 		if err != nil {
 			return nil, fmt.Errorf("failed to convert instance: %w", err)
 		}
@@ -163,11 +188,74 @@ func (p *CloudStackProvider) ListInstances(ctx context.Context, poolID string) (
 	return providerInstances, nil
 }
 
+// RemoveAllInstances destroys every instance of this controller, across all
+// pools. Protected instances are kept.
 func (p *CloudStackProvider) RemoveAllInstances(ctx context.Context) error {
-	// No-op: garm will manage lifecycles via DeleteInstance and pool scoping.
+	removed, err := p.cli.RemoveAllInstances(ctx, p.controllerID)
+	if err != nil {
+		slog.Error("CloudStackProvider.RemoveAllInstances: failed to remove instances",
+			"controller_id", p.controllerID,
+			"removed", removed,
+			"error", err)
+		return fmt.Errorf("failed to remove all instances: %w", err)
+	}
+	slog.Debug("CloudStackProvider.RemoveAllInstances: completed",
+		"controller_id", p.controllerID,
+		"removed", removed)
 	return nil
 }
 
+// MoveInstanceToPool re-tags an instance that garm moved to another pool, so it
+// is listed under poolID.
+func (p *CloudStackProvider) MoveInstanceToPool(ctx context.Context, instance, poolID string) error {
+	if err := p.cli.MoveInstanceToPool(ctx, instance, poolID); err != nil {
+		return fmt.Errorf("failed to move instance to pool: %w", err)
+	}
+	return nil
+}
+
+// ListTemplates returns the templates available in the configured zone, to
+// help pick the template for the config.
+func (p *CloudStackProvider) ListTemplates(ctx context.Context) ([]client.TemplateInfo, error) {
+	templates, err := p.cli.ListTemplates(ctx, p.cli.Config().ZoneID())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates: %w", err)
+	}
+	return templates, nil
+}
+
+// ResolvedConfig returns the names and resolved UUIDs of the resources the
+// provider deploys with, without credentials.
+func (p *CloudStackProvider) ResolvedConfig(ctx context.Context) config.ResolvedSummary {
+	return p.cli.Config().ResolvedSummary()
+}
+
+// DumpInventory returns a JSON-serializable snapshot of every VM owned by this
+// controller, across all pools.
+func (p *CloudStackProvider) DumpInventory(ctx context.Context) ([]client.InventoryEntry, error) {
+	inventory, err := p.cli.DumpInventory(ctx, p.controllerID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dump inventory: %w", err)
+	}
+	return inventory, nil
+}
+
+// ReapExpired destroys the VMs of this controller whose lease (lease_ttl) has
+// expired, and returns how many were destroyed.
+func (p *CloudStackProvider) ReapExpired(ctx context.Context) (int, error) {
+	reaped, err := p.cli.ReapExpired(ctx, p.controllerID)
+	if err != nil {
+		return reaped, fmt.Errorf("failed to reap expired instances: %w", err)
+	}
+	return reaped, nil
+}
+
+// SetDeploySummaryHook registers fn to receive the summary of every VM this
+// provider deploys, for example to feed an audit log.
+func (p *CloudStackProvider) SetDeploySummaryHook(fn func(client.DeploySummary)) {
+	p.cli.SetDeploySummaryHook(fn)
+}
+
 func (p *CloudStackProvider) Stop(ctx context.Context, instance string, force bool) error {
 	if err := p.cli.StopInstance(ctx, instance, force); err != nil {
 		return fmt.Errorf("failed to stop instance: %w", err)
@@ -182,6 +270,45 @@ func (p *CloudStackProvider) Start(ctx context.Context, instance string) error {
 	return nil
 }
 
+// EnsurePowerState starts or stops an instance as needed to bring it to the
+// desired state, running or stopped.
+func (p *CloudStackProvider) EnsurePowerState(ctx context.Context, instance string, desired params.InstanceStatus) error {
+	if err := p.cli.EnsurePowerState(ctx, instance, desired); err != nil {
+		return fmt.Errorf("failed to ensure power state of instance: %w", err)
+	}
+	return nil
+}
+
+// Restart reboots an instance and waits for it to be Running again.
+func (p *CloudStackProvider) Restart(ctx context.Context, instance string) error {
+	if err := p.cli.RestartInstance(ctx, instance); err != nil {
+		return fmt.Errorf("failed to restart instance: %w", err)
+	}
+	return nil
+}
+
+// AttachISO attaches an ISO, given by name or ID, to an instance.
+func (p *CloudStackProvider) AttachISO(ctx context.Context, instance, iso string) error {
+	if err := p.cli.AttachISO(ctx, instance, iso); err != nil {
+		return fmt.Errorf("failed to attach ISO: %w", err)
+	}
+	return nil
+}
+
+// DetachISO detaches the ISO attached to an instance, if any.
+func (p *CloudStackProvider) DetachISO(ctx context.Context, instance string) error {
+	if err := p.cli.DetachISO(ctx, instance); err != nil {
+		return fmt.Errorf("failed to detach ISO: %w", err)
+	}
+	return nil
+}
+
+// Close waits for in-flight CloudStack operations to finish, bounded by the
+// context, and prevents new ones from starting.
+func (p *CloudStackProvider) Close(ctx context.Context) error {
+	return p.cli.Close(ctx)
+}
+
 func (p *CloudStackProvider) GetVersion(ctx context.Context) string {
 	return Version
 }
@@ -196,7 +323,7 @@ func (p *CloudStackProvider) ValidatePoolInfo(ctx context.Context, image string,
 	// Basic validation - we could add more checks here in the future
 	// For now, we rely on the JSON schema validation for extraspecs
 	if extraspecs != "" {
-		if err := spec.ValidateExtraSpecs(extraspecs); err != nil {
+		if err := spec.ValidatePoolExtraSpecs(p.cli.Config(), extraspecs); err != nil {
 			return fmt.Errorf("invalid extra_specs: %w", err)
 		}
 	}